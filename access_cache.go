@@ -0,0 +1,96 @@
+package githttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CachedAccessChecker wraps an AccessChecker that is slow to ask, such as
+// one querying LDAP, so that its decisions are kept in cache per user,
+// credentials, client address, repository, namespace and operation, which
+// are all the checker may decide on: access granted for ttl and access
+// denied for negativeTTL, zero not caching them. A single clone makes
+// several requests, which then only need one decision. Requests for
+// credentials and failures are not cached.
+func CachedAccessChecker(cache Cache, ttl, negativeTTL time.Duration, checker AccessChecker) AccessChecker {
+	return cachedAccessChecker{cache, ttl, negativeTTL, checker}
+}
+
+type cachedAccessChecker struct {
+	cache       Cache
+	ttl         time.Duration
+	negativeTTL time.Duration
+	checker     AccessChecker
+}
+
+func (c cachedAccessChecker) CheckAccess(r *http.Request, id *Identity, repo string, op Operation) error {
+	_, err := c.CheckAccessIdentity(r, id, repo, op)
+	return err
+}
+
+// CheckAccessIdentity also keeps the identity found by checkers that are
+// IdentityCheckers
+func (c cachedAccessChecker) CheckAccessIdentity(r *http.Request, id *Identity, repo string, op Operation) (*Identity, error) {
+	// The checker may authenticate the request itself, or decide on the
+	// address of the client, so they stand for the user as much as id
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s\x00%s\x00%s\x00%s\x00", repo, namespace(r.Context()), op, requestIP(r))
+	if id != nil {
+		fmt.Fprintf(sum, "id:%s\x00", id.Name)
+	}
+	for _, h := range c.credentialHeaders() {
+		fmt.Fprintf(sum, "%s\x00", strings.Join(r.Header.Values(h), "\x00"))
+	}
+	key := "access:" + hex.EncodeToString(sum.Sum(nil))
+
+	if b, ok := c.cache.Get(key); ok {
+		var res authResult
+		if err := json.Unmarshal(b, &res); err == nil {
+			return res.Identity, authDecisionError(res.Decision)
+		}
+	}
+
+	var found *Identity
+	var err error
+	if checker, ok := c.checker.(IdentityChecker); ok {
+		found, err = checker.CheckAccessIdentity(r, id, repo, op)
+	} else {
+		err = c.checker.CheckAccess(r, id, repo, op)
+	}
+	switch {
+	case err == nil && c.ttl > 0:
+		if b, merr := json.Marshal(authResult{Decision: "allow", Identity: found}); merr == nil {
+			c.cache.Set(key, b, c.ttl)
+		}
+	case errors.Is(err, ErrAccessDenied) && c.negativeTTL > 0:
+		if b, merr := json.Marshal(authResult{Decision: "deny"}); merr == nil {
+			c.cache.Set(key, b, c.negativeTTL)
+		}
+	}
+	return found, err
+}
+
+// credentialHeaders returns the headers the checker may authenticate
+// requests with
+func (c cachedAccessChecker) credentialHeaders() []string {
+	if auth, ok := c.checker.(*ExternalAuth); ok {
+		return auth.Headers
+	}
+	return []string{"Authorization", "Cookie"}
+}
+
+// requestIP returns the address of the client
+func requestIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,41 @@
+package githttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// cookieOrIPChecker allows requests with a session cookie or from 10.0.0.1
+type cookieOrIPChecker struct{}
+
+func (cookieOrIPChecker) CheckAccess(r *http.Request, id *Identity, repo string, op Operation) error {
+	if r.Header.Get("Cookie") == "session=ok" || requestIP(r) == "10.0.0.1" {
+		return nil
+	}
+	return ErrAccessDenied
+}
+
+func TestCachedAccessCheckerKey(t *testing.T) {
+	checker := CachedAccessChecker(NewMemoryCache(), time.Minute, time.Minute, cookieOrIPChecker{})
+
+	allowed := httptest.NewRequest("GET", "/test.git/info/refs", nil)
+	allowed.Header.Set("Cookie", "session=ok")
+	if err := checker.CheckAccess(allowed, nil, "test.git", OpRead); err != nil {
+		t.Fatalf("cookie: %s", err)
+	}
+	anonymous := httptest.NewRequest("GET", "/test.git/info/refs", nil)
+	if err := checker.CheckAccess(anonymous, nil, "test.git", OpRead); err != ErrAccessDenied {
+		t.Fatalf("anonymous after cookie: %v, want access denied", err)
+	}
+
+	local := httptest.NewRequest("GET", "/test.git/info/refs", nil)
+	local.RemoteAddr = "10.0.0.1:1234"
+	if err := checker.CheckAccess(local, nil, "test.git", OpRead); err != nil {
+		t.Fatalf("address: %s", err)
+	}
+	if err := checker.CheckAccess(anonymous, nil, "test.git", OpRead); err != ErrAccessDenied {
+		t.Fatalf("anonymous after address: %v, want access denied", err)
+	}
+}
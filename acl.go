@@ -0,0 +1,93 @@
+package githttp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Operation is the kind of access a request needs to a repository
+type Operation int
+
+// Operations checked by an AccessChecker
+const (
+	OpRead Operation = iota
+	OpWrite
+)
+
+func (op Operation) String() string {
+	if op == OpWrite {
+		return "write"
+	}
+	return "read"
+}
+
+// AccessChecker decides whether a request may access a repository. id is
+// nil for anonymous requests and repo is the repository path of the URL,
+// without leading slash. The git namespace of the request, if any, is in
+// the RequestInfo of its context. It returns nil to grant access, and
+// ErrAuthRequired or ErrAccessDenied otherwise.
+type AccessChecker interface {
+	CheckAccess(r *http.Request, id *Identity, repo string, op Operation) error
+}
+
+// IdentityChecker is an AccessChecker that also finds out who the request
+// is made on behalf of, such as an auth gateway answering with the
+// effective user. The identity it returns, if not nil, replaces id for the
+// rest of the request.
+type IdentityChecker interface {
+	AccessChecker
+	CheckAccessIdentity(r *http.Request, id *Identity, repo string, op Operation) (*Identity, error)
+}
+
+// requestOperation returns the access a request to the service needs.
+// Pushes and their ref advertisement write, everything else reads.
+func requestOperation(s Service, r *http.Request) Operation {
+	if s.Write {
+		return OpWrite
+	}
+	if s.ParseURLNamedParams(r)["serviceType"] == receivePack {
+		return OpWrite
+	}
+	if strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") == receivePack {
+		return OpWrite
+	}
+	return OpRead
+}
+
+// checkAccess applies the configured AccessChecker, if any, returning the
+// request carrying the identity it found
+func (gsh GitSmartHTTP) checkAccess(s Service, r *http.Request, repo string) (*http.Request, error) {
+	if gsh.Access == nil {
+		return r, nil
+	}
+	repo, op := strings.TrimPrefix(repo, "/"), requestOperation(s, r)
+	checker, ok := gsh.Access.(IdentityChecker)
+	if !ok {
+		return r, gsh.Access.CheckAccess(r, gsh.identity(r), repo, op)
+	}
+	id, err := checker.CheckAccessIdentity(r, gsh.identity(r), repo, op)
+	if err == nil && id != nil {
+		r = r.WithContext(context.WithValue(r.Context(), authorizedIdentityContextKey{}, id))
+	}
+	return r, err
+}
+
+// RequestInfo is what GitSmartHTTP found out about a request for a
+// repository before handling it
+type RequestInfo struct {
+	// Repo is the repository requested, relative to the repositories root
+	Repo      string
+	Operation Operation
+	// Namespace is the git namespace requested within Repo, if any
+	Namespace string
+}
+
+type requestInfoContextKey struct{}
+
+// RequestInfoFromContext returns the RequestInfo of the request whose
+// context is ctx, for middleware added with Use.
+func RequestInfoFromContext(ctx context.Context) (RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoContextKey{}).(RequestInfo)
+	return info, ok
+}
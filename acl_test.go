@@ -0,0 +1,57 @@
+package githttp
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+// repoChecker denies the repository secret.git
+type repoChecker struct{}
+
+func (repoChecker) CheckAccess(r *http.Request, id *Identity, repo string, op Operation) error {
+	if repo == "secret.git" {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+func TestAccessCheckDotSegments(t *testing.T) {
+	// The ServeMux of Handler would redirect to the clean path before the
+	// server saw it, unlike the routers Middleware is mounted in
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh := NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: root, ExportAll: true, UploadPack: true, Access: repoChecker{}})
+		return gsh.Middleware(http.NotFoundHandler())
+	})
+	srv.CreateRepo("public.git", map[string]string{"README": "hello\n"})
+	srv.CreateRepo("secret.git", map[string]string{"README": "hello\n"})
+
+	for _, c := range []struct {
+		method, path string
+		status       int
+	}{
+		{"GET", "/public.git/info/refs?service=git-upload-pack", http.StatusOK},
+		{"GET", "/secret.git/info/refs?service=git-upload-pack", http.StatusForbidden},
+		{"GET", "/./secret.git/info/refs?service=git-upload-pack", http.StatusForbidden},
+		{"GET", "//secret.git/info/refs?service=git-upload-pack", http.StatusForbidden},
+		{"GET", "/./public.git/info/refs?service=git-upload-pack", http.StatusOK},
+		{"GET", "/x/../secret.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"GET", "/public.git/../secret.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"POST", "/./secret.git/git-upload-pack", http.StatusForbidden},
+	} {
+		req, err := http.NewRequest(c.method, srv.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %s: status %d, want %d", c.method, c.path, resp.StatusCode, c.status)
+		}
+	}
+}
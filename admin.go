@@ -0,0 +1,21 @@
+package githttp
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminOnly protects an admin endpoint with a bearer token. Without a token
+// configured every request is refused.
+func adminOnly(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="git-http-backend admin"`)
+			writeErrorBody(w, r, http.StatusUnauthorized, CodeAuthRequired, ErrAuthRequired.Error())
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,75 @@
+package githttp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// RepoAPIHandler serves the repository API: the list of repositories at
+// /api/repos/, the size, objects, refs and last use of a repository at
+// /api/repos/<repo>, and at /api/repos/<repo>/<action> its usage
+// statistics at stats and, to admins, backups at bundle, which also
+// restores repositories from uploaded bundles, integrity checks at fsck,
+// garbage collections at gc and the settings overriding server settings
+// for the repository at settings.
+func (gsh GitSmartHTTP) RepoAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/api/repos")
+		if name == "/" && r.Method == "GET" {
+			gsh.serveRepoList(w, r)
+			return
+		}
+		if repo, err := gsh.normalizeRepo(name); err == nil && r.Method == "GET" && gsh.repoExists(repo) {
+			gsh.serveRepoDetails(w, r, strings.TrimPrefix(repo, "/"))
+			return
+		}
+		i := strings.LastIndex(name, "/")
+		if i <= 0 {
+			writeErrorMessage(w, r, http.StatusNotFound, "not found")
+			return
+		}
+		repo, err := gsh.normalizeRepo(name[:i])
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		repo = strings.TrimPrefix(repo, "/")
+		op := OpRead
+		if r.Method != "GET" {
+			op = OpWrite
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoContextKey{}, RequestInfo{Repo: repo, Operation: op}))
+
+		switch action := name[i+1:]; {
+		case action == "stats" && r.Method == "GET" && gsh.repoStats != nil:
+			gsh.serveRepoStats(w, r, repo)
+		case action == "bundle" && r.Method == "GET":
+			adminOnly(gsh.AdminToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gsh.serveBundle(w, r, repo)
+			})).ServeHTTP(w, r)
+		case action == "bundle" && (r.Method == "PUT" || r.Method == "POST"):
+			adminOnly(gsh.AdminToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gsh.restoreBundle(w, r, repo)
+			})).ServeHTTP(w, r)
+		case action == "fsck" && (r.Method == "GET" || r.Method == "POST"):
+			adminOnly(gsh.AdminToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gsh.serveFsck(w, r, repo)
+			})).ServeHTTP(w, r)
+		case action == "gc" && (r.Method == "GET" || r.Method == "POST"):
+			adminOnly(gsh.AdminToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gsh.serveGC(w, r, repo)
+			})).ServeHTTP(w, r)
+		case action == "prune-refs" && r.Method == "POST":
+			adminOnly(gsh.AdminToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gsh.servePruneRefs(w, r, repo)
+			})).ServeHTTP(w, r)
+		case action == "settings" && (r.Method == "GET" || r.Method == "PUT"):
+			adminOnly(gsh.AdminToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gsh.serveRepoSettings(w, r, repo)
+			})).ServeHTTP(w, r)
+		default:
+			writeErrorMessage(w, r, http.StatusNotFound, "not found")
+		}
+	})
+}
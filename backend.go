@@ -0,0 +1,55 @@
+package githttp
+
+import (
+	"context"
+	"io"
+)
+
+// Backend serves the smart protocol services of repositories. The default
+// backend runs the git binary; embedders can plug in other implementations,
+// for example one built on go-git's transport server, to run where no git
+// installation is available. The git binary backend is the only one this
+// module ships.
+type Backend interface {
+	// AdvertiseRefs returns the ref advertisement of the service for the
+	// repository, without the "# service=" preamble.
+	AdvertiseRefs(ctx context.Context, repoPath, service string) ([]byte, error)
+	// ServeRPC runs a stateless RPC round of the service, reading the
+	// request from body and writing the result to out.
+	ServeRPC(ctx context.Context, repoPath, service string, body io.Reader, out io.Writer) error
+}
+
+// RefsStreamer is implemented by Backends able to write the ref
+// advertisement as it is produced. It is then streamed to clients rather
+// than held in memory whole, unless the refs cache needs it.
+type RefsStreamer interface {
+	// StreamRefs writes the ref advertisement of the service for the
+	// repository to out, without the "# service=" preamble.
+	StreamRefs(ctx context.Context, repoPath, service string, out io.Writer) error
+}
+
+// gitBinaryBackend is the Backend running git processes through the process
+// manager of the server.
+type gitBinaryBackend struct {
+	gsh GitSmartHTTP
+}
+
+func (b gitBinaryBackend) AdvertiseRefs(ctx context.Context, repoPath, service string) ([]byte, error) {
+	return b.gsh.spawnAdvertiseRefs(ctx, repoPath, service)
+}
+
+func (b gitBinaryBackend) StreamRefs(ctx context.Context, repoPath, service string, out io.Writer) error {
+	return b.gsh.streamAdvertiseRefs(ctx, repoPath, service, out)
+}
+
+func (b gitBinaryBackend) ServeRPC(ctx context.Context, repoPath, service string, body io.Reader, out io.Writer) error {
+	return b.gsh.runRPC(ctx, out, repoPath, service, body)
+}
+
+// backend returns the configured Backend, defaulting to the git binary
+func (gsh GitSmartHTTP) backend() Backend {
+	if gsh.Backend != nil {
+		return gsh.Backend
+	}
+	return gitBinaryBackend{gsh: gsh}
+}
@@ -0,0 +1,58 @@
+package githttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+// countingBackend records the calls made to the Backend it wraps
+type countingBackend struct {
+	Backend
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (b *countingBackend) count(call string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls[call]++
+}
+
+func (b *countingBackend) AdvertiseRefs(ctx context.Context, repoPath, service string) ([]byte, error) {
+	b.count("refs " + service)
+	return b.Backend.AdvertiseRefs(ctx, repoPath, service)
+}
+
+func (b *countingBackend) ServeRPC(ctx context.Context, repoPath, service string, body io.Reader, out io.Writer) error {
+	b.count("rpc " + service)
+	return b.Backend.ServeRPC(ctx, repoPath, service, body, out)
+}
+
+func TestBackend(t *testing.T) {
+	var backend *countingBackend
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		cfg := &GitSmartHTTPConfig{ReposRootPath: root, ExportAll: true, UploadPack: true, ReceivePack: true}
+		gsh := NewGitSmartHTTP(cfg)
+		backend = &countingBackend{Backend: gitBinaryBackend{gsh}, calls: make(map[string]int)}
+		cfg.Backend = backend
+		return gsh.Handler()
+	})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	work := srv.Clone("test.git")
+	githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+	srv.Push(work, "HEAD:master")
+
+	// The wrapper hides StreamRefs, so advertisements go through AdvertiseRefs
+	for _, call := range []string{"refs git-upload-pack", "rpc git-upload-pack", "refs git-receive-pack", "rpc git-receive-pack"} {
+		if backend.calls[call] == 0 {
+			t.Errorf("no %s call, calls %v", call, backend.calls)
+		}
+	}
+}
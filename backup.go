@@ -0,0 +1,256 @@
+package githttp
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names backup objects so that they sort chronologically
+const backupTimeFormat = "20060102T150405Z"
+
+// BackupStatus tells how the backups of a repository are going
+type BackupStatus struct {
+	LastBackup  time.Time `json:"last_backup,omitempty"`
+	LastFull    time.Time `json:"last_full,omitempty"`
+	LastKey     string    `json:"last_key,omitempty"`
+	LastSize    int64     `json:"last_size,omitempty"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// tips are the ref tips the last backup contains, which the next
+	// incremental backup starts from
+	tips []string
+}
+
+// bundleBackups periodically writes bundles of every repository to a
+// bucket, under <prefix><repo>/<time>-full.bundle or -incr.bundle. A full
+// bundle is written every fullInterval, and in between incremental ones
+// holding what changed since the previous backup, if anything did. Backups
+// no longer needed to restore any state within retention are deleted.
+//
+// The tips incremental backups start from are only kept in memory, so the
+// first backup of a repository after a restart is a full one.
+type bundleBackups struct {
+	gsh          GitSmartHTTP
+	bucket       *S3Bucket
+	prefix       string
+	interval     time.Duration
+	fullInterval time.Duration
+	retention    time.Duration
+
+	mu    sync.Mutex
+	repos map[string]*BackupStatus
+}
+
+func newBundleBackups(gsh GitSmartHTTP, bucket *S3Bucket, prefix string, interval, fullInterval, retention time.Duration) *bundleBackups {
+	return &bundleBackups{
+		gsh:          gsh,
+		bucket:       bucket,
+		prefix:       prefix,
+		interval:     interval,
+		fullInterval: fullInterval,
+		retention:    retention,
+		repos:        make(map[string]*BackupStatus),
+	}
+}
+
+func (b *bundleBackups) run() {
+	for {
+		err := b.gsh.walkRepos(func(repo, repoPath string) {
+			b.backup(context.Background(), repo, repoPath)
+		})
+		if err != nil {
+			log.Printf("Cannot list repositories to back up: %s", err)
+		}
+		time.Sleep(b.interval)
+	}
+}
+
+// backup writes a bundle of the repository if it changed since its last
+// backup, and deletes the backups retention no longer needs
+func (b *bundleBackups) backup(ctx context.Context, repo, repoPath string) {
+	b.mu.Lock()
+	st := b.repos[repo]
+	if st == nil {
+		st = &BackupStatus{}
+		b.repos[repo] = st
+	}
+	prev := *st
+	b.mu.Unlock()
+
+	now := time.Now().UTC()
+	key, size, tips, err := b.write(ctx, repo, repoPath, prev, now)
+
+	b.mu.Lock()
+	st.LastAttempt = now
+	st.LastError = ""
+	if err != nil {
+		st.LastError = err.Error()
+	} else if key != "" {
+		st.LastBackup = now
+		st.LastKey = key
+		st.LastSize = size
+		if strings.HasSuffix(key, "-full.bundle") {
+			st.LastFull = now
+		}
+	}
+	if err == nil {
+		st.tips = tips
+	}
+	b.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Cannot back up %s: %s", repo, err)
+		return
+	}
+	if err := b.prune(ctx, repo, now); err != nil {
+		log.Printf("Cannot delete expired backups of %s: %s", repo, err)
+	}
+}
+
+// write bundles and uploads the repository, returning the key the bundle
+// was stored at, or none when there was nothing to back up, and the tips
+// the repository is now backed up to.
+func (b *bundleBackups) write(ctx context.Context, repo, repoPath string, prev BackupStatus, now time.Time) (string, int64, []string, error) {
+	if b.gsh.tiering != nil && b.gsh.tiering.cold(repoPath) {
+		// Unused since long before, and its packs are in cold storage
+		return "", 0, prev.tips, nil
+	}
+	out, err := b.gsh.processes.git(ctx, repoPath, "for-each-ref", "--format=%(objectname)")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	tips := uniqueLines(out)
+	if len(tips) == 0 {
+		return "", 0, nil, nil
+	}
+
+	full := prev.tips == nil || now.Sub(prev.LastFull) >= b.fullInterval
+	if !full && strings.Join(tips, " ") == strings.Join(prev.tips, " ") {
+		return "", 0, tips, nil
+	}
+
+	f, err := os.CreateTemp("", "backup-*.bundle")
+	if err != nil {
+		return "", 0, nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	args := []string{"bundle", "create", "--quiet", f.Name(), "--all"}
+	if !full {
+		for _, tip := range prev.tips {
+			args = append(args, "^"+tip)
+		}
+	}
+	if _, err := b.gsh.processes.git(ctx, repoPath, args...); err != nil {
+		switch {
+		case !full && strings.Contains(err.Error(), "empty bundle"):
+			// Only deletions since the previous backup
+			return "", 0, tips, nil
+		case !full:
+			// The previous tips may have been pruned after a force push
+			full = true
+			if _, err := b.gsh.processes.git(ctx, repoPath, "bundle", "create", "--quiet", f.Name(), "--all"); err != nil {
+				return "", 0, nil, err
+			}
+		default:
+			return "", 0, nil, err
+		}
+	}
+
+	kind := "incr"
+	if full {
+		kind = "full"
+	}
+	key := b.prefix + repo + "/" + now.Format(backupTimeFormat) + "-" + kind + ".bundle"
+	size, err := b.bucket.PutFile(ctx, key, f.Name())
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return key, size, tips, nil
+}
+
+// prune deletes the backups taken before the latest full backup older than
+// retention, as every state within retention can be restored without them.
+func (b *bundleBackups) prune(ctx context.Context, repo string, now time.Time) error {
+	if b.retention <= 0 {
+		return nil
+	}
+	objects, err := b.bucket.List(ctx, b.prefix+repo+"/")
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, obj := range objects {
+		// Skip backups of repositories nested below this one
+		if !strings.Contains(strings.TrimPrefix(obj.Key, b.prefix+repo+"/"), "/") {
+			keys = append(keys, obj.Key)
+		}
+	}
+	sort.Strings(keys)
+
+	cutoff := now.Add(-b.retention)
+	anchor := ""
+	for _, key := range keys {
+		name := path.Base(key)
+		t, err := time.Parse(backupTimeFormat, strings.SplitN(name, "-", 2)[0])
+		if err != nil || t.After(cutoff) {
+			continue
+		}
+		if strings.HasSuffix(name, "-full.bundle") {
+			anchor = key
+		}
+	}
+
+	for _, key := range keys {
+		if key >= anchor {
+			break
+		}
+		if err := b.bucket.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP reports the backup status of every repository as JSON
+func (b *bundleBackups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeErrorMessage(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	b.mu.Lock()
+	repos := make(map[string]BackupStatus, len(b.repos))
+	for repo, st := range b.repos {
+		repos[repo] = *st
+	}
+	b.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	json.NewEncoder(w).Encode(repos)
+}
+
+func uniqueLines(s string) []string {
+	seen := make(map[string]bool)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		if line != "" && !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
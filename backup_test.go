@@ -0,0 +1,93 @@
+package githttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestBundleBackups(t *testing.T) {
+	var gsh GitSmartHTTP
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh = NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: root, ExportAll: true, UploadPack: true, ReceivePack: true})
+		return gsh.Handler()
+	})
+	repoPath := srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	s3, bucket := newFakeS3(t)
+	backups := newBundleBackups(gsh, bucket, "backups/", time.Hour, time.Hour, 0)
+	ctx := context.Background()
+
+	backups.backup(ctx, "test.git", repoPath)
+	keys := s3.Keys("backups/test.git/")
+	if len(keys) != 1 || !strings.HasSuffix(keys[0], "-full.bundle") {
+		t.Fatalf("first backup wrote %q, want a full bundle", keys)
+	}
+	full := s3.Object(keys[0])
+
+	// Unchanged repositories are not backed up again
+	backups.backup(ctx, "test.git", repoPath)
+	if keys := s3.Keys("backups/test.git/"); len(keys) != 1 {
+		t.Fatalf("backup of an unchanged repository wrote %q", keys)
+	}
+
+	// Changes go in an incremental bundle applying on top of the full one
+	work := srv.Clone("test.git")
+	head := githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+	srv.Push(work, "HEAD:master")
+	time.Sleep(time.Second) // backups are named by the second
+	backups.backup(ctx, "test.git", repoPath)
+	keys = s3.Keys("backups/test.git/")
+	if len(keys) != 2 || !strings.HasSuffix(keys[1], "-incr.bundle") {
+		t.Fatalf("backup after a push wrote %q, want an incremental bundle", keys)
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	githttptest.Git(t, "", "clone", "--quiet", writeBundle(t, string(full)), restored)
+	githttptest.Git(t, restored, "fetch", "--quiet", writeBundle(t, string(s3.Object(keys[1]))), "refs/heads/master")
+	if got := githttptest.Git(t, restored, "rev-parse", "FETCH_HEAD"); got != head {
+		t.Errorf("restored backups at %s, want %s", got, head)
+	}
+
+	rec := httptest.NewRecorder()
+	backups.ServeHTTP(rec, httptest.NewRequest("GET", "/api/backups", nil))
+	var status map[string]BackupStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if st := status["test.git"]; st.LastKey != keys[1] || st.LastFull.IsZero() || st.LastError != "" {
+		t.Errorf("status %+v, want the last backup %s", st, keys[1])
+	}
+}
+
+func TestBundleBackupsRetention(t *testing.T) {
+	s3, bucket := newFakeS3(t)
+	backups := newBundleBackups(GitSmartHTTP{}, bucket, "backups/", time.Hour, time.Hour, 3*time.Hour)
+	for _, name := range []string{
+		"20260101T000000Z-full", "20260101T010000Z-incr", "20260101T020000Z-full",
+		"20260101T030000Z-incr", "20260101T050000Z-full",
+	} {
+		s3.objects["backups/test.git/"+name+".bundle"] = nil
+	}
+	s3.objects["backups/test.git/nested.git/20260101T000000Z-full.bundle"] = nil
+
+	// States since 02:30 are restored from the full backup of 02:00 on
+	now := time.Date(2026, 1, 1, 5, 30, 0, 0, time.UTC)
+	if err := backups.prune(context.Background(), "test.git", now); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"backups/test.git/20260101T020000Z-full.bundle",
+		"backups/test.git/20260101T030000Z-incr.bundle",
+		"backups/test.git/20260101T050000Z-full.bundle",
+		"backups/test.git/nested.git/20260101T000000Z-full.bundle",
+	}
+	if got := s3.Keys("backups/"); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("kept %q, want %q", got, want)
+	}
+}
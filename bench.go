@@ -0,0 +1,285 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaxi/git-http-backend/smarthttp"
+)
+
+// BenchCmd is the name of the command running RunBench
+const BenchCmd = "bench"
+
+// benchOps are the kinds of traffic the bench command replays
+var benchOps = map[string]func(b *bench, ctx context.Context) (int64, error){
+	"info-refs": (*bench).infoRefs,
+	"clone":     (*bench).clone,
+	"push":      (*bench).push,
+}
+
+// RunBench is the entry point of the bench command. It replays a mix of
+// info/refs, clone and push traffic against a repository of a running
+// server and reports latency percentiles and throughput per kind.
+func RunBench(args []string) int {
+	fs := flag.NewFlagSet(BenchCmd, flag.ExitOnError)
+	url := fs.String("url", "", "URL of the repository to run against")
+	mix := fs.String("mix", "info-refs=70,clone=25,push=5", "comma separated kinds of traffic with their weights")
+	concurrency := fs.Int("concurrency", 4, "number of clients running at once")
+	duration := fs.Duration("duration", 30*time.Second, "how long to run")
+	user := fs.String("user", "", "username to authenticate with")
+	password := fs.String("password", "", "password to authenticate with")
+	v2 := fs.Bool("protocol-v2", false, "whether to ask for protocol version 2")
+	fs.Parse(args)
+
+	if *url == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s -url <repository URL> [flags]\n", BenchCmd)
+		fs.PrintDefaults()
+		return 1
+	}
+
+	b := &bench{
+		url:    *url,
+		client: &smarthttp.Client{Username: *user, Password: *password, ProtocolV2: *v2},
+		stats:  make(map[string]*benchStats),
+	}
+	if err := b.parseMix(*mix); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", BenchCmd, err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for ctx.Err() == nil {
+				b.runOne(ctx, b.pick(rnd))
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+
+	b.report(os.Stdout, time.Since(start))
+	return 0
+}
+
+type bench struct {
+	url     string
+	client  *smarthttp.Client
+	ops     []string
+	weights []int
+	total   int
+	pushes  int64
+
+	mu    sync.Mutex
+	stats map[string]*benchStats
+}
+
+// benchStats collects the outcome of one kind of traffic
+type benchStats struct {
+	latencies []time.Duration
+	errors    int
+	bytes     int64
+	lastErr   error
+}
+
+func (b *bench) parseMix(mix string) error {
+	for _, part := range strings.Split(mix, ",") {
+		op, weight, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if _, ok := benchOps[op]; !ok {
+			return fmt.Errorf("unknown kind of traffic %q", op)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return fmt.Errorf("invalid weight of %s: %q", op, weight)
+		}
+		b.ops = append(b.ops, op)
+		b.weights = append(b.weights, w)
+		b.total += w
+	}
+	if b.total == 0 {
+		return errors.New("the weights of the mix add up to zero")
+	}
+	return nil
+}
+
+func (b *bench) pick(rnd *rand.Rand) string {
+	n := rnd.Intn(b.total)
+	for i, w := range b.weights {
+		if n < w {
+			return b.ops[i]
+		}
+		n -= w
+	}
+	return b.ops[len(b.ops)-1]
+}
+
+func (b *bench) runOne(ctx context.Context, op string) {
+	start := time.Now()
+	n, err := benchOps[op](b, ctx)
+	elapsed := time.Since(start)
+	// Requests cut short by the end of the run do not count
+	if ctx.Err() != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := b.stats[op]
+	if s == nil {
+		s = &benchStats{}
+		b.stats[op] = s
+	}
+	if err != nil {
+		s.errors++
+		s.lastErr = err
+		return
+	}
+	s.latencies = append(s.latencies, elapsed)
+	s.bytes += n
+}
+
+func (b *bench) infoRefs(ctx context.Context) (int64, error) {
+	_, err := b.client.Discover(ctx, b.url, smarthttp.UploadPack)
+	return 0, err
+}
+
+// clone fetches every branch and tag, the way a fresh clone does
+func (b *bench) clone(ctx context.Context) (int64, error) {
+	adv, err := b.client.Discover(ctx, b.url, smarthttp.UploadPack)
+	if err != nil {
+		return 0, err
+	}
+	refs := adv.Refs
+	if adv.Version == 2 {
+		if refs, err = b.client.LsRefs(ctx, b.url, "refs/heads/", "refs/tags/"); err != nil {
+			return 0, err
+		}
+	}
+
+	var wants []string
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		if ref.Name != "HEAD" && !seen[ref.Hash] {
+			seen[ref.Hash] = true
+			wants = append(wants, ref.Hash)
+		}
+	}
+	if len(wants) == 0 {
+		return 0, nil
+	}
+
+	cw := &countingWriter{}
+	err = b.client.Fetch(ctx, b.url, adv, smarthttp.FetchRequest{Wants: wants}, cw)
+	return cw.n, err
+}
+
+// push creates a ref at the commit HEAD points to and deletes it again,
+// which runs receive-pack without adding objects to the repository. A
+// push cut short by the end of the run may leave its ref below refs/bench/.
+func (b *bench) push(ctx context.Context) (int64, error) {
+	adv, err := b.client.Discover(ctx, b.url, smarthttp.ReceivePack)
+	if err != nil {
+		return 0, err
+	}
+	var head string
+	for _, ref := range adv.Refs {
+		if strings.HasPrefix(ref.Name, "refs/heads/") {
+			head = ref.Hash
+			break
+		}
+	}
+	if head == "" {
+		return 0, errors.New("no branch to push")
+	}
+
+	b.mu.Lock()
+	b.pushes++
+	ref := fmt.Sprintf("refs/bench/%d-%d", os.Getpid(), b.pushes)
+	b.mu.Unlock()
+
+	for _, cmd := range []smarthttp.Command{
+		{Ref: ref, Old: smarthttp.ZeroID, New: head},
+		{Ref: ref, Old: head, New: smarthttp.ZeroID},
+	} {
+		var pack io.Reader
+		if cmd.New != smarthttp.ZeroID {
+			pack = bytes.NewReader(emptyPack())
+		}
+		result, err := b.client.Push(ctx, b.url, adv, []smarthttp.Command{cmd}, pack, nil)
+		if err != nil {
+			return 0, err
+		}
+		if reason := result.Refs[ref]; reason != "" {
+			return 0, fmt.Errorf("%s rejected: %s", ref, reason)
+		}
+	}
+	return 0, nil
+}
+
+// emptyPack returns a pack without objects
+func emptyPack() []byte {
+	pack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00")
+	sum := sha1.Sum(pack)
+	return append(pack, sum[:]...)
+}
+
+func (b *bench) report(w io.Writer, elapsed time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fmt.Fprintf(w, "%-10s %8s %7s %9s %9s %9s %9s %9s %12s\n", "", "requests", "errors", "req/s", "p50", "p90", "p99", "max", "bytes/s")
+	for _, op := range b.ops {
+		s := b.stats[op]
+		if s == nil {
+			continue
+		}
+		sort.Slice(s.latencies, func(i, k int) bool { return s.latencies[i] < s.latencies[k] })
+		fmt.Fprintf(w, "%-10s %8d %7d %9.1f %9s %9s %9s %9s %12.0f\n", op,
+			len(s.latencies), s.errors, float64(len(s.latencies))/elapsed.Seconds(),
+			percentile(s.latencies, 50), percentile(s.latencies, 90), percentile(s.latencies, 99), percentile(s.latencies, 100),
+			float64(s.bytes)/elapsed.Seconds())
+		if s.lastErr != nil {
+			fmt.Fprintf(w, "%-10s last error: %s\n", "", s.lastErr)
+		}
+	}
+}
+
+// percentile returns the p-th percentile of the sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(time.Microsecond)
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
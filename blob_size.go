@@ -0,0 +1,74 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// blobSizePolicy rejects pushes introducing blobs larger than max bytes
+type blobSizePolicy struct {
+	max int64
+}
+
+func (p blobSizePolicy) CheckPush(ctx context.Context, push *Push) (map[string]string, error) {
+	rejected := make(map[string]string)
+	for _, u := range push.Updates {
+		if u.IsDelete() {
+			continue
+		}
+		q, err := push.Objects.quarantine()
+		if err != nil {
+			return nil, err
+		}
+		blob, err := q.LargeBlob(ctx, u.New, p.max)
+		if err != nil {
+			return nil, err
+		}
+		if blob != nil {
+			rejected[u.Ref] = fmt.Sprintf("%s (blob %s) is %d bytes, larger than the limit of %d bytes", blob.path, blob.id, blob.size, p.max)
+		}
+	}
+	return rejected, nil
+}
+
+type largeBlob struct {
+	id   string
+	path string
+	size int64
+}
+
+// LargeBlob returns a blob larger than limit bytes that is reachable from
+// the pushed commit but not from any ref of the repository, or nil if there
+// is none.
+func (q *objectQuarantine) LargeBlob(ctx context.Context, id string, limit int64) (*largeBlob, error) {
+	objects, err := q.git(ctx, nil, "rev-list", "--objects", id, "--not", "--all")
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := q.git(ctx, bytes.NewReader(objects), "cat-file", "--batch-check=%(objectname) %(objecttype) %(objectsize) %(rest)")
+	if err != nil {
+		return nil, err
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(sizes))
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), " ", 4)
+		if len(fields) < 3 || fields[1] != "blob" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || size <= limit {
+			continue
+		}
+		blob := &largeBlob{id: fields[0], size: size}
+		if len(fields) == 4 {
+			blob.path = fields[3]
+		}
+		return blob, nil
+	}
+	return nil, sc.Err()
+}
@@ -0,0 +1,25 @@
+package githttp
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize matches the buffer size io.Copy allocates on every call
+const copyBufferSize = 32 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyBuffer is io.Copy with a buffer borrowed from copyBufferPool, so
+// streaming responses under heavy load do not allocate a new buffer each.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,38 @@
+package githttp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// plainWriter hides the ReaderFrom of the writer it wraps, as the response
+// writers of throttled and tracked responses do
+type plainWriter struct{ io.Writer }
+
+// BenchmarkCopy compares io.Copy, allocating a buffer per call, with
+// copyBuffer under concurrent streaming responses
+func BenchmarkCopy(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 256*1024)
+	for _, bench := range []struct {
+		name string
+		copy func(io.Writer, io.Reader) (int64, error)
+	}{
+		{"io.Copy", io.Copy},
+		{"copyBuffer", copyBuffer},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					// LimitReader hides the WriterTo of bytes.Reader
+					src := io.LimitReader(bytes.NewReader(data), int64(len(data)))
+					if _, err := bench.copy(plainWriter{io.Discard}, src); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// bundleHoldBack is how much of a bundle is buffered before it is sent
+const bundleHoldBack = 64 << 10
+
+// serveBundle streams a git bundle of all refs of the repository, for
+// backups without access to its files. With a since query parameter only
+// the objects not reachable from that revision are bundled, making an
+// incremental backup.
+func (gsh GitSmartHTTP) serveBundle(w http.ResponseWriter, r *http.Request, repo string) {
+	repoPath := gsh.localPath(repo)
+	if err := gsh.validateRepo(repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := gsh.warmRepo(r.Context(), repo, repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	args := []string{"--git-dir", repoPath, "bundle", "create", "--quiet", "-", "--all"}
+	since := r.URL.Query().Get("since")
+	if since != "" {
+		if strings.HasPrefix(since, "-") || strings.ContainsAny(since, " \t\n") {
+			writeErrorMessage(w, r, http.StatusBadRequest, "invalid since revision")
+			return
+		}
+		args = append(args, "^"+since)
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-bundle")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.TrimSuffix(path.Base(repo), ".git")+".bundle"))
+	setHeaders(w, hdrNoCache())
+
+	// The start of the bundle is held back, so that git failing before it
+	// gets to the objects, as it does refusing an empty bundle once the
+	// header is written, is still reported with a status.
+	out := &writeTracker{Writer: w}
+	bw := bufio.NewWriterSize(out, bundleHoldBack)
+	var stderr bytes.Buffer
+	err := gsh.processes.Command(nil, args...).Run(r.Context(), nil, bw, &stderr)
+	if err == nil {
+		bw.Flush()
+		return
+	}
+	if out.written {
+		log.Printf("Cannot bundle %s: %s: %s", repo, err, bytes.TrimSpace(stderr.Bytes()))
+		return
+	}
+
+	w.Header().Del("Content-Disposition")
+	msg := strings.TrimSpace(stderr.String())
+	if strings.Contains(msg, "empty bundle") {
+		// Nothing changed since the revision
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if since != "" && strings.Contains(msg, "revision") {
+		writeErrorMessage(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	writeError(w, r, fmt.Errorf("git bundle create: %s: %s", err, msg))
+}
+
+// restoreBundle recreates the repository from an uploaded git bundle, or
+// updates its refs from it when the repository exists. The bundle is
+// verified first, so a corrupt upload or one missing prerequisite objects
+// leaves the repository untouched. With prune set, refs missing from the
+// bundle are deleted.
+func (gsh GitSmartHTTP) restoreBundle(w http.ResponseWriter, r *http.Request, repo string) {
+	repoPath := gsh.localPath(repo)
+	if !gsh.insideRoot(repoPath) {
+		writeError(w, r, ErrRepoNotFound)
+		return
+	}
+
+	bundle, err := os.CreateTemp("", "restore-*.bundle")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer os.Remove(bundle.Name())
+	size, err := io.Copy(bundle, r.Body)
+	if cerr := bundle.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	dir, exists := gitDir(repoPath)
+	if !exists && gsh.quotas != nil {
+		if err := gsh.quotas.check(repo, size); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	status := http.StatusOK
+	if exists {
+		if err := gsh.warmRepo(r.Context(), repo, repoPath); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	} else {
+		// Restore next to where the repository goes and move it in place
+		// once complete, so that half restored repositories are never served.
+		if err := os.MkdirAll(filepath.Dir(repoPath), 0755); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		tmp, err := os.MkdirTemp(filepath.Dir(repoPath), "."+filepath.Base(repoPath)+".tmp-")
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer os.RemoveAll(tmp)
+		if _, err := gsh.processes.git(r.Context(), tmp, "init", "--quiet", "--bare", tmp); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		dir = tmp
+		status = http.StatusCreated
+	}
+
+	if _, err := gsh.processes.git(r.Context(), dir, "bundle", "verify", "--quiet", bundle.Name()); err != nil {
+		writeErrorMessage(w, r, http.StatusBadRequest, "invalid bundle: "+err.Error())
+		return
+	}
+	// git verifies a bare header as a bundle, one restoring nothing
+	if heads, err := gsh.processes.git(r.Context(), dir, "bundle", "list-heads", bundle.Name()); err != nil || heads == "" {
+		writeErrorMessage(w, r, http.StatusBadRequest, "invalid bundle: no refs")
+		return
+	}
+	args := []string{"fetch", "--quiet", "--update-head-ok"}
+	if v, _ := strconv.ParseBool(r.URL.Query().Get("prune")); v {
+		args = append(args, "--prune")
+	}
+	if _, err := gsh.processes.git(r.Context(), dir, append(args, bundle.Name(), "+refs/*:refs/*")...); err != nil {
+		// Verifying the bundle leaves its pack unchecked, which fails here
+		// when it is truncated or corrupt
+		writeErrorMessage(w, r, http.StatusBadRequest, "invalid bundle: "+err.Error())
+		return
+	}
+	if !exists {
+		gsh.restoreHead(r, dir, bundle.Name())
+		if err := os.Rename(dir, repoPath); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if gsh.refsCache != nil {
+		gsh.refsCache.Invalidate(repoPath)
+	}
+	gsh.details.Invalidate(repoPath)
+	if gsh.quotas != nil {
+		gsh.quotas.Invalidate(repo)
+	}
+	gsh.refreshServerInfo(r.Context(), repoPath)
+
+	heads, _ := gsh.processes.git(r.Context(), repoPath, "for-each-ref", "--format=%(objectname) %(refname)")
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	io.WriteString(w, heads)
+}
+
+// restoreHead points HEAD of a restored repository at the branch the HEAD
+// of the bundle was at, if it recorded one.
+func (gsh GitSmartHTTP) restoreHead(r *http.Request, dir, bundle string) {
+	out, err := gsh.processes.git(r.Context(), dir, "bundle", "list-heads", bundle)
+	if err != nil {
+		return
+	}
+	heads := make(map[string]string)
+	var branches []string
+	for _, line := range strings.Split(out, "\n") {
+		id, ref, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		heads[ref] = id
+		if strings.HasPrefix(ref, "refs/heads/") {
+			branches = append(branches, ref)
+		}
+	}
+	head, ok := heads["HEAD"]
+	if !ok {
+		return
+	}
+	for _, ref := range branches {
+		if heads[ref] == head {
+			gsh.processes.git(r.Context(), dir, "symbolic-ref", "HEAD", ref)
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package githttp
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+// writeBundle writes the bundle into a file and returns its path
+func writeBundle(t *testing.T, bundle string) string {
+	path := filepath.Join(t.TempDir(), "test.bundle")
+	if err := os.WriteFile(path, []byte(bundle), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBundleBackup(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{AdminToken: testAdminToken})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	first := srv.Ref("test.git", "HEAD")
+	url := srv.URL + "/api/repos/test.git/bundle"
+
+	if resp, _ := request(t, "GET", url, "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous backup: %d, want 401", resp.StatusCode)
+	}
+
+	resp, bundle := adminRequest(t, "GET", url, "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-git-bundle" {
+		t.Fatalf("backup: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	restored := filepath.Join(t.TempDir(), "restored")
+	githttptest.Git(t, "", "clone", "--quiet", writeBundle(t, bundle), restored)
+	if got := githttptest.Git(t, restored, "rev-parse", "HEAD"); got != first {
+		t.Errorf("full backup restored at %s, want %s", got, first)
+	}
+
+	// An incremental backup applies on top of the full one
+	work := srv.Clone("test.git")
+	second := githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+	srv.Push(work, "HEAD:master")
+	resp, bundle = adminRequest(t, "GET", url+"?since="+first, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("incremental backup: %d", resp.StatusCode)
+	}
+	githttptest.Git(t, restored, "fetch", "--quiet", writeBundle(t, bundle), "refs/heads/master")
+	if got := githttptest.Git(t, restored, "rev-parse", "FETCH_HEAD"); got != second {
+		t.Errorf("incremental backup restored at %s, want %s", got, second)
+	}
+
+	if resp, _ := adminRequest(t, "GET", url+"?since="+second, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("backup since the last commit: %d, want 204", resp.StatusCode)
+	}
+	if resp, body := adminRequest(t, "GET", url+"?since=--all", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("backup since an option: %d, want 400: %s", resp.StatusCode, strings.TrimSpace(body))
+	}
+}
+
+func TestBundleRestore(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{AdminToken: testAdminToken})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	work := srv.Clone("test.git")
+	githttptest.Git(t, work, "checkout", "--quiet", "-b", "topic")
+	topic := githttptest.Commit(t, work, map[string]string{"README": "topic\n"}, "topic")
+	full := filepath.Join(t.TempDir(), "full.bundle")
+	githttptest.Git(t, work, "bundle", "create", "--quiet", full, "master", "topic")
+	bundle, err := os.ReadFile(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, body := adminRequest(t, "PUT", srv.URL+"/api/repos/restored.git/bundle", string(bundle))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("restore: %d %s", resp.StatusCode, body)
+	}
+	if got, want := srv.Ref("restored.git", "refs/heads/topic"), topic; got != want {
+		t.Errorf("restored topic at %s, want %s", got, want)
+	}
+	srv.Clone("restored.git")
+
+	// Refs missing from the bundle are only deleted with prune
+	master := filepath.Join(t.TempDir(), "master.bundle")
+	githttptest.Git(t, work, "bundle", "create", "--quiet", master, "master")
+	bundle, err = os.ReadFile(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, body := adminRequest(t, "PUT", srv.URL+"/api/repos/restored.git/bundle", string(bundle)); resp.StatusCode != http.StatusOK || srv.Ref("restored.git", "refs/heads/topic") == "" {
+		t.Errorf("update: %d %s, want topic kept", resp.StatusCode, body)
+	}
+	if resp, body := adminRequest(t, "PUT", srv.URL+"/api/repos/restored.git/bundle?prune=true", string(bundle)); resp.StatusCode != http.StatusOK || srv.Ref("restored.git", "refs/heads/topic") != "" {
+		t.Errorf("update with prune: %d %s, want topic deleted", resp.StatusCode, body)
+	}
+
+	// Invalid bundles leave nothing behind
+	for _, corrupt := range []string{"not a bundle", "# v2 git bundle\n\n", string(bundle[:len(bundle)-20])} {
+		if resp, _ := adminRequest(t, "PUT", srv.URL+"/api/repos/corrupt.git/bundle", corrupt); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("corrupt bundle %.20q: %d, want 400", corrupt, resp.StatusCode)
+		}
+	}
+	incremental := filepath.Join(t.TempDir(), "incremental.bundle")
+	githttptest.Git(t, work, "bundle", "create", "--quiet", incremental, "master..topic")
+	bundle, err = os.ReadFile(incremental)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := adminRequest(t, "PUT", srv.URL+"/api/repos/incomplete.git/bundle", string(bundle)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bundle missing prerequisites: %d, want 400", resp.StatusCode)
+	}
+	entries, err := os.ReadDir(srv.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "test.git" && e.Name() != "restored.git" {
+			t.Errorf("failed restores left %s behind", e.Name())
+		}
+	}
+}
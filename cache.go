@@ -0,0 +1,155 @@
+package githttp
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache stores values shared by the caches of the server, such as ref
+// advertisements and authentication results. Pointing several servers at
+// one shared Cache keeps them consistent behind a load balancer. Values may
+// be dropped at any time.
+type Cache interface {
+	// Get returns the value stored under key
+	Get(key string) ([]byte, bool)
+	// Set stores value under key for ttl, zero meaning no expiry
+	Set(key string, value []byte, ttl time.Duration)
+	// Delete drops the values stored under the keys
+	Delete(keys ...string)
+}
+
+// Bounds of the cache NewMemoryCache returns
+const (
+	DefaultMemoryCacheEntries = 100000
+	DefaultMemoryCacheBytes   = 64 << 20
+)
+
+// memoryCacheSweep is how often a memoryCache drops its expired values
+const memoryCacheSweep = time.Minute
+
+// memoryCache is the Cache local to the process. It keeps at most
+// maxEntries values taking maxBytes with their keys, dropping the least
+// recently used ones to make room for new ones, and drops expired values
+// every memoryCacheSweep rather than waiting for them to be looked up.
+type memoryCache struct {
+	maxEntries int
+	maxBytes   int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds the *memoryCacheEntry values, the most recently used first
+	lru   *list.List
+	bytes int64
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (e *memoryCacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// NewMemoryCache returns a Cache local to the process, bounded to
+// DefaultMemoryCacheEntries values and DefaultMemoryCacheBytes
+func NewMemoryCache() Cache {
+	return NewMemoryCacheSize(DefaultMemoryCacheEntries, DefaultMemoryCacheBytes)
+}
+
+// NewMemoryCacheSize returns a Cache local to the process keeping at most
+// maxEntries values taking maxBytes with their keys, zero meaning no limit
+func NewMemoryCacheSize(maxEntries int, maxBytes int64) Cache {
+	c := newMemoryCache(maxEntries, maxBytes)
+	go c.sweepLoop(memoryCacheSweep)
+	return c
+}
+
+func newMemoryCache(maxEntries int, maxBytes int64) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*memoryCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &memoryCacheEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	if c.maxBytes > 0 && entry.size() > c.maxBytes {
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+	for (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *memoryCache) Delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		if elem, ok := c.entries[key]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// remove drops the entry of elem, with the lock held
+func (c *memoryCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*memoryCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+}
+
+// sweep drops the expired values
+func (c *memoryCache) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if entry := elem.Value.(*memoryCacheEntry); !entry.expires.IsZero() && now.After(entry.expires) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+func (c *memoryCache) sweepLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.sweep()
+	}
+}
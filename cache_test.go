@@ -0,0 +1,64 @@
+package githttp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheBounds(t *testing.T) {
+	c := newMemoryCache(3, 0)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, []byte(key), 0)
+	}
+	c.Get("a")
+	c.Set("d", []byte("d"), 0)
+	if _, ok := c.Get("b"); ok {
+		t.Error("least recently used value kept beyond the entry limit")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if v, ok := c.Get(key); !ok || string(v) != key {
+			t.Errorf("%s: %q, %v", key, v, ok)
+		}
+	}
+
+	// Keys count towards the bytes too
+	c = newMemoryCache(0, 10)
+	c.Set("a", []byte("1234"), 0)
+	c.Set("b", []byte("1234"), 0)
+	if c.bytes != 10 || c.lru.Len() != 2 {
+		t.Fatalf("%d values of %d bytes, want 2 of 10", c.lru.Len(), c.bytes)
+	}
+	c.Set("c", []byte("1"), 0)
+	if _, ok := c.Get("a"); ok || c.bytes != 7 {
+		t.Errorf("over the byte limit: %d bytes, a kept %v", c.bytes, ok)
+	}
+	c.Set("b", []byte("12"), 0)
+	if c.bytes != 5 {
+		t.Errorf("replaced value: %d bytes, want 5", c.bytes)
+	}
+	c.Set("big", []byte(strings.Repeat("x", 10)), 0)
+	if _, ok := c.Get("big"); ok || c.lru.Len() != 2 {
+		t.Errorf("value larger than the cache stored, or evicted the others")
+	}
+	c.Delete("b", "c")
+	if c.bytes != 0 || len(c.entries) != 0 || c.lru.Len() != 0 {
+		t.Errorf("after Delete: %d bytes, %d entries", c.bytes, len(c.entries))
+	}
+}
+
+func TestMemoryCacheSweep(t *testing.T) {
+	c := newMemoryCache(0, 0)
+	c.Set("expired", []byte("x"), time.Nanosecond)
+	c.Set("fresh", []byte("x"), time.Hour)
+	c.Set("forever", []byte("x"), 0)
+	time.Sleep(time.Millisecond)
+
+	c.sweep()
+	if _, ok := c.entries["expired"]; ok {
+		t.Error("expired value kept by sweep")
+	}
+	if len(c.entries) != 2 || c.bytes != int64(len("fresh")+len("forever")+2) {
+		t.Errorf("%d values of %d bytes left, want fresh and forever", len(c.entries), c.bytes)
+	}
+}
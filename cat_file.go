@@ -0,0 +1,281 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errObjectMissing = errors.New("object missing")
+
+// catFilePool keeps one long running `git cat-file --batch` process per
+// recently used repository, so objects can be served without forking git
+// on every request. Processes unused for longer than idle are stopped.
+//
+// The processes run under the ProcessManager, each holding a slot for as
+// long as it runs. When the manager limits the processes, at most half of
+// the slots are kept by the pool, the least recently used process being
+// stopped to make room for another.
+type catFilePool struct {
+	processes *ProcessManager
+	idle      time.Duration
+	max       int
+
+	mu      sync.Mutex
+	batches map[string]*catFileBatch
+}
+
+// catFileBatch talks to a single `git cat-file --batch` process. lastUsed
+// is guarded by the pool lock, everything else by the batch lock.
+type catFileBatch struct {
+	mu       sync.Mutex
+	gs       *GitRPCClient
+	stdout   *bufio.Reader
+	lastUsed time.Time
+}
+
+func newCatFilePool(processes *ProcessManager, idle time.Duration) *catFilePool {
+	p := &catFilePool{
+		processes: processes,
+		idle:      idle,
+		max:       -1,
+		batches:   make(map[string]*catFileBatch),
+	}
+	if processes.MaxProcesses > 0 {
+		p.max = processes.MaxProcesses / 2
+	}
+	go p.reapLoop()
+	return p
+}
+
+// WriteLooseObject writes the object in the loose object format, a zlib
+// stream of "<type> <size>\0<content>", into w. found is called once the
+// object is found, before anything is written, so that nothing is written
+// when it fails with errObjectMissing or cannot look the object up.
+//
+// The object is read out of cat-file before it is written, so that a slow
+// client does not keep the process of the repository from other requests.
+func (p *catFilePool) WriteLooseObject(w io.Writer, repoPath, oid string, found func()) error {
+	b, pooled, err := p.batch(repoPath)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	obj, err := b.readObject(oid)
+	if !pooled {
+		b.stop()
+	} else if err != nil && err != errObjectMissing {
+		// The process is out of sync with us now, start over next time.
+		p.remove(repoPath, b)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer obj.close()
+
+	found()
+	return obj.writeLoose(w)
+}
+
+// batch returns the batch of the repository, starting its process if
+// needed. pooled is false for a process the pool has no room for, which
+// the caller stops once done.
+func (p *catFilePool) batch(repoPath string) (b *catFileBatch, pooled bool, err error) {
+	p.mu.Lock()
+	if b, ok := p.batches[repoPath]; ok {
+		b.lastUsed = time.Now()
+		p.mu.Unlock()
+		return b, true, nil
+	}
+	evicted := p.evict()
+	p.mu.Unlock()
+	stopBatches(evicted)
+
+	dir, ok := gitDir(repoPath)
+	if !ok {
+		return nil, false, ErrRepoNotFound
+	}
+	gs := p.processes.NewGitRPCClient(&GitRPCClientConfig{
+		Stream: true,
+	})
+	gs.CatFileBatch(dir)
+
+	// The process outlives the request, so the request going away neither
+	// kills it nor gives up its slot.
+	if err := gs.Start(context.Background()); err != nil {
+		return nil, false, err
+	}
+
+	b = &catFileBatch{
+		gs:       gs,
+		stdout:   bufio.NewReader(gs.StdoutReader),
+		lastUsed: time.Now(),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.batches[repoPath]; ok || (p.max >= 0 && len(p.batches) >= p.max) {
+		return b, false, nil
+	}
+	p.batches[repoPath] = b
+	return b, true, nil
+}
+
+// evict removes the least recently used batch when the pool is full, for
+// the caller to stop once the pool is unlocked
+func (p *catFilePool) evict() []*catFileBatch {
+	if p.max <= 0 || len(p.batches) < p.max {
+		return nil
+	}
+
+	var oldest string
+	for repoPath, b := range p.batches {
+		if oldest == "" || b.lastUsed.Before(p.batches[oldest].lastUsed) {
+			oldest = repoPath
+		}
+	}
+	b := p.batches[oldest]
+	delete(p.batches, oldest)
+	return []*catFileBatch{b}
+}
+
+// remove stops the process of the batch, which must be locked by the caller
+func (p *catFilePool) remove(repoPath string, b *catFileBatch) {
+	p.mu.Lock()
+	if p.batches[repoPath] == b {
+		delete(p.batches, repoPath)
+	}
+	p.mu.Unlock()
+
+	b.stop()
+}
+
+func (p *catFilePool) reapLoop() {
+	for range time.Tick(p.idle) {
+		var idle []*catFileBatch
+
+		p.mu.Lock()
+		for repoPath, b := range p.batches {
+			if time.Since(b.lastUsed) > p.idle {
+				idle = append(idle, b)
+				delete(p.batches, repoPath)
+			}
+		}
+		p.mu.Unlock()
+
+		stopBatches(idle)
+	}
+}
+
+// stopBatches stops the processes of batches removed from the pool, once
+// whoever uses them is done
+func stopBatches(batches []*catFileBatch) {
+	for _, b := range batches {
+		b.mu.Lock()
+		b.stop()
+		b.mu.Unlock()
+	}
+}
+
+func (b *catFileBatch) stop() {
+	b.gs.StdinWriter.Close()
+	b.gs.Close()
+}
+
+// catFileMemoryLimit is the size of the largest object read out of
+// cat-file into memory, larger ones being spooled to a temporary file
+const catFileMemoryLimit = 1 << 20
+
+// catFileObject is an object read out of cat-file
+type catFileObject struct {
+	typ     string
+	size    int64
+	content io.Reader
+	spool   *os.File
+}
+
+// readObject reads the object out of the process
+func (b *catFileBatch) readObject(oid string) (*catFileObject, error) {
+	if _, err := fmt.Fprintf(b.gs.StdinWriter, "%s\n", oid); err != nil {
+		return nil, err
+	}
+
+	header, err := b.stdout.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(header)
+	if len(fields) == 2 && fields[1] == "missing" {
+		return nil, errObjectMissing
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected cat-file header %q", header)
+	}
+
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &catFileObject{typ: fields[1], size: size}
+	if size <= catFileMemoryLimit {
+		content := make([]byte, size)
+		if _, err := io.ReadFull(b.stdout, content); err != nil {
+			return nil, err
+		}
+		obj.content = bytes.NewReader(content)
+	} else {
+		if obj.spool, err = os.CreateTemp("", "git-http-backend-object-"); err != nil {
+			return nil, err
+		}
+		n, err := copyBuffer(obj.spool, io.LimitReader(b.stdout, size))
+		if err == nil && n != size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			_, err = obj.spool.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			obj.close()
+			return nil, err
+		}
+		obj.content = obj.spool
+	}
+
+	// Every object is followed by a newline
+	if _, err := b.stdout.Discard(1); err != nil {
+		obj.close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+// writeLoose writes the object into w in the loose object format
+func (obj *catFileObject) writeLoose(w io.Writer) error {
+	zw := zlib.NewWriter(w)
+	fmt.Fprintf(zw, "%s %d\x00", obj.typ, obj.size)
+	if _, err := copyBuffer(zw, obj.content); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// close removes the temporary file of a spooled object
+func (obj *catFileObject) close() {
+	if obj.spool != nil {
+		obj.spool.Close()
+		os.Remove(obj.spool.Name())
+	}
+}
@@ -0,0 +1,106 @@
+package githttp
+
+import (
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+// getLooseObject fetches an object of a repository as a loose object,
+// returning the status and the inflated object
+func getLooseObject(t *testing.T, srv *githttptest.Server, repo, oid string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Get(srv.RepoURL(repo) + "/objects/" + oid[:2] + "/" + oid[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, ""
+	}
+	zr, err := zlib.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(object)
+}
+
+func TestCatFileBatch(t *testing.T) {
+	var gsh GitSmartHTTP
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh = NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: root, ExportAll: true, UploadPack: true, CatFileBatch: true, MaxProcesses: 2})
+		return gsh.Handler()
+	})
+	srv.CreateRepo("a.git", map[string]string{"README": "hello\n"})
+	srv.CreateRepo("b.git", map[string]string{"README": "hello\n"})
+	blob := srv.Ref("a.git", "HEAD:README")
+
+	// The pool keeps one of the two slots, stopping the process of a.git
+	// for the one of b.git
+	for _, repo := range []string{"a.git", "b.git", "a.git"} {
+		if status, object := getLooseObject(t, srv, repo, blob); status != http.StatusOK || object != "blob 6\x00hello\n" {
+			t.Errorf("%s: status %d, object %q", repo, status, object)
+		}
+		if active := gsh.Processes().Active; active != 1 {
+			t.Errorf("%s: %d git processes running, want 1", repo, active)
+		}
+	}
+
+	if status, _ := getLooseObject(t, srv, "a.git", "0123456789012345678901234567890123456789"); status != http.StatusNotFound {
+		t.Errorf("missing object: status %d, want %d", status, http.StatusNotFound)
+	}
+	if status, _ := getLooseObject(t, srv, "missing.git", blob); status != http.StatusNotFound {
+		t.Errorf("missing repository: status %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestCatFileSlowClient(t *testing.T) {
+	var gsh GitSmartHTTP
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh = NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: root, ExportAll: true, UploadPack: true, CatFileBatch: true})
+		return gsh.Handler()
+	})
+	big := strings.Repeat("large object\n", catFileMemoryLimit/8)
+	srv.CreateRepo("a.git", map[string]string{"README": "hello\n", "BIG": big})
+	readme := srv.Ref("a.git", "HEAD:README")
+	bigBlob := srv.Ref("a.git", "HEAD:BIG")
+
+	// A client not reading its object must not hold the process up
+	stalled, unblock := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- gsh.catFiles.WriteLooseObject(unblock, gsh.localPath("a.git"), bigBlob, func() {})
+	}()
+	result := make(chan string)
+	go func() {
+		_, object := getLooseObject(t, srv, "a.git", readme)
+		result <- object
+	}()
+	select {
+	case object := <-result:
+		if object != "blob 6\x00hello\n" {
+			t.Errorf("object %q", object)
+		}
+	case <-time.After(10 * time.Second):
+		stalled.Close()
+		t.Fatal("request waiting for a stalled client")
+	}
+	stalled.Close()
+	<-done
+
+	// Objects too large for memory are spooled
+	if status, object := getLooseObject(t, srv, "a.git", bigBlob); status != http.StatusOK || object != fmt.Sprintf("blob %d\x00%s", len(big), big) {
+		t.Errorf("large object: status %d, %d bytes", status, len(object))
+	}
+}
@@ -0,0 +1,60 @@
+package githttp
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// clientLimiter caps the smart HTTP operations running at once per client
+// IP, so that a runaway script fetching in parallel cannot take up every
+// git process of the server.
+type clientLimiter struct {
+	max int
+
+	mu      sync.Mutex
+	clients map[string]int
+}
+
+func newClientLimiter(max int) *clientLimiter {
+	return &clientLimiter{max: max, clients: make(map[string]int)}
+}
+
+// acquire takes a slot of the client, telling whether one was free
+func (l *clientLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.clients[ip] >= l.max {
+		return false
+	}
+	l.clients[ip]++
+	return true
+}
+
+func (l *clientLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.clients[ip]--; l.clients[ip] <= 0 {
+		delete(l.clients, ip)
+	}
+}
+
+// limitClient takes a slot of the client IP of a smart HTTP request. It
+// answers with 429 when the client has none left, returning false.
+func (gsh GitSmartHTTP) limitClient(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if gsh.clients == nil || !isSmartRequest(r) {
+		return func() {}, true
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !gsh.clients.acquire(ip) {
+		writeError(w, r, ErrTooManyRequests)
+		return nil, false
+	}
+	return func() { gsh.clients.release(ip) }, true
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	githttp "github.com/jaxi/git-http-backend"
+)
+
+// VERSION is the version of the binary
+var VERSION string
+
+// COMMIT is current commit SHA number
+var COMMIT string
+
+// BANNER shows at the beginning of the command line
+const BANNER = `
+       _ _     _   _   _          _             _               _
+  __ _(_) |_  | |_| |_| |_ _ __  | |__  __ _ __| |_____ _ _  __| |
+ / _` + "` " + `| |  _| | ' \  _|  _| '_ \ | '_ \/ _` + "` " + `/ _| / / -_) ' \/ _` + "`" + ` |
+ \__, |_|\__| |_||_\__|\__| .__/ |_.__/\__,_\__|_\_\___|_||_\__,_|
+ |___/                    |_|
+  Git HTTP Backend
+    Version: %s Build: %s
+`
+
+// serverHeader returns the default Server header, naming the version
+func serverHeader() string {
+	if VERSION == "" {
+		return "git-http-backend"
+	}
+	return "git-http-backend/" + VERSION
+}
+
+func main() {
+	var vsn, cachePrivate bool
+	var redisAddr, redisPassword, natsAddr, natsSubject, kafkaBrokers, kafkaTopic, journalPath, gitoliteConf, authURL, protectionPath, protectedTags, signedRepos, dcoRepos, repoGitConfigPath, hideRefs, hiddenRefsPath, backupEndpoint, backupBucket, backupRegion, tierEndpoint, tierBucket, tierRegion, pruneRefs, tokenSecret, tokenRealm, tokenService, jwtRules, jwtSecret, jwtKey, jwtIssuer, jwtAudience, ownerQuotas, trustedProxies, gatewayUserHeaders, otlpEndpoint, errorTemplate string
+	var gitConfig, gitEnv, gitArgs, listen, routePolicies stringList
+	var gitEnvPassthrough string
+	var authCacheTTL, accessCacheTTL, accessCacheNegativeTTL, tokenTTL time.Duration
+	var tokenDirect bool
+	var memoryCacheEntries int
+	var memoryCacheBytes int64
+	gsc := githttp.GitSmartHTTPConfig{}
+
+	flag.BoolVar(&vsn, "version", false, "print version")
+	flag.StringVar(&gsc.ReposRootPath, "repos-root-path", "/etc/git-http-backend", "directory that contains git repositories to serve")
+	flag.BoolVar(&gsc.ReceivePack, "git-receive-pack", true, "whether to receive what is pushed into repository")
+	flag.BoolVar(&gsc.UploadPack, "git-upload-pack", true, "whether to send objects packed back to git-fetch-pack")
+	flag.BoolVar(&gsc.ExportAll, "export-all", true, "whether to serve every repository, not only those containing git-daemon-export-ok")
+	flag.StringVar(&gsc.GitSuffix, "git-suffix", githttp.GitSuffixExact, "how to handle the .git suffix of repository URLs: exact, optional, require or redirect")
+	flag.DurationVar(&gsc.TextCache.MaxAge, "text-cache-max-age", 0, "how long clients and proxies may cache HEAD, info/packs and other text files (0 disables caching)")
+	flag.DurationVar(&gsc.ObjectCache.MaxAge, "object-cache-max-age", 365*24*time.Hour, "how long clients and proxies may cache objects, packs and pack indexes (0 disables caching)")
+	flag.BoolVar(&gsc.ObjectCache.Immutable, "object-cache-immutable", false, "whether to mark cached objects, packs and pack indexes as immutable")
+	flag.BoolVar(&cachePrivate, "cache-private", false, "whether to only allow private caches, not shared proxies, to store responses")
+	flag.IntVar(&gsc.Port, "port", 8080, "port that the Git server backend runs on")
+	flag.DurationVar(&gsc.DrainTimeout, "drain-timeout", 0, "how long the requests being served may take to finish when the server stops on SIGTERM or upgrades on SIGUSR2, handing its listeners over to the binary at its path started again (without limit when 0)")
+	flag.Var(&listen, "listen", "address to listen on instead of -port, such as :8080, tls://[::1]:8443?cert=c.pem&key=k.pem or unix:///run/git-http-backend.sock?mode=0660, with the options client-ca, read-only and admin (may be repeated)")
+	flag.StringVar(&gsc.MOTD, "motd", "", "message of the day shown on every fetch and push, before the one in the motd file of the repository")
+	flag.BoolVar(&gsc.PushSummary, "push-summary", false, "whether to show pushers a summary of the refs their push updated")
+	flag.StringVar(&gsc.PushSummaryURL, "push-summary-url", "", "URL shown in the push summary for every updated ref, with {repo}, {ref} and {new} replaced, such as the page of its CI pipeline")
+	flag.StringVar(&gsc.ServerHeader, "server-header", serverHeader(), "Server header sent with every response (not sent when empty)")
+	flag.StringVar(&gsc.GitServerHeader, "git-server-header", "", "X-Git-Server header sent with every response, such as the name and version of the server in a fleet (not sent when empty)")
+	flag.BoolVar(&gsc.RefsCache, "refs-cache", false, "whether to cache info/refs advertisements until the refs of a repository change")
+	flag.StringVar(&gsc.PackCacheDir, "pack-cache-dir", "", "directory to cache upload-pack responses of identical requests in (disabled when empty)")
+	flag.DurationVar(&gsc.PackCacheTTL, "pack-cache-ttl", time.Hour, "how long a cached upload-pack response is served")
+	flag.DurationVar(&gsc.NegotiationCacheTTL, "negotiation-cache-ttl", 0, "how long to cache the upload-pack negotiation rounds of clients sending a "+githttp.NegotiationSessionHeader+" header, so that repeated rounds of a fetch are not walked again (0 disables the cache)")
+	flag.Int64Var(&gsc.NegotiationCacheSize, "negotiation-cache-size", githttp.DefaultNegotiationCacheSize, "most bytes the negotiation rounds cached in memory take, apart from the other cached values (not used with -redis-addr)")
+	flag.IntVar(&gsc.MinCloneDepth, "min-clone-depth", 0, "smallest depth shallow fetches may ask for, such as 2 to refuse storms of --depth=1 clones (0 means no limit)")
+	flag.IntVar(&gsc.MaxCloneDepth, "max-clone-depth", 0, "largest depth shallow fetches may ask for (0 means no limit)")
+	flag.IntVar(&gsc.MaxDeepen, "max-deepen", 0, "most commits a fetch may deepen a shallow clone by with --deepen (0 means no limit)")
+	flag.IntVar(&gsc.MaxClientRequests, "max-client-requests", 0, "maximum number of smart HTTP requests served at once per client IP, answered with 429 beyond (0 means no limit)")
+	flag.BoolVar(&gsc.SerializePushes, "serialize-pushes", false, "whether pushes into a repository wait for each other, using a lock file in the repository to include other servers sharing the storage")
+	flag.IntVar(&gsc.MaxProcesses, "max-git-processes", 0, "maximum number of git processes running at once (0 means no limit)")
+	flag.IntVar(&gsc.MaxQueuedProcesses, "max-queued-git-processes", 0, "maximum number of git processes waiting for one of -max-git-processes to finish, requests beyond being answered with 429 (0 means no limit)")
+	flag.DurationVar(&gsc.QueueTimeout, "git-queue-timeout", 0, "how long git processes wait for one of -max-git-processes to finish before their request is answered with 429 (0 means as long as the request lasts)")
+	flag.BoolVar(&gsc.CatFileBatch, "cat-file-batch", false, "whether to serve loose object requests from a long running git cat-file --batch process, including objects stored in packs")
+	flag.Int64Var(&gsc.ConnRateLimit, "conn-rate-limit", 0, "maximum bytes per second sent by upload-pack responses and dumb HTTP downloads per connection (0 means no limit)")
+	flag.Int64Var(&gsc.RepoRateLimit, "repo-rate-limit", 0, "maximum bytes per second sent by upload-pack responses and dumb HTTP downloads per repository (0 means no limit)")
+	flag.Var(&routePolicies, "route-policy", "limits of a route, info-refs, upload-pack, receive-pack or objects, overriding the server-wide ones, such as objects:timeout=10m,conn-rate=1048576 with the limits timeout, max-body-size, conn-rate and repo-rate (may be repeated)")
+	flag.Int64Var(&gsc.MaxUploadPackBodySize, "max-upload-pack-body-size", 0, "maximum size in bytes of an upload-pack request body (0 means no limit)")
+	flag.Int64Var(&gsc.MaxReceivePackBodySize, "max-receive-pack-body-size", 0, "maximum size in bytes of a receive-pack request body, that is of a push (0 means no limit)")
+	flag.DurationVar(&gsc.UploadPackTimeout, "upload-pack-timeout", 0, "maximum time a git upload-pack process may run (0 means no limit)")
+	flag.DurationVar(&gsc.ReceivePackTimeout, "receive-pack-timeout", 30*time.Minute, "maximum time a git receive-pack process may run (0 means no limit)")
+	flag.StringVar(&gsc.PrimaryURL, "primary-url", "", "URL of the primary server to forward pushes to, making this server a replica serving fetches only (disabled when empty)")
+	flag.StringVar(&gsc.UpstreamURL, "upstream-url", "", "URL of a server, such as https://github.com, to mirror repositories missing locally from when they are fetched (disabled when empty)")
+	flag.DurationVar(&gsc.UpstreamTTL, "upstream-ttl", 5*time.Minute, "how long a mirror is served before it is refreshed from upstream in the background (0 never refreshes)")
+	flag.DurationVar(&gsc.UpstreamSyncAge, "upstream-sync-age", 0, "how old a mirror may be before a ref advertisement waits for it to be refreshed from upstream (0 never waits)")
+	flag.DurationVar(&gsc.UpstreamSyncTimeout, "upstream-sync-timeout", 10*time.Second, "how long a ref advertisement waits for a mirror to be refreshed before serving the stale copy")
+	flag.StringVar(&gsc.RepoStatsPath, "repo-stats-path", "", "file to keep usage statistics of every repository in, served at /api/repos/<repo>/stats (disabled when empty)")
+	flag.StringVar(&backupEndpoint, "backup-s3-endpoint", "https://s3.amazonaws.com", "URL of the S3 compatible service to back repositories up to, with credentials taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	flag.StringVar(&backupBucket, "backup-s3-bucket", "", "bucket to back every repository up to as git bundles, with the status served at /api/backups (disabled when empty)")
+	flag.StringVar(&backupRegion, "backup-s3-region", "us-east-1", "region of the backup bucket")
+	flag.StringVar(&gsc.BackupPrefix, "backup-prefix", "", "prefix of the keys backups are stored at, such as git/")
+	flag.DurationVar(&gsc.BackupInterval, "backup-interval", 24*time.Hour, "how often repositories are backed up")
+	flag.DurationVar(&gsc.BackupFullInterval, "backup-full-interval", 7*24*time.Hour, "how often full backups are taken, with incremental ones in between")
+	flag.StringVar(&tierEndpoint, "tier-s3-endpoint", "https://s3.amazonaws.com", "URL of the S3 compatible service to move the packs of unused repositories to, with credentials taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	flag.StringVar(&tierBucket, "tier-s3-bucket", "", "bucket to move the packs of repositories unused for -tier-age to (disabled when empty)")
+	flag.StringVar(&tierRegion, "tier-s3-region", "us-east-1", "region of the cold storage bucket")
+	flag.StringVar(&gsc.TierPrefix, "tier-prefix", "", "prefix of the keys packs are stored at in cold storage, such as packs/")
+	flag.DurationVar(&gsc.TierAge, "tier-age", 90*24*time.Hour, "how long a repository goes unused before its packs move to cold storage")
+	flag.DurationVar(&gsc.TierInterval, "tier-interval", 24*time.Hour, "how often repositories are checked for packs to move to cold storage")
+	flag.BoolVar(&gsc.TierRedirect, "tier-redirect", false, "whether dumb HTTP downloads of packs in cold storage are redirected to the bucket rather than fetching the packs back")
+	flag.StringVar(&pruneRefs, "prune-refs", "", "comma separated patterns of refs, such as refs/merge-requests/, deleted from repositories when older than -prune-refs-age")
+	flag.DurationVar(&gsc.PruneRefsAge, "prune-refs-age", 30*24*time.Hour, "how old the commit of a ref matching -prune-refs must be for it to be deleted")
+	flag.DurationVar(&gsc.PruneRefsInterval, "prune-refs-interval", 0, "how often stale refs are pruned from every repository (disabled when zero)")
+	flag.BoolVar(&gsc.PruneRefsDryRun, "prune-refs-dry-run", false, "whether the scheduled ref pruning only logs the refs it would delete")
+	flag.DurationVar(&gsc.BackupRetention, "backup-retention", 30*24*time.Hour, "how far back repositories can be restored from backups (0 keeps every backup)")
+	flag.DurationVar(&gsc.JanitorInterval, "janitor-interval", 0, "how often stale lock files, quarantine directories and temporary packs left by crashed git processes are removed (0 disables the cleanup)")
+	flag.DurationVar(&gsc.JanitorAge, "janitor-age", time.Hour, "how old lock files and temporary files must be to be removed")
+	flag.BoolVar(&gsc.JanitorDryRun, "janitor-dry-run", false, "whether to only log the stale files that would be removed")
+	flag.DurationVar(&gsc.SlowRequestThreshold, "slow-request-threshold", 0, "log requests taking longer, with their repository, client, size and git command line (0 disables the slow request log)")
+	flag.BoolVar(&gsc.RelayStderr, "relay-stderr", false, "whether to relay git's stderr to clients on the sideband channel when they support one")
+	flag.StringVar(&gsc.PackObjectsCacheDir, "pack-objects-cache-dir", "", "directory to cache pack-objects output in through uploadpack.packObjectsHook (disabled when empty)")
+	flag.DurationVar(&gsc.PackObjectsCacheTTL, "pack-objects-cache-ttl", 10*time.Minute, "how long cached pack-objects output is reused")
+	flag.StringVar(&redisAddr, "redis-addr", "", "address of a Redis server to share caches through (caches are kept in memory when empty)")
+	flag.IntVar(&memoryCacheEntries, "memory-cache-entries", githttp.DefaultMemoryCacheEntries, "most values the caches kept in memory hold, the least recently used being dropped beyond (0 means no limit)")
+	flag.Int64Var(&memoryCacheBytes, "memory-cache-size", githttp.DefaultMemoryCacheBytes, "most bytes the values of the caches kept in memory take (0 means no limit)")
+	flag.StringVar(&redisPassword, "redis-password", "", "password of the Redis server")
+	flag.StringVar(&natsAddr, "nats-addr", "", "address of a NATS server to publish push events to (disabled when empty)")
+	flag.StringVar(&natsSubject, "nats-subject", "git.push", "NATS subject push events are published on")
+	flag.StringVar(&kafkaBrokers, "kafka-brokers", "", "comma separated addresses of Kafka brokers to publish push events through (disabled when empty, cannot be combined with -nats-addr)")
+	flag.StringVar(&kafkaTopic, "kafka-topic", "git.push", "Kafka topic push events are published to, on its first partition")
+	flag.StringVar(&journalPath, "journal-path", "", "file to journal every pushed ref update in, queried at /debug/journal with the admin token (disabled when empty)")
+	flag.StringVar(&gsc.EventSpoolDir, "event-spool-dir", "", "directory push events are kept in until published (defaults to a directory in the system temp dir)")
+	flag.StringVar(&authURL, "auth-url", "", "URL of an external service deciding on repository access, like nginx's auth_request (cannot be combined with -gitolite-conf)")
+	flag.DurationVar(&accessCacheTTL, "access-cache-ttl", 0, "how long granted access of a user to a repository is cached (0 disables caching)")
+	flag.DurationVar(&accessCacheNegativeTTL, "access-cache-negative-ttl", 0, "how long denied access of a user to a repository is cached (0 disables caching)")
+	flag.StringVar(&tokenSecret, "token-auth-secret", "", "secret signing the short-lived tokens issued at /token, which requests for repositories then need, like container registries do (disabled when empty)")
+	flag.StringVar(&tokenRealm, "token-auth-realm", "/token", "URL of the token endpoint clients are sent to when a token is required")
+	flag.StringVar(&tokenService, "token-auth-service", "git-http-backend", "name of the service tokens are issued for")
+	flag.DurationVar(&tokenTTL, "token-auth-ttl", 5*time.Minute, "how long issued tokens are valid")
+	flag.BoolVar(&tokenDirect, "token-auth-direct", false, "whether requests without a token may still authenticate with the credentials the token endpoint takes")
+	flag.DurationVar(&authCacheTTL, "auth-cache-ttl", 0, "how long decisions of the external auth service are cached (0 disables caching)")
+	flag.StringVar(&protectionPath, "protection-rules", "", "JSON file of branch protection rules, also changed through the admin API (disabled when empty)")
+	flag.BoolVar(&gsc.Trace2, "trace2", false, "whether the trace2 events of the git processes serving fetches and pushes are captured, logging their key timings and object counts with the request")
+	flag.StringVar(&errorTemplate, "error-template", "", "path of the html/template errors are rendered with for browsers, given the Status, StatusText and Message of the error")
+	flag.StringVar(&githttp.ErrorDocumentationURL, "error-docs-url", "", "URL of the page documenting errors, linked from JSON and HTML errors with {code} replaced by the code of the error")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "URL of the OpenTelemetry collector spans of fetches and pushes, down to git's trace2 regions, are sent to with OTLP/HTTP, such as http://localhost:4318/v1/traces (disabled when empty)")
+	flag.BoolVar(&gsc.AdvertiseSessionID, "advertise-session-id", false, "whether clients are asked for their session ID, logged with their requests and recorded with their pushes")
+	flag.Int64Var(&gsc.OwnerQuota, "owner-quota", 0, "maximum disk space in bytes the repositories of each owner, the first directory of their path, take together (0 means no limit)")
+	flag.StringVar(&ownerQuotas, "owner-quotas", "", "JSON file of the quotas in bytes of some owners, such as {\"team-x\": 10737418240}, overriding -owner-quota")
+	flag.Int64Var(&gsc.MaxBlobSize, "max-blob-size", 0, "maximum size in bytes of a file a push may introduce (0 means no limit)")
+	flag.StringVar(&gsc.PushCertKeyring, "push-cert-keyring", "", "GPG keyring to verify signed pushes against (push certificates are not offered when empty)")
+	flag.StringVar(&gsc.PushCertNonceSeed, "push-cert-nonce-seed", "", "secret push certificate nonces are derived from, shared by all servers of a fleet (random when empty)")
+	flag.DurationVar(&gsc.PushCertSlop, "push-cert-slop", 5*time.Minute, "how old a push certificate nonce may be")
+	flag.StringVar(&gsc.CommitKeyring, "commit-keyring", "", "GPG keyring of the keys allowed to sign commits on refs requiring signed commits")
+	flag.StringVar(&gsc.CommitAllowedSigners, "commit-allowed-signers", "", "SSH allowed signers file of the keys allowed to sign commits on refs requiring signed commits")
+	flag.StringVar(&signedRepos, "require-signed-push", "", "comma separated patterns of repositories only accepting signed pushes")
+	flag.StringVar(&dcoRepos, "require-dco", "", "comma separated patterns of repositories whose new commits need a Signed-off-by trailer of the pusher")
+	flag.BoolVar(&gsc.DCOExemptMerges, "dco-exempt-merges", true, "whether merge commits are exempt from -require-dco")
+	flag.StringVar(&protectedTags, "protected-tags", "", "comma separated patterns of tags that cannot be moved or deleted once created, such as v*")
+	flag.StringVar(&gsc.AdminToken, "admin-token", "", "bearer token required by the admin API under /admin/ and the gRPC management service of proto/management.proto (both are disabled when empty)")
+	flag.StringVar(&gsc.GitPath, "git-path", "", "git binary to run, such as /opt/git/bin/git (the one found in PATH when empty)")
+	flag.Var(&gitArgs, "git-args", "extra arguments of a git command as command=args, such as upload-pack=--timeout=600 (may be repeated)")
+	flag.Var(&gitEnv, "git-env", "environment variable KEY=value set for every git process, such as GIT_TRACE_PACKET=/tmp/trace (may be repeated)")
+	flag.StringVar(&gitEnvPassthrough, "git-env-passthrough", strings.Join(githttp.DefaultGitEnvPassthrough, ","), "comma separated names or patterns of the environment variables forwarded to git, such as *_proxy,*_PROXY (* forwards the whole environment)")
+	flag.Var(&gitConfig, "git-config", "git config key=value git runs with for every repository, such as receive.fsckObjects=true (may be repeated)")
+	flag.BoolVar(&gsc.UpdateServerInfo, "update-server-info", false, "whether info/refs and objects/info/packs of repositories are regenerated after every push, garbage collection and ref pruning, for dumb HTTP clients and static mirrors reading the repositories off the storage")
+	flag.StringVar(&gsc.SHAInWant, "sha-in-want", "", "which commits clients may fetch by object name without a ref advertised for them: off, tip (tips of hidden refs too) or reachable (any commit reachable from a ref); empty leaves it to the git config")
+	flag.StringVar(&repoGitConfigPath, "repo-git-config", "", "JSON file of git config overrides for repositories matching a pattern")
+	flag.StringVar(&hideRefs, "hide-refs", "", "comma separated ref prefixes, such as refs/pull/,refs/ci/, hidden from clients of every repository")
+	flag.StringVar(&hiddenRefsPath, "hidden-refs", "", "JSON file of ref prefixes hidden from clients of repositories matching a pattern")
+	flag.BoolVar(&gsc.Namespaces, "namespaces", false, "whether to serve the git namespace given in /<repo>/ns/<namespace>/ URLs or the Git-Namespace header")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "comma separated CIDRs of the gateways, such as oauth2-proxy, whose requests name the user they authenticated in -gateway-user-headers (disabled when empty)")
+	flag.StringVar(&gatewayUserHeaders, "gateway-user-headers", strings.Join(githttp.DefaultGatewayUserHeaders, ","), "comma separated headers trusted gateways name the authenticated user in, the first present being used")
+	flag.StringVar(&jwtRules, "jwt-rules", "", "JSON file of rules mapping the claims of JSON web tokens requests carry to repository permissions (cannot be combined with -auth-url or -gitolite-conf)")
+	flag.StringVar(&jwtSecret, "jwt-secret", "", "secret HS256 JSON web tokens are signed with")
+	flag.StringVar(&jwtKey, "jwt-public-key", "", "PEM file of the public key RS256 or ES256 JSON web tokens are signed with")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", "", "issuer JSON web tokens must come from (any when empty)")
+	flag.StringVar(&jwtAudience, "jwt-audience", "", "audience JSON web tokens must be meant for (any when empty)")
+	flag.StringVar(&gitoliteConf, "gitolite-conf", "", "gitolite.conf to read repository access rules from (everyone may access everything when empty)")
+
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, fmt.Sprintf(BANNER, VERSION, COMMIT))
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	log.SetOutput(githttp.NewRedactingWriter(os.Stderr))
+
+	gsc.TextCache.Private = cachePrivate
+	gsc.ObjectCache.Private = cachePrivate
+
+	if redisAddr != "" {
+		gsc.Cache = githttp.NewRedisCache(redisAddr, redisPassword, 16)
+	} else {
+		gsc.Cache = githttp.NewMemoryCacheSize(memoryCacheEntries, memoryCacheBytes)
+	}
+
+	if trustedProxies != "" {
+		proxies, err := githttp.ParseCIDRs(trustedProxies)
+		if err != nil {
+			log.Fatalf("Invalid -trusted-proxies: %s", err)
+		}
+		var headers []string
+		for _, h := range strings.Split(gatewayUserHeaders, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				headers = append(headers, h)
+			}
+		}
+		gsc.IdentityFunc = githttp.GatewayIdentityFunc(proxies, headers)
+	}
+
+	if authURL != "" {
+		if gitoliteConf != "" {
+			log.Fatal("-auth-url and -gitolite-conf cannot be combined")
+		}
+		auth := githttp.NewExternalAuth(authURL)
+		if authCacheTTL > 0 {
+			auth.Cache = gsc.Cache
+			auth.CacheTTL = authCacheTTL
+		}
+		gsc.Access = auth
+	}
+
+	if gitoliteConf != "" {
+		acl, err := githttp.LoadGitoliteConf(gitoliteConf)
+		if err != nil {
+			log.Fatalf("Cannot load %s: %s", gitoliteConf, err)
+		}
+		gsc.Access = acl
+	}
+
+	for _, spec := range routePolicies {
+		route, p, err := githttp.ParseRoutePolicy(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if gsc.RoutePolicies == nil {
+			gsc.RoutePolicies = make(map[string]githttp.RoutePolicy)
+		}
+		gsc.RoutePolicies[route] = p
+	}
+
+	for _, spec := range listen {
+		l, err := githttp.ParseListener(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gsc.Listeners = append(gsc.Listeners, l)
+	}
+
+	if errorTemplate != "" {
+		tmpl, err := githttp.LoadErrorTemplate(errorTemplate)
+		if err != nil {
+			log.Fatalf("Cannot load %s: %s", errorTemplate, err)
+		}
+		githttp.ErrorTemplate = tmpl
+	}
+
+	if otlpEndpoint != "" {
+		gsc.Tracing = githttp.NewOTLPExporter(otlpEndpoint, "git-http-backend")
+	}
+
+	if ownerQuotas != "" {
+		quotas, err := githttp.LoadOwnerQuotas(ownerQuotas)
+		if err != nil {
+			log.Fatalf("Cannot load %s: %s", ownerQuotas, err)
+		}
+		gsc.OwnerQuotas = quotas
+	}
+
+	if jwtRules != "" {
+		if authURL != "" || gitoliteConf != "" {
+			log.Fatal("-jwt-rules cannot be combined with -auth-url or -gitolite-conf")
+		}
+		rules, err := githttp.LoadJWTRules(jwtRules)
+		if err != nil {
+			log.Fatalf("Cannot load %s: %s", jwtRules, err)
+		}
+		auth := &githttp.JWTAuth{Secret: []byte(jwtSecret), Issuer: jwtIssuer, Audience: jwtAudience, Rules: rules}
+		if jwtKey != "" {
+			if auth.Key, err = githttp.LoadJWTKey(jwtKey); err != nil {
+				log.Fatalf("Cannot load %s: %s", jwtKey, err)
+			}
+		}
+		gsc.Access = auth
+	}
+
+	if gsc.Access != nil && (accessCacheTTL > 0 || accessCacheNegativeTTL > 0) {
+		gsc.Access = githttp.CachedAccessChecker(gsc.Cache, accessCacheTTL, accessCacheNegativeTTL, gsc.Access)
+	}
+
+	if tokenSecret != "" {
+		auth := githttp.NewTokenAuth([]byte(tokenSecret), tokenRealm, tokenService, gsc.Access)
+		auth.TTL = tokenTTL
+		auth.Direct = tokenDirect
+		auth.IdentityFunc = gsc.IdentityFunc
+		gsc.Access = auth
+	}
+
+	if protectionPath != "" {
+		bp, err := githttp.LoadBranchProtection(protectionPath)
+		if err != nil {
+			log.Fatalf("Cannot load %s: %s", protectionPath, err)
+		}
+		gsc.Protection = bp
+	}
+
+	if signedRepos != "" {
+		for _, pattern := range strings.Split(signedRepos, ",") {
+			gsc.RequireSignedPush = append(gsc.RequireSignedPush, strings.TrimSpace(pattern))
+		}
+	}
+
+	for _, kv := range gitConfig {
+		if err := githttp.CheckGitConfig(kv); err != nil {
+			log.Fatal(err)
+		}
+	}
+	gsc.GitConfig = gitConfig
+	if err := githttp.CheckSHAInWant(gsc.SHAInWant); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, kv := range gitArgs {
+		name, args, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			log.Fatalf("-git-args %s is not command=args", kv)
+		}
+		if gsc.GitArgs == nil {
+			gsc.GitArgs = make(map[string][]string)
+		}
+		gsc.GitArgs[name] = append(gsc.GitArgs[name], strings.Fields(args)...)
+	}
+
+	for _, kv := range gitEnv {
+		if !strings.Contains(kv, "=") {
+			log.Fatalf("-git-env %s is not KEY=value", kv)
+		}
+	}
+	gsc.GitEnv = gitEnv
+	gsc.GitEnvPassthrough = []string{}
+	for _, name := range strings.Split(gitEnvPassthrough, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			gsc.GitEnvPassthrough = append(gsc.GitEnvPassthrough, name)
+		}
+	}
+
+	if repoGitConfigPath != "" {
+		configs, err := githttp.LoadRepoGitConfig(repoGitConfigPath)
+		if err != nil {
+			log.Fatalf("Cannot load %s: %s", repoGitConfigPath, err)
+		}
+		gsc.RepoGitConfig = configs
+	}
+
+	if hiddenRefsPath != "" {
+		hidden, err := githttp.LoadHiddenRefs(hiddenRefsPath)
+		if err != nil {
+			log.Fatalf("Cannot load %s: %s", hiddenRefsPath, err)
+		}
+		gsc.HiddenRefs = hidden
+	}
+
+	if hideRefs != "" {
+		var hidden githttp.HiddenRefs
+		for _, ref := range strings.Split(hideRefs, ",") {
+			hidden.Refs = append(hidden.Refs, strings.TrimSpace(ref))
+		}
+		gsc.HiddenRefs = append(gsc.HiddenRefs, hidden)
+	}
+
+	if dcoRepos != "" {
+		for _, pattern := range strings.Split(dcoRepos, ",") {
+			gsc.RequireDCO = append(gsc.RequireDCO, strings.TrimSpace(pattern))
+		}
+	}
+
+	if protectedTags != "" {
+		if gsc.Protection == nil {
+			gsc.Protection = &githttp.BranchProtection{}
+		}
+		for _, pattern := range strings.Split(protectedTags, ",") {
+			gsc.Protection.Static = append(gsc.Protection.Static, githttp.ProtectionRule{
+				Ref:       "refs/tags/" + strings.TrimSpace(pattern),
+				Immutable: true,
+			})
+		}
+	}
+
+	if pruneRefs != "" {
+		for _, pattern := range strings.Split(pruneRefs, ",") {
+			gsc.PruneRefs = append(gsc.PruneRefs, strings.TrimSpace(pattern))
+		}
+	}
+
+	if tierBucket != "" {
+		gsc.TierBucket = githttp.NewS3Bucket(tierEndpoint, tierBucket, tierRegion, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	}
+	if backupBucket != "" {
+		gsc.BackupBucket = githttp.NewS3Bucket(backupEndpoint, backupBucket, backupRegion, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	}
+
+	if journalPath != "" {
+		gsc.Journal = githttp.NewFileJournal(journalPath)
+	}
+
+	if natsAddr != "" && kafkaBrokers != "" {
+		log.Fatal("-nats-addr and -kafka-brokers cannot be combined")
+	}
+	if natsAddr != "" {
+		gsc.EventPublisher = githttp.NewNATSPublisher(natsAddr, natsSubject)
+	}
+	if kafkaBrokers != "" {
+		gsc.EventPublisher = githttp.NewKafkaPublisher(strings.Split(kafkaBrokers, ","), kafkaTopic)
+	}
+
+	if vsn {
+		fmt.Printf("git-http-backend version: %s, commit: %s\n", VERSION, COMMIT)
+		os.Exit(0)
+	}
+
+	if flag.NArg() >= 1 {
+		switch flag.Args()[0] {
+		case "version":
+			fmt.Printf("git-http-backend version: %s, commit: %s\n", VERSION, COMMIT)
+			os.Exit(0)
+		case "help":
+			flag.Usage()
+			os.Exit(0)
+		case githttp.PackObjectsHookCmd:
+			os.Exit(githttp.RunPackObjectsHook(flag.Args()[1:]))
+		case githttp.ConformanceCmd:
+			os.Exit(githttp.RunConformance(&gsc, flag.Args()[1:]))
+		case githttp.BenchCmd:
+			os.Exit(githttp.RunBench(flag.Args()[1:]))
+		}
+	}
+
+	gsh := githttp.NewGitSmartHTTP(&gsc)
+	expvar.Publish("git_processes", expvar.Func(func() interface{} {
+		return gsh.Processes()
+	}))
+	expvar.Publish("git_transfers", expvar.Func(func() interface{} {
+		return gsh.Transfers()
+	}))
+	if len(gsh.Listeners) == 0 {
+		log.Printf(BANNER+"    Running on port %d", VERSION, COMMIT, gsh.Port)
+	} else {
+		log.Printf(BANNER, VERSION, COMMIT)
+		for _, l := range gsh.Listeners {
+			log.Printf("Listening on %s", l)
+		}
+	}
+	gsh.ListenAndServe()
+}
+
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
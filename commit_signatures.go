@@ -0,0 +1,99 @@
+package githttp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// commitKeys are the keys commit signatures are checked against: a GPG
+// keyring, imported into a private GnuPG home, and an SSH allowed signers
+// file.
+type commitKeys struct {
+	env []string
+}
+
+func newCommitKeys(keyring, allowedSigners string) (*commitKeys, error) {
+	keys := &commitKeys{}
+
+	if keyring != "" {
+		home, err := os.MkdirTemp("", "git-http-backend-gpg-")
+		if err != nil {
+			return nil, err
+		}
+		out, err := exec.Command("gpg", "--homedir", home, "--batch", "--import", keyring).CombinedOutput()
+		if err != nil {
+			os.RemoveAll(home)
+			return nil, fmt.Errorf("cannot import %s: %s", keyring, strings.TrimSpace(string(out)))
+		}
+		keys.env = append(keys.env, "GNUPGHOME="+home)
+	}
+
+	if allowedSigners != "" {
+		path, err := filepath.Abs(allowedSigners)
+		if err != nil {
+			return nil, err
+		}
+		keys.env = append(keys.env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=gpg.ssh.allowedSignersFile",
+			"GIT_CONFIG_VALUE_0="+path,
+		)
+	}
+	return keys, nil
+}
+
+// signedCommitsPolicy rejects updates of refs requiring signed commits
+// that introduce commits without a good signature by one of the keys.
+type signedCommitsPolicy struct {
+	protection *BranchProtection
+	keys       *commitKeys
+}
+
+func (p signedCommitsPolicy) CheckPush(ctx context.Context, push *Push) (map[string]string, error) {
+	rejected := make(map[string]string)
+	for _, u := range push.Updates {
+		if u.IsDelete() || !p.protection.requiresSignedCommits(push.Repo, u.Ref) {
+			continue
+		}
+		q, err := push.Objects.quarantine()
+		if err != nil {
+			return nil, err
+		}
+		commit, err := q.UnsignedCommit(ctx, u.New, p.keys)
+		if err != nil {
+			return nil, err
+		}
+		if commit != "" {
+			rejected[u.Ref] = fmt.Sprintf("commit %s is not signed by an allowed key", commit)
+		}
+	}
+	return rejected, nil
+}
+
+// UnsignedCommit returns the first commit reachable from id but not from
+// any ref of the repository that lacks a good signature by one of the keys,
+// or an empty string if all of them are signed.
+func (q *objectQuarantine) UnsignedCommit(ctx context.Context, id string, keys *commitKeys) (string, error) {
+	var env []string
+	if keys != nil {
+		env = keys.env
+	}
+	out, err := q.gitEnv(ctx, env, nil, "log", "--format=%H %G?", id, "--not", "--all")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		commit, status, ok := strings.Cut(line, " ")
+		// G is a good signature by a trusted key, U one by a key of
+		// unknown trust, which is fine since the keyring is what we trust.
+		if ok && status != "G" && status != "U" {
+			return commit, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,337 @@
+package githttp
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ConformanceCmd is the name of the command running RunConformance
+const ConformanceCmd = "conformance"
+
+// RunConformance is the entry point of the conformance command. It serves
+// throwaway repositories with the configuration given on the command line
+// and runs every git binary given through clone, shallow clone, fetch,
+// push, force push, tag push and delete, in protocol versions 0 and 2,
+// checking the ref advertisements byte by byte.
+func RunConformance(cfg *GitSmartHTTPConfig, args []string) int {
+	fs := flag.NewFlagSet(ConformanceCmd, flag.ExitOnError)
+	gits := fs.String("git", "git", "comma separated git binaries to run, such as several versions of git")
+	verbose := fs.Bool("v", false, "show the server log")
+	fs.Parse(args)
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	root, err := os.MkdirTemp("", "git-http-backend-conformance")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", ConformanceCmd, err)
+		return 1
+	}
+	defer os.RemoveAll(root)
+
+	cfg.ReposRootPath = filepath.Join(root, "repos")
+	cfg.ReceivePack = true
+	cfg.UploadPack = true
+	cfg.ExportAll = true
+	srv := httptest.NewServer(NewGitSmartHTTP(cfg))
+	defer srv.Close()
+
+	failed := 0
+	n := 0
+	for _, bin := range strings.Split(*gits, ",") {
+		c := &conformance{git: strings.TrimSpace(bin), root: root}
+		version, err := c.run("", "version")
+		if err != nil {
+			fmt.Printf("SKIP %s: %s\n", c.git, err)
+			continue
+		}
+		for _, proto := range []int{0, 2} {
+			n++
+			c.proto = proto
+			c.repo = fmt.Sprintf("conformance-%d.git", n)
+			c.url = srv.URL + "/" + c.repo
+			for _, check := range c.checks() {
+				if err := check.fn(); err != nil {
+					failed++
+					fmt.Printf("FAIL %s, protocol %d: %s: %s\n", version, proto, check.name, err)
+				} else {
+					fmt.Printf("ok   %s, protocol %d: %s\n", version, proto, check.name)
+				}
+			}
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d checks failed\n", failed)
+		return 1
+	}
+	return 0
+}
+
+// conformance runs the checks of one git binary and protocol version
+// against one repository
+type conformance struct {
+	git   string
+	proto int
+	root  string
+	repo  string
+	url   string
+	work  string
+}
+
+type conformanceCheck struct {
+	name string
+	fn   func() error
+}
+
+// checks returns the checks in the order they have to run in, each one
+// building on the state the ones before left.
+func (c *conformance) checks() []conformanceCheck {
+	return []conformanceCheck{
+		{"create repository", c.create},
+		{"upload-pack advertisement", func() error { return c.advertisement(uploadPack) }},
+		{"receive-pack advertisement", func() error { return c.advertisement(receivePack) }},
+		{"clone", c.clone},
+		{"shallow clone", c.shallowClone},
+		{"push", c.push},
+		{"fetch", c.fetch},
+		{"force push", c.forcePush},
+		{"tag push", c.tagPush},
+		{"delete", c.delete},
+	}
+}
+
+func (c *conformance) bare() string {
+	return filepath.Join(c.root, "repos", c.repo)
+}
+
+func (c *conformance) dir(name string) string {
+	return filepath.Join(c.root, strings.TrimSuffix(c.repo, ".git")+"-"+name)
+}
+
+// run runs git in dir with the configuration of the machine left out
+func (c *conformance) run(dir string, args ...string) (string, error) {
+	cmd := exec.Command(c.git, append([]string{"-c", "protocol.version=" + strconv.Itoa(c.proto)}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_GLOBAL="+os.DevNull,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME=conformance",
+		"GIT_AUTHOR_EMAIL=conformance@example.com",
+		"GIT_COMMITTER_NAME=conformance",
+		"GIT_COMMITTER_EMAIL=conformance@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// expectRef makes sure the ref of the served repository is at want, or
+// does not exist when want is empty.
+func (c *conformance) expectRef(ref, want string) error {
+	got, _ := c.run(c.bare(), "rev-parse", "--verify", "--quiet", ref)
+	if got != want {
+		return fmt.Errorf("%s is %q on the server, want %q", ref, got, want)
+	}
+	return nil
+}
+
+func (c *conformance) commit(dir, msg string, args ...string) (string, error) {
+	if _, err := c.run(dir, append([]string{"commit", "--quiet", "--allow-empty", "-m", msg}, args...)...); err != nil {
+		return "", err
+	}
+	return c.run(dir, "rev-parse", "HEAD")
+}
+
+func (c *conformance) create() error {
+	seed := c.dir("seed")
+	if _, err := c.run("", "init", "--quiet", "--bare", c.bare()); err != nil {
+		return err
+	}
+	if _, err := c.run(c.bare(), "symbolic-ref", "HEAD", "refs/heads/master"); err != nil {
+		return err
+	}
+	if _, err := c.run("", "init", "--quiet", seed); err != nil {
+		return err
+	}
+	for _, msg := range []string{"first", "second"} {
+		if err := os.WriteFile(filepath.Join(seed, "file"), []byte(msg+"\n"), 0644); err != nil {
+			return err
+		}
+		if _, err := c.run(seed, "add", "file"); err != nil {
+			return err
+		}
+		if _, err := c.commit(seed, msg); err != nil {
+			return err
+		}
+	}
+	_, err := c.run(seed, "push", "--quiet", c.bare(), "HEAD:refs/heads/master")
+	return err
+}
+
+// advertisement checks the framing of the info/refs response byte by byte:
+// the service announcement, a flush, the refs with capabilities on the
+// first one and a final flush, all well formed pkt-lines.
+func (c *conformance) advertisement(service string) error {
+	resp, err := http.Get(c.url + "/info/refs?service=" + service)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if ct, want := resp.Header.Get("Content-Type"), "application/x-"+service+"-advertisement"; ct != want {
+		return fmt.Errorf("content type %q, want %q", ct, want)
+	}
+	if cc := resp.Header.Get("Cache-Control"); !strings.Contains(cc, "no-cache") {
+		return fmt.Errorf("cache control %q, want no-cache", cc)
+	}
+
+	br := bufio.NewReader(resp.Body)
+	var lines []string
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("truncated pkt-line header after %d lines", len(lines))
+		}
+		size, err := strconv.ParseUint(string(header[:]), 16, 16)
+		if err != nil || (size > 0 && size < 4) || size > pktMaxLen {
+			return fmt.Errorf("malformed pkt-line header %q", header)
+		}
+		if size == 0 {
+			lines = append(lines, "")
+			continue
+		}
+		payload := make([]byte, size-4)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return fmt.Errorf("pkt-line shorter than its header %q", header)
+		}
+		if payload[len(payload)-1] != '\n' {
+			return fmt.Errorf("pkt-line %q does not end in a newline", payload)
+		}
+		lines = append(lines, string(payload))
+	}
+
+	switch {
+	case len(lines) < 4:
+		return fmt.Errorf("%d pkt-lines, want at least 4", len(lines))
+	case lines[0] != "# service="+service+"\n":
+		return fmt.Errorf("first pkt-line %q, want the service announcement", lines[0])
+	case lines[1] != "":
+		return fmt.Errorf("no flush after the service announcement")
+	case !strings.Contains(lines[2], "\x00"):
+		return fmt.Errorf("no capabilities on the first ref %q", lines[2])
+	case lines[len(lines)-1] != "":
+		return fmt.Errorf("no flush at the end")
+	}
+	for _, line := range lines[2 : len(lines)-1] {
+		if len(line) < 42 || line[40] != ' ' {
+			return fmt.Errorf("malformed ref line %q", line)
+		}
+	}
+	return nil
+}
+
+func (c *conformance) clone() error {
+	c.work = c.dir("clone")
+	if _, err := c.run("", "clone", "--quiet", c.url, c.work); err != nil {
+		return err
+	}
+	head, err := c.run(c.work, "rev-parse", "HEAD")
+	if err != nil {
+		return err
+	}
+	return c.expectRef("refs/heads/master", head)
+}
+
+func (c *conformance) shallowClone() error {
+	dir := c.dir("shallow")
+	if _, err := c.run("", "clone", "--quiet", "--depth", "1", c.url, dir); err != nil {
+		return err
+	}
+	count, err := c.run(dir, "rev-list", "--count", "HEAD")
+	if err != nil {
+		return err
+	}
+	if count != "1" {
+		return fmt.Errorf("%s commits in a clone of depth 1", count)
+	}
+	return nil
+}
+
+func (c *conformance) push() error {
+	head, err := c.commit(c.work, "pushed")
+	if err != nil {
+		return err
+	}
+	if _, err := c.run(c.work, "push", "--quiet", "origin", "HEAD:master"); err != nil {
+		return err
+	}
+	return c.expectRef("refs/heads/master", head)
+}
+
+func (c *conformance) fetch() error {
+	dir := c.dir("shallow")
+	if _, err := c.run(dir, "fetch", "--quiet", "origin"); err != nil {
+		return err
+	}
+	fetched, err := c.run(dir, "rev-parse", "origin/master")
+	if err != nil {
+		return err
+	}
+	return c.expectRef("refs/heads/master", fetched)
+}
+
+func (c *conformance) forcePush() error {
+	head, err := c.commit(c.work, "rewritten", "--amend")
+	if err != nil {
+		return err
+	}
+	if _, err := c.run(c.work, "push", "--quiet", "--force", "origin", "HEAD:master"); err != nil {
+		return err
+	}
+	return c.expectRef("refs/heads/master", head)
+}
+
+func (c *conformance) tagPush() error {
+	if _, err := c.run(c.work, "tag", "-a", "v1", "-m", "v1"); err != nil {
+		return err
+	}
+	tag, err := c.run(c.work, "rev-parse", "refs/tags/v1")
+	if err != nil {
+		return err
+	}
+	if _, err := c.run(c.work, "push", "--quiet", "origin", "v1"); err != nil {
+		return err
+	}
+	return c.expectRef("refs/tags/v1", tag)
+}
+
+func (c *conformance) delete() error {
+	if _, err := c.run(c.work, "push", "--quiet", "origin", "HEAD:refs/heads/doomed"); err != nil {
+		return err
+	}
+	if _, err := c.run(c.work, "push", "--quiet", "origin", ":doomed"); err != nil {
+		return err
+	}
+	return c.expectRef("refs/heads/doomed", "")
+}
@@ -0,0 +1,104 @@
+package githttp
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"path"
+	"strings"
+)
+
+// dcoPolicy rejects pushes to the repositories matching the patterns that
+// introduce commits without a Signed-off-by of the pusher, or of their
+// author for pushers without email.
+type dcoPolicy struct {
+	repos        []string
+	exemptMerges bool
+}
+
+func (p dcoPolicy) CheckPush(ctx context.Context, push *Push) (map[string]string, error) {
+	if !matchesAny(p.repos, push.Repo) {
+		return nil, nil
+	}
+
+	var email string
+	if push.Pusher != nil {
+		email = push.Pusher.Email
+	}
+	signer := email
+	if signer == "" {
+		signer = "its author"
+	}
+
+	rejected := make(map[string]string)
+	for _, u := range push.Updates {
+		if u.IsDelete() {
+			continue
+		}
+		q, err := push.Objects.quarantine()
+		if err != nil {
+			return nil, err
+		}
+		commit, err := q.UnsignedOffCommit(ctx, u.New, email, p.exemptMerges)
+		if err != nil {
+			return nil, err
+		}
+		if commit != "" {
+			rejected[u.Ref] = fmt.Sprintf("commit %s lacks a Signed-off-by of %s", commit, signer)
+		}
+	}
+	return rejected, nil
+}
+
+// matchesAny reports whether name matches any of the path.Match patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// UnsignedOffCommit returns the first commit reachable from id but not from
+// any ref of the repository without a Signed-off-by trailer of email, or of
+// the commit author when email is empty. Merge commits are skipped when
+// exemptMerges is set.
+func (q *objectQuarantine) UnsignedOffCommit(ctx context.Context, id, email string, exemptMerges bool) (string, error) {
+	out, err := q.git(ctx, nil, "log", "--format=%H%x00%P%x00%ae%x00%(trailers:key=Signed-off-by,valueonly,separator=%x01)%x1e", id, "--not", "--all")
+	if err != nil {
+		return "", err
+	}
+
+	for _, record := range strings.Split(string(out), "\x1e") {
+		fields := strings.Split(strings.TrimSpace(record), "\x00")
+		if len(fields) != 4 {
+			continue
+		}
+		commit, parents, author, trailers := fields[0], fields[1], fields[2], fields[3]
+		if exemptMerges && len(strings.Fields(parents)) > 1 {
+			continue
+		}
+
+		want := email
+		if want == "" {
+			want = author
+		}
+		if !hasSignoff(trailers, want) {
+			return commit, nil
+		}
+	}
+	return "", nil
+}
+
+// hasSignoff reports whether the Signed-off-by trailer values, separated by
+// \x01, include one of email.
+func hasSignoff(trailers, email string) bool {
+	for _, value := range strings.Split(trailers, "\x01") {
+		addr, err := mail.ParseAddress(strings.TrimSpace(value))
+		if err == nil && strings.EqualFold(addr.Address, email) {
+			return true
+		}
+	}
+	return false
+}
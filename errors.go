@@ -0,0 +1,303 @@
+package githttp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Errors returned by GitSmartHTTP. Embedding applications can compare
+// against them with errors.Is and use ErrorStatus to find out how they are
+// reported to clients.
+var (
+	ErrRepoNotFound    = errors.New("repository not found")
+	ErrRepoNotExported = errors.New("repository not exported")
+	ErrServiceDisabled = errors.New("service disabled")
+	ErrUnknownService  = errors.New("unknown service")
+	ErrInvalidPush     = errors.New("invalid push request")
+	ErrContentType     = errors.New("unsupported content type")
+	ErrAuthRequired    = errors.New("authentication required")
+	ErrAccessDenied    = errors.New("access denied")
+	ErrQuotaExceeded   = errors.New("quota exceeded")
+	ErrTooManyRequests = errors.New("too many concurrent requests")
+	ErrGitTimeout      = errors.New("git command timed out")
+
+	ErrPrimaryUnavailable = errors.New("primary unavailable")
+)
+
+// Codes of the errors reported in ErrorBody
+const (
+	CodeRepoNotFound       = "repo_not_found"
+	CodeRepoNotExported    = "repo_not_exported"
+	CodeServiceDisabled    = "service_disabled"
+	CodeUnknownService     = "unknown_service"
+	CodeInvalidPush        = "invalid_push"
+	CodeContentType        = "unsupported_content_type"
+	CodeAuthRequired       = "auth_required"
+	CodeAccessDenied       = "access_denied"
+	CodeQuotaExceeded      = "quota_exceeded"
+	CodeTooManyRequests    = "too_many_requests"
+	CodeGitTimeout         = "git_timeout"
+	CodePrimaryUnavailable = "primary_unavailable"
+	CodeRequestTooLarge    = "request_too_large"
+	CodeInternal           = "internal_error"
+)
+
+// retryAfter is how many seconds clients turned away for load are told to
+// wait before retrying
+const retryAfter = "1"
+
+// ErrorStatus returns the HTTP status an error is reported with
+func ErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	switch {
+	case errors.Is(err, ErrRepoNotFound), errors.Is(err, ErrRepoNotExported):
+		return http.StatusNotFound
+	case errors.Is(err, ErrServiceDisabled), errors.Is(err, ErrAccessDenied):
+		return http.StatusForbidden
+	case errors.Is(err, ErrUnknownService), errors.Is(err, ErrInvalidPush):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrContentType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrAuthRequired):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrTooManyRequests):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrGitTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrPrimaryUnavailable):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ErrorCode returns the code an error is reported with in ErrorBody
+func ErrorCode(err error) string {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return CodeRequestTooLarge
+	}
+
+	for _, c := range []struct {
+		err  error
+		code string
+	}{
+		{ErrRepoNotFound, CodeRepoNotFound},
+		{ErrRepoNotExported, CodeRepoNotExported},
+		{ErrServiceDisabled, CodeServiceDisabled},
+		{ErrUnknownService, CodeUnknownService},
+		{ErrInvalidPush, CodeInvalidPush},
+		{ErrContentType, CodeContentType},
+		{ErrAuthRequired, CodeAuthRequired},
+		{ErrAccessDenied, CodeAccessDenied},
+		{ErrQuotaExceeded, CodeQuotaExceeded},
+		{ErrTooManyRequests, CodeTooManyRequests},
+		{ErrGitTimeout, CodeGitTimeout},
+		{ErrPrimaryUnavailable, CodePrimaryUnavailable},
+	} {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return CodeInternal
+}
+
+// statusCode returns the code of errors known only by their HTTP status,
+// such as not_found or bad_request
+func statusCode(status int) string {
+	if status == http.StatusInternalServerError {
+		return CodeInternal
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// writeError reports err to the client with its HTTP status. Unexpected
+// errors are logged and only their status is shown to the client.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := ErrorStatus(err)
+	msg := err.Error()
+	if status == http.StatusInternalServerError {
+		log.Printf("%s %s failed (request %s): %s", r.Method, r.URL.Path, requestID(w, r), err)
+		msg = http.StatusText(status)
+	}
+
+	var challenge *tokenChallengeError
+	if errors.As(err, &challenge) {
+		w.Header().Set("WWW-Authenticate", challenge.challenge)
+	} else if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Git"`)
+	}
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	writeErrorBody(w, r, status, ErrorCode(err), msg)
+}
+
+// ErrorBody is the JSON body of errors, for scripts driving the API. Code
+// is one of the Code constants, or the HTTP status in snake case, such as
+// not_found, for errors without a code of their own. The fields are only
+// ever added to.
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// RequestID is the X-Request-Id of the request, the one given by the
+	// client or a proxy, or else one made up for the error, which is also
+	// in the log
+	RequestID string `json:"request_id"`
+	// Repo is the repository of the request, relative to the repositories
+	// root, when known
+	Repo             string `json:"repo,omitempty"`
+	DocumentationURL string `json:"documentation_url,omitempty"`
+}
+
+// ErrorDocumentationURL is the page documenting the errors, with {code}
+// replaced by the code of the error, such as
+// https://docs.example.com/git/errors#{code}. Errors have no
+// documentation_url when empty.
+var ErrorDocumentationURL string
+
+// ErrorPage is what ErrorTemplate renders
+type ErrorPage struct {
+	ErrorBody
+	Status     int
+	StatusText string
+}
+
+// ErrorTemplate renders the errors shown to browsers, for branded error
+// pages. A minimal page is shown when nil.
+var ErrorTemplate *template.Template
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p><small>Request {{.RequestID}}{{if .DocumentationURL}} &middot; <a href="{{.DocumentationURL}}">{{.Code}}</a>{{end}}</small></p>
+</body>
+</html>
+`))
+
+// LoadErrorTemplate parses the html/template at path as the ErrorTemplate
+func LoadErrorTemplate(path string) (*template.Template, error) {
+	return template.ParseFiles(path)
+}
+
+// writeErrorMessage writes an error known only by its HTTP status
+func writeErrorMessage(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	writeErrorBody(w, r, status, statusCode(status), msg)
+}
+
+// writeErrorBody writes an error in the format the client asks for in its
+// Accept header: an ErrorBody for tooling and the API, HTML for browsers
+// and plain text otherwise, as git expects.
+func writeErrorBody(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	body := ErrorBody{Code: code, Message: msg, RequestID: requestID(w, r)}
+	if info, ok := RequestInfoFromContext(r.Context()); ok {
+		body.Repo = info.Repo
+	}
+	if ErrorDocumentationURL != "" {
+		body.DocumentationURL = strings.ReplaceAll(ErrorDocumentationURL, "{code}", code)
+	}
+
+	switch errorMediaType(r.Header.Get("Accept")) {
+	case "application/json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	case "text/html":
+		tmpl := ErrorTemplate
+		if tmpl == nil {
+			tmpl = defaultErrorTemplate
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		if err := tmpl.Execute(w, ErrorPage{ErrorBody: body, Status: status, StatusText: http.StatusText(status)}); err != nil {
+			log.Printf("Cannot render error page: %s", err)
+		}
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		if status == http.StatusRequestEntityTooLarge || status == http.StatusGatewayTimeout {
+			// Let git show the reason instead of just the status code.
+			io.WriteString(w, pktError(msg))
+			return
+		}
+		io.WriteString(w, msg+"\n")
+	}
+}
+
+// requestID returns the X-Request-Id of the request, making one up and
+// sending it back when the request has none
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if id := w.Header().Get("X-Request-Id"); id != "" {
+		return id
+	}
+	id := r.Header.Get("X-Request-Id")
+	if id == "" || len(id) > 128 {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	w.Header().Set("X-Request-Id", id)
+	return id
+}
+
+// errorMediaType picks the error format the Accept header prefers among
+// JSON, HTML and plain text, plain text when it names none of them
+func errorMediaType(accept string) string {
+	best, bestQ := "text/plain", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/json", "text/html", "text/plain":
+			if q > bestQ {
+				best, bestQ = mediaType, q
+			}
+		}
+	}
+	return best
+}
+
+// writeTracker remembers whether anything has been written through it, so
+// that a failure can still be reported with a proper status.
+type writeTracker struct {
+	io.Writer
+	written bool
+	n       int64
+}
+
+func (t *writeTracker) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		t.written = true
+	}
+	n, err := t.Writer.Write(p)
+	t.n += int64(n)
+	return n, err
+}
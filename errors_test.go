@@ -0,0 +1,185 @@
+package githttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestErrorStatusAndCode(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ErrRepoNotFound, http.StatusNotFound, CodeRepoNotFound},
+		{ErrRepoNotExported, http.StatusNotFound, CodeRepoNotExported},
+		{ErrServiceDisabled, http.StatusForbidden, CodeServiceDisabled},
+		{ErrUnknownService, http.StatusBadRequest, CodeUnknownService},
+		{ErrInvalidPush, http.StatusBadRequest, CodeInvalidPush},
+		{ErrContentType, http.StatusUnsupportedMediaType, CodeContentType},
+		{ErrAuthRequired, http.StatusUnauthorized, CodeAuthRequired},
+		{ErrAccessDenied, http.StatusForbidden, CodeAccessDenied},
+		{ErrQuotaExceeded, http.StatusInsufficientStorage, CodeQuotaExceeded},
+		{ErrTooManyRequests, http.StatusTooManyRequests, CodeTooManyRequests},
+		{ErrGitTimeout, http.StatusGatewayTimeout, CodeGitTimeout},
+		{ErrPrimaryUnavailable, http.StatusBadGateway, CodePrimaryUnavailable},
+		{&http.MaxBytesError{Limit: 1}, http.StatusRequestEntityTooLarge, CodeRequestTooLarge},
+		{errors.New("disk on fire"), http.StatusInternalServerError, CodeInternal},
+	} {
+		// Errors keep their status and code when wrapped
+		for _, err := range []error{tc.err, fmt.Errorf("serving test.git: %w", tc.err)} {
+			if status, code := ErrorStatus(err), ErrorCode(err); status != tc.status || code != tc.code {
+				t.Errorf("%v: %d %s, want %d %s", err, status, code, tc.status, tc.code)
+			}
+		}
+	}
+}
+
+func TestErrorMediaType(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                                     "text/plain",
+		"*/*":                                  "text/plain",
+		"application/x-git-upload-pack-result": "text/plain",
+		"application/json":                     "application/json",
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": "text/html",
+		"application/json;q=0.5, text/html":                               "text/html",
+		"text/html;q=0.2, text/plain;q=0.8":                               "text/plain",
+		"text/html;q=0, application/json;q=bad":                           "text/plain",
+	} {
+		if got := errorMediaType(accept); got != want {
+			t.Errorf("errorMediaType(%q) = %s, want %s", accept, got, want)
+		}
+	}
+}
+
+func TestErrorFormats(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{})
+	url := srv.URL + "/missing.git/info/refs?service=git-upload-pack"
+	get := func(accept string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// git gets plain text it can show
+	resp, body := get("*/*")
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "text/plain" || body != ErrRepoNotFound.Error()+"\n" {
+		t.Errorf("error for git: %d %s %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	resp, body = get("application/json")
+	var eb ErrorBody
+	if resp.Header.Get("Content-Type") != "application/json" || json.Unmarshal([]byte(body), &eb) != nil || eb.Code != CodeRepoNotFound {
+		t.Errorf("error for tooling: %s %q", resp.Header.Get("Content-Type"), body)
+	}
+
+	resp, body = get("text/html,application/xhtml+xml,*/*;q=0.8")
+	if resp.Header.Get("Content-Type") != "text/html; charset=utf-8" || resp.Header.Get("X-Content-Type-Options") != "nosniff" ||
+		!strings.Contains(body, "<h1>404 Not Found</h1>") || !strings.Contains(body, "<p>"+ErrRepoNotFound.Error()+"</p>") {
+		t.Errorf("error for browsers: %s %q", resp.Header.Get("Content-Type"), body)
+	}
+
+	// Branded pages get the error, escaped
+	defer func(tmpl *template.Template) { ErrorTemplate = tmpl }(ErrorTemplate)
+	ErrorTemplate = template.Must(template.New("error").Parse(`<em>{{.Status}} {{.Code}}: {{.Message}}</em>`))
+	_, body = get("text/html")
+	if want := "<em>404 repo_not_found: repository not found</em>"; body != want {
+		t.Errorf("branded error page %q, want %q", body, want)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/html")
+	writeErrorMessage(rec, req, http.StatusBadRequest, "<script>")
+	if got := rec.Body.String(); !strings.Contains(got, "&lt;script&gt;") {
+		t.Errorf("error page %q, want the message escaped", got)
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	defer func(url string) { ErrorDocumentationURL = url }(ErrorDocumentationURL)
+	ErrorDocumentationURL = "https://docs.example.com/git/errors#{code}"
+	srv := newTestServer(t, GitSmartHTTPConfig{AdminToken: testAdminToken})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	errorBody := func(method, url, requestID string) (*http.Response, map[string]string) {
+		t.Helper()
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		if requestID != "" {
+			req.Header.Set("X-Request-Id", requestID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	// The request ID of the client is kept
+	resp, body := errorBody("POST", srv.URL+"/api/repos/test.git/gc", "req-123")
+	want := map[string]string{
+		"code":              CodeAuthRequired,
+		"message":           body["message"],
+		"request_id":        "req-123",
+		"repo":              "test.git",
+		"documentation_url": "https://docs.example.com/git/errors#" + CodeAuthRequired,
+	}
+	if resp.StatusCode != http.StatusUnauthorized || !reflect.DeepEqual(body, want) || body["message"] == "" {
+		t.Errorf("error %d %v, want 401 %v", resp.StatusCode, body, want)
+	}
+	if got := resp.Header.Get("X-Request-Id"); got != "req-123" {
+		t.Errorf("X-Request-Id %q, want req-123", got)
+	}
+
+	// Otherwise one is made up and sent back, and errors without a code
+	// of their own go by their status
+	resp, body = errorBody("GET", srv.URL+"/api/nothing", "")
+	if body["code"] != "not_found" || body["request_id"] == "" || body["request_id"] != resp.Header.Get("X-Request-Id") {
+		t.Errorf("error %v with X-Request-Id %q, want not_found and the same request ID", body, resp.Header.Get("X-Request-Id"))
+	}
+	if _, ok := body["repo"]; ok {
+		t.Errorf("error %v has a repository", body)
+	}
+	if resp, body := errorBody("GET", srv.URL+"/api/nothing", strings.Repeat("x", 129)); len(body["request_id"]) != 16 || resp.Header.Get("X-Request-Id") != body["request_id"] {
+		t.Errorf("error for an overlong request ID has %q", body["request_id"])
+	}
+
+	// Internal errors are logged under the request ID, without showing
+	// their cause
+	logs := captureLog(t)
+	rec := httptest.NewRecorder()
+	writeError(rec, httptest.NewRequest("GET", "/test.git/HEAD", nil), errors.New("disk on fire"))
+	id := rec.Header().Get("X-Request-Id")
+	if line := logs.Line("request " + id); id == "" || !strings.Contains(line, "disk on fire") {
+		t.Errorf("internal error logged as %q, want its cause under request %s", line, id)
+	}
+	if strings.Contains(rec.Body.String(), "disk on fire") {
+		t.Errorf("internal error shown as %q", rec.Body.String())
+	}
+}
@@ -0,0 +1,141 @@
+package githttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PushEvent describes the refs a push updated
+type PushEvent struct {
+	Repo    string      `json:"repo"`
+	Refs    []RefUpdate `json:"refs"`
+	Pusher  string      `json:"pusher,omitempty"`
+	Time    time.Time   `json:"timestamp"`
+	Options []string    `json:"push_options,omitempty"`
+	// SessionID is the session-id capability of the client
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// Publisher delivers encoded events to a message bus. A nil error means the
+// bus accepted the event.
+type Publisher interface {
+	Publish(data []byte) error
+}
+
+// eventSpool writes events to a directory before publishing them, and only
+// removes them once the publisher accepted them. Events survive broker
+// outages and restarts and are delivered at least once, in order.
+type eventSpool struct {
+	dir  string
+	pub  Publisher
+	seq  uint64
+	wake chan struct{}
+}
+
+func newEventSpool(dir string, pub Publisher) (*eventSpool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &eventSpool{
+		dir:  dir,
+		pub:  pub,
+		wake: make(chan struct{}, 1),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Enqueue spools the event for publishing
+func (s *eventSpool) Enqueue(ev PushEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%020d-%06d.json", time.Now().UnixNano(), atomic.AddUint64(&s.seq, 1)%1000000)
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *eventSpool) run() {
+	retry := time.NewTicker(10 * time.Second)
+	defer retry.Stop()
+
+	for {
+		s.flush()
+		select {
+		case <-s.wake:
+		case <-retry.C:
+		}
+	}
+}
+
+// flush publishes the spooled events oldest first, stopping at the first
+// one the publisher does not accept.
+func (s *eventSpool) flush() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Cannot read event spool: %s", err)
+		return
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		p := filepath.Join(s.dir, name)
+		data, err := os.ReadFile(p)
+		if err != nil {
+			log.Printf("Cannot read spooled event %s: %s", name, err)
+			continue
+		}
+		if err := s.pub.Publish(data); err != nil {
+			log.Printf("Cannot publish event, %d left in spool: %s", len(names)-i, err)
+			return
+		}
+		os.Remove(p)
+	}
+}
+
+// publishPush spools an event for the applied updates of a push
+func (gsh GitSmartHTTP) publishPush(r *http.Request, repo string, updates []RefUpdate, options []string, session string) {
+	ev := PushEvent{
+		Repo:      repo,
+		Refs:      updates,
+		Time:      time.Now().UTC(),
+		Options:   options,
+		SessionID: session,
+	}
+	if id := gsh.identity(r); id != nil {
+		ev.Pusher = id.Name
+	}
+
+	if err := gsh.events.Enqueue(ev); err != nil {
+		log.Printf("Cannot spool push event for %s: %s", ev.Repo, err)
+	}
+}
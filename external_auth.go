@@ -0,0 +1,180 @@
+package githttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ExternalAuth is an AccessChecker delegating the decision to an HTTP
+// endpoint, like nginx's auth_request. The endpoint gets a GET request
+// carrying the credentials headers of the original request along with
+//
+//	X-Original-Method  method of the original request
+//	X-Original-URI     path and query of the original request
+//	X-Original-IP      address of the client
+//	X-Git-Repo         repository path, without leading slash
+//	X-Git-Namespace    git namespace within the repository, if any
+//	X-Git-Operation    read or write
+//
+// and answers 2xx to grant access, 401 to ask for credentials and 403 to
+// deny access. Any other answer fails the request. Granting access, it may
+// answer with
+//
+//	X-Git-User         name of the user the request is made on behalf of
+//	X-Git-Email        email address of that user
+//	X-Git-Groups       comma separated groups of that user
+//	X-Git-Permission   none, read or write, what the user may do
+//
+// The user then becomes the identity of the request, seen by push policies,
+// hooks and the journal. With X-Git-Permission the endpoint can answer the
+// same for both operations, reads needing read or write and writes needing
+// write. These headers are a stable contract for gateway integrations.
+type ExternalAuth struct {
+	URL string
+	// Client defaults to a client timing out after 5s
+	Client *http.Client
+	// Headers are copied from the original request
+	Headers []string
+
+	// Cache keeps granted and denied decisions for CacheTTL, when set, per
+	// repository, namespace, operation, client address and forwarded headers
+	Cache    Cache
+	CacheTTL time.Duration
+}
+
+// NewExternalAuth returns an ExternalAuth asking url, forwarding the
+// Authorization and Cookie headers.
+func NewExternalAuth(url string) *ExternalAuth {
+	return &ExternalAuth{
+		URL:     url,
+		Client:  defaultAuthClient,
+		Headers: []string{"Authorization", "Cookie"},
+	}
+}
+
+var defaultAuthClient = &http.Client{Timeout: 5 * time.Second}
+
+func (a *ExternalAuth) client() *http.Client {
+	if a.Client == nil {
+		return defaultAuthClient
+	}
+	return a.Client
+}
+
+// Permission levels an auth endpoint answers with X-Git-Permission
+const (
+	PermissionNone  = "none"
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+)
+
+// authResult is what the endpoint answered, as cached
+type authResult struct {
+	Decision string    `json:"decision"`
+	Identity *Identity `json:"identity,omitempty"`
+}
+
+func (a *ExternalAuth) CheckAccess(r *http.Request, id *Identity, repo string, op Operation) error {
+	_, err := a.CheckAccessIdentity(r, id, repo, op)
+	return err
+}
+
+func (a *ExternalAuth) CheckAccessIdentity(r *http.Request, id *Identity, repo string, op Operation) (*Identity, error) {
+	clientIP := requestIP(r)
+	var key string
+	if a.Cache != nil {
+		sum := sha256.New()
+		fmt.Fprintf(sum, "%s\x00%s\x00%s\x00%s\x00", repo, namespace(r.Context()), op, clientIP)
+		for _, h := range a.Headers {
+			fmt.Fprintf(sum, "%s\x00", strings.Join(r.Header.Values(h), "\x00"))
+		}
+		key = "auth:" + hex.EncodeToString(sum.Sum(nil))
+
+		if b, ok := a.Cache.Get(key); ok {
+			var res authResult
+			if err := json.Unmarshal(b, &res); err == nil {
+				return res.Identity, authDecisionError(res.Decision)
+			}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "GET", a.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range a.Headers {
+		for _, v := range r.Header.Values(h) {
+			req.Header.Add(h, v)
+		}
+	}
+	req.Header.Set("X-Original-Method", r.Method)
+	req.Header.Set("X-Original-URI", r.URL.RequestURI())
+	req.Header.Set("X-Original-IP", clientIP)
+	req.Header.Set("X-Git-Repo", repo)
+	if ns := namespace(r.Context()); ns != "" {
+		req.Header.Set("X-Git-Namespace", ns)
+	}
+	req.Header.Set("X-Git-Operation", op.String())
+
+	resp, err := a.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("auth request: %w", err)
+	}
+	resp.Body.Close()
+
+	var res authResult
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		res = authResponse(resp.Header, op)
+	case resp.StatusCode == http.StatusUnauthorized:
+		// Asking for credentials is not cached, they are about to change
+		return nil, ErrAuthRequired
+	case resp.StatusCode == http.StatusForbidden:
+		res.Decision = "deny"
+	default:
+		return nil, fmt.Errorf("auth request: unexpected status %s", resp.Status)
+	}
+
+	if a.Cache != nil {
+		if b, err := json.Marshal(res); err == nil {
+			a.Cache.Set(key, b, a.CacheTTL)
+		}
+	}
+	return res.Identity, authDecisionError(res.Decision)
+}
+
+// authResponse reads the user and permission level a granting endpoint
+// answered with
+func authResponse(h http.Header, op Operation) authResult {
+	res := authResult{Decision: "allow"}
+	switch h.Get("X-Git-Permission") {
+	case PermissionNone:
+		res.Decision = "deny"
+	case PermissionRead:
+		if op == OpWrite {
+			res.Decision = "deny"
+		}
+	}
+
+	if name := h.Get("X-Git-User"); name != "" {
+		res.Identity = &Identity{Name: name, Email: h.Get("X-Git-Email")}
+		for _, g := range strings.Split(h.Get("X-Git-Groups"), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				res.Identity.Groups = append(res.Identity.Groups, g)
+			}
+		}
+	}
+	return res
+}
+
+func authDecisionError(decision string) error {
+	if decision == "allow" {
+		return nil
+	}
+	return ErrAccessDenied
+}
@@ -0,0 +1,49 @@
+package githttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExternalAuthCacheKeyIP(t *testing.T) {
+	var calls int
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("X-Original-IP") != "10.0.0.1" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer endpoint.Close()
+
+	auth := NewExternalAuth(endpoint.URL)
+	auth.Cache, auth.CacheTTL = NewMemoryCache(), time.Minute
+
+	local := httptest.NewRequest("GET", "/test.git/info/refs", nil)
+	local.RemoteAddr = "10.0.0.1:1234"
+	if err := auth.CheckAccess(local, nil, "test.git", OpRead); err != nil {
+		t.Fatalf("allowed address: %s", err)
+	}
+	other := httptest.NewRequest("GET", "/test.git/info/refs", nil)
+	other.RemoteAddr = "192.0.2.1:1234"
+	if err := auth.CheckAccess(other, nil, "test.git", OpRead); err != ErrAccessDenied {
+		t.Fatalf("other address: %v, want access denied", err)
+	}
+	if err := auth.CheckAccess(local, nil, "test.git", OpRead); err != nil || calls != 2 {
+		t.Fatalf("allowed address again: %v after %d calls, want it cached", err, calls)
+	}
+}
+
+func TestExternalAuthNilClient(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer endpoint.Close()
+
+	auth := &ExternalAuth{URL: endpoint.URL}
+	r := httptest.NewRequest("GET", "/test.git/info/refs", nil)
+	if err := auth.CheckAccess(r, nil, "test.git", OpRead); err != ErrAccessDenied {
+		t.Fatalf("without client: %v, want access denied", err)
+	}
+}
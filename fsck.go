@@ -0,0 +1,122 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxFsckOutput is how much of the output of git fsck is kept
+const maxFsckOutput = 64 << 10
+
+// States of a repository integrity check
+const (
+	FsckRunning = "running"
+	FsckOK      = "ok"
+	FsckFailed  = "failed"
+)
+
+// FsckStatus is the result of the last integrity check of a repository
+type FsckStatus struct {
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Output   string     `json:"output,omitempty"`
+}
+
+// fsckRuns runs git fsck on repositories in the background and remembers
+// the outcome of the last run of each
+type fsckRuns struct {
+	processes *ProcessManager
+
+	mu    sync.Mutex
+	repos map[string]*FsckStatus
+}
+
+func newFsckRuns(processes *ProcessManager) *fsckRuns {
+	return &fsckRuns{processes: processes, repos: make(map[string]*FsckStatus)}
+}
+
+// start checks the connectivity of the repository unless a check is
+// already running, and returns the status of the check.
+func (f *fsckRuns) start(repo, repoPath string) FsckStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if st, ok := f.repos[repo]; ok && st.State == FsckRunning {
+		return *st
+	}
+	st := &FsckStatus{State: FsckRunning, Started: time.Now().UTC()}
+	f.repos[repo] = st
+
+	go func() {
+		var buf bytes.Buffer
+		err := f.processes.Command(nil, "--git-dir", repoPath, "fsck", "--connectivity-only", "--no-progress", "--no-dangling").Run(context.Background(), nil, &buf, &buf)
+		out := buf.Bytes()
+		if len(out) > maxFsckOutput {
+			out = out[:maxFsckOutput]
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		finished := time.Now().UTC()
+		st.Finished = &finished
+		st.Output = strings.TrimSpace(string(out))
+		st.State = FsckOK
+		if err != nil {
+			st.State = FsckFailed
+			if st.Output == "" {
+				st.Output = err.Error()
+			}
+		}
+	}()
+	return *st
+}
+
+// Get returns the status of the last check of the repository
+func (f *fsckRuns) Get(repo string) (FsckStatus, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	st, ok := f.repos[repo]
+	if !ok {
+		return FsckStatus{}, false
+	}
+	return *st, true
+}
+
+// serveFsck starts an integrity check of the repository on POST, which
+// is answered right away, and reports the last check on GET.
+func (gsh GitSmartHTTP) serveFsck(w http.ResponseWriter, r *http.Request, repo string) {
+	repoPath := gsh.localPath(repo)
+	if err := gsh.validateRepo(repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := gsh.warmRepo(r.Context(), repo, repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	var st FsckStatus
+	if r.Method == "POST" {
+		st = gsh.fscks.start(repo, repoPath)
+		status = http.StatusAccepted
+	} else {
+		var ok bool
+		if st, ok = gsh.fscks.Get(repo); !ok {
+			writeErrorMessage(w, r, http.StatusNotFound, "repository never checked")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(st)
+}
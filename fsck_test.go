@@ -0,0 +1,64 @@
+package githttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestFsckAPI(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{AdminToken: testAdminToken})
+	srv.CreateRepo("good.git", map[string]string{"README": "hello\n"})
+	broken := srv.CreateRepo("broken.git", map[string]string{"README": "hello\n"})
+	blob := githttptest.Git(t, broken, "rev-parse", "HEAD:README")
+	if err := os.Remove(filepath.Join(broken, "objects", blob[:2], blob[2:])); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, _ := adminRequest(t, "GET", srv.URL+"/api/repos/good.git/fsck", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status before any check: %d, want 404", resp.StatusCode)
+	}
+
+	for repo, want := range map[string]string{"good.git": FsckOK, "broken.git": FsckFailed} {
+		resp, body := adminRequest(t, "POST", srv.URL+"/api/repos/"+repo+"/fsck", "")
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("%s: %d %s, want 202", repo, resp.StatusCode, body)
+		}
+		var st FsckStatus
+		waitFor(t, "fsck of "+repo, func() bool {
+			_, body := adminRequest(t, "GET", srv.URL+"/api/repos/"+repo+"/fsck", "")
+			st = FsckStatus{}
+			return json.Unmarshal([]byte(body), &st) == nil && st.State != FsckRunning
+		})
+		if st.State != want || st.Finished == nil {
+			t.Errorf("%s checked %s, want %s: %s", repo, st.State, want, st.Output)
+		}
+		if want == FsckFailed && !strings.Contains(st.Output, blob) {
+			t.Errorf("%s output %q, want the missing blob %s", repo, st.Output, blob)
+		}
+	}
+
+	// The listing shows the outcome of the checks, without their output
+	_, body := request(t, "GET", srv.URL+"/api/repos/", "", "")
+	var repos []RepoInfo
+	if err := json.Unmarshal([]byte(body), &repos); err != nil {
+		t.Fatal(err)
+	}
+	states := make(map[string]string)
+	for _, info := range repos {
+		if info.Fsck != nil {
+			states[info.Name] = info.Fsck.State
+			if info.Fsck.Output != "" {
+				t.Errorf("listing shows the output of the check of %s", info.Name)
+			}
+		}
+	}
+	if states["good.git"] != FsckOK || states["broken.git"] != FsckFailed {
+		t.Errorf("listing shows checks %v", states)
+	}
+}
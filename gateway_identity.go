@@ -0,0 +1,77 @@
+package githttp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultGatewayUserHeaders are the headers oauth2-proxy and most API
+// gateways name the user they authenticated in
+var DefaultGatewayUserHeaders = []string{"X-Forwarded-User", "X-Auth-Request-User"}
+
+// GatewayIdentityFunc returns an IdentityFunc taking the user an upstream
+// gateway, such as oauth2-proxy, authenticated from the first of headers
+// the request has. The email and groups come from the matching Email and
+// Groups headers, such as X-Forwarded-Email and X-Forwarded-Groups for
+// X-Forwarded-User, groups being comma separated. The headers are only
+// trusted on requests coming straight from proxies, anyone else could set
+// them.
+func GatewayIdentityFunc(proxies []*net.IPNet, headers []string) func(r *http.Request) *Identity {
+	return func(r *http.Request) *Identity {
+		addr, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			addr = r.RemoteAddr
+		}
+		ip := net.ParseIP(addr)
+		trusted := false
+		for _, proxy := range proxies {
+			trusted = trusted || (ip != nil && proxy.Contains(ip))
+		}
+		if !trusted {
+			return nil
+		}
+
+		for _, h := range headers {
+			name := strings.TrimSpace(r.Header.Get(h))
+			if name == "" {
+				continue
+			}
+			prefix := strings.TrimSuffix(h, "User")
+			id := &Identity{Name: name, Email: strings.TrimSpace(r.Header.Get(prefix + "Email"))}
+			for _, g := range strings.Split(r.Header.Get(prefix+"Groups"), ",") {
+				if g = strings.TrimSpace(g); g != "" {
+					id.Groups = append(id.Groups, g)
+				}
+			}
+			return id
+		}
+		return nil
+	}
+}
+
+// ParseCIDRs parses comma separated CIDRs, taking single addresses as
+// networks of their own
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if ip := net.ParseIP(cidr); ip != nil {
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))})
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,236 @@
+package githttp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes of garbage collection, from the cheapest to the most thorough
+const (
+	// GCAuto collects only when git finds enough loose objects or packs
+	GCAuto = "auto"
+	// GCNormal always repacks and prunes unreachable objects
+	GCNormal = "normal"
+	// GCAggressive also recomputes every delta, which takes much longer
+	GCAggressive = "aggressive"
+)
+
+// States of a garbage collection job
+const (
+	GCQueued  = "queued"
+	GCRunning = "running"
+	GCDone    = "done"
+	GCFailed  = "failed"
+)
+
+// maxGCJobs is how many finished jobs are remembered
+const maxGCJobs = 100
+
+// GCJob is a garbage collection of a repository requested through the API
+type GCJob struct {
+	ID       string     `json:"id"`
+	Repo     string     `json:"repo"`
+	Mode     string     `json:"mode"`
+	State    string     `json:"state"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Output   string     `json:"output,omitempty"`
+}
+
+// gcJobs runs the garbage collections requested through the API one at a
+// time, in the order they were requested. Each holds the lock of its
+// repository, so that it does not run while pushes are serialized into the
+// repository or its packs move to or from cold storage.
+type gcJobs struct {
+	gsh   GitSmartHTTP
+	queue chan *GCJob
+
+	mu   sync.Mutex
+	jobs map[string]*GCJob
+}
+
+func newGCJobs(gsh GitSmartHTTP) *gcJobs {
+	g := &gcJobs{
+		gsh:   gsh,
+		queue: make(chan *GCJob, maxGCJobs),
+		jobs:  make(map[string]*GCJob),
+	}
+	go g.run()
+	return g
+}
+
+// enqueue adds a garbage collection of the repository to the queue,
+// failing with ErrTooManyRequests when the queue is full
+func (g *gcJobs) enqueue(repo, mode string) (GCJob, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &GCJob{ID: hex.EncodeToString(id), Repo: repo, Mode: mode, State: GCQueued, Created: time.Now().UTC()}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	select {
+	case g.queue <- job:
+	default:
+		return GCJob{}, ErrTooManyRequests
+	}
+	g.jobs[job.ID] = job
+	g.forget()
+	return *job, nil
+}
+
+// forget drops the oldest finished jobs beyond maxGCJobs
+func (g *gcJobs) forget() {
+	var finished []*GCJob
+	for _, job := range g.jobs {
+		if job.Finished != nil {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= maxGCJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Finished.Before(*finished[j].Finished) })
+	for _, job := range finished[:len(finished)-maxGCJobs] {
+		delete(g.jobs, job.ID)
+	}
+}
+
+func (g *gcJobs) run() {
+	for job := range g.queue {
+		g.mu.Lock()
+		started := time.Now().UTC()
+		job.State = GCRunning
+		job.Started = &started
+		g.mu.Unlock()
+
+		out, err := g.collect(job)
+
+		g.mu.Lock()
+		finished := time.Now().UTC()
+		job.Finished = &finished
+		job.Output = strings.TrimSpace(out)
+		job.State = GCDone
+		if err != nil {
+			job.State = GCFailed
+			job.Output = strings.TrimSpace(err.Error())
+		}
+		g.mu.Unlock()
+	}
+}
+
+// collect runs git gc on the repository of the job under its lock
+func (g *gcJobs) collect(job *GCJob) (string, error) {
+	ctx := context.Background()
+	repoPath := g.gsh.localPath(job.Repo)
+	if err := g.gsh.warmRepo(ctx, job.Repo, repoPath); err != nil {
+		return "", err
+	}
+
+	unlock, err := g.gsh.repoLocks.Lock(ctx, repoPath)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	args := []string{"gc", "--quiet"}
+	switch job.Mode {
+	case GCAuto:
+		args = append(args, "--auto")
+	case GCAggressive:
+		args = append(args, "--aggressive")
+	}
+	dir, _ := gitDir(repoPath)
+	out, err := g.gsh.processes.git(ctx, dir, args...)
+	if err == nil {
+		g.gsh.refreshServerInfo(ctx, repoPath)
+	}
+
+	g.gsh.details.Invalidate(repoPath)
+	if g.gsh.refsCache != nil {
+		g.gsh.refsCache.Invalidate(repoPath)
+	}
+	return out, err
+}
+
+// Get returns the job with the given ID
+func (g *gcJobs) Get(id string) (GCJob, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	job, ok := g.jobs[id]
+	if !ok {
+		return GCJob{}, false
+	}
+	return *job, true
+}
+
+// List returns the jobs of the repository, the most recent first
+func (g *gcJobs) List(repo string) []GCJob {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	jobs := []GCJob{}
+	for _, job := range g.jobs {
+		if job.Repo == repo {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Created.After(jobs[j].Created) })
+	return jobs
+}
+
+// serveGC queues a garbage collection of the repository on POST, in the
+// mode given by the mode parameter, answering with the job right away. On
+// GET it reports the job given by the id parameter, or every job of the
+// repository.
+func (gsh GitSmartHTTP) serveGC(w http.ResponseWriter, r *http.Request, repo string) {
+	repoPath := gsh.localPath(repo)
+	if err := gsh.validateRepo(repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	var body interface{}
+	switch id := r.URL.Query().Get("id"); {
+	case r.Method == "POST":
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = GCNormal
+		}
+		if mode != GCAuto && mode != GCNormal && mode != GCAggressive {
+			writeErrorMessage(w, r, http.StatusBadRequest, "invalid mode "+mode+", want "+GCAuto+", "+GCNormal+" or "+GCAggressive)
+			return
+		}
+		job, err := gsh.gcs.enqueue(repo, mode)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		body = job
+		status = http.StatusAccepted
+	case id != "":
+		job, ok := gsh.gcs.Get(id)
+		if !ok || job.Repo != repo {
+			writeErrorMessage(w, r, http.StatusNotFound, "no such job")
+			return
+		}
+		body = job
+	default:
+		body = gsh.gcs.List(repo)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
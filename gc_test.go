@@ -0,0 +1,64 @@
+package githttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestGCAPI(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{AdminToken: testAdminToken})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"}, map[string]string{"README": "more\n"})
+	gcURL := srv.URL + "/api/repos/test.git/gc"
+
+	details := func() RepoDetails {
+		t.Helper()
+		_, body := request(t, "GET", srv.URL+"/api/repos/test.git", "", "")
+		var d RepoDetails
+		if err := json.Unmarshal([]byte(body), &d); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	if d := details(); d.Objects.Loose == 0 || d.Objects.Packs != 0 {
+		t.Fatalf("objects before gc %+v, want loose ones only", d.Objects)
+	}
+
+	if resp, _ := request(t, "POST", gcURL, "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("gc without the admin token: %d, want 401", resp.StatusCode)
+	}
+	if resp, _ := adminRequest(t, "POST", gcURL+"?mode=thorough", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("gc in an unknown mode: %d, want 400", resp.StatusCode)
+	}
+	if resp, _ := adminRequest(t, "GET", gcURL+"?id=unknown", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown job: %d, want 404", resp.StatusCode)
+	}
+
+	resp, body := adminRequest(t, "POST", gcURL, "")
+	var job GCJob
+	if resp.StatusCode != http.StatusAccepted || json.Unmarshal([]byte(body), &job) != nil {
+		t.Fatalf("gc: %d %s, want 202 and the job", resp.StatusCode, body)
+	}
+	if job.ID == "" || job.Repo != "test.git" || job.Mode != GCNormal {
+		t.Errorf("queued job %+v, want a normal gc of test.git", job)
+	}
+	waitFor(t, "gc job", func() bool {
+		_, body := adminRequest(t, "GET", gcURL+"?id="+job.ID, "")
+		job = GCJob{}
+		return json.Unmarshal([]byte(body), &job) == nil && job.Finished != nil
+	})
+	if job.State != GCDone || job.Started == nil {
+		t.Errorf("finished job %+v, want done", job)
+	}
+
+	// The details count the objects again after the gc
+	if d := details(); d.Objects.Loose != 0 || d.Objects.Packs != 1 || d.Objects.Packed != 6 {
+		t.Errorf("objects after gc %+v, want a pack of 6", d.Objects)
+	}
+
+	_, body = adminRequest(t, "GET", gcURL, "")
+	var jobs []GCJob
+	if err := json.Unmarshal([]byte(body), &jobs); err != nil || len(jobs) != 1 || jobs[0].ID != job.ID {
+		t.Errorf("jobs of test.git %s, want the one gc", body)
+	}
+}
@@ -0,0 +1,71 @@
+package githttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RepoGitConfig holds git config overrides for the repositories matching
+// the path.Match pattern Repo, given as "key=value" like git -c takes them.
+type RepoGitConfig struct {
+	Repo   string   `json:"repo"`
+	Config []string `json:"config"`
+}
+
+// LoadRepoGitConfig reads a JSON array of RepoGitConfig from path
+func LoadRepoGitConfig(path string) ([]RepoGitConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []RepoGitConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, c := range configs {
+		for _, kv := range c.Config {
+			if err := CheckGitConfig(kv); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return configs, nil
+}
+
+// CheckGitConfig makes sure kv is a "section.key=value" pair
+func CheckGitConfig(kv string) error {
+	key, _, ok := strings.Cut(kv, "=")
+	if !ok || !strings.Contains(key, ".") || strings.HasPrefix(key, ".") || strings.HasSuffix(key, ".") {
+		return fmt.Errorf("invalid git config %q, want section.key=value", kv)
+	}
+	return nil
+}
+
+// repoGitConfig returns the -c options git runs with for the repository:
+// those the server needs, then the server wide overrides, then those of
+// matching repositories in order, so that later ones win, and last those
+// of the settings of the repository.
+func (gsh GitSmartHTTP) repoGitConfig(ctx context.Context, repoPath string) []string {
+	config := append([]string(nil), gsh.gitConfig...)
+	config = append(config, shaInWantConfig(gsh.SHAInWant)...)
+	config = append(config, gsh.GitConfig...)
+
+	if rel, err := filepath.Rel(gsh.ReposRootPath, repoPath); err == nil {
+		repo := filepath.ToSlash(rel)
+		config = append(config, gsh.hideRefsConfig(ctx, repo)...)
+		for _, c := range gsh.RepoGitConfig {
+			if matchesAny([]string{c.Repo}, repo) {
+				config = append(config, c.Config...)
+			}
+		}
+	}
+
+	if st := gsh.repoSettings(repoPath); st.SHAInWant != nil {
+		config = append(config, shaInWantConfig(*st.SHAInWant)...)
+	}
+	return config
+}
@@ -0,0 +1,36 @@
+package githttp
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// DefaultGitEnvPassthrough are the environment variables of the server
+// forwarded to git unless configured otherwise: those git and the system
+// need to run, but none that change what git does, such as GIT_DIR or the
+// proxy settings.
+var DefaultGitEnvPassthrough = []string{
+	"PATH", "HOME", "USER", "LANG", "LC_*", "TZ", "TMPDIR",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+	"SYSTEMROOT", "WINDIR", "COMSPEC", "PATHEXT",
+}
+
+// gitEnviron returns the environment to run git with: the server's
+// variables whose names match one of the passthrough patterns, "*"
+// forwarding all of them, followed by the "KEY=value" pairs of set and
+// extra, extra overriding the others.
+func gitEnviron(passthrough, set []string, extra ...string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		for _, pattern := range passthrough {
+			if ok, _ := path.Match(pattern, name); ok {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	env = append(env, set...)
+	return append(env, extra...)
+}
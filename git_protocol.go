@@ -0,0 +1,33 @@
+package githttp
+
+import (
+	"context"
+	"net/http"
+)
+
+type gitProtocolKey struct{}
+
+// withGitProtocol moves the Git-Protocol header of a request, with which
+// clients ask for protocol version 2, into its context. Like the CGI
+// git-http-backend, git gets it as GIT_PROTOCOL.
+func withGitProtocol(r *http.Request) *http.Request {
+	proto := r.Header.Get("Git-Protocol")
+	if proto == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), gitProtocolKey{}, proto))
+}
+
+// gitProtocol returns the protocol parameters requested in ctx, if any
+func gitProtocol(ctx context.Context) string {
+	proto, _ := ctx.Value(gitProtocolKey{}).(string)
+	return proto
+}
+
+// gitProtocolEnv returns the environment git serves the protocol of ctx with
+func gitProtocolEnv(ctx context.Context) []string {
+	if proto := gitProtocol(ctx); proto != "" {
+		return []string{"GIT_PROTOCOL=" + proto}
+	}
+	return nil
+}
@@ -1,109 +1,335 @@
-package main
+package githttp
 
 import (
+	"context"
+	"errors"
 	"io"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
 )
 
 const gitBackend = "git"
 
+var (
+	gitPathOnce sync.Once
+	gitPath     string
+)
+
+// gitExecutable returns the absolute path of the git binary, git.exe on
+// Windows, looked up in PATH once. It falls back to the plain name and lets
+// exec report the failure.
+func gitExecutable() string {
+	gitPathOnce.Do(func() {
+		var err error
+		if gitPath, err = exec.LookPath(gitBackend); err != nil {
+			gitPath = gitBackend
+		}
+	})
+	return gitPath
+}
+
+// ErrRPCPrepared is returned when a GitRPCClient is asked to set up a
+// second command, as each client runs a single git process
+var ErrRPCPrepared = errors.New("git command already set up")
+
 // GitRPCClientConfig is the configuration for the Git RPC Service
 type GitRPCClientConfig struct {
 	Stream bool
+	// GitPath is the git binary to run, the one found in PATH when empty.
+	// A ProcessManager fills it in with its own.
+	GitPath string
+	// Args holds extra arguments of git commands by command name, such as
+	// "upload-pack": {"--strict"}, passed right after the command name
+	Args map[string][]string
+	// GitConfig holds "key=value" pairs passed to git as -c options
+	GitConfig []string
+	// Env holds "KEY=value" pairs added to the environment of git
+	Env []string
+	// Timeout kills the git process when it runs for longer, zero meaning
+	// no limit
+	Timeout time.Duration
 }
 
-// GitRPCClient is the stateless rpc client talks to Git
+// RPCOptions are the options of the upload-pack and receive-pack commands
+type RPCOptions struct {
+	// AdvertiseRefs only advertises the refs of the repository instead of
+	// serving a request
+	AdvertiseRefs bool
+}
+
+// GitRPCClient runs a git command, such as the stateless RPC of
+// upload-pack or receive-pack. The command is set up by one of UploadPack,
+// ReceivePack, CatFileBatch, UpdateServerInfo or Git and then run either
+// with Output or Run, or with Start and Wait when streaming. The context
+// given to Output, Run or Start kills the process when it is done,
+// typically because the client of the request went away.
 type GitRPCClient struct {
-	RPCConfig    gitRPCConfig
 	StdinWriter  io.WriteCloser
 	StdoutReader io.ReadCloser
 	StderrReader io.ReadCloser
+	args         []string
 	cmd          *exec.Cmd
+	ctx          context.Context
+	cancel       context.CancelFunc
+	manager      *ProcessManager
+	mu           sync.Mutex
+	running      bool
 	*GitRPCClientConfig
 }
 
-type gitRPCConfig map[string]string
-
 // NewGitRPCClient returns a new GitRPCClient that works as a RPC client that
 // talks to Git.
 func NewGitRPCClient(config *GitRPCClientConfig) *GitRPCClient {
-	cfg := make(gitRPCConfig)
-	cfg["advertise_refs"] = "--advertise-refs"
+	return &GitRPCClient{GitRPCClientConfig: config}
+}
 
-	gs := &GitRPCClient{
-		RPCConfig:          cfg,
-		GitRPCClientConfig: config,
+// UploadPack sets up git upload-pack, serving git fetch-pack and git
+// ls-remote clients, which are invoked from git fetch, git pull, and git
+// clone.
+func (gs *GitRPCClient) UploadPack(repoPath string, opts RPCOptions) error {
+	return gs.prepare(append(gs.subcommand("upload-pack"), opts.args(repoPath)...))
+}
+
+// ReceivePack sets up git receive-pack, serving git send-pack clients,
+// which is invoked from git push.
+func (gs *GitRPCClient) ReceivePack(repoPath string, opts RPCOptions) error {
+	return gs.prepare(append(gs.subcommand("receive-pack"), opts.args(repoPath)...))
+}
+
+func (opts RPCOptions) args(repoPath string) []string {
+	var args []string
+	if opts.AdvertiseRefs {
+		args = append(args, "--advertise-refs")
 	}
-	return gs
+	return append(args, "--stateless-rpc", repoPath)
 }
 
-// Output is a block call that returns the RPC result back as a byte sequence
-// It will return an error when the RPC call is not successful.
-func (gs *GitRPCClient) Output() ([]byte, error) {
-	return gs.cmd.Output()
+// CatFileBatch sets up git cat-file serving object contents of the git
+// directory dir for object names written to its stdin, one per line, until
+// stdin is closed.
+func (gs *GitRPCClient) CatFileBatch(dir string) error {
+	args := append([]string{"--git-dir", dir}, gs.subcommand("cat-file")...)
+	return gs.prepare(append(args, "--batch"))
 }
 
-// Wait happens after the Start call, which is a block call that will only finish
-// when the RPC has been finished.
-// Error will be raised when unexpected happens.
-func (gs *GitRPCClient) Wait() error {
-	return gs.cmd.Wait()
+// Git sets up the git command given by args, such as the plumbing commands
+// run by the admin API and the push policies
+func (gs *GitRPCClient) Git(args ...string) error {
+	return gs.prepare(args)
+}
+
+// UpdateServerInfo sets up git update-server-info, updating the auxiliary
+// info files dumb servers serve: objects/info/packs and info/refs.
+// See https://git-scm.com/docs/gitrepository-layout to understand what they are for
+func (gs *GitRPCClient) UpdateServerInfo(repoPath string) error {
+	return gs.prepare(append([]string{"--git-dir", repoPath}, gs.subcommand("update-server-info")...))
+}
+
+// CommandLine returns the command line of the git command set up
+func (gs *GitRPCClient) CommandLine() []string {
+	git := gs.GitPath
+	if git == "" {
+		git = gitExecutable()
+	}
+	args := []string{git}
+	for _, c := range gs.GitConfig {
+		args = append(args, "-c", c)
+	}
+	return append(args, gs.args...)
+}
+
+func (gs *GitRPCClient) prepare(args []string) error {
+	if gs.args != nil {
+		return ErrRPCPrepared
+	}
+	gs.args = args
+	return nil
+}
+
+// subcommand returns the git command name followed by its extra arguments
+func (gs *GitRPCClient) subcommand(name string) []string {
+	return append([]string{name}, gs.Args[name]...)
+}
+
+// interruptGrace is how long an interrupted git process has to exit
+// before it is killed
+const interruptGrace = 5 * time.Second
+
+// command creates the process of the command set up, interrupted once ctx
+// is done or Timeout elapsed, and killed if it does not exit soon after.
+func (gs *GitRPCClient) command(ctx context.Context) error {
+	if gs.args == nil {
+		return errors.New("no git command set up")
+	}
+	if gs.cmd != nil {
+		return ErrRPCPrepared
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	gs.ctx = ctx
+	if gs.Timeout > 0 {
+		gs.ctx, gs.cancel = context.WithTimeout(ctx, gs.Timeout)
+	}
+	args := gs.CommandLine()
+	gs.cmd = exec.CommandContext(gs.ctx, args[0], args[1:]...)
+	if gs.manager != nil {
+		gs.cmd.Env = gs.manager.environ(gs.Env...)
+	} else {
+		gs.cmd.Env = gitEnviron(DefaultGitEnvPassthrough, nil, gs.Env...)
+	}
+	gs.cmd.Cancel = gs.Interrupt
+	gs.cmd.WaitDelay = interruptGrace
+	return nil
+}
+
+// Output runs the command and returns its output. It fails with
+// ErrGitTimeout when the process was killed for exceeding Timeout.
+func (gs *GitRPCClient) Output(ctx context.Context) ([]byte, error) {
+	if err := gs.command(ctx); err != nil {
+		return nil, err
+	}
+	if err := gs.begin(); err != nil {
+		return nil, err
+	}
+	defer gs.end()
+
+	out, err := gs.cmd.Output()
+	if err != nil && gs.TimedOut() {
+		return out, ErrGitTimeout
+	}
+	return out, err
+}
+
+// Run runs the command with the given stdin, stdout and stderr, any of
+// which may be nil. It fails with ErrGitTimeout like Output.
+func (gs *GitRPCClient) Run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer) error {
+	if err := gs.command(ctx); err != nil {
+		return err
+	}
+	gs.cmd.Stdin, gs.cmd.Stdout, gs.cmd.Stderr = stdin, stdout, stderr
+	if err := gs.begin(); err != nil {
+		return err
+	}
+	defer gs.end()
+
+	err := gs.cmd.Run()
+	if err != nil && gs.TimedOut() {
+		return ErrGitTimeout
+	}
+	return err
 }
 
 // Start begins a RPC call. It will expose the stdin/stdout/stderr pipe when
 // streaming is allowed.
-func (gs *GitRPCClient) Start() error {
+func (gs *GitRPCClient) Start(ctx context.Context) error {
+	if err := gs.command(ctx); err != nil {
+		return err
+	}
 	if gs.Stream {
 		err := gs.ioPrepare()
 		if err != nil {
 			return err
 		}
 	}
-	return gs.cmd.Start()
+
+	if err := gs.begin(); err != nil {
+		return err
+	}
+	if err := gs.cmd.Start(); err != nil {
+		gs.end()
+		return err
+	}
+	return nil
 }
 
-// UploadPack serves git fetch-pack and git ls-remote clients, which are
-// invoked from git fetch, git pull, and git clone.
-func (gs *GitRPCClient) UploadPack(repoPath string, cfg map[string]struct{}) {
-	args := []string{"upload-pack"}
+// Wait happens after the Start call, which is a block call that will only finish
+// when the RPC has been finished.
+// Error will be raised when unexpected happens.
+func (gs *GitRPCClient) Wait() error {
+	defer gs.end()
 
-	for k := range cfg {
-		args = append(args, gs.RPCConfig[k])
+	err := gs.cmd.Wait()
+	if err != nil && gs.TimedOut() {
+		return ErrGitTimeout
 	}
-	args = append(args, "--stateless-rpc", repoPath)
+	return err
+}
 
-	gs.cmd = exec.Command(gitBackend, args...)
+// TimedOut reports whether the process was killed for exceeding Timeout
+func (gs *GitRPCClient) TimedOut() bool {
+	return gs.Timeout > 0 && gs.ctx != nil && gs.ctx.Err() == context.DeadlineExceeded
 }
 
-// ReceivePack serves git send-pack clients, which is invoked from git push.
-func (gs *GitRPCClient) ReceivePack(repoPath string, cfg map[string]struct{}) {
-	args := []string{"receive-pack"}
+// Close kills the process of a started RPC call that has not been waited
+// for yet and reaps it. It is safe to call Close after Wait.
+func (gs *GitRPCClient) Close() error {
+	gs.mu.Lock()
+	running := gs.running
+	gs.mu.Unlock()
 
-	for k := range cfg {
-		args = append(args, gs.RPCConfig[k])
+	if !running {
+		if gs.cancel != nil {
+			gs.cancel()
+		}
+		return nil
 	}
-	args = append(args, "--stateless-rpc", repoPath)
 
-	gs.cmd = exec.Command(gitBackend, args...)
+	gs.Kill()
+	return gs.Wait()
 }
 
-// UpdateServerInfo updates auxiliary info file to help dumb servers.
-// It will update objects/info/packs and info/refs.
-// See https://git-scm.com/docs/gitrepository-layout to understand what they are for
-func (gs *GitRPCClient) UpdateServerInfo(repoPath string, cfg map[string]struct{}) {
-	args := []string{"update-server-info"}
+// Kill stops the process of a started RPC call without waiting for it. The
+// process still has to be reaped with Wait or Close.
+func (gs *GitRPCClient) Kill() error {
+	if gs.cmd == nil || gs.cmd.Process == nil {
+		return nil
+	}
+	return gs.cmd.Process.Kill()
+}
+
+// Interrupt asks the process of a started RPC call to stop, giving git the
+// chance to clean up after itself, such as receive-pack removing its
+// quarantine. It is killed where interrupts are not supported.
+func (gs *GitRPCClient) Interrupt() error {
+	if gs.cmd == nil || gs.cmd.Process == nil {
+		return nil
+	}
+	if err := gs.cmd.Process.Signal(os.Interrupt); err != nil {
+		return gs.cmd.Process.Kill()
+	}
+	return nil
+}
 
-	for k := range cfg {
-		args = append(args, gs.RPCConfig[k])
+// begin marks the client as running, waiting for a slot of its manager
+func (gs *GitRPCClient) begin() error {
+	if gs.manager != nil {
+		if err := gs.manager.acquire(gs.ctx, gs); err != nil {
+			return err
+		}
 	}
-	args = append(args, "--stateless-rpc", repoPath)
 
-	pwd, _ := os.Getwd()
-	defer os.Chdir(pwd)
+	gs.mu.Lock()
+	gs.running = true
+	gs.mu.Unlock()
+	return nil
+}
+
+// end marks the client as finished, releasing its slot exactly once
+func (gs *GitRPCClient) end() {
+	gs.mu.Lock()
+	running := gs.running
+	gs.running = false
+	gs.mu.Unlock()
 
-	os.Chdir(repoPath)
-	gs.cmd = exec.Command(gitBackend, args...)
+	if running && gs.manager != nil {
+		gs.manager.release(gs)
+	}
+	if gs.cancel != nil {
+		gs.cancel()
+	}
 }
 
 func (gs *GitRPCClient) ioPrepare() error {
@@ -0,0 +1,176 @@
+// Package githttptest runs git smart HTTP handlers on an httptest.Server
+// next to throwaway bare repositories, and drives the git client against
+// them, so that servers can be integration tested in process.
+//
+//	srv := githttptest.NewServer(t, func(root string) http.Handler {
+//		return newHandler(root)
+//	})
+//	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+//	work := srv.Clone("test.git")
+//	githttptest.Commit(t, work, map[string]string{"f": "more\n"}, "second")
+//	srv.Push(work, "HEAD:master")
+package githttptest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Server serves the repositories below Root
+type Server struct {
+	*httptest.Server
+	Root string
+
+	t testing.TB
+}
+
+// NewServer creates an empty repositories root and serves the handler
+// newHandler returns for it until the test ends.
+func NewServer(t testing.TB, newHandler func(root string) http.Handler) *Server {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root := filepath.Join(t.TempDir(), "repos")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Server: httptest.NewServer(newHandler(root)), Root: root, t: t}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// RepoURL returns the URL the repository is served at
+func (s *Server) RepoURL(repo string) string {
+	return s.URL + "/" + strings.TrimPrefix(repo, "/")
+}
+
+// CreateRepo creates a bare repository below Root with one commit on
+// master per set of files given, mapping file names to their content, and
+// returns its path.
+func (s *Server) CreateRepo(repo string, commits ...map[string]string) string {
+	s.t.Helper()
+
+	path := filepath.Join(s.Root, filepath.FromSlash(repo))
+	Git(s.t, "", "init", "--quiet", "--bare", path)
+	Git(s.t, path, "symbolic-ref", "HEAD", "refs/heads/master")
+	if len(commits) == 0 {
+		return path
+	}
+
+	work := s.t.TempDir()
+	Git(s.t, work, "init", "--quiet")
+	for i, files := range commits {
+		Commit(s.t, work, files, "commit "+strconv.Itoa(i+1))
+	}
+	Git(s.t, work, "push", "--quiet", path, "HEAD:refs/heads/master")
+	return path
+}
+
+// Clone clones the repository over HTTP into a new directory and returns
+// it, failing the test if the clone fails.
+func (s *Server) Clone(repo string, args ...string) string {
+	s.t.Helper()
+
+	work := filepath.Join(s.t.TempDir(), "work")
+	Git(s.t, "", append(append([]string{"clone", "--quiet"}, args...), s.RepoURL(repo), work)...)
+	return work
+}
+
+// Push pushes the refspecs from the clone in work to its origin, failing
+// the test if the push fails.
+func (s *Server) Push(work string, refspecs ...string) {
+	s.t.Helper()
+	Git(s.t, work, append([]string{"push", "--quiet", "origin"}, refspecs...)...)
+}
+
+// PushRejected pushes the refspecs from the clone in work to its origin,
+// failing the test unless the push fails. It returns what git printed.
+func (s *Server) PushRejected(work string, refspecs ...string) string {
+	s.t.Helper()
+
+	out, err := run(work, append([]string{"push", "origin"}, refspecs...)...)
+	if err == nil {
+		s.t.Fatalf("git push %s succeeded, want it rejected:\n%s", strings.Join(refspecs, " "), out)
+	}
+	return out
+}
+
+// Ref returns the commit the ref of the repository points to on the
+// server side, or an empty string if it does not exist.
+func (s *Server) Ref(repo, ref string) string {
+	s.t.Helper()
+
+	out, err := run(filepath.Join(s.Root, filepath.FromSlash(repo)), "rev-parse", "--verify", "--quiet", ref)
+	if err != nil {
+		return ""
+	}
+	return out
+}
+
+// Commit writes the files into the work tree and commits them
+func Commit(t testing.TB, work string, files map[string]string, msg string) string {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(work, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Git(t, work, "add", "--all")
+	Git(t, work, "commit", "--quiet", "--allow-empty", "-m", msg)
+	return Git(t, work, "rev-parse", "HEAD")
+}
+
+// Git runs git in dir and returns its trimmed output, failing the test if
+// git fails.
+func Git(t testing.TB, dir string, args ...string) string {
+	t.Helper()
+
+	out, err := run(dir, args...)
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return out
+}
+
+// GitFails runs git in dir and returns its trimmed output, failing the
+// test unless git fails.
+func GitFails(t testing.TB, dir string, args ...string) string {
+	t.Helper()
+
+	out, err := run(dir, args...)
+	if err == nil {
+		t.Fatalf("git %s succeeded, want it to fail:\n%s", strings.Join(args, " "), out)
+	}
+	return out
+}
+
+func run(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// Keep the configuration of the machine running the tests out
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_GLOBAL="+os.DevNull,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME=githttptest",
+		"GIT_AUTHOR_EMAIL=githttptest@example.com",
+		"GIT_COMMITTER_NAME=githttptest",
+		"GIT_COMMITTER_EMAIL=githttptest@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
@@ -0,0 +1,211 @@
+package githttp
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// GitoliteACL is an AccessChecker reading its rules from a gitolite.conf,
+// so gitolite installations can move to HTTP without rewriting them.
+//
+// Groups, repo blocks, wildcard repos and include statements are supported.
+// Access is decided per repository like gitolite's first access check: R
+// grants reads, any rule with W grants writes, whatever refs it is limited
+// to. Deny rules, options and config lines are ignored. Users may also be
+// members of groups through the Groups of their Identity. Anonymous requests
+// are checked as AnonymousUser, and @all matches every user.
+type GitoliteACL struct {
+	AnonymousUser string
+
+	groups map[string][]string
+	repos  []*gitoliteRepo
+}
+
+type gitoliteRepo struct {
+	name  string
+	match *regexp.Regexp
+	rules []gitoliteRule
+}
+
+type gitoliteRule struct {
+	perm  string
+	users []string
+}
+
+var gitoliteRepoPattern = regexp.MustCompile(`[\\^$*+?()\[\]{}|]`)
+
+// LoadGitoliteConf parses the gitolite.conf at path
+func LoadGitoliteConf(path string) (*GitoliteACL, error) {
+	acl := &GitoliteACL{
+		AnonymousUser: "anonymous",
+		groups:        make(map[string][]string),
+	}
+	if err := acl.parse(path, nil); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (acl *GitoliteACL) parse(path string, current []*gitoliteRepo) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "include" || fields[0] == "subconf":
+			if len(fields) < 2 {
+				return fmt.Errorf("%s:%d: include without file", path, lineNo)
+			}
+			pattern := strings.Trim(fields[len(fields)-1], `"'`)
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %s", path, lineNo, err)
+			}
+			for _, m := range matches {
+				if err := acl.parse(m, current); err != nil {
+					return err
+				}
+			}
+
+		case fields[0] == "repo":
+			current = nil
+			for _, name := range acl.expand(fields[1:]) {
+				current = append(current, acl.repo(name))
+			}
+
+		case strings.HasPrefix(fields[0], "@") && len(fields) >= 2 && fields[1] == "=":
+			acl.groups[fields[0]] = append(acl.groups[fields[0]], fields[2:]...)
+
+		case fields[0] == "config" || fields[0] == "option":
+			// Not relevant to access over HTTP
+
+		default:
+			eq := strings.IndexByte(line, '=')
+			if eq < 0 {
+				return fmt.Errorf("%s:%d: cannot parse %q", path, lineNo, strings.TrimSpace(line))
+			}
+			lhs := strings.Fields(line[:eq])
+			if len(lhs) == 0 {
+				return fmt.Errorf("%s:%d: rule without permission", path, lineNo)
+			}
+			if current == nil {
+				return fmt.Errorf("%s:%d: rule outside of a repo block", path, lineNo)
+			}
+			rule := gitoliteRule{perm: lhs[0], users: strings.Fields(line[eq+1:])}
+			for _, repo := range current {
+				repo.rules = append(repo.rules, rule)
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// repo returns the block of the repository, creating it on first use
+func (acl *GitoliteACL) repo(name string) *gitoliteRepo {
+	for _, repo := range acl.repos {
+		if repo.name == name {
+			return repo
+		}
+	}
+
+	repo := &gitoliteRepo{name: name}
+	if gitoliteRepoPattern.MatchString(name) {
+		if re, err := regexp.Compile("^(?:" + name + ")$"); err == nil {
+			repo.match = re
+		}
+	}
+	acl.repos = append(acl.repos, repo)
+	return repo
+}
+
+// expand replaces groups by their members, recursively
+func (acl *GitoliteACL) expand(names []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	var walk func(names []string)
+	walk = func(names []string) {
+		for _, name := range names {
+			if members, ok := acl.groups[name]; ok {
+				if !seen[name] {
+					seen[name] = true
+					walk(members)
+				}
+				continue
+			}
+			out = append(out, name)
+		}
+	}
+	walk(names)
+	return out
+}
+
+// memberOf reports whether user, also belonging to the given groups, is
+// named by any of names.
+func (acl *GitoliteACL) memberOf(user string, groups []string, names []string) bool {
+	for _, name := range names {
+		if name == "@all" || name == user {
+			return true
+		}
+		for _, g := range groups {
+			if name == "@"+g {
+				return true
+			}
+		}
+		if members, ok := acl.groups[name]; ok && acl.memberOf(user, groups, acl.expand(members)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *GitoliteACL) CheckAccess(r *http.Request, id *Identity, repo string, op Operation) error {
+	user, groups := acl.AnonymousUser, []string(nil)
+	if id != nil {
+		user, groups = id.Name, id.Groups
+	}
+	name := strings.TrimSuffix(repo, ".git")
+
+	for _, repo := range acl.repos {
+		if repo.name != name && (repo.match == nil || !repo.match.MatchString(name)) {
+			continue
+		}
+		for _, rule := range repo.rules {
+			if strings.HasPrefix(rule.perm, "-") {
+				continue
+			}
+			granted := strings.Contains(rule.perm, "R")
+			if op == OpWrite {
+				granted = strings.Contains(rule.perm, "W")
+			}
+			if granted && acl.memberOf(user, groups, rule.users) {
+				return nil
+			}
+		}
+	}
+
+	if id == nil {
+		return ErrAuthRequired
+	}
+	return ErrAccessDenied
+}
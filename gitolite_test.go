@@ -0,0 +1,60 @@
+package githttp
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestGitoliteAccess(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "gitolite.conf")
+	err := os.WriteFile(conf, []byte("@devs = alice\n\nrepo test\n    RW+ = @devs\n    R   = bob\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := LoadGitoliteConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, GitSmartHTTPConfig{
+		Access: acl,
+		IdentityFunc: func(r *http.Request) *Identity {
+			if user, _, ok := r.BasicAuth(); ok {
+				return &Identity{Name: user}
+			}
+			return nil
+		},
+	})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	userURL := func(user string) string {
+		u, err := url.Parse(srv.RepoURL("test.git"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.User = url.UserPassword(user, "secret")
+		return u.String()
+	}
+
+	dir := t.TempDir()
+	githttptest.GitFails(t, dir, "clone", srv.RepoURL("test.git"), "anonymous")
+	if out := githttptest.GitFails(t, dir, "clone", userURL("mallory"), "mallory"); !strings.Contains(out, "403") {
+		t.Errorf("clone of a user without access:\n%s", out)
+	}
+
+	work := filepath.Join(dir, "bob")
+	githttptest.Git(t, "", "clone", "--quiet", userURL("bob"), work)
+	head := githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+	srv.PushRejected(work, "HEAD:master")
+
+	githttptest.Git(t, work, "remote", "set-url", "origin", userURL("alice"))
+	srv.Push(work, "HEAD:master")
+	if got := srv.Ref("test.git", "refs/heads/master"); got != head {
+		t.Errorf("master at %s, want %s", got, head)
+	}
+}
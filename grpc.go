@@ -0,0 +1,160 @@
+package githttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Status codes of gRPC calls
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcMaxMessage is the largest request message accepted
+const grpcMaxMessage = 4 << 20
+
+// grpcError fails a call with a status code
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code, fmt.Sprintf(format, args...)}
+}
+
+// grpcMethod handles a unary call, given the request message
+type grpcMethod func(ctx context.Context, req []byte) (protoMessage, error)
+
+// grpcServer serves the unary methods of a gRPC service over HTTP/2, at
+// /<service>/<method>, to clients giving token as bearer credentials
+type grpcServer struct {
+	service string
+	token   string
+	methods map[string]grpcMethod
+}
+
+func (s grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		writeErrorMessage(w, r, http.StatusUnsupportedMediaType, "gRPC over HTTP/2 only")
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if s.token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) != 1 {
+		s.writeStatus(w, grpcErrorf(grpcUnauthenticated, "admin token required"))
+		return
+	}
+	method, ok := s.methods[strings.TrimPrefix(r.URL.Path, "/"+s.service+"/")]
+	if !ok {
+		s.writeStatus(w, grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path))
+		return
+	}
+
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		s.writeStatus(w, err)
+		return
+	}
+	resp, err := method(r.Context(), req)
+	if err != nil {
+		s.writeStatus(w, err)
+		return
+	}
+
+	var e protoEncoder
+	resp.marshalProto(&e)
+	frame := make([]byte, 5, 5+len(e.b))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(e.b)))
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcOK))
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(frame, e.b...))
+}
+
+// readGRPCMessage reads the single, uncompressed message of a unary call
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "cannot read request: %s", err)
+	}
+	if header[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed requests are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return nil, grpcErrorf(grpcResourceExhausted, "request larger than %d bytes", grpcMaxMessage)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "cannot read request: %s", err)
+	}
+	return msg, nil
+}
+
+// writeStatus fails the call with the status of err, as a response made of
+// trailers only
+func (s grpcServer) writeStatus(w http.ResponseWriter, err error) {
+	code, msg := grpcStatus(err)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", grpcPercentEncode(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcStatus returns the status code and message a call failing with err
+// ends with
+func grpcStatus(err error) (int, string) {
+	var gerr *grpcError
+	if errors.As(err, &gerr) {
+		return gerr.code, gerr.msg
+	}
+
+	switch ErrorStatus(err) {
+	case http.StatusNotFound:
+		return grpcNotFound, err.Error()
+	case http.StatusForbidden:
+		return grpcPermissionDenied, err.Error()
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated, err.Error()
+	case http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		return grpcResourceExhausted, err.Error()
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return grpcUnavailable, err.Error()
+	case http.StatusBadRequest:
+		return grpcInvalidArgument, err.Error()
+	}
+	log.Printf("gRPC call failed: %s", err)
+	return grpcInternal, "internal error"
+}
+
+// grpcPercentEncode encodes a status message the way grpc-message needs
+func grpcPercentEncode(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,70 @@
+package githttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// showHiddenRefsHeader is the header admins send the admin token in to see
+// and push to hidden refs, for example with
+// git -c http.extraHeader="X-Show-Hidden-Refs: <token>" fetch
+const showHiddenRefsHeader = "X-Show-Hidden-Refs"
+
+// HiddenRefs lists ref prefixes, such as refs/pull/, that are neither
+// advertised to nor accepted from clients of the repositories matching the
+// path.Match pattern Repo, or of every repository when Repo is empty.
+type HiddenRefs struct {
+	Repo string   `json:"repo"`
+	Refs []string `json:"refs"`
+}
+
+// LoadHiddenRefs reads a JSON array of HiddenRefs from path
+func LoadHiddenRefs(path string) ([]HiddenRefs, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hidden []HiddenRefs
+	if err := json.Unmarshal(data, &hidden); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return hidden, nil
+}
+
+type hiddenRefsShownKey struct{}
+
+// showHiddenRefs marks the request as made by an admin, who sees hidden refs
+func (gsh GitSmartHTTP) showHiddenRefs(r *http.Request) *http.Request {
+	token := r.Header.Get(showHiddenRefsHeader)
+	if token == "" || gsh.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(gsh.AdminToken)) != 1 {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), hiddenRefsShownKey{}, true))
+}
+
+// hiddenRefsShown tells whether hidden refs are exposed in ctx. Responses
+// made with them shown must not be cached for everyone else.
+func hiddenRefsShown(ctx context.Context) bool {
+	shown, _ := ctx.Value(hiddenRefsShownKey{}).(bool)
+	return shown
+}
+
+// hideRefsConfig returns the transfer.hideRefs options of the repository
+func (gsh GitSmartHTTP) hideRefsConfig(ctx context.Context, repo string) []string {
+	if hiddenRefsShown(ctx) {
+		return nil
+	}
+	var config []string
+	for _, h := range gsh.HiddenRefs {
+		if h.Repo == "" || matchesAny([]string{h.Repo}, repo) {
+			for _, ref := range h.Refs {
+				config = append(config, "transfer.hideRefs="+ref)
+			}
+		}
+	}
+	return config
+}
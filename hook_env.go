@@ -0,0 +1,40 @@
+package githttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type hookEnvContextKey struct{}
+
+// withHookEnv returns the request with the environment receive-pack hooks
+// see the pusher in attached to its context. Like the CGI git-http-backend
+// it sets REMOTE_ADDR and, for authenticated requests, REMOTE_USER, with
+// the committer of reflog entries being the pusher.
+func (gsh GitSmartHTTP) withHookEnv(r *http.Request) *http.Request {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	env := []string{"REMOTE_ADDR=" + addr}
+
+	if id := gsh.identity(r); id != nil && id.Name != "" {
+		email := id.Email
+		if email == "" {
+			email = id.Name + "@http." + addr
+		}
+		env = append(env,
+			"REMOTE_USER="+id.Name,
+			"GIT_COMMITTER_NAME="+id.Name,
+			"GIT_COMMITTER_EMAIL="+email,
+		)
+	}
+	return r.WithContext(context.WithValue(r.Context(), hookEnvContextKey{}, env))
+}
+
+// hookEnv returns the environment attached to ctx by withHookEnv
+func hookEnv(ctx context.Context) []string {
+	env, _ := ctx.Value(hookEnvContextKey{}).([]string)
+	return env
+}
@@ -0,0 +1,75 @@
+package githttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Identity is the authenticated user a request is made on behalf of
+type Identity struct {
+	Name   string
+	Email  string
+	Groups []string
+}
+
+type identityContextKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the identity. Authentication
+// middleware running in front of GitSmartHTTP uses it to hand over the user
+// it authenticated.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, id)
+}
+
+// IdentityFromContext returns the identity stored in ctx by WithIdentity,
+// or nil if there is none.
+func IdentityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityContextKey{}).(*Identity)
+	return id
+}
+
+// authorizedIdentityContextKey holds the identity an IdentityChecker found
+type authorizedIdentityContextKey struct{}
+
+// identity returns the authenticated user of the request, if any
+func (gsh GitSmartHTTP) identity(r *http.Request) *Identity {
+	if id, ok := r.Context().Value(authorizedIdentityContextKey{}).(*Identity); ok {
+		return id
+	}
+	if gsh.IdentityFunc != nil {
+		return gsh.IdentityFunc(r)
+	}
+	return IdentityFromContext(r.Context())
+}
+
+// CachedIdentityFunc wraps an IdentityFunc doing expensive authentication,
+// such as a call to an identity provider, so that its result is kept in
+// cache for ttl per set of credentials. Requests without credentials are
+// passed through.
+func CachedIdentityFunc(cache Cache, ttl time.Duration, fn func(r *http.Request) *Identity) func(r *http.Request) *Identity {
+	return func(r *http.Request) *Identity {
+		creds := r.Header.Get("Authorization")
+		if creds == "" {
+			return fn(r)
+		}
+
+		sum := sha256.Sum256([]byte(creds))
+		key := "identity:" + hex.EncodeToString(sum[:])
+		if b, ok := cache.Get(key); ok {
+			var id *Identity
+			if err := json.Unmarshal(b, &id); err == nil {
+				return id
+			}
+		}
+
+		id := fn(r)
+		if b, err := json.Marshal(id); err == nil {
+			cache.Set(key, b, ttl)
+		}
+		return id
+	}
+}
@@ -0,0 +1,88 @@
+package githttp
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// janitor removes what crashed git processes leave behind: lock files,
+// which keep refs from being updated until removed, receive-pack
+// quarantine directories and temporary pack files, as well as repositories
+// half mirrored or restored by the server itself. Only what is older than
+// age is removed, as anything younger may belong to a running process.
+type janitor struct {
+	gsh    GitSmartHTTP
+	age    time.Duration
+	dryRun bool
+}
+
+func (j janitor) run(interval time.Duration) {
+	for {
+		j.sweep()
+		time.Sleep(interval)
+	}
+}
+
+func (j janitor) sweep() {
+	entries, err := os.ReadDir(j.gsh.ReposRootPath)
+	if err != nil {
+		log.Printf("Cannot clean up %s: %s", j.gsh.ReposRootPath, err)
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), ".") && strings.Contains(e.Name(), ".tmp-") {
+			j.remove(filepath.Join(j.gsh.ReposRootPath, e.Name()))
+		}
+	}
+
+	err = j.gsh.walkRepos(func(repo, repoPath string) {
+		dir, _ := gitDir(repoPath)
+		j.clean(dir)
+		j.gsh.details.Invalidate(repoPath)
+	})
+	if err != nil {
+		log.Printf("Cannot clean up %s: %s", j.gsh.ReposRootPath, err)
+	}
+}
+
+// clean removes the stale files of a git directory
+func (j janitor) clean(dir string) {
+	objects := filepath.Join(dir, "objects")
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := d.Name()
+		switch {
+		case d.IsDir() && filepath.Dir(p) == objects && strings.Contains(name, "incoming-"):
+			j.remove(p)
+			return filepath.SkipDir
+		case d.IsDir():
+			return nil
+		case strings.HasSuffix(name, ".lock"),
+			strings.HasPrefix(name, "tmp_") && strings.HasPrefix(p, objects+string(filepath.Separator)):
+			j.remove(p)
+		}
+		return nil
+	})
+}
+
+// remove deletes p when it is older than the age threshold
+func (j janitor) remove(p string) {
+	fi, err := os.Lstat(p)
+	if err != nil || time.Since(fi.ModTime()) < j.age {
+		return
+	}
+	if j.dryRun {
+		log.Printf("Would remove stale %s, last modified %s ago", p, time.Since(fi.ModTime()).Round(time.Second))
+		return
+	}
+	log.Printf("Removing stale %s, last modified %s ago", p, time.Since(fi.ModTime()).Round(time.Second))
+	if err := os.RemoveAll(p); err != nil {
+		log.Printf("Cannot remove %s: %s", p, err)
+	}
+}
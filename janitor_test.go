@@ -0,0 +1,68 @@
+package githttp
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestJanitor(t *testing.T) {
+	var gsh GitSmartHTTP
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh = NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: root, ExportAll: true, UploadPack: true, ReceivePack: true})
+		return gsh.Handler()
+	})
+	repoPath := srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	work := srv.Clone("test.git")
+	githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+
+	old := time.Now().Add(-2 * time.Hour)
+	create := func(p string, dir bool, mtime time.Time) string {
+		t.Helper()
+		var err error
+		if dir {
+			err = os.MkdirAll(p, 0755)
+		} else {
+			err = os.WriteFile(p, nil, 0644)
+		}
+		if err == nil {
+			err = os.Chtimes(p, mtime, mtime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	stale := []string{
+		create(filepath.Join(repoPath, "refs", "heads", "master.lock"), false, old),
+		create(filepath.Join(repoPath, "objects", "incoming-abc123"), true, old),
+		create(filepath.Join(repoPath, "objects", "pack", "tmp_pack_abc123"), false, old),
+		create(filepath.Join(srv.Root, ".restored.git.tmp-123"), true, old),
+	}
+	fresh := create(filepath.Join(repoPath, "config.lock"), false, time.Now())
+
+	// The stale lock keeps master from being updated
+	srv.PushRejected(work, "HEAD:master")
+
+	janitor{gsh: gsh, age: time.Hour, dryRun: true}.sweep()
+	for _, p := range append(stale, fresh) {
+		if _, err := os.Lstat(p); err != nil {
+			t.Errorf("dry run removed %s", p)
+		}
+	}
+
+	janitor{gsh: gsh, age: time.Hour}.sweep()
+	for _, p := range stale {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("stale %s kept", p)
+		}
+	}
+	if _, err := os.Lstat(fresh); err != nil {
+		t.Errorf("fresh %s removed", fresh)
+	}
+	srv.Push(work, "HEAD:master")
+}
@@ -0,0 +1,286 @@
+package githttp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalEntry records a single ref update of a push
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	Repo     string    `json:"repo"`
+	Ref      string    `json:"ref"`
+	Old      string    `json:"old"`
+	New      string    `json:"new"`
+	User     string    `json:"user,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	// Signer and PushCert are set for signed pushes
+	Signer   string `json:"signer,omitempty"`
+	PushCert string `json:"push_cert,omitempty"`
+	// SessionID is the session-id capability of the client
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// JournalQuery selects journal entries. Empty fields match everything.
+type JournalQuery struct {
+	Repo  string
+	Ref   string
+	User  string
+	Since time.Time
+	Until time.Time
+	// Limit caps the number of entries returned, zero meaning no limit
+	Limit int
+}
+
+func (q JournalQuery) matches(e JournalEntry) bool {
+	return (q.Repo == "" || q.Repo == e.Repo) &&
+		(q.Ref == "" || q.Ref == e.Ref) &&
+		(q.User == "" || q.User == e.User) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// Journal keeps the history of ref updates
+type Journal interface {
+	Record(entries []JournalEntry) error
+	// Query returns the matching entries, newest first
+	Query(q JournalQuery) ([]JournalEntry, error)
+}
+
+// FileJournal is a Journal appending JSON lines to a local file. The file
+// is indexed in memory by repository, ref, user and time as it grows, so
+// queries only read the entries they return.
+type FileJournal struct {
+	Path string
+
+	mu sync.Mutex
+	// size is how much of the file is indexed, up to the end of its last
+	// complete line
+	size    int64
+	entries []journalIndexEntry
+	byRepo  map[string][]int
+	byRef   map[string][]int
+	byUser  map[string][]int
+}
+
+// journalIndexEntry locates an entry in the file of a FileJournal
+type journalIndexEntry struct {
+	off  int64
+	len  int
+	time time.Time
+}
+
+// NewFileJournal returns a FileJournal writing to path
+func NewFileJournal(path string) *FileJournal {
+	return &FileJournal{Path: path}
+}
+
+func (j *FileJournal) Record(entries []JournalEntry) error {
+	var buf []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.OpenFile(j.Path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	return j.index(f)
+}
+
+// index adds the entries appended to the file since it was last indexed,
+// by this process or another one, starting over when it was truncated
+func (j *FileJournal) index(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if j.byRepo == nil || fi.Size() < j.size {
+		j.size, j.entries = 0, nil
+		j.byRepo = make(map[string][]int)
+		j.byRef = make(map[string][]int)
+		j.byUser = make(map[string][]int)
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, j.size, 1<<62))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Leave a line being written for the next time
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var e JournalEntry
+		if json.Unmarshal(line, &e) == nil {
+			n := len(j.entries)
+			j.entries = append(j.entries, journalIndexEntry{j.size, len(line), e.Time})
+			j.byRepo[e.Repo] = append(j.byRepo[e.Repo], n)
+			j.byRef[e.Ref] = append(j.byRef[e.Ref], n)
+			j.byUser[e.User] = append(j.byUser[e.User], n)
+		}
+		j.size += int64(len(line))
+	}
+}
+
+func (j *FileJournal) Query(q JournalQuery) ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.Open(j.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := j.index(f); err != nil {
+		return nil, err
+	}
+
+	// Walk the shortest list of entries the query narrows down to
+	var candidates []int
+	all := true
+	for _, c := range []struct {
+		value string
+		index map[string][]int
+	}{{q.Repo, j.byRepo}, {q.Ref, j.byRef}, {q.User, j.byUser}} {
+		if c.value == "" {
+			continue
+		}
+		if list := c.index[c.value]; all || len(list) < len(candidates) {
+			candidates, all = list, false
+		}
+	}
+	n := len(candidates)
+	if all {
+		n = len(j.entries)
+	}
+
+	var found []JournalEntry
+	for k := n - 1; k >= 0 && (q.Limit <= 0 || len(found) < q.Limit); k-- {
+		ie := j.entries[k]
+		if !all {
+			ie = j.entries[candidates[k]]
+		}
+		if (!q.Since.IsZero() && ie.time.Before(q.Since)) || (!q.Until.IsZero() && !ie.time.Before(q.Until)) {
+			continue
+		}
+
+		line := make([]byte, ie.len)
+		if _, err := f.ReadAt(line, ie.off); err != nil {
+			return nil, err
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, err
+		}
+		if q.matches(e) {
+			found = append(found, e)
+		}
+	}
+	return found, nil
+}
+
+// recordJournal adds the applied updates of a push to the journal
+func (gsh GitSmartHTTP) recordJournal(r *http.Request, repo string, updates []RefUpdate, cert *pushCert, session string) {
+	user := ""
+	if id := gsh.identity(r); id != nil {
+		user = id.Name
+	}
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	var signer, certText string
+	if cert != nil {
+		signer, certText = cert.Signer, cert.Text
+	}
+
+	now := time.Now().UTC()
+	entries := make([]JournalEntry, 0, len(updates))
+	for _, u := range updates {
+		entries = append(entries, JournalEntry{
+			Time:     now,
+			Repo:     repo,
+			Ref:      u.Ref,
+			Old:      u.Old,
+			New:      u.New,
+			User:     user,
+			ClientIP: clientIP,
+			Signer:   signer,
+			PushCert: certText,
+
+			SessionID: session,
+		})
+	}
+
+	if err := gsh.Journal.Record(entries); err != nil {
+		log.Printf("Cannot journal push to %s: %s", repo, err)
+	}
+}
+
+// JournalHandler answers journal queries given as the repo, ref, user,
+// since, until (RFC 3339) and limit query parameters with a JSON array.
+func JournalHandler(j Journal) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		q := JournalQuery{
+			Repo: strings.TrimPrefix(params.Get("repo"), "/"),
+			Ref:  params.Get("ref"),
+			User: params.Get("user"),
+		}
+
+		var err error
+		if v := params.Get("since"); v != "" && err == nil {
+			q.Since, err = time.Parse(time.RFC3339, v)
+		}
+		if v := params.Get("until"); v != "" && err == nil {
+			q.Until, err = time.Parse(time.RFC3339, v)
+		}
+		if v := params.Get("limit"); v != "" && err == nil {
+			q.Limit, err = strconv.Atoi(v)
+		}
+		if err != nil {
+			writeErrorMessage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		entries, err := j.Query(q)
+		if err != nil {
+			log.Printf("Cannot query journal: %s", err)
+			writeErrorMessage(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if entries == nil {
+			entries = []JournalEntry{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+}
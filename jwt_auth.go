@@ -0,0 +1,272 @@
+package githttp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// JWTRule grants a permission on repositories to the bearers of JSON web
+// tokens with a claim of a given value. Value may hold {name} placeholders,
+// each matching a part of the claim without colon, slash, space or the
+// pattern characters *?[\ of path.Match, which are substituted in Repos,
+// path.Match patterns of the repositories. For
+// example, the scope claim "repo:team-x:write" matches
+//
+//	{"claim": "scope", "value": "repo:{team}:write", "repos": ["{team}/*"], "permission": "write"}
+//
+// granting pushes to every repository under team-x.
+type JWTRule struct {
+	Claim string   `json:"claim"`
+	Value string   `json:"value"`
+	Repos []string `json:"repos"`
+	// Permission is PermissionRead or PermissionWrite, which implies read
+	Permission string `json:"permission"`
+
+	value *regexp.Regexp
+	names []string
+}
+
+var jwtPlaceholder = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// compile turns the value of the rule into a regular expression
+func (rule *JWTRule) compile() error {
+	if rule.Claim == "" || rule.Value == "" {
+		return errors.New("rule without claim or value")
+	}
+	if rule.Permission != PermissionRead && rule.Permission != PermissionWrite {
+		return fmt.Errorf("invalid permission %q, want %s or %s", rule.Permission, PermissionRead, PermissionWrite)
+	}
+	var expr strings.Builder
+	last := 0
+	for _, m := range jwtPlaceholder.FindAllStringSubmatchIndex(rule.Value, -1) {
+		expr.WriteString(regexp.QuoteMeta(rule.Value[last:m[0]]))
+		expr.WriteString(`([^:/\s*?\[\\]+)`)
+		rule.names = append(rule.names, rule.Value[m[2]:m[3]])
+		last = m[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(rule.Value[last:]))
+	var err error
+	rule.value, err = regexp.Compile("^" + expr.String() + "$")
+	return err
+}
+
+// repos returns the repository patterns the rule grants for a claim value,
+// none when it does not match
+func (rule *JWTRule) repos(value string) []string {
+	m := rule.value.FindStringSubmatch(value)
+	if m == nil {
+		return nil
+	}
+	repos := make([]string, len(rule.Repos))
+	for i, repo := range rule.Repos {
+		for j, name := range rule.names {
+			repo = strings.ReplaceAll(repo, "{"+name+"}", m[j+1])
+		}
+		repos[i] = repo
+	}
+	return repos
+}
+
+// JWTAuth is an AccessChecker granting access according to the claims of
+// the JSON web token requests carry as "Authorization: Bearer <token>",
+// issued by an identity provider. Tokens are verified with Secret for
+// HS256 or Key for RS256 and ES256, and must come from Issuer and be meant
+// for Audience, unless empty. Rules map the claims, such as groups, scope
+// or aud, to permissions on repositories, and the token subject becomes
+// the identity of the request.
+type JWTAuth struct {
+	Secret   []byte
+	Key      crypto.PublicKey
+	Issuer   string
+	Audience string
+	Rules    []JWTRule
+}
+
+// LoadJWTRules reads the JSON array of JWTRules at path
+func LoadJWTRules(path string) ([]JWTRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []JWTRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// LoadJWTKey reads the PEM encoded public key tokens are signed with
+func LoadJWTKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		return cert.PublicKey, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+func (a *JWTAuth) CheckAccess(r *http.Request, id *Identity, repo string, op Operation) error {
+	_, err := a.CheckAccessIdentity(r, id, repo, op)
+	return err
+}
+
+func (a *JWTAuth) CheckAccessIdentity(r *http.Request, id *Identity, repo string, op Operation) (*Identity, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, ErrAuthRequired
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, ErrAuthRequired
+	}
+
+	for i := range a.Rules {
+		rule := &a.Rules[i]
+		if op == OpWrite && rule.Permission != PermissionWrite {
+			continue
+		}
+		for _, value := range claimValues(claims, rule.Claim) {
+			if matchesAny(rule.repos(value), repo) {
+				return claimsIdentity(claims), nil
+			}
+		}
+	}
+	return nil, ErrAccessDenied
+}
+
+// claimValues returns the values of a claim, splitting the space separated
+// scopes of the scope claim
+func claimValues(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		if name == "scope" {
+			return strings.Fields(v)
+		}
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// claimsIdentity returns the user the token was issued to
+func claimsIdentity(claims map[string]interface{}) *Identity {
+	id := &Identity{Groups: claimValues(claims, "groups")}
+	id.Name, _ = claims["preferred_username"].(string)
+	if id.Name == "" {
+		id.Name, _ = claims["sub"].(string)
+	}
+	id.Email, _ = claims["email"].(string)
+	if id.Name == "" {
+		return nil
+	}
+	return id
+}
+
+// verify checks the signature, validity period, issuer and audience of a
+// token, returning its claims
+func (a *JWTAuth) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	sum := sha256.Sum256(signed)
+	switch key := a.Key.(type) {
+	case nil:
+		mac := hmac.New(sha256.New, a.Secret)
+		mac.Write(signed)
+		if header.Alg != "HS256" || len(a.Secret) == 0 || !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errors.New("bad token signature")
+		}
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+			return nil, errors.New("bad token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(key, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("bad token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", a.Key)
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); !ok || now >= exp {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, errors.New("token not valid yet")
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, errors.New("token from another issuer")
+	}
+	if a.Audience != "" {
+		found := false
+		for _, aud := range claimValues(claims, "aud") {
+			found = found || aud == a.Audience
+		}
+		if !found {
+			return nil, errors.New("token for another audience")
+		}
+	}
+	return claims, nil
+}
@@ -0,0 +1,51 @@
+package githttp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// hs256Token signs the claims with secret
+func hs256Token(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTRulePlaceholderPattern(t *testing.T) {
+	rule := JWTRule{Claim: "scope", Value: "repo:{team}:write", Repos: []string{"{team}/*"}, Permission: PermissionWrite}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if repos := rule.repos("repo:team-x:write"); len(repos) != 1 || repos[0] != "team-x/*" {
+		t.Errorf("team-x: repos = %v", repos)
+	}
+	for _, value := range []string{"repo:*:write", "repo:team-?:write", "repo:[a-z]*:write", `repo:team\x:write`, "repo:a/b:write"} {
+		if repos := rule.repos(value); repos != nil {
+			t.Errorf("%s: repos = %v, want no match", value, repos)
+		}
+	}
+
+	secret := []byte("secret")
+	auth := &JWTAuth{Secret: secret, Rules: []JWTRule{rule}}
+	r := httptest.NewRequest("POST", "/team-y/app.git/git-receive-pack", nil)
+	r.Header.Set("Authorization", "Bearer "+hs256Token(t, secret, map[string]interface{}{
+		"sub":   "mallory",
+		"scope": "repo:*:write",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}))
+	if err := auth.CheckAccess(r, nil, "team-y/app.git", OpWrite); err != ErrAccessDenied {
+		t.Errorf("wildcard scope: %v, want access denied", err)
+	}
+}
@@ -0,0 +1,366 @@
+package githttp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kafka API keys and the versions of them spoken, which brokers understand
+// since Kafka 0.11
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 4
+)
+
+// kafkaMaxResponse is the largest response read from a broker
+const kafkaMaxResponse = 16 << 20
+
+var kafkaCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaPublisher publishes events to a partition of a Kafka topic, using
+// the binary Kafka protocol. It asks the brokers for the leader of the
+// partition and produces to it, an event only counting as delivered once
+// every in-sync replica has it. Keeping to a single partition keeps the
+// events in the order they were spooled in.
+type KafkaPublisher struct {
+	Brokers   []string
+	Topic     string
+	Partition int32
+	Timeout   time.Duration
+
+	mu          sync.Mutex
+	conn        net.Conn
+	correlation int32
+}
+
+// NewKafkaPublisher returns a KafkaPublisher for the first partition of
+// topic, finding its leader through the brokers at the addresses given
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		Brokers: brokers,
+		Topic:   topic,
+		Timeout: 5 * time.Second,
+	}
+}
+
+func (p *KafkaPublisher) Publish(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	err := p.produce(data)
+	if err != nil {
+		// Look the leader up again next time, it may have moved
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+// connect asks the brokers in turn for the leader of the partition and
+// dials it
+func (p *KafkaPublisher) connect() error {
+	err := errors.New("kafka: no brokers")
+	for _, addr := range p.Brokers {
+		var leader string
+		if leader, err = p.leader(addr); err != nil {
+			continue
+		}
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", leader, p.Timeout); err != nil {
+			continue
+		}
+		p.conn = conn
+		return nil
+	}
+	return err
+}
+
+// leader returns the address of the leader of the partition, as the
+// broker at addr knows it
+func (p *KafkaPublisher) leader(addr string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	var req kafkaEncoder
+	req.int32(1)
+	req.string(p.Topic)
+	req.int8(0) // leave creating topics to the admins
+	resp, err := p.roundTrip(conn, kafkaMetadata, kafkaMetadataVersion, req.b)
+	if err != nil {
+		return "", err
+	}
+
+	d := kafkaDecoder{b: resp}
+	d.int32() // throttle time
+	brokers := make(map[int32]string)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster id
+	d.int32()  // controller id
+
+	leader := int32(-1)
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code, name := d.int16(), d.string()
+		d.int8() // internal
+		if name == p.Topic && code != 0 {
+			return "", kafkaError(code)
+		}
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			code, index, id := d.int16(), d.int32(), d.int32()
+			d.int32s() // replicas
+			d.int32s() // in-sync replicas
+			if name == p.Topic && index == p.Partition {
+				if code != 0 {
+					return "", kafkaError(code)
+				}
+				leader = id
+			}
+		}
+	}
+	if d.err != nil {
+		return "", d.err
+	}
+
+	a, ok := brokers[leader]
+	if !ok {
+		return "", fmt.Errorf("kafka: no leader for partition %d of %s", p.Partition, p.Topic)
+	}
+	return a, nil
+}
+
+// produce appends data to the partition as a record batch of one record
+func (p *KafkaPublisher) produce(data []byte) error {
+	var req kafkaEncoder
+	req.int16(-1) // no transactional id
+	req.int16(-1) // acknowledged by all in-sync replicas
+	req.int32(int32(p.Timeout / time.Millisecond))
+	req.int32(1)
+	req.string(p.Topic)
+	req.int32(1)
+	req.int32(p.Partition)
+	req.bytes(kafkaRecordBatch(data, time.Now()))
+	resp, err := p.roundTrip(p.conn, kafkaProduce, kafkaProduceVersion, req.b)
+	if err != nil {
+		return err
+	}
+
+	d := kafkaDecoder{b: resp}
+	acked := false
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		name := d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			index, code := d.int32(), d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if d.err == nil && name == p.Topic && index == p.Partition {
+				if code != 0 {
+					return kafkaError(code)
+				}
+				acked = true
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if !acked {
+		return errors.New("kafka: produce not acknowledged")
+	}
+	return nil
+}
+
+// roundTrip sends a request and returns the body of its response
+func (p *KafkaPublisher) roundTrip(conn net.Conn, apiKey, version int16, body []byte) ([]byte, error) {
+	p.correlation++
+	var req kafkaEncoder
+	req.int32(0) // size, set once known
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(p.correlation)
+	req.string("git-http-backend")
+	req.b = append(req.b, body...)
+	binary.BigEndian.PutUint32(req.b, uint32(len(req.b)-4))
+
+	conn.SetDeadline(time.Now().Add(p.Timeout))
+	if _, err := conn.Write(req.b); err != nil {
+		return nil, err
+	}
+
+	var header [8]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 4 || size > kafkaMaxResponse {
+		return nil, fmt.Errorf("kafka: invalid response size %d", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != p.correlation {
+		return nil, fmt.Errorf("kafka: response to request %d, want %d", id, p.correlation)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// kafkaRecordBatch returns an uncompressed record batch, in the format of
+// magic 2, holding value as its only record
+func kafkaRecordBatch(value []byte, t time.Time) []byte {
+	var rec []byte
+	rec = append(rec, 0)               // attributes
+	rec = binary.AppendVarint(rec, 0)  // timestamp delta
+	rec = binary.AppendVarint(rec, 0)  // offset delta
+	rec = binary.AppendVarint(rec, -1) // no key
+	rec = binary.AppendVarint(rec, int64(len(value)))
+	rec = append(rec, value...)
+	rec = binary.AppendVarint(rec, 0) // headers
+
+	ts := t.UnixMilli()
+	var e kafkaEncoder
+	e.int64(0)  // base offset
+	e.int32(0)  // batch length, set once known
+	e.int32(-1) // partition leader epoch
+	e.int8(2)   // magic
+	e.int32(0)  // CRC, set once known
+	e.int16(0)  // attributes, no compression
+	e.int32(0)  // last offset delta
+	e.int64(ts) // first timestamp
+	e.int64(ts) // max timestamp
+	e.int64(-1) // no producer id
+	e.int16(-1) // producer epoch
+	e.int32(-1) // base sequence
+	e.int32(1)
+	e.b = binary.AppendVarint(e.b, int64(len(rec)))
+	e.b = append(e.b, rec...)
+
+	binary.BigEndian.PutUint32(e.b[8:], uint32(len(e.b)-12))
+	// The CRC covers everything from the attributes on
+	binary.BigEndian.PutUint32(e.b[17:], crc32.Checksum(e.b[21:], kafkaCRC))
+	return e.b
+}
+
+// kafkaErrors names the error codes a publish most likely fails with
+var kafkaErrors = map[int16]string{
+	3:  "unknown topic or partition",
+	6:  "not leader or follower",
+	7:  "request timed out",
+	10: "message too large",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "topic authorization failed",
+}
+
+func kafkaError(code int16) error {
+	if msg, ok := kafkaErrors[code]; ok {
+		return errors.New("kafka: " + msg)
+	}
+	return fmt.Errorf("kafka: error code %d", code)
+}
+
+// kafkaEncoder appends the big endian fields of Kafka requests
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+var errKafkaTruncated = errors.New("kafka: truncated response")
+
+// kafkaDecoder reads the fields of Kafka responses one after the other,
+// setting err and returning zero values once the response is exhausted
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+// next consumes n bytes, returning nil when fewer are left
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err == nil && (n < 0 || len(d.b) < n) {
+		d.err = errKafkaTruncated
+	}
+	if d.err != nil {
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string, a null one being empty
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// int32s skips an array of int32
+func (d *kafkaDecoder) int32s() {
+	if n := d.int32(); n > 0 {
+		d.next(4 * int(n))
+	}
+}
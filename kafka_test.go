@@ -0,0 +1,215 @@
+package githttp
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKafka is a single broker leading the first partition of every topic,
+// recording the values produced to it
+type fakeKafka struct {
+	t    *testing.T
+	ln   net.Listener
+	port int32
+
+	mu        sync.Mutex
+	values    []string
+	metadata  int
+	errorCode int16
+}
+
+func newFakeKafka(t *testing.T) *fakeKafka {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	k := &fakeKafka{t: t, ln: ln, port: int32(ln.Addr().(*net.TCPAddr).Port)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go k.serve(conn)
+		}
+	}()
+	return k
+}
+
+func (k *fakeKafka) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		d := kafkaDecoder{b: req}
+		apiKey, version, correlation := d.int16(), d.int16(), d.int32()
+		d.string() // client id
+
+		var resp kafkaEncoder
+		resp.int32(0)
+		resp.int32(correlation)
+		switch {
+		case apiKey == kafkaMetadata && version == kafkaMetadataVersion:
+			k.metadataResponse(&d, &resp)
+		case apiKey == kafkaProduce && version == kafkaProduceVersion:
+			k.produceResponse(&d, &resp)
+		default:
+			k.t.Errorf("unexpected request %d version %d", apiKey, version)
+			return
+		}
+		if d.err != nil {
+			k.t.Errorf("malformed request %d: %s", apiKey, d.err)
+			return
+		}
+		binary.BigEndian.PutUint32(resp.b, uint32(len(resp.b)-4))
+		conn.Write(resp.b)
+	}
+}
+
+func (k *fakeKafka) metadataResponse(d *kafkaDecoder, resp *kafkaEncoder) {
+	k.mu.Lock()
+	k.metadata++
+	k.mu.Unlock()
+
+	d.int32()
+	topic := d.string()
+	d.int8()
+
+	resp.int32(0) // throttle time
+	resp.int32(1)
+	resp.int32(7)
+	resp.string("127.0.0.1")
+	resp.int32(k.port)
+	resp.int16(-1) // rack
+	resp.int16(-1) // cluster id
+	resp.int32(7)
+	resp.int32(1)
+	resp.int16(0)
+	resp.string(topic)
+	resp.int8(0)
+	resp.int32(1)
+	resp.int16(0)
+	resp.int32(0)
+	resp.int32(7) // leader
+	resp.int32(1)
+	resp.int32(7)
+	resp.int32(1)
+	resp.int32(7)
+}
+
+func (k *fakeKafka) produceResponse(d *kafkaDecoder, resp *kafkaEncoder) {
+	d.int16() // transactional id
+	if acks := d.int16(); acks != -1 {
+		k.t.Errorf("acks %d, want -1", acks)
+	}
+	d.int32()
+	d.int32()
+	topic := d.string()
+	d.int32()
+	partition := d.int32()
+	batch := d.next(int(d.int32()))
+	if d.err != nil {
+		return
+	}
+	k.record(batch)
+
+	k.mu.Lock()
+	code := k.errorCode
+	k.mu.Unlock()
+	resp.int32(1)
+	resp.string(topic)
+	resp.int32(1)
+	resp.int32(partition)
+	resp.int16(code)
+	resp.int64(0)  // base offset
+	resp.int64(-1) // log append time
+	resp.int32(0)  // throttle time
+}
+
+// record checks a record batch of one record and keeps its value
+func (k *fakeKafka) record(batch []byte) {
+	if len(batch) < 61 || batch[16] != 2 {
+		k.t.Errorf("invalid record batch % x", batch)
+		return
+	}
+	if n := int(binary.BigEndian.Uint32(batch[8:])); n != len(batch)-12 {
+		k.t.Errorf("batch length %d, want %d", n, len(batch)-12)
+	}
+	if crc := binary.BigEndian.Uint32(batch[17:]); crc != crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)) {
+		k.t.Errorf("batch CRC %x does not match", crc)
+	}
+	if n := binary.BigEndian.Uint32(batch[57:]); n != 1 {
+		k.t.Errorf("%d records, want 1", n)
+	}
+
+	rec := batch[61:]
+	var fields []int64
+	for i := 0; i < 5; i++ {
+		v, n := binary.Varint(rec)
+		if n <= 0 {
+			k.t.Errorf("invalid record % x", batch[61:])
+			return
+		}
+		fields = append(fields, v)
+		rec = rec[n:]
+		if i == 0 {
+			rec = rec[1:] // attributes
+		}
+	}
+	// length, timestamp delta, offset delta, key length, value length
+	if fields[3] != -1 || int(fields[4]) > len(rec) {
+		k.t.Errorf("invalid record % x", batch[61:])
+		return
+	}
+	k.mu.Lock()
+	k.values = append(k.values, string(rec[:fields[4]]))
+	k.mu.Unlock()
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	k := newFakeKafka(t)
+	p := NewKafkaPublisher([]string{"127.0.0.1:1", "127.0.0.1:" + strconv.Itoa(int(k.port))}, "git.push")
+
+	for _, ev := range []string{`{"repo":"a.git"}`, `{"repo":"b.git"}`} {
+		if err := p.Publish([]byte(ev)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	k.mu.Lock()
+	k.errorCode = 19
+	k.mu.Unlock()
+	if err := p.Publish([]byte(`{"repo":"c.git"}`)); err == nil || err.Error() != "kafka: not enough replicas" {
+		t.Errorf("publish without enough replicas: %v", err)
+	}
+
+	// The leader is looked up again after a failure
+	k.mu.Lock()
+	k.errorCode = 0
+	k.mu.Unlock()
+	if err := p.Publish([]byte(`{"repo":"c.git"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if want := []string{`{"repo":"a.git"}`, `{"repo":"b.git"}`, `{"repo":"c.git"}`, `{"repo":"c.git"}`}; strings.Join(k.values, "\n") != strings.Join(want, "\n") {
+		t.Errorf("values %q, want %q", k.values, want)
+	}
+	if k.metadata != 2 {
+		t.Errorf("%d metadata requests, want 2", k.metadata)
+	}
+}
@@ -0,0 +1,47 @@
+package githttp
+
+import (
+	"net/http"
+	"time"
+)
+
+// RequestEvent describes a repository request to the OnRequestStart and
+// OnRequestEnd callbacks
+type RequestEvent struct {
+	Repo      string
+	Operation Operation
+	// User is the authenticated user, nil for anonymous requests
+	User *Identity
+	// Status, Duration and BytesOut are only set once the request ended
+	Status   int
+	Duration time.Duration
+	BytesOut int64
+}
+
+// serveWithCallbacks serves the request with h between the OnRequestStart
+// and OnRequestEnd callbacks
+func (gsh GitSmartHTTP) serveWithCallbacks(h http.Handler, w http.ResponseWriter, r *http.Request, info RequestInfo) {
+	if gsh.OnRequestStart == nil && gsh.OnRequestEnd == nil {
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	ev := RequestEvent{Repo: info.Repo, Operation: info.Operation, User: gsh.identity(r)}
+	if gsh.OnRequestStart != nil {
+		gsh.OnRequestStart(r, ev)
+	}
+
+	out := &countingResponseWriter{ResponseWriter: w}
+	start := time.Now()
+	h.ServeHTTP(out, r)
+
+	if gsh.OnRequestEnd != nil {
+		ev.Status = out.status
+		if ev.Status == 0 {
+			ev.Status = http.StatusOK
+		}
+		ev.Duration = time.Since(start)
+		ev.BytesOut = out.n
+		gsh.OnRequestEnd(r, ev)
+	}
+}
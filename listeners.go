@@ -0,0 +1,281 @@
+package githttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Listener is an address the server listens on, with settings of its own.
+// Listeners are given as URLs:
+//
+//	:8080 or tcp://:8080                    plain HTTP, on IPv4 and IPv6
+//	tcp4://0.0.0.0:8080, tcp6://[::]:8080   plain HTTP, on one of them
+//	tls://[::1]:8443?cert=c.pem&key=k.pem   HTTPS, also serving HTTP/2
+//	unix:///run/git-http-backend.sock?mode=0660
+//
+// with the options client-ca=<pem> to require client certificates signed
+// by those CAs over TLS, read-only=true to refuse pushes and admin=false to
+// leave out the API, admin and debug endpoints.
+type Listener struct {
+	// Network is tcp, tcp4, tcp6 or unix
+	Network string
+	Addr    string
+	// CertFile and KeyFile serve HTTPS when set
+	CertFile string
+	KeyFile  string
+	// ClientCAFile makes HTTPS require client certificates signed by the
+	// CAs in it
+	ClientCAFile string
+	// Mode is the permissions of a unix socket, left to the umask when zero
+	Mode os.FileMode
+	// ReadOnly refuses pushes
+	ReadOnly bool
+	// NoAdmin leaves out the API, admin and debug endpoints
+	NoAdmin bool
+}
+
+// ParseListener parses a listener URL
+func ParseListener(spec string) (Listener, error) {
+	if !strings.Contains(spec, "://") {
+		spec = "tcp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return Listener{}, fmt.Errorf("invalid listener %q: %w", spec, err)
+	}
+
+	l := Listener{Network: u.Scheme, Addr: u.Host}
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6":
+	case "tls":
+		l.Network = "tcp"
+	case "unix":
+		l.Addr = u.Path
+	default:
+		return Listener{}, fmt.Errorf("invalid listener %q: unknown scheme %s", spec, u.Scheme)
+	}
+	if l.Addr == "" {
+		return Listener{}, fmt.Errorf("invalid listener %q: no address", spec)
+	}
+
+	q := u.Query()
+	l.CertFile, l.KeyFile, l.ClientCAFile = q.Get("cert"), q.Get("key"), q.Get("client-ca")
+	if u.Scheme == "tls" && (l.CertFile == "" || l.KeyFile == "") {
+		return Listener{}, fmt.Errorf("invalid listener %q: tls needs cert and key", spec)
+	}
+	if u.Scheme != "tls" && (l.CertFile != "" || l.KeyFile != "" || l.ClientCAFile != "") {
+		return Listener{}, fmt.Errorf("invalid listener %q: cert, key and client-ca need tls", spec)
+	}
+	if mode := q.Get("mode"); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || u.Scheme != "unix" {
+			return Listener{}, fmt.Errorf("invalid listener %q: invalid mode %s", spec, mode)
+		}
+		l.Mode = os.FileMode(m)
+	}
+	if v := q.Get("read-only"); v != "" {
+		if l.ReadOnly, err = strconv.ParseBool(v); err != nil {
+			return Listener{}, fmt.Errorf("invalid listener %q: invalid read-only %s", spec, v)
+		}
+	}
+	if v := q.Get("admin"); v != "" {
+		admin, err := strconv.ParseBool(v)
+		if err != nil {
+			return Listener{}, fmt.Errorf("invalid listener %q: invalid admin %s", spec, v)
+		}
+		l.NoAdmin = !admin
+	}
+	return l, nil
+}
+
+func (l Listener) String() string {
+	switch {
+	case l.Network == "unix":
+		return "unix:" + l.Addr
+	case l.CertFile != "":
+		return "https://" + l.Addr
+	default:
+		return "http://" + l.Addr
+	}
+}
+
+// listen opens the socket of the listener, replacing a stale unix socket
+func (l Listener) listen() (net.Listener, error) {
+	if l.Network == "unix" {
+		if fi, err := os.Lstat(l.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.Addr)
+		}
+	}
+	ln, err := net.Listen(l.Network, l.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if l.Network == "unix" && l.Mode != 0 {
+		if err := os.Chmod(l.Addr, l.Mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// adminPrefixes are the paths of the endpoints left out by NoAdmin
+var adminPrefixes = []string{"/api/", "/admin/", "/debug/"}
+
+type readOnlyListenerKey struct{}
+
+// handler restricts h to what the listener allows
+func (l Listener) handler(h http.Handler) http.Handler {
+	if !l.ReadOnly && !l.NoAdmin {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.NoAdmin {
+			for _, prefix := range adminPrefixes {
+				if strings.HasPrefix(r.URL.Path, prefix) || r.URL.Path+"/" == prefix {
+					writeErrorMessage(w, r, http.StatusNotFound, "not found")
+					return
+				}
+			}
+		}
+		if l.ReadOnly {
+			r = r.WithContext(context.WithValue(r.Context(), readOnlyListenerKey{}, true))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// readOnlyListener tells whether the request came in on a listener
+// refusing pushes
+func readOnlyListener(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyListenerKey{}).(bool)
+	return readOnly
+}
+
+// server returns the server of h on the listener
+func (l Listener) server(h http.Handler) (*http.Server, error) {
+	srv := &http.Server{Handler: l.handler(h)}
+	if l.CertFile == "" {
+		// HTTP/2 without TLS, for gRPC clients
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+		return srv, nil
+	}
+
+	srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if l.ClientCAFile != "" {
+		pem, err := os.ReadFile(l.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(l.ClientCAFile + ": no certificates")
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return srv, nil
+}
+
+// serve serves srv on the socket of the listener until it fails or srv is
+// shut down
+func (l Listener) serve(srv *http.Server, ln net.Listener) error {
+	if l.CertFile == "" {
+		return srv.Serve(ln)
+	}
+	return srv.ServeTLS(ln, l.CertFile, l.KeyFile)
+}
+
+// serveListeners serves h on the listeners, taking over the sockets handed
+// over by the binary this one upgrades, until the process is told to stop
+// with SIGINT or SIGTERM, or to upgrade. Requests being served are drained
+// before returning, for at most drain unless zero.
+func serveListeners(listeners []Listener, h http.Handler, drain time.Duration) {
+	inherited := inheritedListeners()
+	lns := make([]net.Listener, len(listeners))
+	srvs := make([]*http.Server, len(listeners))
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		ln, ok := inherited[l.String()]
+		if ok {
+			delete(inherited, l.String())
+			log.Printf("Taking over %s", l)
+		} else {
+			var err error
+			if ln, err = l.listen(); err != nil {
+				log.Fatalf("Cannot listen on %s: %s", l, err)
+			}
+		}
+		srv, err := l.server(h)
+		if err != nil {
+			log.Fatalf("Cannot listen on %s: %s", l, err)
+		}
+		lns[i], srvs[i] = ln, srv
+		go func(l Listener) {
+			errs <- fmt.Errorf("%s: %w", l, l.serve(srv, ln))
+		}(l)
+	}
+	for _, ln := range inherited {
+		ln.Close()
+	}
+	notifyReady()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, upgradeSignals...)...)
+	for {
+		select {
+		case err := <-errs:
+			log.Fatal(err)
+		case sig := <-sigs:
+			if sig == os.Interrupt || sig == syscall.SIGTERM {
+				log.Printf("Received %s, draining requests", sig)
+			} else if err := handOver(listeners, lns); err != nil {
+				log.Printf("Cannot upgrade: %s", err)
+				continue
+			} else {
+				log.Printf("Handed the listeners over to the new binary, draining requests")
+			}
+			shutdown(srvs, drain)
+			return
+		}
+	}
+}
+
+// shutdown stops the servers once the requests they serve are done, or
+// drain passed unless zero
+func shutdown(srvs []*http.Server, drain time.Duration) {
+	ctx := context.Background()
+	if drain > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, drain)
+		defer cancel()
+	}
+	var wg sync.WaitGroup
+	for _, srv := range srvs {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Cannot drain requests: %s", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,187 @@
+package githttp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestParseListener(t *testing.T) {
+	for spec, want := range map[string]Listener{
+		":8080":                    {Network: "tcp", Addr: ":8080"},
+		"tcp4://0.0.0.0:8080":      {Network: "tcp4", Addr: "0.0.0.0:8080"},
+		"tcp6://[::]:8080?admin=0": {Network: "tcp6", Addr: "[::]:8080", NoAdmin: true},
+		"tls://[::1]:8443?cert=c.pem&key=k.pem&client-ca=ca.pem": {Network: "tcp", Addr: "[::1]:8443", CertFile: "c.pem", KeyFile: "k.pem", ClientCAFile: "ca.pem"},
+		"unix:///run/git.sock?mode=0660&read-only=true":          {Network: "unix", Addr: "/run/git.sock", Mode: 0660, ReadOnly: true},
+	} {
+		got, err := ParseListener(spec)
+		if err != nil || got != want {
+			t.Errorf("ParseListener(%q) = %+v, %v, want %+v", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{
+		"udp://:53",
+		"tcp://",
+		"tls://:8443?cert=c.pem",
+		":8080?cert=c.pem&key=k.pem",
+		":8080?mode=0660",
+		"unix:///run/git.sock?mode=rw",
+		":8080?read-only=maybe",
+		":8080?admin=maybe",
+	} {
+		if _, err := ParseListener(spec); err == nil {
+			t.Errorf("ParseListener(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestListenerRestrictions(t *testing.T) {
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh := NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: root, ExportAll: true, UploadPack: true, ReceivePack: true, AdminToken: testAdminToken})
+		return Listener{ReadOnly: true, NoAdmin: true}.handler(gsh.Handler())
+	})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	// Read-only listeners serve fetches but not pushes
+	work := srv.Clone("test.git")
+	githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+	if out := srv.PushRejected(work, "HEAD:master"); !strings.Contains(out, "403") {
+		t.Errorf("push on a read-only listener: %s, want a 403", out)
+	}
+
+	for _, path := range []string{"/api", "/api/repos/", "/admin/", "/debug/pprof/"} {
+		if resp, _ := adminRequest(t, "GET", srv.URL+path, ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s without admin endpoints: %d, want 404", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix socket permissions on windows")
+	}
+	l := Listener{Network: "unix", Addr: filepath.Join(t.TempDir(), "git.sock"), Mode: 0600}
+
+	// Sockets left behind by a server that did not stop cleanly are
+	// replaced
+	stale, err := net.Listen("unix", l.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := l.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(l.Addr); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, want 0600: %v", fi.Mode(), err)
+	}
+	srv, err := l.server(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "hello") }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.serve(srv, ln)
+	defer srv.Close()
+
+	if got := unixGet(t, l.Addr, "/"); got != "hello" {
+		t.Errorf("unix listener served %q", got)
+	}
+}
+
+// unixGet gets path from the server on the unix socket at addr
+func unixGet(t *testing.T, addr, path string) string {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		},
+		DisableKeepAlives: true,
+	}}
+	resp, err := client.Get("http://git" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestShutdownDrains(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		select {
+		case <-release:
+			io.WriteString(w, "done")
+		case <-time.After(5 * time.Second):
+		}
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	get := func() chan string {
+		got := make(chan string, 1)
+		go func() {
+			resp, err := http.Get("http://" + ln.Addr().String())
+			if err != nil {
+				got <- err.Error()
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			got <- string(body)
+		}()
+		<-entered
+		return got
+	}
+
+	// Requests being served finish before the server stops
+	got := get()
+	stopped := make(chan struct{})
+	go func() {
+		shutdown([]*http.Server{srv}, 0)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("shutdown did not wait for the request being served")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if body := <-got; body != "done" {
+		t.Errorf("drained request got %q", body)
+	}
+	<-stopped
+
+	// Unless they take longer than drain
+	srv = &http.Server{Handler: srv.Handler}
+	if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	release = make(chan struct{})
+	got = get()
+	start := time.Now()
+	shutdown([]*http.Server{srv}, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s with a drain of 50ms", elapsed)
+	}
+	if body := <-got; body == "done" {
+		t.Error("request outliving the drain was served")
+	}
+}
@@ -1,39 +1,31 @@
-package main
+package githttp
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
-	"flag"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httputil"
 	"os"
-	"path"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// VERSION is the version of the binary
-var VERSION string
-
-// COMMIT is current commit SHA number
-var COMMIT string
-
 const (
 	uploadPack  = "git-upload-pack"
 	receivePack = "git-receive-pack"
-	//BANNER shows at the beginning of the command line
-	BANNER = `
-       _ _     _   _   _          _             _               _
-  __ _(_) |_  | |_| |_| |_ _ __  | |__  __ _ __| |_____ _ _  __| |
- / _` + "` " + `| |  _| | ' \  _|  _| '_ \ | '_ \/ _` + "` " + `/ _| / / -_) ' \/ _` + "`" + ` |
- \__, |_|\__| |_||_\__|\__| .__/ |_.__/\__,_\__|_\_\___|_||_\__,_|
- |___/                    |_|
-  Git HTTP Backend
-    Version: %s Build: %s
-`
 )
 
 // Service defines the Git Smart HTTP request by the given method and pattern
@@ -41,6 +33,12 @@ type Service struct {
 	Method  string
 	Pattern *regexp.Regexp
 	Handler func(s Service, w http.ResponseWriter, r *http.Request)
+	// Write makes access checks treat requests of the service as writes
+	Write bool
+
+	// route is the route whose RoutePolicy applies, one of the Route
+	// constants
+	route string
 }
 
 // ParseURLNamedParams parse the request into named parameters
@@ -58,12 +56,303 @@ func (s *Service) ParseURLNamedParams(r *http.Request) map[string]string {
 	return namedParams
 }
 
+// allowsMethod reports whether the service handles the request method. HEAD
+// is accepted wherever GET is; net/http drops the body for it.
+func (s *Service) allowsMethod(method string) bool {
+	return method == s.Method || (method == "HEAD" && s.Method == "GET")
+}
+
+// methods returns the request methods the service handles
+func (s *Service) methods() []string {
+	if s.Method == "GET" {
+		return []string{"GET", "HEAD"}
+	}
+	return []string{s.Method}
+}
+
 // GitSmartHTTPConfig is the configuration for GitSmartHTTP
 type GitSmartHTTPConfig struct {
 	ReposRootPath string
 	ReceivePack   bool
 	UploadPack    bool
+	ExportAll     bool
+	GitSuffix     string
 	Port          int
+	RefsCache     bool
+	PackCacheDir  string
+	PackCacheTTL  time.Duration
+	MaxProcesses  int
+	CatFileBatch  bool
+	ConnRateLimit int64
+	RepoRateLimit int64
+
+	// RoutePolicies override the rate limits, body size limits and
+	// timeouts of the server by route, one of the Route constants
+	RoutePolicies map[string]RoutePolicy
+
+	// MinCloneDepth and MaxCloneDepth bound the depth of shallow fetches,
+	// MaxDeepen how many commits a fetch may deepen a shallow clone by.
+	// Zero leaves them unbounded.
+	MinCloneDepth int
+	MaxCloneDepth int
+	MaxDeepen     int
+
+	// MaxClientRequests caps the smart HTTP requests served at once per
+	// client IP, zero meaning no cap
+	MaxClientRequests int
+
+	// MaxQueuedProcesses bounds how many git processes wait for one of
+	// MaxProcesses to finish and QueueTimeout how long, their requests
+	// failing with ErrTooManyRequests beyond
+	MaxQueuedProcesses int
+	QueueTimeout       time.Duration
+
+	// SerializePushes lets only one push into a repository run at a time,
+	// across all servers sharing the storage, and keeps pushes from running
+	// along garbage collections, ref pruning and pack tiering
+	SerializePushes bool
+
+	// NegotiationCacheTTL is how long the upload-pack negotiation rounds
+	// of a session are cached for, zero disabling the cache
+	NegotiationCacheTTL time.Duration
+	// NegotiationCacheSize bounds the bytes the negotiation rounds take
+	// when Cache is the in-memory one, DefaultNegotiationCacheSize when zero.
+	// Rounds are then kept apart from the other cached values, which
+	// clients naming sessions at will could otherwise push out.
+	NegotiationCacheSize int64
+
+	// Trace2 has the git processes serving fetches and pushes write trace2
+	// events, whose key timings, such as the phases of pack-objects, and
+	// object counts are logged with the request
+	Trace2 bool
+
+	// Tracing exports a span for every fetch and push request, with the git
+	// processes serving it and their trace2 regions as child spans, when
+	// set
+	Tracing *OTLPExporter
+
+	// AdvertiseSessionID has git ask clients for the session-id
+	// capability, which is logged with their requests and recorded in the
+	// journal and push events, to correlate the requests and retries of a
+	// fetch or push
+	AdvertiseSessionID bool
+
+	// OwnerQuota limits the disk space the repositories of each owner,
+	// the first directory of their path, take together. OwnerQuotas holds
+	// the quotas of some owners. Zero means no limit.
+	OwnerQuota  int64
+	OwnerQuotas map[string]int64
+
+	MaxUploadPackBodySize  int64
+	MaxReceivePackBodySize int64
+
+	UploadPackTimeout  time.Duration
+	ReceivePackTimeout time.Duration
+
+	RelayStderr bool
+
+	// TextCache applies to HEAD, info/packs, alternates and dumb info/refs,
+	// ObjectCache to loose objects, packs and their indexes
+	TextCache   CachePolicy
+	ObjectCache CachePolicy
+
+	PackObjectsCacheDir string
+	PackObjectsCacheTTL time.Duration
+
+	// IdentityFunc returns the authenticated user of a request, nil meaning
+	// an anonymous request. It defaults to IdentityFromContext; set it to
+	// read the user from wherever the surrounding middleware stores it.
+	IdentityFunc func(r *http.Request) *Identity
+
+	// OnRequestStart and OnRequestEnd are called before and after every
+	// repository request is handled, including those refused, such as for
+	// accounting or anomaly detection
+	OnRequestStart func(r *http.Request, ev RequestEvent)
+	OnRequestEnd   func(r *http.Request, ev RequestEvent)
+
+	// Backend serves upload-pack and receive-pack, defaulting to the git
+	// binary
+	Backend Backend
+
+	// Storage gives access to repository files, defaulting to the local
+	// disk
+	Storage Storage
+
+	// Cache holds the refs cache, defaulting to memory local to the
+	// process. Set it to a shared cache such as a RedisCache when running
+	// several servers behind a load balancer.
+	Cache Cache
+
+	// EventPublisher receives an event for every push updating refs. Events
+	// are spooled in EventSpoolDir until the publisher accepts them.
+	EventPublisher Publisher
+	EventSpoolDir  string
+
+	// Journal records every ref update pushed, when set
+	Journal Journal
+
+	// Access decides who may read and write which repository. Everyone
+	// may access every repository when it is nil.
+	Access AccessChecker
+
+	// Protection rejects pushes breaking its rules, when set
+	Protection *BranchProtection
+
+	// MaxBlobSize rejects pushes introducing larger blobs, zero meaning no
+	// limit
+	MaxBlobSize int64
+
+	// PushCertKeyring is the GPG keyring signed pushes are verified
+	// against. Setting it makes receive-pack advertise push-cert, with
+	// nonces derived from PushCertNonceSeed and valid for PushCertSlop.
+	// Servers behind one load balancer need the same seed.
+	PushCertKeyring   string
+	PushCertNonceSeed string
+	PushCertSlop      time.Duration
+	// RequireSignedPush lists path.Match patterns of repositories only
+	// accepting signed pushes
+	RequireSignedPush []string
+
+	// CommitKeyring and CommitAllowedSigners hold the GPG and SSH keys
+	// commits need to be signed with where protection rules require it
+	CommitKeyring        string
+	CommitAllowedSigners string
+
+	// RequireDCO lists path.Match patterns of repositories whose new
+	// commits need a Signed-off-by of the pusher, or of their author for
+	// pushers without email. DCOExemptMerges skips merge commits.
+	RequireDCO      []string
+	DCOExemptMerges bool
+
+	// PushPolicies are consulted on every push after the built-in ones
+	PushPolicies []PushPolicy
+
+	// GitConfig holds "key=value" overrides git runs with for every
+	// repository, RepoGitConfig those for some of them
+	GitConfig     []string
+	RepoGitConfig []RepoGitConfig
+
+	// SHAInWant lets upload-pack serve objects asked for by name that no
+	// advertised ref points to, one of SHAInWantOff, SHAInWantTip and
+	// SHAInWantReachable. Empty leaves it to the git config.
+	SHAInWant string
+
+	// UpdateServerInfo regenerates info/refs and objects/info/packs of
+	// repositories after every push and maintenance run, for dumb HTTP
+	// clients and static mirrors served off the same storage. Repository
+	// settings may override it.
+	UpdateServerInfo bool
+
+	// GitPath is the git binary every git command runs, the one found in
+	// PATH when empty. GitArgs holds extra arguments of git commands by
+	// command name, such as "upload-pack": {"--timeout=600"}.
+	GitPath string
+	GitArgs map[string][]string
+
+	// GitEnv holds "KEY=value" pairs set in the environment of every git
+	// process. Of the server's own environment only the variables matching
+	// GitEnvPassthrough, DefaultGitEnvPassthrough when nil, are forwarded.
+	GitEnv            []string
+	GitEnvPassthrough []string
+
+	// HiddenRefs are kept from clients other than admins sending the admin
+	// token in the X-Show-Hidden-Refs header
+	HiddenRefs []HiddenRefs
+
+	// Namespaces serves the git namespace given in /<repo>/ns/<namespace>/
+	// URLs or the Git-Namespace header, letting several logical
+	// repositories share the objects of one
+	Namespaces bool
+
+	// MOTD is the message of the day shown by git on every fetch and push,
+	// before the one in the motd file of the repository
+	MOTD string
+
+	// PushSummary shows pushers the refs their push updated, along with
+	// PushSummaryURL for each of them, in which {repo}, {ref} and {new}
+	// are replaced, such as the page of the CI pipeline run for it
+	PushSummary    bool
+	PushSummaryURL string
+
+	// ServerHeader and GitServerHeader are sent as the Server and
+	// X-Git-Server headers of every response, unless empty
+	ServerHeader    string
+	GitServerHeader string
+
+	// Listeners are the addresses the server listens on, instead of Port
+	// when set
+	Listeners []Listener
+
+	// DrainTimeout is how long the requests being served may take to finish
+	// when the server stops or upgrades, without limit when zero
+	DrainTimeout time.Duration
+
+	// PrimaryURL makes the server a replica serving fetches itself and
+	// forwarding pushes to the primary server at this URL
+	PrimaryURL string
+
+	// UpstreamURL makes the server a caching proxy of the server at this
+	// URL, mirroring repositories from it when they are first fetched and
+	// refreshing mirrors older than UpstreamTTL in the background. Ref
+	// advertisements of mirrors older than UpstreamSyncAge wait up to
+	// UpstreamSyncTimeout for a refresh, zero disabling the wait.
+	UpstreamURL         string
+	UpstreamTTL         time.Duration
+	UpstreamSyncAge     time.Duration
+	UpstreamSyncTimeout time.Duration
+
+	// RepoStatsPath is the file usage statistics of every repository are
+	// kept in, served at /api/repos/<repo>/stats, when set
+	RepoStatsPath string
+
+	// BackupBucket makes the server write bundles of every repository to
+	// the bucket every BackupInterval, below BackupPrefix. Full bundles are
+	// written every BackupFullInterval and incremental ones in between.
+	// Backups no longer needed to restore a state within BackupRetention
+	// are deleted, zero keeping them all.
+	BackupBucket       *S3Bucket
+	BackupPrefix       string
+	BackupInterval     time.Duration
+	BackupFullInterval time.Duration
+	BackupRetention    time.Duration
+
+	// TierBucket makes the server move the packs of repositories unused
+	// for TierAge to the bucket, below TierPrefix, checking every
+	// TierInterval. They are fetched back when the repository is served
+	// again, unless TierRedirect redirects dumb HTTP downloads of them to
+	// the bucket instead.
+	TierBucket   *S3Bucket
+	TierPrefix   string
+	TierAge      time.Duration
+	TierInterval time.Duration
+	TierRedirect bool
+
+	// PruneRefs are the patterns, as git for-each-ref takes them, of the
+	// refs deleted from repositories when their commit is older than
+	// PruneRefsAge, along with the remote-tracking refs of mirrors whose
+	// branch is gone upstream. Refs are pruned through the API, and every
+	// PruneRefsInterval unless zero, only logging what would be deleted
+	// with PruneRefsDryRun.
+	PruneRefs         []string
+	PruneRefsAge      time.Duration
+	PruneRefsInterval time.Duration
+	PruneRefsDryRun   bool
+
+	// JanitorInterval is how often lock files, quarantine directories and
+	// temporary packs older than JanitorAge are removed from repositories,
+	// zero disabling the cleanup. JanitorDryRun only logs what would be
+	// removed.
+	JanitorInterval time.Duration
+	JanitorAge      time.Duration
+	JanitorDryRun   bool
+
+	// SlowRequestThreshold logs requests taking longer, with the git
+	// commands they ran, zero disabling the slow request log
+	SlowRequestThreshold time.Duration
+
+	// AdminToken is the bearer token guarding the admin API, which is only
+	// served when it is set
+	AdminToken string
 }
 
 // GitSmartHTTP acts as an Git Smart HTTP server's handler and deal
@@ -71,12 +360,182 @@ type GitSmartHTTPConfig struct {
 type GitSmartHTTP struct {
 	Services []Service
 	*GitSmartHTTPConfig
+	refsCache *refsCache
+	packCache *packCache
+	processes *ProcessManager
+	transfers *transferStats
+	repoStats *repoStats
+	catFiles  *catFilePool
+	bandwidth *bandwidth
+	events    *eventSpool
+	policies  []PushPolicy
+	gitConfig []string
+	primary   *httputil.ReverseProxy
+	upstream  *upstreamMirror
+	backups   *bundleBackups
+	tiering   *packTiering
+	details   *repoDetailsCache
+	gcs       *gcJobs
+	prunes    *refPruner
+	quotas    *ownerQuotas
+	fscks     *fsckRuns
+	settings  *repoSettingsCache
+
+	commitKeys   *commitKeys
+	negotiations *negotiationCache
+	clients      *clientLimiter
+	repoLocks    *repoLocks
+
+	middlewares []func(http.Handler) http.Handler
 }
 
 // NewGitSmartHTTP returns a GitSmartHTTP
 func NewGitSmartHTTP(cfg *GitSmartHTTPConfig) GitSmartHTTP {
 	gsh := GitSmartHTTP{
 		GitSmartHTTPConfig: cfg,
+		processes:          NewProcessManager(cfg.MaxProcesses),
+		transfers:          newTransferStats(),
+		settings:           newRepoSettingsCache(),
+		details:            newRepoDetailsCache(),
+		bandwidth:          newBandwidth(),
+	}
+
+	gsh.processes.MaxQueued = cfg.MaxQueuedProcesses
+	gsh.processes.QueueTimeout = cfg.QueueTimeout
+	gsh.processes.GitPath = cfg.GitPath
+	gsh.processes.GitEnv = cfg.GitEnv
+	gsh.processes.GitEnvPassthrough = cfg.GitEnvPassthrough
+	gsh.fscks = newFsckRuns(gsh.processes)
+
+	if cfg.Cache == nil {
+		cfg.Cache = NewMemoryCache()
+	}
+
+	if cfg.RefsCache {
+		gsh.refsCache = newRefsCache(cfg.Cache)
+	}
+
+	if cfg.CatFileBatch {
+		gsh.catFiles = newCatFilePool(gsh.processes, 5*time.Minute)
+	}
+
+	if cfg.PrimaryURL != "" {
+		proxy, err := newPrimaryProxy(cfg.PrimaryURL)
+		if err != nil {
+			log.Printf("Cannot forward pushes to the primary: %s", err)
+		} else {
+			gsh.primary = proxy
+		}
+	}
+
+	if cfg.UpstreamURL != "" {
+		gsh.upstream = newUpstreamMirror(gsh.processes, cfg.UpstreamURL, cfg.UpstreamTTL, cfg.UpstreamSyncAge, cfg.UpstreamSyncTimeout)
+	}
+
+	if cfg.RepoStatsPath != "" {
+		stats, err := loadRepoStats(cfg.RepoStatsPath)
+		if err != nil {
+			log.Printf("Cannot load repository statistics from %s: %s", cfg.RepoStatsPath, err)
+		} else {
+			gsh.repoStats = stats
+			go stats.run()
+		}
+	}
+
+	if cfg.PackCacheDir != "" {
+		gsh.packCache = newPackCache(cfg.PackCacheDir, cfg.PackCacheTTL)
+	}
+	gsh.repoLocks = newRepoLocks()
+	if cfg.MaxClientRequests > 0 {
+		gsh.clients = newClientLimiter(cfg.MaxClientRequests)
+	}
+	if cfg.NegotiationCacheTTL > 0 {
+		store := cfg.Cache
+		if _, ok := store.(*memoryCache); ok {
+			size := cfg.NegotiationCacheSize
+			if size <= 0 {
+				size = DefaultNegotiationCacheSize
+			}
+			store = NewMemoryCacheSize(0, size)
+		}
+		gsh.negotiations = newNegotiationCache(store, cfg.NegotiationCacheTTL)
+	}
+
+	// Let receive-pack accept git push -o, so the options reach the push
+	// checks, events and hooks
+	gsh.gitConfig = append(gsh.gitConfig, "receive.advertisePushOptions=true")
+	if cfg.AdvertiseSessionID {
+		gsh.gitConfig = append(gsh.gitConfig, "transfer.advertiseSID=true")
+	}
+
+	if cfg.PushCertKeyring != "" {
+		if cfg.PushCertNonceSeed == "" {
+			seed := make([]byte, 32)
+			rand.Read(seed)
+			cfg.PushCertNonceSeed = hex.EncodeToString(seed)
+		}
+		gsh.gitConfig = append(gsh.gitConfig,
+			"receive.certNonceSeed="+cfg.PushCertNonceSeed,
+			fmt.Sprintf("receive.certNonceSlop=%d", int(cfg.PushCertSlop.Seconds())))
+	}
+
+	var keys *commitKeys
+	if cfg.CommitKeyring != "" || cfg.CommitAllowedSigners != "" {
+		var err error
+		keys, err = newCommitKeys(cfg.CommitKeyring, cfg.CommitAllowedSigners)
+		if err != nil {
+			log.Printf("Cannot set up commit signature verification: %s", err)
+		}
+	}
+	gsh.commitKeys = keys
+	gsh.policies = pushPolicies(cfg, keys)
+
+	if cfg.PackObjectsCacheDir != "" {
+		hook, err := packObjectsHookConfig(cfg.PackObjectsCacheDir, cfg.PackObjectsCacheTTL)
+		if err != nil {
+			log.Printf("Cannot set up the pack-objects hook: %s", err)
+		} else {
+			gsh.gitConfig = append(gsh.gitConfig, hook)
+			go func() {
+				for range time.Tick(cfg.PackObjectsCacheTTL) {
+					pruneCacheDir(cfg.PackObjectsCacheDir, cfg.PackObjectsCacheTTL)
+				}
+			}()
+		}
+	}
+
+	if cfg.EventPublisher != nil {
+		spoolDir := cfg.EventSpoolDir
+		if spoolDir == "" {
+			spoolDir = filepath.Join(os.TempDir(), "git-http-backend-events")
+		}
+		events, err := newEventSpool(spoolDir, cfg.EventPublisher)
+		if err != nil {
+			log.Printf("Cannot set up the event spool: %s", err)
+		} else {
+			gsh.events = events
+		}
+	}
+
+	if cfg.TierBucket != nil {
+		gsh.tiering = newPackTiering(gsh, cfg.TierBucket, cfg.TierPrefix, cfg.TierAge, cfg.TierRedirect)
+		go gsh.tiering.run(cfg.TierInterval)
+	}
+	if cfg.BackupBucket != nil {
+		gsh.backups = newBundleBackups(gsh, cfg.BackupBucket, cfg.BackupPrefix, cfg.BackupInterval, cfg.BackupFullInterval, cfg.BackupRetention)
+		go gsh.backups.run()
+	}
+	gsh.gcs = newGCJobs(gsh)
+	gsh.prunes = newRefPruner(gsh, cfg.PruneRefs, cfg.PruneRefsAge)
+	if cfg.OwnerQuota > 0 || len(cfg.OwnerQuotas) > 0 {
+		gsh.quotas = newOwnerQuotas(gsh, cfg.OwnerQuota, cfg.OwnerQuotas)
+	}
+	if cfg.PruneRefsInterval > 0 {
+		go gsh.prunes.run(cfg.PruneRefsInterval, cfg.PruneRefsDryRun)
+	}
+
+	if cfg.JanitorInterval > 0 {
+		go janitor{gsh: gsh, age: cfg.JanitorAge, dryRun: cfg.JanitorDryRun}.run(cfg.JanitorInterval)
 	}
 
 	gsh.Services = []Service{
@@ -84,51 +543,61 @@ func NewGitSmartHTTP(cfg *GitSmartHTTPConfig) GitSmartHTTP {
 			Method:  "GET",
 			Pattern: regexp.MustCompile("(?P<repoPath>.*)/HEAD$"),
 			Handler: gsh.handleTextFile,
+			route:   RouteObjects,
 		},
 		Service{
 			Method:  "GET",
 			Pattern: regexp.MustCompile("(?P<repoPath>.*)/info/packs$"),
 			Handler: gsh.handleInfoPacks,
+			route:   RouteObjects,
 		},
 		Service{
 			Method:  "GET",
 			Pattern: regexp.MustCompile("(?P<repoPath>.*)/info/refs$"),
 			Handler: gsh.handleInfoRefs,
+			route:   RouteInfoRefs,
 		},
 		Service{
 			Method:  "GET",
 			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/info/alternates$"),
 			Handler: gsh.handleTextFile,
+			route:   RouteObjects,
 		},
 		Service{
 			Method:  "GET",
 			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/info/http-alternates$"),
 			Handler: gsh.handleTextFile,
+			route:   RouteObjects,
 		},
 		Service{
 			Method:  "GET",
-			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/[0-9a-f]{2}/[0-9a-f]{38}$"),
+			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/(?P<objectDir>[0-9a-f]{2})/(?P<objectFile>[0-9a-f]{38})$"),
 			Handler: gsh.handleLooseObject,
+			route:   RouteObjects,
 		},
 		Service{
 			Method:  "GET",
 			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/pack/pack-[0-9a-f]{40}\\.pack$"),
 			Handler: gsh.handlePackFile,
+			route:   RouteObjects,
 		},
 		Service{
 			Method:  "GET",
 			Pattern: regexp.MustCompile("(?P<repoPath>.*)/objects/pack/pack-[0-9a-f]{40}\\.idx$"),
 			Handler: gsh.handleIdxFile,
+			route:   RouteObjects,
 		},
 		Service{
 			Method:  "POST",
 			Pattern: regexp.MustCompile("(?P<repoPath>.*)/(?P<serviceType>git-upload-pack)$"),
 			Handler: gsh.handleServiceRPC,
+			route:   RouteUploadPack,
 		},
 		Service{
 			Method:  "POST",
 			Pattern: regexp.MustCompile("(?P<repoPath>.*)/(?P<serviceType>git-receive-pack)$"),
 			Handler: gsh.handleServiceRPC,
+			route:   RouteReceivePack,
 		},
 	}
 	return gsh
@@ -136,39 +605,255 @@ func NewGitSmartHTTP(cfg *GitSmartHTTPConfig) GitSmartHTTP {
 
 // ServerHttp implements the iServerHttp nterface of http.Handler
 func (gsh GitSmartHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gsh.serve(w, r, nil)
+}
+
+// Middleware returns a handler that serves the Git requests among the ones
+// it receives and passes everything else on to next, so that GitSmartHTTP
+// can be mounted inside an existing router and middleware stack.
+func (gsh GitSmartHTTP) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gsh.serve(w, r, next)
+	})
+}
+
+// Register adds a service handling requests with the method whose path
+// matches pattern, a regular expression with a repoPath group capturing the
+// repository, such as "(?P<repoPath>.*)/info/lfs/objects/batch$". Requests
+// go through the same repository resolution, access checks and logging as
+// Git requests before reaching handler, which finds the repository with
+// s.ParseURLNamedParams(r)["repoPath"]. Requests other than GET and HEAD
+// need write access. Register panics when pattern is invalid, and must be
+// called before the server starts serving.
+func (gsh *GitSmartHTTP) Register(method, pattern string, handler func(s Service, w http.ResponseWriter, r *http.Request)) {
+	re := regexp.MustCompile(pattern)
+	if re.SubexpIndex("repoPath") < 0 {
+		panic("git-http-backend: pattern " + pattern + " has no repoPath group")
+	}
+	gsh.Services = append(gsh.Services, Service{
+		Method:  method,
+		Pattern: re,
+		Handler: handler,
+		Write:   method != "GET" && method != "HEAD",
+	})
+}
+
+// Use adds middleware wrapping the handling of every request matching a
+// service, the first added being the outermost. Middleware runs once the
+// repository is resolved, before access checks, and finds the repository
+// and operation of the request with RequestInfoFromContext. Use must be
+// called before the server starts serving.
+func (gsh *GitSmartHTTP) Use(middleware ...func(http.Handler) http.Handler) {
+	gsh.middlewares = append(gsh.middlewares, middleware...)
+}
+
+// serve dispatches the request to the service matching it. Requests matching
+// no service are passed on to next, or answered with 404 when next is nil.
+func (gsh GitSmartHTTP) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	r, nsErr := gsh.withNamespace(r)
+	r = withGitProtocol(r)
+
+	var matched *Service
+	var allowed []string
+	for i, service := range gsh.Services {
+		if !service.Pattern.MatchString(r.URL.Path) {
+			continue
+		}
+		if service.allowsMethod(r.Method) {
+			matched = &gsh.Services[i]
+			break
+		}
+		allowed = append(allowed, service.methods()...)
+	}
+
+	if matched == nil && len(allowed) == 0 && next != nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	if gsh.ServerHeader != "" {
+		w.Header().Set("Server", gsh.ServerHeader)
+	}
+	if gsh.GitServerHeader != "" {
+		w.Header().Set("X-Git-Server", gsh.GitServerHeader)
+	}
+
 	// Log request
-	log.Printf(`%s - - "%s %s %s"`, r.RemoteAddr, r.Method, r.URL.Path, r.Proto)
-
-	for _, service := range gsh.Services {
-		if service.Pattern.MatchString(r.URL.Path) {
-			if r.Method == service.Method {
-				service.Handler(service, w, r)
-			} else {
-				methodNotAllowed(w, r)
+	user := "-"
+	if id := gsh.identity(r); id != nil {
+		user = id.Name
+	}
+	if ns := namespace(r.Context()); ns != "" {
+		log.Printf(`%s - %s "%s %s %s" ns=%s`, r.RemoteAddr, user, r.Method, r.URL.Path, r.Proto, ns)
+	} else {
+		log.Printf(`%s - %s "%s %s %s"`, r.RemoteAddr, user, r.Method, r.URL.Path, r.Proto)
+	}
+
+	if matched == nil {
+		if len(allowed) > 0 {
+			methodNotAllowed(w, r, allowed)
+			return
+		}
+		writeErrorMessage(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	if nsErr != nil {
+		writeError(w, r, nsErr)
+		return
+	}
+
+	// Responses of dumb HTTP are files, their timeout bounds the time
+	// writing them takes
+	if route := requestRoute(*matched, r); route == RouteObjects {
+		if timeout := gsh.routePolicy(route, "").Timeout; timeout > 0 {
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+		}
+	}
+
+	// Everything from here on goes by the cleaned name of the repository,
+	// the handlers too as the path is rewritten to it
+	urlRepo := matched.ParseURLNamedParams(r)["repoPath"]
+	repo, err := cleanRepo(urlRepo)
+	if err == nil {
+		repo, err = gsh.normalizeRepo(repo)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if repo != urlRepo {
+		u := *r.URL
+		u.Path = repo + strings.TrimPrefix(r.URL.Path, urlRepo)
+
+		if gsh.GitSuffix == GitSuffixRedirect {
+			status := http.StatusMovedPermanently
+			if r.Method == "POST" {
+				status = http.StatusPermanentRedirect
 			}
-			break
+			http.Redirect(w, r, u.String(), status)
+			return
+		}
+
+		r = r.WithContext(r.Context())
+		r.URL = &u
+	}
+
+	release, ok := gsh.limitClient(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	s := *matched
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gsh.serveRepo(s, w, r, repo)
+	})
+	for i := len(gsh.middlewares) - 1; i >= 0; i-- {
+		h = gsh.middlewares[i](h)
+	}
+	info := RequestInfo{Repo: strings.TrimPrefix(repo, "/"), Operation: requestOperation(s, r), Namespace: namespace(r.Context())}
+	if route := requestRoute(s, r); gsh.repoStats != nil && (route == RouteInfoRefs || route == RouteObjects) {
+		// Fetches and pushes are counted once their transfer finishes
+		out := &countingResponseWriter{ResponseWriter: w}
+		w = out
+		defer func() {
+			if out.status < http.StatusBadRequest {
+				gsh.repoStats.recordBytes(info.Repo, out.n, 0)
+			}
+		}()
+	}
+	gsh.serveWithCallbacks(h, w, r.WithContext(context.WithValue(r.Context(), requestInfoContextKey{}, info)), info)
+}
+
+// serveRepo serves the request for the repository with the service
+// matching it
+func (gsh GitSmartHTTP) serveRepo(matched Service, w http.ResponseWriter, r *http.Request, repo string) {
+	if readOnlyListener(r.Context()) && requestOperation(matched, r) == OpWrite {
+		writeError(w, r, ErrServiceDisabled)
+		return
+	}
+
+	// A replica leaves pushes, with their authentication, to the primary
+	if gsh.primary != nil && requestOperation(matched, r) == OpWrite {
+		gsh.primary.ServeHTTP(w, r)
+		return
+	}
+
+	repoPath := gsh.localPath(repo)
+	r = gsh.showHiddenRefs(r)
+	// Check access first, so that denied users cannot probe which
+	// repositories exist.
+	r, err := gsh.checkAccess(matched, r, repo)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if gsh.upstream != nil && requestOperation(matched, r) == OpRead && gsh.insideRoot(repoPath) {
+		if err := gsh.upstream.ensure(r.Context(), repo, repoPath, strings.HasSuffix(r.URL.Path, "/info/refs")); err != nil {
+			writeError(w, r, err)
+			return
 		}
 	}
+
+	if err := gsh.validateRepo(repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if gsh.tiering != nil && !gsh.tiering.ready(w, r, repo, repoPath) {
+		return
+	}
+
+	if gsh.SlowRequestThreshold > 0 {
+		gsh.serveTimed(matched, w, r, repo)
+		return
+	}
+	matched.Handler(matched, w, r)
 }
 
 func (gsh GitSmartHTTP) handleTextFile(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "text/plain", hdrNoCache())
+	gsh.sendFile(s, w, r, "text/plain", gsh.TextCache.headers())
 }
 
 func (gsh GitSmartHTTP) handleInfoPacks(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "text/plain; charset=utf-8", hdrNoCache())
+	gsh.sendFile(s, w, r, "text/plain; charset=utf-8", gsh.TextCache.headers())
 }
 
 func (gsh GitSmartHTTP) handleLooseObject(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "application/x-git-loose-object", hdrCacheForever())
+	if gsh.catFiles == nil {
+		gsh.sendFile(s, w, r, "application/x-git-loose-object", gsh.ObjectCache.headers())
+		return
+	}
+
+	namedURLParams := s.ParseURLNamedParams(r)
+	repoPath := gsh.localPath(namedURLParams["repoPath"])
+	oid := namedURLParams["objectDir"] + namedURLParams["objectFile"]
+
+	// The object is streamed once found, a missing one still becoming a 404
+	found := false
+	tw := gsh.bandwidth.Throttle(w, r, RouteObjects, repoPath, gsh.routePolicy(RouteObjects, ""))
+	err := gsh.catFiles.WriteLooseObject(tw, repoPath, oid, func() {
+		found = true
+		setHeaders(w, gsh.ObjectCache.headers())
+		w.Header().Set("Content-Type", "application/x-git-loose-object")
+	})
+	if err != nil && err != errObjectMissing {
+		log.Printf("Cannot read object %s: %s", oid, err)
+	}
+	if err != nil && !found {
+		writeErrorMessage(w, r, http.StatusNotFound, "not found")
+	}
 }
 
 func (gsh GitSmartHTTP) handlePackFile(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "application/x-git-packed-objects", hdrCacheForever())
+	gsh.sendFile(s, w, r, "application/x-git-packed-objects", gsh.ObjectCache.headers())
 }
 
 func (gsh GitSmartHTTP) handleIdxFile(s Service, w http.ResponseWriter, r *http.Request) {
-	gsh.sendFile(w, r, "application/x-git-packed-objects-toc", hdrCacheForever())
+	gsh.sendFile(s, w, r, "application/x-git-packed-objects-toc", gsh.ObjectCache.headers())
 }
 
 func (gsh GitSmartHTTP) handleInfoRefs(s Service, w http.ResponseWriter, r *http.Request) {
@@ -177,92 +862,512 @@ func (gsh GitSmartHTTP) handleInfoRefs(s Service, w http.ResponseWriter, r *http
 	serviceType := r.FormValue("service")
 
 	namedURLParams := s.ParseURLNamedParams(r)
-	repoPath := path.Join(gsh.ReposRootPath, namedURLParams["repoPath"])
+	repoPath := gsh.localPath(namedURLParams["repoPath"])
 
-	gs := NewGitRPCClient(&GitRPCClientConfig{
-		Stream: false,
-	})
+	if serviceType != "" && serviceType != uploadPack && serviceType != receivePack {
+		writeError(w, r, ErrUnknownService)
+		return
+	}
+
+	if serviceType != "" && !gsh.serviceAccess(repoPath, serviceType) {
+		writeError(w, r, ErrServiceDisabled)
+		return
+	}
+	if serviceType != "" {
+		w = gsh.bandwidth.Throttle(w, r, RouteInfoRefs, repoPath, gsh.routePolicy(RouteInfoRefs, serviceType))
+	}
 
-	if gsh.serviceAccess(serviceType) {
+	streamer, streams := gsh.backend().(RefsStreamer)
+	if serviceType != "" && streams && !gsh.cachesRefs(r.Context()) {
 		w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", serviceType))
 		setHeaders(w, hdrNoCache())
+
+		out := &advertisementWriter{w: w, prefix: pktWrite(fmt.Sprintf("# service=%s\n", serviceType)) + pktFlush()}
+		err := streamer.StreamRefs(r.Context(), repoPath, serviceType, out)
+		if err != nil && !out.started {
+			w.Header().Del("Content-Type")
+			writeError(w, r, err)
+			return
+		}
+		out.flush()
+	} else if serviceType != "" {
+		refs, err := gsh.advertiseRefs(r.Context(), repoPath, serviceType)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		prefix := pktWrite(fmt.Sprintf("# service=%s\n", serviceType)) + pktFlush()
+
+		w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", serviceType))
+		w.Header().Set("Content-Length", strconv.Itoa(len(prefix)+len(refs)))
+		setHeaders(w, hdrNoCache())
 		w.WriteHeader(http.StatusOK)
 
-		rpcCfg := map[string]struct{}{
-			"advertise_refs": struct{}{},
+		fmt.Fprint(w, prefix)
+		w.Write(refs)
+	} else {
+		if err := gsh.updateServerInfo(r.Context(), repoPath); err != nil {
+			log.Printf("Cannot update server info of %s: %s", repoPath, err)
 		}
 
-		if serviceType == uploadPack {
-			gs.UploadPack(repoPath, rpcCfg)
-		} else {
-			gs.ReceivePack(repoPath, rpcCfg)
+		gsh.sendFile(s, w, r, "text/plain; charset=utf-8", gsh.TextCache.headers())
+	}
+}
+
+// advertisementFlushSize is how much of a streamed ref advertisement is
+// written before it is flushed to the client
+const advertisementFlushSize = 64 << 10
+
+// advertisementWriter streams a ref advertisement to the client, starting
+// the response with the service preamble once git writes the first bytes,
+// so that git failing right away can still be reported with a status.
+type advertisementWriter struct {
+	w         http.ResponseWriter
+	prefix    string
+	started   bool
+	unflushed int
+}
+
+func (a *advertisementWriter) Write(p []byte) (int, error) {
+	if !a.started {
+		a.started = true
+		a.w.WriteHeader(http.StatusOK)
+		if _, err := io.WriteString(a.w, a.prefix); err != nil {
+			return 0, err
 		}
-		refs, _ := gs.Output()
+	}
+	n, err := a.w.Write(p)
+	a.unflushed += n
+	if a.unflushed >= advertisementFlushSize {
+		a.flush()
+	}
+	return n, err
+}
 
-		fmt.Fprint(w, pktWrite(fmt.Sprintf("# service=%s\n", serviceType)))
-		fmt.Fprint(w, pktFlush())
-		w.Write(refs)
+func (a *advertisementWriter) flush() {
+	if a.started && a.unflushed > 0 {
+		http.NewResponseController(a.w).Flush()
+		a.unflushed = 0
+	}
+}
+
+// advertiseRefs returns the ref advertisement of the repository for the
+// given service, served from the refs cache when it is enabled and the refs
+// of the repository have not changed since.
+func (gsh GitSmartHTTP) advertiseRefs(ctx context.Context, repoPath, serviceType string) ([]byte, error) {
+	var stamp time.Time
+	if gsh.cachesRefs(ctx) {
+		stamp = refsStamp(gsh.storage(), repoPath)
+		if refs, ok := gsh.refsCache.Get(repoPath, refsCacheService(ctx, serviceType), stamp); ok {
+			return refs, nil
+		}
+	}
+
+	refs, err := gsh.backend().AdvertiseRefs(ctx, repoPath, serviceType)
+	if err != nil {
+		return nil, err
+	}
+
+	if gsh.refsCache != nil && !stamp.IsZero() {
+		gsh.refsCache.Set(repoPath, refsCacheService(ctx, serviceType), stamp, refs)
+	}
+	return refs, nil
+}
+
+// spawnAdvertiseRefs runs git to advertise the refs of the repository
+func (gsh GitSmartHTTP) spawnAdvertiseRefs(ctx context.Context, repoPath, serviceType string) ([]byte, error) {
+	var refs bytes.Buffer
+	if err := gsh.streamAdvertiseRefs(ctx, repoPath, serviceType, &refs); err != nil {
+		return nil, err
+	}
+	return refs.Bytes(), nil
+}
+
+// streamAdvertiseRefs runs git to advertise the refs of the repository,
+// copying the advertisement to out as git writes it
+func (gsh GitSmartHTTP) streamAdvertiseRefs(ctx context.Context, repoPath, serviceType string, out io.Writer) error {
+	gs := gsh.processes.NewGitRPCClient(&GitRPCClientConfig{
+		Stream:    true,
+		Args:      gsh.GitArgs,
+		GitConfig: gsh.repoGitConfig(ctx, repoPath),
+		Env:       append(namespaceEnv(ctx), gitProtocolEnv(ctx)...),
+		Timeout:   gsh.routePolicy(RouteInfoRefs, serviceType).Timeout,
+	})
+	defer gs.Close()
+
+	opts := RPCOptions{AdvertiseRefs: true}
+	if serviceType == uploadPack {
+		gs.UploadPack(repoPath, opts)
 	} else {
-		gs.UploadPack(repoPath, map[string]struct{}{})
-		gs.Output()
+		gs.ReceivePack(repoPath, opts)
+	}
+	noteCommand(ctx, gs.CommandLine())
+
+	if err := gs.Start(ctx); err != nil {
+		return err
+	}
+	gs.StdinWriter.Close()
 
-		gsh.sendFile(w, r, "text/plain; charset=utf-8", hdrNoCache())
+	var stderr bytes.Buffer
+	stderrDone := make(chan struct{})
+	go func() {
+		copyBuffer(&stderr, gs.StderrReader)
+		close(stderrDone)
+	}()
+
+	if _, err := copyBuffer(out, gs.StdoutReader); err != nil {
+		return err
+	}
+	<-stderrDone
+
+	if err := gs.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return err
 	}
+	return nil
 }
 
 func (gsh GitSmartHTTP) handleServiceRPC(s Service, w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	namedURLParams := s.ParseURLNamedParams(r)
+	// Policies, quotas and statistics go by the name serve checked access
+	// to, not by what the request path spelled
+	info, _ := RequestInfoFromContext(r.Context())
+	repo := info.Repo
+	repoPath := gsh.localPath(repo)
+	serviceType := s.ParseURLNamedParams(r)["serviceType"]
 
-	repoPath := path.Join(gsh.ReposRootPath, namedURLParams["repoPath"])
-	serviceType := namedURLParams["serviceType"]
+	if !gsh.serviceAccess(repoPath, serviceType) {
+		writeError(w, r, ErrServiceDisabled)
+		return
+	}
+
+	if r.Header.Get("Content-Type") != fmt.Sprintf("application/x-%s-request", serviceType) {
+		writeError(w, r, ErrContentType)
+		return
+	}
 
-	if !gsh.serviceAccess(serviceType) {
-		w.WriteHeader(http.StatusForbidden)
-		w.Header().Set("Content-Type", "text/plain")
+	// Checks needing nothing but the headers come before the body is first
+	// read, which is when the 100 Continue clients sending "Expect:
+	// 100-continue" wait for goes out, so that pushes bound to be refused
+	// are refused before their pack is uploaded. Go closes the connection
+	// after the error instead of reading the body it never asked for.
+	settings := gsh.repoSettings(repoPath)
+	limit := gsh.maxBodySize(settings, serviceType)
+	if limit > 0 && r.ContentLength > limit {
+		writeError(w, r, &http.MaxBytesError{Limit: limit})
 		return
 	}
 
-	var reqBody []byte
+	if serviceType == receivePack && gsh.quotas != nil {
+		if err := gsh.quotas.check(repo, r.ContentLength); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	var body io.Reader = r.Body
 
 	switch r.Header.Get("Content-Encoding") {
 	case "gzip":
 		reader, err := gzip.NewReader(r.Body)
 		if err != nil {
 			log.Printf("Cannot parse request body with: %s", err)
-			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeErrorMessage(w, r, http.StatusUnprocessableEntity, "invalid gzip body")
 			return
 		}
 		defer reader.Close()
-		reqBody, _ = ioutil.ReadAll(reader)
-	default:
-		reqBody, _ = ioutil.ReadAll(r.Body)
+		body = reader
 	}
 
-	gs := NewGitRPCClient(&GitRPCClientConfig{
-		Stream: true,
-	})
+	tr := newTransfer(serviceType, repo, body)
+	body = tr
+	if gsh.Tracing != nil {
+		tr.span = startSpan(r, r.Method+" "+serviceType)
+		tr.span.Attrs["url.path"] = r.URL.Path
+		tr.span.Attrs["git.repo"] = tr.repo
+	}
+	out := &writeTracker{}
+	defer gsh.finishTransfer(r, tr, out)
+
+	if limit > 0 {
+		body = http.MaxBytesReader(w, ioutil.NopCloser(body), limit)
+	}
+
+	var push pushRequest
+	var policies []PushPolicy
+	if serviceType == receivePack {
+		policies = gsh.pushPoliciesFor(repo, settings)
+	}
+	if serviceType == receivePack && (gsh.events != nil || gsh.Journal != nil || gsh.PushSummary || gsh.AdvertiseSessionID || len(policies) > 0) {
+		var err error
+		push, body, err = readPushRequest(body)
+		if err != nil && len(policies) > 0 {
+			// git would apply what it makes of the request unchecked
+			var maxBytesErr *http.MaxBytesError
+			if !errors.As(err, &maxBytesErr) {
+				err = fmt.Errorf("%w: %s", ErrInvalidPush, err)
+			}
+			writeError(w, r, err)
+			return
+		}
+		tr.session = push.SessionID()
+	}
+
+	if serviceType == receivePack && gsh.SerializePushes {
+		unlock, err := gsh.repoLocks.Lock(r.Context(), repoPath)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer unlock()
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", serviceType))
+
+	if serviceType == uploadPack {
+		tr.fetch, body = readFetchRequest(body)
+		tr.session = tr.fetch.SessionID
+		if err := gsh.checkDepth(tr.fetch); err != nil {
+			tr.depthRejected = true
+			io.WriteString(w, pktError(err.Error()))
+			return
+		}
+	}
 
+	if len(policies) > 0 && len(push.Updates) > 0 {
+		var rejected bool
+		var err error
+		body, rejected, err = gsh.checkPush(r.Context(), w, policies, gsh.identity(r), repo, repoPath, &push, body)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if rejected {
+			return
+		}
+	}
+
+	route := serviceRoute(serviceType)
 	if serviceType == uploadPack {
-		gs.UploadPack(repoPath, map[string]struct{}{})
+		w = gsh.bandwidth.Throttle(w, r, route, repoPath, gsh.routePolicy(route, serviceType))
 	} else {
-		gs.ReceivePack(repoPath, map[string]struct{}{})
+		body = gsh.bandwidth.ThrottleBody(body, r, route, repoPath, gsh.routePolicy(route, serviceType))
+		r = gsh.withHookEnv(r)
 	}
 
-	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", serviceType))
+	if gsh.PushSummary && len(push.Updates) > 0 {
+		r = r.WithContext(withSidebandTrailer(r.Context(), func() string {
+			return gsh.pushSummary(r.Context(), repo, repoPath, push.Updates)
+		}))
+	}
 
-	if err := gs.Start(); err != nil {
+	if gsh.Trace2 || gsh.Tracing != nil {
+		tr.trace2 = &trace2Summary{keepSpans: gsh.Tracing != nil}
+		r = r.WithContext(withTrace2(r.Context(), tr.trace2))
+	}
+
+	out.Writer = w
+
+	rpc := func(out io.Writer, body io.Reader) error {
+		return gsh.backend().ServeRPC(r.Context(), repoPath, serviceType, body, out)
+	}
+	if serviceType == uploadPack && gsh.packCache != nil && !hiddenRefsShown(r.Context()) && namespace(r.Context()) == "" {
+		serve := rpc
+		rpc = func(out io.Writer, body io.Reader) error {
+			reqBody, err := ioutil.ReadAll(body)
+			if err != nil {
+				// Never cache what a partial request asked for
+				return err
+			}
+			// ls-refs and want-ref are answered with refs, so protocol
+			// version 2 responses only hold as long as the refs do
+			var variant string
+			if proto := gitProtocol(r.Context()); proto != "" {
+				variant = proto + "\x00" + strconv.FormatInt(refsStamp(gsh.storage(), repoPath).UnixNano(), 10)
+			}
+			return gsh.packCache.Serve(out, repoPath, variant, reqBody, func(out io.Writer) error {
+				return serve(out, bytes.NewReader(reqBody))
+			})
+		}
+	}
+	if session := r.Header.Get(NegotiationSessionHeader); serviceType == uploadPack && gsh.negotiations != nil && session != "" {
+		serve := rpc
+		rpc = func(out io.Writer, body io.Reader) error {
+			reqBody, err := ioutil.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			key := gsh.negotiationKey(r, session, repoPath, reqBody)
+			return gsh.negotiations.Serve(out, key, reqBody, func(out io.Writer) error {
+				return serve(out, bytes.NewReader(reqBody))
+			})
+		}
+	}
+	err := rpc(out, body)
+
+	if err != nil {
+		if !out.written {
+			writeError(w, r, err)
+		} else if errors.Is(err, ErrGitTimeout) {
+			io.WriteString(w, pktError(err.Error()))
+		}
+	}
+
+	if serviceType == receivePack && gsh.refsCache != nil {
+		gsh.refsCache.Invalidate(repoPath)
+	}
+	if serviceType == receivePack && gsh.quotas != nil {
+		gsh.quotas.Invalidate(repo)
+	}
+	if serviceType == receivePack {
+		gsh.details.Invalidate(repoPath)
+		if err == nil {
+			gsh.refreshServerInfo(context.WithoutCancel(r.Context()), repoPath)
+		}
+	}
+
+	if err == nil && len(push.Updates) > 0 {
+		gsh.afterPush(r, repo, repoPath, push)
+	}
+}
+
+// runRPC runs the stateless RPC of the given service against the repository,
+// feeding it the request body and copying its output into out. The body is
+// pumped into git concurrently with reading its output, so neither side can
+// block on a full pipe. The git process is killed once ctx is done.
+func (gsh GitSmartHTTP) runRPC(ctx context.Context, out io.Writer, repoPath, serviceType string, body io.Reader) error {
+	trace := newTrace2Capture(ctx)
+	defer trace.finish()
+	gs := gsh.processes.NewGitRPCClient(&GitRPCClientConfig{
+		Stream:    true,
+		Args:      gsh.GitArgs,
+		GitConfig: gsh.repoGitConfig(ctx, repoPath),
+		Env:       append(append(append(namespaceEnv(ctx), gitProtocolEnv(ctx)...), hookEnv(ctx)...), trace.env()...),
+		Timeout:   gsh.timeout(serviceType),
+	})
+	defer gs.Close()
+
+	if serviceType == uploadPack {
+		gs.UploadPack(repoPath, RPCOptions{})
+	} else {
+		gs.ReceivePack(repoPath, RPCOptions{})
+	}
+	noteCommand(ctx, gs.CommandLine())
+
+	if err := gs.Start(ctx); err != nil {
 		log.Printf("Git RPC call %s cannot be started successfully: %s", serviceType, err)
+		return err
+	}
+
+	br := bufio.NewReaderSize(body, pktMaxLen)
+	motd := gsh.motd(repoPath)
+	trailer := sidebandTrailer(ctx)
+	var sidebandLen int
+	if gsh.RelayStderr || motd != "" || trailer != nil {
+		sidebandLen = sidebandMaxLen(peekCapabilities(br))
 	}
 
-	gs.StdinWriter.Write(reqBody)
-	io.Copy(w, gs.StdoutReader)
-	io.Copy(w, gs.StderrReader)
+	stdinErr := make(chan error, 1)
+	go func() {
+		src := &bodyReader{Reader: br}
+		_, err := copyBuffer(gs.StdinWriter, src)
+		if _, ok := err.(*http.MaxBytesError); ok {
+			// Stop git before it reports on the truncated request.
+			gs.Kill()
+		} else if src.err != nil {
+			// The client went away mid-request. Interrupt git right away
+			// rather than have it work through what was received, which
+			// also lets receive-pack discard its quarantine.
+			log.Printf("Git RPC call %s on %s aborted, reading the request failed: %s", serviceType, repoPath, src.err)
+			gs.Interrupt()
+		}
+		gs.StdinWriter.Close()
+		stdinErr <- err
+	}()
+
+	var stderr bytes.Buffer
+	stderrDone := make(chan struct{})
+	go func() {
+		copyBuffer(&stderr, gs.StderrReader)
+		close(stderrDone)
+	}()
+
+	var written int64
+	var heldFlush bool
+	var err error
+	if sidebandLen > 0 {
+		written, heldFlush, err = copyHoldingFlush(out, gs.StdoutReader)
+	} else {
+		written, err = copyBuffer(out, gs.StdoutReader)
+	}
+	if err != nil {
+		log.Printf("Git RPC call %s cannot be streamed to the client: %s", serviceType, err)
+		return err
+	}
+	<-stderrDone
 
-	if err := gs.Wait(); err != nil {
-		log.Printf("Git RPC call %s cannot be stopped properly: %s", serviceType, err)
+	waitErr := gs.Wait()
+
+	// stderr is never part of the protocol stream. It is relayed on the
+	// sideband, as progress or as the fatal error, only when the client
+	// asked for one and the response is already underway.
+	if msg := string(bytes.TrimSpace(stderr.Bytes())); msg != "" {
+		if waitErr == nil {
+			log.Printf("Git RPC call %s on %s: %s", serviceType, repoPath, msg)
+		}
+		if gsh.RelayStderr && sidebandLen > 0 && written > 0 {
+			band := byte(2)
+			if waitErr != nil {
+				band = 3
+			}
+			io.WriteString(out, sidebandMessages(band, msg+"\n", sidebandLen))
+		}
 	}
+	// The push summary and the message of the day go at the end of the
+	// sideband stream, which only the response carrying the pack or the
+	// push report has.
+	if heldFlush && waitErr == nil {
+		msg := motd
+		if trailer != nil {
+			msg = trailer() + msg
+		}
+		if msg != "" {
+			io.WriteString(out, sidebandMessages(2, msg, sidebandLen))
+		}
+	}
+	if heldFlush {
+		io.WriteString(out, pktFlush())
+	}
+
+	if err := waitErr; err != nil {
+		if errors.Is(err, ErrGitTimeout) {
+			log.Printf("Git RPC call %s was killed after running for %s", serviceType, gs.Timeout)
+			return err
+		}
+		select {
+		case err := <-stdinErr:
+			if _, ok := err.(*http.MaxBytesError); ok {
+				return err
+			}
+		default:
+		}
+		log.Printf("Git RPC call %s cannot be stopped properly: %s: %s", serviceType, err, bytes.TrimSpace(stderr.Bytes()))
+		return err
+	}
+
+	select {
+	case err := <-stdinErr:
+		if err != nil {
+			log.Printf("Git RPC call %s cannot be fed the request: %s", serviceType, err)
+			return err
+		}
+	default:
+	}
+	return nil
 }
 
 func pktWrite(s string) string {
@@ -271,56 +1376,99 @@ func pktWrite(s string) string {
 	return sSize + s
 }
 
+// pktError returns an ERR pkt-line, which git shows to the user as a remote
+// error.
+func pktError(msg string) string {
+	return pktWrite("ERR " + msg + "\n")
+}
+
 func pktFlush() string {
 	return "0000"
 }
 
-func (gsh GitSmartHTTP) sendFile(w http.ResponseWriter, r *http.Request, contentType string, hdr map[string]string) {
-	fullPath := path.Join(gsh.ReposRootPath, r.URL.Path)
-
-	f, err := os.Open(fullPath)
+// sendFile serves the requested file of the repository from the storage.
+// Content-Length, Last-Modified, Range and conditional requests are all
+// handled by http.ServeContent.
+//
+// With the local storage, ServeContent hands the *os.File to the ReaderFrom
+// of the connection, which lets the runtime use sendfile(2) on Linux, so w
+// must not be wrapped in a writer hiding it unless the copy has to go
+// through userspace anyway, as for throttled responses.
+func (gsh GitSmartHTTP) sendFile(s Service, w http.ResponseWriter, r *http.Request, contentType string, hdr map[string]string) {
+	urlRepo := s.ParseURLNamedParams(r)["repoPath"]
+	name := strings.TrimPrefix(r.URL.Path, urlRepo+"/")
+
+	f, err := gsh.storage().Open(gsh.localPath(urlRepo), name)
 	if err != nil {
-		w.Header().Set("Content-Type", "text/plain")
-		http.NotFound(w, r)
+		writeErrorMessage(w, r, http.StatusNotFound, "not found")
 		return
 	}
+	defer f.Close()
 
 	fInfo, err := f.Stat()
 	if err != nil {
-		fmt.Fprintf(w, "Cannot fetch file %v", err)
+		writeError(w, r, fmt.Errorf("cannot fetch file: %w", err))
 		return
 	}
 
-	size := strconv.FormatInt(fInfo.Size(), 10)
-	mtime := fInfo.ModTime().Format(time.RFC850)
+	if fInfo.IsDir() {
+		writeErrorMessage(w, r, http.StatusNotFound, "not found")
+		return
+	}
 
 	setHeaders(w, hdr)
-
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", size)
-	w.Header().Set("Last-Modified", mtime)
+	w = gsh.bandwidth.Throttle(w, r, RouteObjects, gsh.localPath(urlRepo), gsh.routePolicy(RouteObjects, ""))
 
-	io.Copy(w, f)
+	http.ServeContent(w, r, fInfo.Name(), fInfo.ModTime(), f)
 }
 
-func (gsh GitSmartHTTP) serviceAccess(service string) bool {
+// maxBodySize returns the largest request body accepted for the service,
+// zero meaning no limit.
+func (gsh GitSmartHTTP) maxBodySize(settings RepoSettings, service string) int64 {
 	if service == uploadPack {
+		if settings.MaxUploadPackBodySize != nil {
+			return *settings.MaxUploadPackBodySize
+		}
+		return gsh.routePolicy(RouteUploadPack, service).MaxBodySize
+	}
+	if settings.MaxReceivePackBodySize != nil {
+		return *settings.MaxReceivePackBodySize
+	}
+	return gsh.routePolicy(RouteReceivePack, service).MaxBodySize
+}
+
+// timeout returns how long git may run for the service, zero meaning no
+// limit.
+func (gsh GitSmartHTTP) timeout(service string) time.Duration {
+	return gsh.routePolicy(serviceRoute(service), service).Timeout
+}
+
+func (gsh GitSmartHTTP) serviceAccess(repoPath, service string) bool {
+	settings := gsh.repoSettings(repoPath)
+	if service == uploadPack {
+		if settings.UploadPack != nil {
+			return *settings.UploadPack
+		}
 		return gsh.UploadPack
 	}
 
 	if service == receivePack {
+		if settings.ReceivePack != nil {
+			return *settings.ReceivePack
+		}
 		return gsh.ReceivePack
 	}
 
 	return false
 }
 
-func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed []string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
 	if r.Proto == "HTTP/1.1" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeErrorMessage(w, r, http.StatusMethodNotAllowed, "method not allowed")
 	} else {
-		w.WriteHeader(http.StatusBadRequest)
+		writeErrorMessage(w, r, http.StatusBadRequest, "method not allowed")
 	}
 }
 
@@ -332,66 +1480,40 @@ func hdrNoCache() map[string]string {
 	}
 }
 
-func hdrCacheForever() map[string]string {
-	now := time.Now()
-	expires := now.Add(31536000 * time.Second)
-
-	return map[string]string{
-		"Date":          now.Format(time.RFC850),
-		"Expires":       expires.Format(time.RFC850),
-		"Cache-Control": "public, max-age=31536000",
-	}
+// CachePolicy describes the caching headers sent with a class of responses.
+// A zero MaxAge disables caching.
+type CachePolicy struct {
+	MaxAge    time.Duration
+	Immutable bool
+	Private   bool
 }
 
-func setHeaders(w http.ResponseWriter, hdr map[string]string) {
-	for key, value := range hdr {
-		w.Header().Set(key, value)
+func (p CachePolicy) headers() map[string]string {
+	if p.MaxAge <= 0 {
+		return hdrNoCache()
 	}
-}
-
-var gsh GitSmartHTTP
 
-func init() {
-	var vsn bool
-	gsc := GitSmartHTTPConfig{}
-
-	flag.BoolVar(&vsn, "version", false, "print version")
-	flag.StringVar(&gsc.ReposRootPath, "repos-root-path", "/etc/git-http-backend", "directory that contains git repositories to serve")
-	flag.BoolVar(&gsc.ReceivePack, receivePack, true, "whether to receive what is pushed into repository")
-	flag.BoolVar(&gsc.UploadPack, uploadPack, true, "whether to send objects packed back to git-fetch-pack")
-	flag.IntVar(&gsc.Port, "port", 8080, "port that the Git server backend runs on")
+	now := time.Now()
+	expires := now.Add(p.MaxAge)
 
-	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, fmt.Sprintf(BANNER, VERSION, COMMIT))
-		flag.PrintDefaults()
+	cacheControl := "public"
+	if p.Private {
+		cacheControl = "private"
 	}
-
-	flag.Parse()
-
-	if vsn {
-		fmt.Printf("git-http-backend version: %s, commit: %s\n", VERSION, COMMIT)
-		os.Exit(0)
+	cacheControl += fmt.Sprintf(", max-age=%d", int64(p.MaxAge/time.Second))
+	if p.Immutable {
+		cacheControl += ", immutable"
 	}
 
-	if flag.NArg() >= 1 {
-		switch flag.Args()[0] {
-		case "version":
-			fmt.Printf("git-http-backend version: %s, commit: %s\n", VERSION, COMMIT)
-			os.Exit(0)
-		case "help":
-			flag.Usage()
-			os.Exit(0)
-		}
+	return map[string]string{
+		"Date":          now.UTC().Format(http.TimeFormat),
+		"Expires":       expires.UTC().Format(http.TimeFormat),
+		"Cache-Control": cacheControl,
 	}
-
-	gsh = NewGitSmartHTTP(&gsc)
 }
 
-func main() {
-
-	mux := http.NewServeMux()
-	mux.Handle("/", gsh)
-	port := fmt.Sprintf(":%d", gsh.Port)
-	log.Printf(BANNER+"    Running on port %d", VERSION, COMMIT, gsh.Port)
-	http.ListenAndServe(port, mux)
+func setHeaders(w http.ResponseWriter, hdr map[string]string) {
+	for key, value := range hdr {
+		w.Header().Set(key, value)
+	}
 }
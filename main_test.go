@@ -0,0 +1,497 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+// newTestServer serves throwaway repositories with cfg, which is completed
+// with the root of the repositories and enables both services
+func newTestServer(t *testing.T, cfg GitSmartHTTPConfig) *githttptest.Server {
+	return githttptest.NewServer(t, func(root string) http.Handler {
+		cfg.ReposRootPath = root
+		cfg.ExportAll = true
+		cfg.ReceivePack = true
+		cfg.UploadPack = true
+		return NewGitSmartHTTP(&cfg).Handler()
+	})
+}
+
+// fakeGit writes a git standing in for the real one that runs script
+func fakeGit(t *testing.T, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell scripts do not run on Windows")
+	}
+	git := filepath.Join(t.TempDir(), "git")
+	if err := os.WriteFile(git, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return git
+}
+
+func TestRPCPipesConcurrently(t *testing.T) {
+	// git echoing the request writes its output while the request is
+	// still coming in, filling the pipes well before the end of it
+	gsh := NewGitSmartHTTP(&GitSmartHTTPConfig{
+		ReposRootPath: t.TempDir(),
+		UploadPack:    true,
+		GitPath:       fakeGit(t, "exec cat"),
+	})
+	req := bytes.Repeat([]byte("0032want 0000000000000000000000000000000000000000\n"), 1<<16)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	if err := gsh.runRPC(ctx, &out, t.TempDir(), uploadPack, bytes.NewReader(req)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), req) {
+		t.Errorf("git wrote %d bytes, want the %d of the request", out.Len(), len(req))
+	}
+}
+
+// request sends a request with the body, of the content type unless
+// empty, and returns the response along with its body
+func request(t *testing.T, method, url, contentType, body string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// testAdminToken is the admin token of test servers setting AdminToken
+const testAdminToken = "secret"
+
+// adminRequest sends a request with the body authenticated as admin and
+// returns the response along with its body
+func adminRequest(t *testing.T, method, url, body string) (*http.Response, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func TestErrorStatuses(t *testing.T) {
+	newServer := func(gitPath string) *githttptest.Server {
+		srv := githttptest.NewServer(t, func(root string) http.Handler {
+			return NewGitSmartHTTP(&GitSmartHTTPConfig{
+				ReposRootPath: root,
+				ExportAll:     true,
+				UploadPack:    true,
+				GitPath:       gitPath,
+			}).Handler()
+		})
+		srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+		return srv
+	}
+	srv := newServer("")
+	failing := newServer(fakeGit(t, "echo fatal: broken >&2; exit 1"))
+
+	for _, tc := range []struct {
+		name                      string
+		srv                       *githttptest.Server
+		method, path, contentType string
+		status                    int
+	}{
+		{"missing repository", srv, "GET", "/missing.git/info/refs?service=git-upload-pack", "", http.StatusNotFound},
+		{"disabled service", srv, "GET", "/test.git/info/refs?service=git-receive-pack", "", http.StatusForbidden},
+		{"disabled RPC", srv, "POST", "/test.git/git-receive-pack", "application/x-git-receive-pack-request", http.StatusForbidden},
+		{"failing advertisement", failing, "GET", "/test.git/info/refs?service=git-upload-pack", "", http.StatusInternalServerError},
+		{"failing RPC", failing, "POST", "/test.git/git-upload-pack", "application/x-git-upload-pack-request", http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := request(t, tc.method, tc.srv.URL+tc.path, tc.contentType, "0000")
+			if resp.StatusCode != tc.status {
+				t.Errorf("status %d, want %d: %s", resp.StatusCode, tc.status, body)
+			}
+			// git's failure is logged, not shown
+			if strings.Contains(body, "broken") {
+				t.Errorf("body %q shows the error of git", body)
+			}
+		})
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{MaxUploadPackBodySize: 1 << 10})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	head := srv.Ref("test.git", "HEAD")
+	srv.Clone("test.git")
+
+	wants := strings.Repeat(pktWrite("want "+head+"\n"), 100)
+	resp, body := request(t, "POST", srv.RepoURL("test.git")+"/git-upload-pack", "application/x-git-upload-pack-request", wants)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(body, "ERR ") {
+		t.Errorf("too large request: %d %q, want 413 with an ERR packet", resp.StatusCode, body)
+	}
+
+	// Compressed requests are limited by their decompressed size
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, wants)
+	zw.Close()
+	req, err := http.NewRequest("POST", srv.RepoURL("test.git")+"/git-upload-pack", &gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Content-Encoding", "gzip")
+	gzResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzResp.Body.Close()
+	if gzResp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large compressed request: %d, want 413", gzResp.StatusCode)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{MaxReceivePackBodySize: 1 << 20})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	u, err := url.Parse(srv.RepoURL("test.git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// post sends the headers of a push announcing a body of size bytes,
+	// and returns the status line the server answers with before the
+	// body is sent
+	post := func(size int64, contentType string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "POST %s/git-receive-pack HTTP/1.1\r\nHost: %s\r\nContent-Type: %s\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n",
+			u.Path, u.Host, contentType, size)
+		status, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(status)
+	}
+
+	for _, tc := range []struct {
+		size        int64
+		contentType string
+		want        string
+	}{
+		{2 << 20, "application/x-git-receive-pack-request", "HTTP/1.1 413 Request Entity Too Large"},
+		{1 << 10, "application/octet-stream", "HTTP/1.1 415 Unsupported Media Type"},
+		{1 << 10, "application/x-git-receive-pack-request", "HTTP/1.1 100 Continue"},
+	} {
+		if got := post(tc.size, tc.contentType); got != tc.want {
+			t.Errorf("push of %d bytes as %s answered %q before its body, want %q", tc.size, tc.contentType, got, tc.want)
+		}
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	head := srv.Ref("test.git", "HEAD")
+
+	for _, path := range []string{
+		"/info/refs?service=git-upload-pack",
+		"/info/refs",
+		"/HEAD",
+		"/objects/" + head[:2] + "/" + head[2:],
+	} {
+		get, getBody := request(t, "GET", srv.RepoURL("test.git")+path, "", "")
+		if get.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %d", path, get.StatusCode)
+		}
+		resp, body := request(t, "HEAD", srv.RepoURL("test.git")+path, "", "")
+		if resp.StatusCode != http.StatusOK || body != "" {
+			t.Errorf("HEAD %s: %d with %d bytes, want 200 without body", path, resp.StatusCode, len(body))
+		}
+		if resp.Header.Get("Content-Type") != get.Header.Get("Content-Type") {
+			t.Errorf("HEAD %s: content type %q, want %q", path, resp.Header.Get("Content-Type"), get.Header.Get("Content-Type"))
+		}
+		if resp.ContentLength >= 0 && resp.ContentLength != int64(len(getBody)) {
+			t.Errorf("HEAD %s: content length %d, want %d", path, resp.ContentLength, len(getBody))
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		allow        string
+	}{
+		{"GET", "/git-upload-pack", http.StatusMethodNotAllowed, "POST"},
+		{"PUT", "/info/refs", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"DELETE", "/HEAD", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"GET", "/nothing/here", http.StatusNotFound, ""},
+		{"POST", "/nothing/here", http.StatusNotFound, ""},
+	} {
+		resp, _ := request(t, tc.method, srv.RepoURL("test.git")+tc.path, "", "")
+		if resp.StatusCode != tc.status || resp.Header.Get("Allow") != tc.allow {
+			t.Errorf("%s %s: %d allowing %q, want %d allowing %q", tc.method, tc.path, resp.StatusCode, resp.Header.Get("Allow"), tc.status, tc.allow)
+		}
+	}
+}
+
+func TestValidateRepo(t *testing.T) {
+	var gsh GitSmartHTTP
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh = NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: root, UploadPack: true})
+		return gsh.Handler()
+	})
+	exported := srv.CreateRepo("exported.git", map[string]string{"README": "hello\n"})
+	if err := os.WriteFile(filepath.Join(exported, "git-daemon-export-ok"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv.CreateRepo("private.git", map[string]string{"README": "hello\n"})
+	if err := os.MkdirAll(filepath.Join(srv.Root, "plain", "objects"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	spawned := gsh.Processes().Spawned
+	for _, repo := range []string{"private.git", "plain", "missing.git"} {
+		resp, _ := request(t, "POST", srv.RepoURL(repo)+"/git-upload-pack", "application/x-git-upload-pack-request", "0000")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: %d, want 404", repo, resp.StatusCode)
+		}
+	}
+	if n := gsh.Processes().Spawned - spawned; n != 0 {
+		t.Errorf("refused requests ran %d git processes, want none", n)
+	}
+
+	resp, _ := request(t, "GET", srv.RepoURL("exported.git")+"/info/refs?service=git-upload-pack", "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("exported repository: %d, want 200", resp.StatusCode)
+	}
+}
+
+// waitFor fails the test unless cond becomes true within 5s
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestClientDisconnectKillsGit(t *testing.T) {
+	var gsh GitSmartHTTP
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh = NewGitSmartHTTP(&GitSmartHTTPConfig{
+			ReposRootPath: root,
+			ExportAll:     true,
+			UploadPack:    true,
+			GitPath:       fakeGit(t, "exec sleep 60"),
+		})
+		return gsh.Handler()
+	})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "POST", srv.RepoURL("test.git")+"/git-upload-pack", strings.NewReader("0000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	done := make(chan struct{})
+	go func() {
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+		}
+		close(done)
+	}()
+
+	waitFor(t, "git to start", func() bool { return gsh.Processes().Active == 1 })
+	cancel()
+	<-done
+	waitFor(t, "git to be killed", func() bool { return gsh.Processes().Active == 0 })
+}
+
+func TestGitTimeout(t *testing.T) {
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		return NewGitSmartHTTP(&GitSmartHTTPConfig{
+			ReposRootPath:     root,
+			ExportAll:         true,
+			UploadPack:        true,
+			UploadPackTimeout: 100 * time.Millisecond,
+			GitPath:           fakeGit(t, "exec sleep 60"),
+		}).Handler()
+	})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	start := time.Now()
+	resp, body := request(t, "POST", srv.RepoURL("test.git")+"/git-upload-pack", "application/x-git-upload-pack-request", "0000")
+	if resp.StatusCode != http.StatusGatewayTimeout || !strings.Contains(body, "ERR "+ErrGitTimeout.Error()) {
+		t.Errorf("%d %q, want 504 with an ERR packet", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("git was killed after %s", elapsed)
+	}
+}
+
+func TestStderrKeptOutOfResponse(t *testing.T) {
+	newServer := func(relay bool) *githttptest.Server {
+		srv := githttptest.NewServer(t, func(root string) http.Handler {
+			return NewGitSmartHTTP(&GitSmartHTTPConfig{
+				ReposRootPath: root,
+				ExportAll:     true,
+				UploadPack:    true,
+				RelayStderr:   relay,
+				GitPath:       fakeGit(t, `cat >/dev/null; echo warning: slow >&2; printf '0008NAK\n0000'`),
+			}).Handler()
+		})
+		srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+		return srv
+	}
+	req := pktWrite("want "+strings.Repeat("1", 40)+" side-band-64k\n") + pktFlush() + pktWrite("done\n")
+
+	_, body := request(t, "POST", newServer(false).RepoURL("test.git")+"/git-upload-pack", "application/x-git-upload-pack-request", req)
+	if body != "0008NAK\n0000" {
+		t.Errorf("response %q, want what git wrote to stdout only", body)
+	}
+
+	// Relayed, stderr goes on the progress band ahead of the final flush
+	_, body = request(t, "POST", newServer(true).RepoURL("test.git")+"/git-upload-pack", "application/x-git-upload-pack-request", req)
+	if want := "0008NAK\n" + pktWrite("\x02warning: slow\n") + pktFlush(); body != want {
+		t.Errorf("relayed response %q, want %q", body, want)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	for _, tc := range []struct {
+		method, path, contentType string
+		status                    int
+	}{
+		{"POST", "/git-upload-pack", "", http.StatusUnsupportedMediaType},
+		{"POST", "/git-upload-pack", "application/x-git-receive-pack-request", http.StatusUnsupportedMediaType},
+		{"POST", "/git-receive-pack", "application/octet-stream", http.StatusUnsupportedMediaType},
+		{"GET", "/info/refs?service=git-frobnicate", "", http.StatusBadRequest},
+		{"POST", "/git-upload-pack", "application/x-git-upload-pack-request", http.StatusOK},
+	} {
+		resp, body := request(t, tc.method, srv.RepoURL("test.git")+tc.path, tc.contentType, "0000")
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s as %q: %d, want %d: %s", tc.method, tc.path, tc.contentType, resp.StatusCode, tc.status, body)
+		}
+	}
+}
+
+func TestGitSuffix(t *testing.T) {
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, tc := range []struct {
+		mode   string
+		status map[string]int
+	}{
+		{GitSuffixExact, map[string]int{"foo.git": 200, "foo": 404, "bar": 200, "bar.git": 404}},
+		{GitSuffixOptional, map[string]int{"foo.git": 200, "foo": 200, "bar": 200, "bar.git": 200}},
+		{GitSuffixRequire, map[string]int{"foo.git": 200, "foo": 404, "bar": 404, "bar.git": 404}},
+		{GitSuffixRedirect, map[string]int{"foo.git": 200, "foo": 301, "bar": 200, "bar.git": 404}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			srv := newTestServer(t, GitSmartHTTPConfig{GitSuffix: tc.mode})
+			srv.CreateRepo("foo.git", map[string]string{"README": "foo\n"})
+			srv.CreateRepo("bar", map[string]string{"README": "bar\n"})
+
+			for repo, status := range tc.status {
+				resp, err := noRedirect.Get(srv.RepoURL(repo) + "/info/refs?service=git-upload-pack")
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != status {
+					t.Errorf("%s: %d, want %d", repo, resp.StatusCode, status)
+				}
+				if status == http.StatusMovedPermanently {
+					if loc := resp.Header.Get("Location"); loc != "/"+repo+".git/info/refs?service=git-upload-pack" {
+						t.Errorf("%s redirected to %q", repo, loc)
+					}
+					// git follows the redirect for the requests after
+					srv.Clone(repo)
+				}
+			}
+		})
+	}
+}
+
+func TestCachePolicies(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{
+		TextCache:   CachePolicy{MaxAge: time.Minute, Private: true},
+		ObjectCache: CachePolicy{MaxAge: 365 * 24 * time.Hour, Immutable: true},
+	})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	head := srv.Ref("test.git", "HEAD")
+	noCache := hdrNoCache()["Cache-Control"]
+
+	for path, want := range map[string]string{
+		"/HEAD":                                 "private, max-age=60",
+		"/objects/" + head[:2] + "/" + head[2:]: "public, max-age=31536000, immutable",
+		"/info/refs?service=git-upload-pack":    noCache,
+	} {
+		resp, _ := request(t, "GET", srv.RepoURL("test.git")+path, "", "")
+		if got := resp.Header.Get("Cache-Control"); got != want {
+			t.Errorf("%s cached with %q, want %q", path, got, want)
+		}
+	}
+
+	// The zero policy disables caching
+	srv = newTestServer(t, GitSmartHTTPConfig{})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	head = srv.Ref("test.git", "HEAD")
+	resp, _ := request(t, "GET", srv.RepoURL("test.git")+"/objects/"+head[:2]+"/"+head[2:], "", "")
+	if got := resp.Header.Get("Cache-Control"); resp.StatusCode != http.StatusOK || got != noCache {
+		t.Errorf("object cached with %q without policy, want %q", got, noCache)
+	}
+}
@@ -0,0 +1,301 @@
+package githttp
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+// ManagementService is the gRPC service through which automation manages
+// the server, defined in proto/management.proto. It is served next to the
+// admin API, to clients giving the admin token.
+const ManagementService = "githttp.v1.Management"
+
+// managementServer returns the gRPC server of ManagementService
+func (gsh GitSmartHTTP) managementServer() grpcServer {
+	return grpcServer{
+		service: ManagementService,
+		token:   gsh.AdminToken,
+		methods: map[string]grpcMethod{
+			"ListRepositories":   gsh.grpcListRepositories,
+			"GetRepository":      gsh.grpcGetRepository,
+			"StartGC":            gsh.grpcStartGC,
+			"GetGCJob":           gsh.grpcGetGCJob,
+			"StartFsck":          gsh.grpcStartFsck,
+			"GetFsck":            gsh.grpcGetFsck,
+			"SyncMirror":         gsh.grpcSyncMirror,
+			"GetProtectionRules": gsh.grpcGetProtectionRules,
+			"SetProtectionRules": gsh.grpcSetProtectionRules,
+		},
+	}
+}
+
+// repositoryRequest reads the name field of RepositoryRequest and
+// StartGCRequest, and the mode field of the latter
+func repositoryRequest(req []byte) (name, mode string, err error) {
+	d := protoDecoder{b: req}
+	for d.next() {
+		switch d.field {
+		case 1:
+			name = string(d.bytes)
+		case 2:
+			mode = string(d.bytes)
+		}
+	}
+	if d.err != nil {
+		return "", "", grpcErrorf(grpcInvalidArgument, "%s", d.err)
+	}
+	return name, mode, nil
+}
+
+// managedRepo resolves the repository a call names, which must exist
+func (gsh GitSmartHTTP) managedRepo(req []byte) (repo, repoPath, mode string, err error) {
+	name, mode, err := repositoryRequest(req)
+	if err != nil {
+		return "", "", "", err
+	}
+	if name == "" {
+		return "", "", "", grpcErrorf(grpcInvalidArgument, "no repository name")
+	}
+	if repo, err = gsh.normalizeRepo("/" + strings.TrimPrefix(name, "/")); err != nil {
+		return "", "", "", err
+	}
+	repo = strings.TrimPrefix(repo, "/")
+	repoPath = gsh.localPath(repo)
+	return repo, repoPath, mode, gsh.validateRepo(repoPath)
+}
+
+// repoList is ListRepositoriesResponse
+type repoList []RepoInfo
+
+func (l repoList) marshalProto(e *protoEncoder) {
+	for _, info := range l {
+		e.message(1, info)
+	}
+}
+
+func (info RepoInfo) marshalProto(e *protoEncoder) {
+	e.string(1, info.Name)
+	if info.Fsck != nil {
+		e.message(2, *info.Fsck)
+	}
+}
+
+func (gsh GitSmartHTTP) grpcListRepositories(ctx context.Context, req []byte) (protoMessage, error) {
+	var repos repoList
+	err := gsh.walkRepos(func(repo, repoPath string) {
+		if gsh.validateRepo(repoPath) != nil {
+			return
+		}
+		info := RepoInfo{Name: repo}
+		if st, ok := gsh.fscks.Get(repo); ok {
+			st.Output = ""
+			info.Fsck = &st
+		}
+		repos = append(repos, info)
+	})
+	if err != nil {
+		log.Printf("Cannot list repositories: %s", err)
+	}
+	return repos, nil
+}
+
+func (d RepoDetails) marshalProto(e *protoEncoder) {
+	e.string(1, d.Name)
+	e.int(2, d.DiskSize)
+	e.message(3, d.Objects)
+	e.message(4, d.Refs)
+	e.time(5, d.LastPush)
+	e.time(6, d.LastFetch)
+	e.time(7, &d.Computed)
+}
+
+func (c ObjectCounts) marshalProto(e *protoEncoder) {
+	e.int(1, c.Loose)
+	e.int(2, c.LooseSize)
+	e.int(3, c.Packed)
+	e.int(4, c.Packs)
+	e.int(5, c.PackSize)
+	e.int(6, c.PrunePackable)
+	e.int(7, c.Garbage)
+	e.int(8, c.GarbageSize)
+}
+
+func (c RefCounts) marshalProto(e *protoEncoder) {
+	e.int(1, int64(c.Branches))
+	e.int(2, int64(c.Tags))
+	e.int(3, int64(c.Other))
+}
+
+func (gsh GitSmartHTTP) grpcGetRepository(ctx context.Context, req []byte) (protoMessage, error) {
+	repo, repoPath, _, err := gsh.managedRepo(req)
+	if err != nil {
+		return nil, err
+	}
+	return gsh.repoDetails(ctx, repo, repoPath)
+}
+
+func (job GCJob) marshalProto(e *protoEncoder) {
+	e.string(1, job.ID)
+	e.string(2, job.Repo)
+	e.string(3, job.Mode)
+	e.string(4, job.State)
+	e.time(5, &job.Created)
+	e.time(6, job.Started)
+	e.time(7, job.Finished)
+	e.string(8, job.Output)
+}
+
+func (gsh GitSmartHTTP) grpcStartGC(ctx context.Context, req []byte) (protoMessage, error) {
+	repo, _, mode, err := gsh.managedRepo(req)
+	if err != nil {
+		return nil, err
+	}
+	if mode == "" {
+		mode = GCNormal
+	}
+	if mode != GCAuto && mode != GCNormal && mode != GCAggressive {
+		return nil, grpcErrorf(grpcInvalidArgument, "invalid mode %s, want %s, %s or %s", mode, GCAuto, GCNormal, GCAggressive)
+	}
+	return gsh.gcs.enqueue(repo, mode)
+}
+
+func (gsh GitSmartHTTP) grpcGetGCJob(ctx context.Context, req []byte) (protoMessage, error) {
+	id, _, err := repositoryRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	job, ok := gsh.gcs.Get(id)
+	if !ok {
+		return nil, grpcErrorf(grpcNotFound, "no such job")
+	}
+	return job, nil
+}
+
+func (st FsckStatus) marshalProto(e *protoEncoder) {
+	e.string(1, st.State)
+	e.time(2, &st.Started)
+	e.time(3, st.Finished)
+	e.string(4, st.Output)
+}
+
+func (gsh GitSmartHTTP) grpcStartFsck(ctx context.Context, req []byte) (protoMessage, error) {
+	repo, repoPath, _, err := gsh.managedRepo(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := gsh.warmRepo(ctx, repo, repoPath); err != nil {
+		return nil, err
+	}
+	return gsh.fscks.start(repo, repoPath), nil
+}
+
+func (gsh GitSmartHTTP) grpcGetFsck(ctx context.Context, req []byte) (protoMessage, error) {
+	repo, _, _, err := gsh.managedRepo(req)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := gsh.fscks.Get(repo)
+	if !ok {
+		return nil, grpcErrorf(grpcNotFound, "repository never checked")
+	}
+	return st, nil
+}
+
+// mirrorSynced is SyncMirrorResponse
+type mirrorSynced struct{}
+
+func (mirrorSynced) marshalProto(e *protoEncoder) {}
+
+func (gsh GitSmartHTTP) grpcSyncMirror(ctx context.Context, req []byte) (protoMessage, error) {
+	if gsh.upstream == nil {
+		return nil, grpcErrorf(grpcFailedPrecondition, "no upstream to mirror")
+	}
+	name, _, err := repositoryRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := gsh.normalizeRepo("/" + strings.TrimPrefix(name, "/"))
+	if err != nil {
+		return nil, err
+	}
+	repo = strings.TrimPrefix(repo, "/")
+	repoPath := gsh.localPath(repo)
+	if name == "" || !gsh.insideRoot(repoPath) {
+		return nil, grpcErrorf(grpcInvalidArgument, "invalid repository name %q", name)
+	}
+	if err := gsh.upstream.sync(ctx, repo, repoPath); err != nil {
+		return nil, err
+	}
+	return mirrorSynced{}, nil
+}
+
+// protectionRules is ProtectionRules
+type protectionRules []ProtectionRule
+
+func (rules protectionRules) marshalProto(e *protoEncoder) {
+	for _, rule := range rules {
+		e.message(1, rule)
+	}
+}
+
+func (rule ProtectionRule) marshalProto(e *protoEncoder) {
+	e.string(1, rule.Repo)
+	e.string(2, rule.Ref)
+	e.bool(3, rule.DenyForcePush)
+	e.bool(4, rule.DenyDelete)
+	e.bool(5, rule.Immutable)
+	e.bool(6, rule.RequireSignedCommits)
+}
+
+func (gsh GitSmartHTTP) grpcGetProtectionRules(ctx context.Context, req []byte) (protoMessage, error) {
+	if gsh.Protection == nil {
+		return nil, grpcErrorf(grpcFailedPrecondition, "branch protection disabled")
+	}
+	return protectionRules(gsh.Protection.Rules()), nil
+}
+
+func (gsh GitSmartHTTP) grpcSetProtectionRules(ctx context.Context, req []byte) (protoMessage, error) {
+	if gsh.Protection == nil {
+		return nil, grpcErrorf(grpcFailedPrecondition, "branch protection disabled")
+	}
+
+	var rules []ProtectionRule
+	d := protoDecoder{b: req}
+	for d.next() {
+		if d.field != 1 {
+			continue
+		}
+		var rule ProtectionRule
+		rd := protoDecoder{b: d.bytes}
+		for rd.next() {
+			switch rd.field {
+			case 1:
+				rule.Repo = string(rd.bytes)
+			case 2:
+				rule.Ref = string(rd.bytes)
+			case 3:
+				rule.DenyForcePush = rd.varint != 0
+			case 4:
+				rule.DenyDelete = rd.varint != 0
+			case 5:
+				rule.Immutable = rd.varint != 0
+			case 6:
+				rule.RequireSignedCommits = rd.varint != 0
+			}
+		}
+		if rd.err != nil {
+			d.err = rd.err
+			break
+		}
+		rules = append(rules, rule)
+	}
+	if d.err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", d.err)
+	}
+
+	if err := gsh.Protection.SetRules(rules); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	return protectionRules(gsh.Protection.Rules()), nil
+}
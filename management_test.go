@@ -0,0 +1,206 @@
+package githttp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+// grpcCall makes a unary call, returning its status and response message
+func grpcCall(t *testing.T, client *http.Client, url, method, token string, req protoMessage) (int, []byte) {
+	t.Helper()
+
+	var e protoEncoder
+	req.marshalProto(&e)
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(e.b)))
+	hreq, err := http.NewRequest("POST", url+"/"+ManagementService+"/"+method, bytes.NewReader(append(frame, e.b...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(hreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := resp.Header.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Trailer.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		t.Fatalf("%s: no grpc-status, HTTP status %d", method, resp.StatusCode)
+	}
+	if code != grpcOK {
+		return code, nil
+	}
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		t.Fatalf("%s: malformed response %q", method, body)
+	}
+	return code, body[5:]
+}
+
+// protoStrings returns the string fields of a message, by field number
+func protoStrings(t *testing.T, msg []byte) map[int][]string {
+	t.Helper()
+	fields := make(map[int][]string)
+	d := protoDecoder{b: msg}
+	for d.next() {
+		if d.wireType == protoBytes {
+			fields[d.field] = append(fields[d.field], string(d.bytes))
+		}
+	}
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	return fields
+}
+
+// repoName is RepositoryRequest and GetGCJobRequest
+type repoName string
+
+func (name repoName) marshalProto(e *protoEncoder) {
+	e.string(1, string(name))
+}
+
+func TestProtoWire(t *testing.T) {
+	// The examples of the protobuf encoding documentation
+	var e protoEncoder
+	e.int(1, 150)
+	e.string(2, "testing")
+	if want := []byte{0x08, 0x96, 0x01, 0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}; !bytes.Equal(e.b, want) {
+		t.Fatalf("encoded % x, want % x", e.b, want)
+	}
+
+	d := protoDecoder{b: append(e.b, 0x1d, 1, 2, 3, 4)}
+	var got []int
+	for d.next() {
+		got = append(got, d.field)
+	}
+	if d.err != nil || len(got) != 3 || d.field != 3 {
+		t.Fatalf("decoded fields %v, error %v", got, d.err)
+	}
+
+	d = protoDecoder{b: []byte{0x12, 0x07, 't', 'e'}}
+	for d.next() {
+	}
+	if d.err == nil {
+		t.Fatal("truncated message decoded")
+	}
+}
+
+func TestManagementService(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{})
+	srv.CreateRepo("team/test.git", map[string]string{"README": "hello\n"})
+
+	// Serve the same repositories over cleartext HTTP/2, as the listeners do
+	gsh := NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: srv.Root, ExportAll: true, UploadPack: true, AdminToken: "secret", Protection: &BranchProtection{Path: filepath.Join(t.TempDir(), "rules.json")}})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := Listener{Network: "tcp", Addr: ln.Addr().String()}
+	h2, err := l.server(gsh.Handler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l.serve(h2, ln)
+	defer h2.Close()
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+	url := "http://" + ln.Addr().String()
+
+	if code, _ := grpcCall(t, client, url, "ListRepositories", "wrong", repoName("")); code != grpcUnauthenticated {
+		t.Errorf("wrong token: status %d, want %d", code, grpcUnauthenticated)
+	}
+	if code, _ := grpcCall(t, client, url, "Nope", "secret", repoName("")); code != grpcUnimplemented {
+		t.Errorf("unknown method: status %d, want %d", code, grpcUnimplemented)
+	}
+
+	_, resp := grpcCall(t, client, url, "ListRepositories", "secret", repoName(""))
+	repos := protoStrings(t, resp)[1]
+	if len(repos) != 1 || protoStrings(t, []byte(repos[0]))[1][0] != "team/test.git" {
+		t.Errorf("repositories %q", repos)
+	}
+
+	code, resp := grpcCall(t, client, url, "GetRepository", "secret", repoName("team/test.git"))
+	if code != grpcOK || protoStrings(t, resp)[1][0] != "team/test.git" {
+		t.Errorf("GetRepository: status %d, response %q", code, resp)
+	}
+	if code, _ := grpcCall(t, client, url, "GetRepository", "secret", repoName("missing.git")); code != grpcNotFound {
+		t.Errorf("missing repository: status %d, want %d", code, grpcNotFound)
+	}
+	if code, _ := grpcCall(t, client, url, "SyncMirror", "secret", repoName("team/test.git")); code != grpcFailedPrecondition {
+		t.Errorf("SyncMirror without upstream: status %d, want %d", code, grpcFailedPrecondition)
+	}
+
+	code, resp = grpcCall(t, client, url, "StartGC", "secret", repoName("team/test.git"))
+	job := protoStrings(t, resp)
+	if code != grpcOK || job[2][0] != "team/test.git" || job[3][0] != GCNormal {
+		t.Fatalf("StartGC: status %d, job %v", code, job)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		code, resp = grpcCall(t, client, url, "GetGCJob", "secret", repoName(job[1][0]))
+		if code != grpcOK || protoStrings(t, resp)[1][0] != job[1][0] {
+			t.Fatalf("GetGCJob: status %d, job %q", code, resp)
+		}
+		if state := protoStrings(t, resp)[4][0]; state == GCDone {
+			break
+		} else if state == GCFailed || time.Now().After(deadline) {
+			t.Fatalf("GetGCJob: job %s", state)
+		}
+	}
+
+	if code, _ := grpcCall(t, client, url, "GetFsck", "secret", repoName("team/test.git")); code != grpcNotFound {
+		t.Errorf("GetFsck before StartFsck: status %d, want %d", code, grpcNotFound)
+	}
+	if code, _ := grpcCall(t, client, url, "StartFsck", "secret", repoName("team/test.git")); code != grpcOK {
+		t.Fatalf("StartFsck: status %d", code)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		code, resp = grpcCall(t, client, url, "GetFsck", "secret", repoName("team/test.git"))
+		if code != grpcOK {
+			t.Fatalf("GetFsck: status %d", code)
+		}
+		if state := protoStrings(t, resp)[1][0]; state == FsckOK {
+			break
+		} else if state == FsckFailed || time.Now().After(deadline) {
+			t.Fatalf("GetFsck: %s %q", state, protoStrings(t, resp)[4])
+		}
+	}
+
+	rules := protectionRules{{Ref: "refs/tags/*", Immutable: true}}
+	if code, resp = grpcCall(t, client, url, "SetProtectionRules", "secret", rules); code != grpcOK {
+		t.Fatalf("SetProtectionRules: status %d", code)
+	}
+	if rule := protoStrings(t, resp)[1]; len(rule) != 1 || protoStrings(t, []byte(rule[0]))[2][0] != "refs/tags/*" {
+		t.Errorf("rules set %q", rule)
+	}
+	if stored, err := os.ReadFile(gsh.Protection.Path); err != nil || !bytes.Contains(stored, []byte(`"immutable": true`)) {
+		t.Errorf("rules stored %q, %v", stored, err)
+	}
+	if code, _ := grpcCall(t, client, url, "SetProtectionRules", "secret", protectionRules{{Ref: "["}}); code != grpcInvalidArgument {
+		t.Errorf("invalid rule: status %d, want %d", code, grpcInvalidArgument)
+	}
+
+	// Git keeps working over HTTP/1.1 on the same listener
+	githttptest.Git(t, "", "ls-remote", url+"/team/test.git")
+}
@@ -0,0 +1,36 @@
+package githttp
+
+import (
+	"io"
+	"strings"
+)
+
+// motdFile is the file in a repository holding its message of the day
+const motdFile = "motd"
+
+// motd returns the message of the day shown to clients fetching from or
+// pushing to the repository: the global one followed by the one of the
+// repository, if any.
+func (gsh GitSmartHTTP) motd(repoPath string) string {
+	var msg strings.Builder
+	for _, m := range []string{gsh.MOTD, gsh.repoMOTD(repoPath)} {
+		if m = strings.TrimRight(m, "\n"); m != "" {
+			msg.WriteString(m + "\n")
+		}
+	}
+	return msg.String()
+}
+
+func (gsh GitSmartHTTP) repoMOTD(repoPath string) string {
+	f, err := gsh.storage().Open(repoPath, motdFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	b, err := io.ReadAll(io.LimitReader(f, 4096))
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
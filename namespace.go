@@ -0,0 +1,82 @@
+package githttp
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// namespaceHeader names the namespace of a request as an alternative to a
+// /<repo>/ns/<namespace>/ URL
+const namespaceHeader = "Git-Namespace"
+
+var (
+	namespaceURL   = regexp.MustCompile(`^(.*)/ns/([^/]+)(/info/refs|/git-upload-pack|/git-receive-pack)$`)
+	validNamespace = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+)
+
+type namespaceKey struct{}
+
+// withNamespace moves the git namespace of a smart HTTP request, given in
+// its URL or header, into its context, leaving the URL of the repository
+// that holds the namespace.
+func (gsh GitSmartHTTP) withNamespace(r *http.Request) (*http.Request, error) {
+	if !gsh.Namespaces {
+		return r, nil
+	}
+
+	ns := r.Header.Get(namespaceHeader)
+	if m := namespaceURL.FindStringSubmatch(r.URL.Path); m != nil {
+		ns = m[2]
+		u := *r.URL
+		u.Path = m[1] + m[3]
+		u.RawPath = ""
+		r = r.WithContext(r.Context())
+		r.URL = &u
+	}
+	if ns == "" {
+		return r, nil
+	}
+
+	// Dumb HTTP serves repository files, which are not namespaced.
+	if !validNamespace.MatchString(ns) || strings.Contains(ns, "..") || !isSmartRequest(r) {
+		return r, ErrRepoNotFound
+	}
+	return r.WithContext(context.WithValue(r.Context(), namespaceKey{}, ns)), nil
+}
+
+// namespace returns the git namespace requested in ctx, if any
+func namespace(ctx context.Context) string {
+	ns, _ := ctx.Value(namespaceKey{}).(string)
+	return ns
+}
+
+// namespaceEnv returns the environment git serves the namespace of ctx with
+func namespaceEnv(ctx context.Context) []string {
+	if ns := namespace(ctx); ns != "" {
+		return []string{"GIT_NAMESPACE=" + ns}
+	}
+	return nil
+}
+
+// namespacedRefUpdates returns the updates with the names their refs are
+// stored under in the namespace of ctx.
+func namespacedRefUpdates(ctx context.Context, updates []RefUpdate) []RefUpdate {
+	ns := namespace(ctx)
+	if ns == "" {
+		return updates
+	}
+	namespaced := make([]RefUpdate, len(updates))
+	for i, u := range updates {
+		u.Ref = "refs/namespaces/" + ns + "/" + u.Ref
+		namespaced[i] = u
+	}
+	return namespaced
+}
+
+func isSmartRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/git-upload-pack") ||
+		strings.HasSuffix(r.URL.Path, "/git-receive-pack") ||
+		(strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") != "")
+}
@@ -0,0 +1,47 @@
+package githttp
+
+import (
+	"net/http"
+	"testing"
+)
+
+// namespaceChecker denies the namespace secret
+type namespaceChecker struct{}
+
+func (namespaceChecker) CheckAccess(r *http.Request, id *Identity, repo string, op Operation) error {
+	if info, _ := RequestInfoFromContext(r.Context()); info.Namespace == "secret" {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+func TestNamespaceAccessCheck(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{Namespaces: true, Access: namespaceChecker{}})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	for _, c := range []struct {
+		path, header string
+		status       int
+	}{
+		{"/test.git/info/refs?service=git-upload-pack", "", http.StatusOK},
+		{"/test.git/ns/public/info/refs?service=git-upload-pack", "", http.StatusOK},
+		{"/test.git/ns/secret/info/refs?service=git-upload-pack", "", http.StatusForbidden},
+		{"/test.git/info/refs?service=git-upload-pack", "secret", http.StatusForbidden},
+	} {
+		req, err := http.NewRequest("GET", srv.URL+c.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.header != "" {
+			req.Header.Set(namespaceHeader, c.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s (header %q): status %d, want %d", c.path, c.header, resp.StatusCode, c.status)
+		}
+	}
+}
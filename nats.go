@@ -0,0 +1,99 @@
+package githttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSPublisher publishes events to a subject of a NATS server, using the
+// plain text client protocol. Every publish is followed by a PING, and only
+// counts as delivered once the server answered it with a PONG.
+type NATSPublisher struct {
+	Addr    string
+	Subject string
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewNATSPublisher returns a NATSPublisher for the server at addr
+func NewNATSPublisher(addr, subject string) *NATSPublisher {
+	return &NATSPublisher{
+		Addr:    addr,
+		Subject: subject,
+		Timeout: 5 * time.Second,
+	}
+}
+
+func (p *NATSPublisher) Publish(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	p.conn.SetDeadline(time.Now().Add(p.Timeout))
+	_, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\nPING\r\n", p.Subject, len(data), data)
+	if err == nil {
+		err = p.awaitPong()
+	}
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+// connect dials the server, reads its INFO and sends CONNECT
+func (p *NATSPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.Addr, p.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(p.Timeout))
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return errors.New("nats: no INFO from server")
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"git-http-backend\"}\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn, p.r = conn, r
+	return nil
+}
+
+func (p *NATSPublisher) awaitPong() error {
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("nats: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
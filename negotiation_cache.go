@@ -0,0 +1,101 @@
+package githttp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NegotiationSessionHeader names the session the upload-pack requests of a
+// single fetch share, which clients send with http.extraHeader
+const NegotiationSessionHeader = "Git-Negotiation-Session"
+
+// maxNegotiationResponse is the largest negotiation round response cached
+const maxNegotiationResponse = 1 << 20
+
+// DefaultNegotiationCacheSize is how many bytes the negotiation rounds
+// cached in memory take at most by default
+const DefaultNegotiationCacheSize = 16 << 20
+
+// negotiationCache keeps the responses to the negotiation rounds of
+// upload-pack sessions. Over stateless RPC every round of a fetch is a POST
+// repeating the wants and the common haves found so far, and clients
+// retrying a round, or several rounds ending up with the same haves, would
+// have git walk the same commits again. Rounds are answered from the cache
+// when their session sent the same request before and the refs of the
+// repository have not changed since. The final round, which carries the
+// pack, is never cached here.
+type negotiationCache struct {
+	store Cache
+	ttl   time.Duration
+}
+
+func newNegotiationCache(store Cache, ttl time.Duration) *negotiationCache {
+	return &negotiationCache{store: store, ttl: ttl}
+}
+
+// Serve writes the response to the round with the given request body into
+// w, either from the cache or by calling run and storing what it writes.
+func (c *negotiationCache) Serve(w io.Writer, key string, reqBody []byte, run func(io.Writer) error) error {
+	if negotiationDone(reqBody) {
+		return run(w)
+	}
+
+	if resp, ok := c.store.Get(key); ok {
+		_, err := w.Write(resp)
+		return err
+	}
+
+	var resp bytes.Buffer
+	err := run(io.MultiWriter(w, &resp))
+	if err == nil && resp.Len() <= maxNegotiationResponse {
+		c.store.Set(key, resp.Bytes(), c.ttl)
+	}
+	return err
+}
+
+// negotiationKey identifies a negotiation round of a session by everything
+// its response depends on.
+func (gsh GitSmartHTTP) negotiationKey(r *http.Request, session, repoPath string, reqBody []byte) string {
+	h := sha256.New()
+	for _, s := range []string{
+		session,
+		repoPath,
+		namespace(r.Context()),
+		strconv.FormatBool(hiddenRefsShown(r.Context())),
+		r.Header.Get("Git-Protocol"),
+		strconv.FormatInt(refsStamp(gsh.storage(), repoPath).UnixNano(), 10),
+	} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	h.Write(reqBody)
+	return "negotiation:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// negotiationDone tells whether an upload-pack request ends the
+// negotiation, asking for the pack.
+func negotiationDone(reqBody []byte) bool {
+	for len(reqBody) >= 4 {
+		size, err := strconv.ParseUint(string(reqBody[:4]), 16, 16)
+		if err != nil {
+			return true
+		}
+		if size <= 4 {
+			reqBody = reqBody[4:]
+			continue
+		}
+		if int(size) > len(reqBody) {
+			return true
+		}
+		if string(bytes.TrimSuffix(reqBody[4:size], []byte("\n"))) == "done" {
+			return true
+		}
+		reqBody = reqBody[size:]
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package githttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNegotiationCacheBounded(t *testing.T) {
+	shared := newMemoryCache(0, 0)
+	gsh := NewGitSmartHTTP(&GitSmartHTTPConfig{ReposRootPath: t.TempDir(), Cache: shared, NegotiationCacheTTL: time.Hour, NegotiationCacheSize: 4 << 10})
+	store, ok := gsh.negotiations.store.(*memoryCache)
+	if !ok || store == shared || store.maxBytes != 4<<10 {
+		t.Fatalf("negotiations cached in %T, want a memory cache of their own", gsh.negotiations.store)
+	}
+
+	// Every client session gets rounds of its own
+	round := bytes.Repeat([]byte("x"), 1<<10)
+	for i := 0; i < 16; i++ {
+		err := gsh.negotiations.Serve(io.Discard, fmt.Sprintf("negotiation:%d", i), []byte("0000"), func(w io.Writer) error {
+			_, err := w.Write(round)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.bytes > 4<<10 || store.lru.Len() == 0 {
+		t.Errorf("negotiation rounds take %d bytes, want at most %d", store.bytes, 4<<10)
+	}
+	if shared.lru.Len() != 0 {
+		t.Errorf("%d negotiation rounds in the shared cache", shared.lru.Len())
+	}
+}
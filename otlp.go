@@ -0,0 +1,234 @@
+package githttp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otlpBatchSize is how many spans are sent at most in one export
+const otlpBatchSize = 512
+
+// Span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// Span is a finished span, exported by an OTLPExporter
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]string
+	// Err marks the span as failed when not empty
+	Err string
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector with OTLP over
+// HTTP, encoded as JSON, such as http://localhost:4318/v1/traces. Spans
+// are batched and sent every Interval. Spans are dropped when the
+// collector cannot keep up.
+type OTLPExporter struct {
+	URL      string
+	Service  string
+	Interval time.Duration
+	Client   *http.Client
+
+	once  sync.Once
+	spans chan Span
+}
+
+// NewOTLPExporter returns an OTLPExporter sending spans to url every five
+// seconds
+func NewOTLPExporter(url, service string) *OTLPExporter {
+	return &OTLPExporter{
+		URL:      url,
+		Service:  service,
+		Interval: 5 * time.Second,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Export queues finished spans to be sent
+func (e *OTLPExporter) Export(spans ...Span) {
+	e.once.Do(func() {
+		e.spans = make(chan Span, 8*otlpBatchSize)
+		go e.run()
+	})
+	for _, s := range spans {
+		select {
+		case e.spans <- s:
+		default:
+		}
+	}
+}
+
+func (e *OTLPExporter) run() {
+	tick := time.NewTicker(e.Interval)
+	defer tick.Stop()
+
+	var batch []Span
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := e.send(batch); err != nil {
+			log.Printf("Cannot export %d spans to %s: %s", len(batch), e.URL, err)
+		}
+		batch = nil
+	}
+}
+
+func (e *OTLPExporter) send(batch []Span) error {
+	type value struct {
+		StringValue string `json:"stringValue"`
+	}
+	type attr struct {
+		Key   string `json:"key"`
+		Value value  `json:"value"`
+	}
+	attrs := func(m map[string]string) []attr {
+		out := make([]attr, 0, len(m))
+		for k, v := range m {
+			out = append(out, attr{k, value{v}})
+		}
+		return out
+	}
+	type status struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId,omitempty"`
+		Name         string `json:"name"`
+		Kind         int    `json:"kind"`
+		Start        string `json:"startTimeUnixNano"`
+		End          string `json:"endTimeUnixNano"`
+		Attributes   []attr `json:"attributes,omitempty"`
+		Status       status `json:"status"`
+	}
+
+	spans := make([]span, len(batch))
+	for i, s := range batch {
+		spans[i] = span{
+			TraceID:    hex.EncodeToString(s.TraceID[:]),
+			SpanID:     hex.EncodeToString(s.SpanID[:]),
+			Name:       s.Name,
+			Kind:       s.Kind,
+			Start:      strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes: attrs(s.Attrs),
+		}
+		if s.ParentID != ([8]byte{}) {
+			spans[i].ParentSpanID = hex.EncodeToString(s.ParentID[:])
+		}
+		if s.Err != "" {
+			spans[i].Status = status{Code: 2, Message: s.Err}
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": attrs(map[string]string{"service.name": e.Service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "git-http-backend"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.Client.Post(e.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// newSpanID returns a random span ID
+func newSpanID() [8]byte {
+	var id [8]byte
+	rand.Read(id[:])
+	return id
+}
+
+// startSpan starts the server span of a request, continuing the trace of
+// its W3C traceparent header when it has one
+func startSpan(r *http.Request, name string) *Span {
+	s := &Span{Name: name, Kind: spanKindServer, SpanID: newSpanID(), Start: time.Now(), Attrs: make(map[string]string)}
+
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		trace, err1 := hex.DecodeString(parts[1])
+		parent, err2 := hex.DecodeString(parts[2])
+		if err1 == nil && err2 == nil {
+			copy(s.TraceID[:], trace)
+			copy(s.ParentID[:], parent)
+			return s
+		}
+	}
+	rand.Read(s.TraceID[:])
+	return s
+}
+
+// exportRequest ends the span of a request and exports it along with the
+// spans of the git processes run for it and their regions, so that the
+// time not spent in git shows as network and queueing time
+func (e *OTLPExporter) exportRequest(req *Span, t *trace2Summary) {
+	req.End = time.Now()
+	spans := []Span{*req}
+	if t != nil {
+		t.mu.Lock()
+		ids := make([][8]byte, len(t.spans))
+		for i, s := range t.spans {
+			ids[i] = newSpanID()
+			parent := req.SpanID
+			if s.parent >= 0 {
+				parent = ids[s.parent]
+			}
+			spans = append(spans, Span{
+				TraceID:  req.TraceID,
+				SpanID:   ids[i],
+				ParentID: parent,
+				Name:     s.name,
+				Kind:     spanKindInternal,
+				Start:    s.start,
+				End:      s.end,
+				Attrs:    s.attrs,
+			})
+		}
+		t.mu.Unlock()
+	}
+	e.Export(spans...)
+}
@@ -0,0 +1,128 @@
+package githttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// otlpSpan is a span as the collector gets it
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Attributes   []struct {
+		Key   string `json:"key"`
+		Value struct {
+			StringValue string `json:"stringValue"`
+		} `json:"value"`
+	} `json:"attributes"`
+}
+
+func (s otlpSpan) attr(key string) string {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.StringValue
+		}
+	}
+	return ""
+}
+
+func TestOTLPTracing(t *testing.T) {
+	var mu sync.Mutex
+	var spans []otlpSpan
+	var services []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key   string `json:"key"`
+						Value struct {
+							StringValue string `json:"stringValue"`
+						} `json:"value"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad export", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, a := range rs.Resource.Attributes {
+				if a.Key == "service.name" {
+					services = append(services, a.Value.StringValue)
+				}
+			}
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL+"/v1/traces", "githttp-test")
+	exporter.Interval = 10 * time.Millisecond
+	srv := newTestServer(t, GitSmartHTTPConfig{Tracing: exporter})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	const traceID, parentID = "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331"
+	srv.Clone("test.git", "-c", "http.extraHeader=traceparent: 00-"+traceID+"-"+parentID+"-01")
+
+	// The fetch continues the trace of the client, with the processes git
+	// ran and their regions below it
+	byID := make(map[string]otlpSpan)
+	var region otlpSpan
+	waitFor(t, "the fetch to be exported", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range spans {
+			byID[s.SpanID] = s
+			if s.Name == "write-pack-file" {
+				region = s
+			}
+		}
+		packObjects := byID[region.ParentSpanID]
+		uploadPack := byID[packObjects.ParentSpanID]
+		_, ok := byID[uploadPack.ParentSpanID]
+		return ok
+	})
+	packObjects := byID[region.ParentSpanID]
+	uploadPack := byID[packObjects.ParentSpanID]
+	fetch := byID[uploadPack.ParentSpanID]
+	if packObjects.Name != "git pack-objects" || uploadPack.Name != "git upload-pack" || fetch.Name != "POST git-upload-pack" {
+		t.Errorf("write-pack-file below %q below %q below %q, want pack-objects, upload-pack and the fetch", packObjects.Name, uploadPack.Name, fetch.Name)
+	}
+	for _, s := range []otlpSpan{region, packObjects, uploadPack} {
+		if s.TraceID != traceID || s.Kind != spanKindInternal {
+			t.Errorf("span %s in trace %s of kind %d, want %s and internal", s.Name, s.TraceID, s.Kind, traceID)
+		}
+	}
+	if fetch.TraceID != traceID || fetch.ParentSpanID != parentID || fetch.Kind != spanKindServer {
+		t.Errorf("fetch span in trace %s under %s, want %s under %s", fetch.TraceID, fetch.ParentSpanID, traceID, parentID)
+	}
+	if fetch.attr("git.repo") != "test.git" || fetch.attr("http.response.body.size") == "" {
+		t.Errorf("fetch span attributes %+v, want the repository and sizes", fetch.Attributes)
+	}
+	if uploadPack.attr("git.exit_code") != "0" {
+		t.Errorf("upload-pack span attributes %+v, want its exit code", uploadPack.Attributes)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, service := range services {
+		if service != "githttp-test" {
+			t.Errorf("spans exported for service %q", service)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package githttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ownerUsageTTL is how long the disk usage of an owner is reused, unless
+// a push or restore changes it
+const ownerUsageTTL = time.Minute
+
+// OwnerUsage is the disk usage of the repositories of an owner, the user
+// or organization whose directory they are in, like team-x of
+// team-x/app.git
+type OwnerUsage struct {
+	Owner string `json:"owner"`
+	Repos int    `json:"repos"`
+	Used  int64  `json:"used"`
+	// Quota is zero when the owner has no quota
+	Quota int64 `json:"quota"`
+}
+
+// ownerQuotas limits the disk space the repositories of each owner take
+// together, rejecting pushes and restores of new repositories once the
+// quota is used up. Repositories at the top of the repositories root have
+// no owner and no quota.
+type ownerQuotas struct {
+	gsh GitSmartHTTP
+	// quota applies to owners missing from quotas
+	quota  int64
+	quotas map[string]int64
+
+	mu    sync.Mutex
+	usage map[string]OwnerUsage
+	at    map[string]time.Time
+}
+
+func newOwnerQuotas(gsh GitSmartHTTP, quota int64, quotas map[string]int64) *ownerQuotas {
+	return &ownerQuotas{
+		gsh:    gsh,
+		quota:  quota,
+		quotas: quotas,
+		usage:  make(map[string]OwnerUsage),
+		at:     make(map[string]time.Time),
+	}
+}
+
+// LoadOwnerQuotas reads a JSON object of quotas in bytes by owner
+func LoadOwnerQuotas(path string) (map[string]int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var quotas map[string]int64
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return quotas, nil
+}
+
+// repoOwner returns the owner of the repository, empty for repositories at
+// the top of the repositories root
+func repoOwner(repo string) string {
+	owner, _, ok := strings.Cut(strings.TrimPrefix(repo, "/"), "/")
+	if !ok {
+		return ""
+	}
+	return owner
+}
+
+// Quota returns the quota of the owner, zero meaning no quota
+func (q *ownerQuotas) Quota(owner string) int64 {
+	if quota, ok := q.quotas[owner]; ok {
+		return quota
+	}
+	return q.quota
+}
+
+// Usage returns the disk usage of the owner
+func (q *ownerQuotas) Usage(owner string) (OwnerUsage, error) {
+	q.mu.Lock()
+	u, ok := q.usage[owner]
+	at := q.at[owner]
+	q.mu.Unlock()
+	if ok && time.Since(at) < ownerUsageTTL {
+		return u, nil
+	}
+
+	u = OwnerUsage{Owner: owner, Quota: q.Quota(owner)}
+	root := filepath.Join(q.gsh.ReposRootPath, owner)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if dir, ok := gitDir(p); ok {
+			u.Repos++
+			u.Used += dirSize(dir)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return u, err
+	}
+
+	q.mu.Lock()
+	q.usage[owner] = u
+	q.at[owner] = time.Now()
+	q.mu.Unlock()
+	return u, nil
+}
+
+// Invalidate drops the usage of the owner of the repository
+func (q *ownerQuotas) Invalidate(repo string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.usage, repoOwner(repo))
+}
+
+// check makes sure the owner of the repository has incoming bytes left
+func (q *ownerQuotas) check(repo string, incoming int64) error {
+	owner := repoOwner(repo)
+	if owner == "" || q.Quota(owner) <= 0 {
+		return nil
+	}
+	u, err := q.Usage(owner)
+	if err != nil {
+		return err
+	}
+	if incoming < 0 {
+		incoming = 0
+	}
+	if u.Used+incoming > u.Quota {
+		return fmt.Errorf("%w: %s uses %d of its %d bytes", ErrQuotaExceeded, owner, u.Used, u.Quota)
+	}
+	return nil
+}
+
+// owners returns the directories at the top of the repositories root
+// holding repositories
+func (q *ownerQuotas) owners() ([]string, error) {
+	entries, err := os.ReadDir(q.gsh.ReposRootPath)
+	if err != nil {
+		return nil, err
+	}
+	var owners []string
+	for _, e := range entries {
+		p := filepath.Join(q.gsh.ReposRootPath, e.Name())
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if _, ok := gitDir(p); !ok {
+			owners = append(owners, e.Name())
+		}
+	}
+	sort.Strings(owners)
+	return owners, nil
+}
+
+// ServeHTTP serves the usage of every owner at /api/owners and that of one
+// at /api/owners/<owner>
+func (q *ownerQuotas) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, []string{"GET"})
+		return
+	}
+
+	var body interface{}
+	owner := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/owners"), "/")
+	switch {
+	case owner == "":
+		owners, err := q.owners()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		usages := []OwnerUsage{}
+		for _, owner := range owners {
+			u, err := q.Usage(owner)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			if u.Repos > 0 {
+				usages = append(usages, u)
+			}
+		}
+		body = usages
+	case strings.Contains(owner, "/") || strings.HasPrefix(owner, "."):
+		writeErrorMessage(w, r, http.StatusNotFound, "not found")
+		return
+	default:
+		u, err := q.Usage(owner)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if u.Repos == 0 {
+			writeErrorMessage(w, r, http.StatusNotFound, "not found")
+			return
+		}
+		body = u
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,76 @@
+package githttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestOwnerQuotas(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{
+		AdminToken:  testAdminToken,
+		OwnerQuota:  1 << 30,
+		OwnerQuotas: map[string]int64{"small": 1},
+	})
+	srv.CreateRepo("small/app.git", map[string]string{"README": "hello\n"})
+	srv.CreateRepo("big/app.git", map[string]string{"README": "hello\n"})
+	srv.CreateRepo("top.git", map[string]string{"README": "hello\n"})
+
+	usage := func(owner string) OwnerUsage {
+		t.Helper()
+		resp, body := adminRequest(t, "GET", srv.URL+"/api/owners/"+owner, "")
+		var u OwnerUsage
+		if resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(body), &u) != nil {
+			t.Fatalf("usage of %s: %d %s", owner, resp.StatusCode, body)
+		}
+		return u
+	}
+	before := usage("big")
+	if before.Repos != 1 || before.Used == 0 || before.Quota != 1<<30 {
+		t.Errorf("usage of big %+v, want a repository under the default quota", before)
+	}
+
+	// Owners over their quota cannot push, others can
+	for _, repo := range []string{"small/app.git", "big/app.git", "top.git"} {
+		work := srv.Clone(repo)
+		githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+		if repo == "small/app.git" {
+			if out := srv.PushRejected(work, "HEAD:master"); !strings.Contains(out, "507") {
+				t.Errorf("push over the quota: %s, want a 507", out)
+			}
+			continue
+		}
+		srv.Push(work, "HEAD:master")
+	}
+	if after := usage("big"); after.Used <= before.Used {
+		t.Errorf("usage of big %d after a push, want more than %d", after.Used, before.Used)
+	}
+
+	// Nor restore new repositories
+	_, bundle := adminRequest(t, "GET", srv.URL+"/api/repos/top.git/bundle", "")
+	if resp, body := adminRequest(t, "PUT", srv.URL+"/api/repos/small/restored.git/bundle", bundle); resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("restore over the quota: %d %s, want 507", resp.StatusCode, body)
+	}
+	if resp, body := adminRequest(t, "PUT", srv.URL+"/api/repos/big/restored.git/bundle", bundle); resp.StatusCode != http.StatusCreated {
+		t.Errorf("restore within the quota: %d %s, want 201", resp.StatusCode, body)
+	}
+
+	resp, body := adminRequest(t, "GET", srv.URL+"/api/owners", "")
+	var usages []OwnerUsage
+	if resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(body), &usages) != nil {
+		t.Fatalf("owners: %d %s", resp.StatusCode, body)
+	}
+	if len(usages) != 2 || usages[0].Owner != "big" || usages[0].Repos != 2 || usages[1].Owner != "small" || usages[1].Quota != 1 {
+		t.Errorf("owners %s, want big with 2 repositories and small", body)
+	}
+
+	if resp, _ := adminRequest(t, "GET", srv.URL+"/api/owners/nobody", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("usage of an unknown owner: %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := request(t, "GET", srv.URL+"/api/owners", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("owners without the admin token: %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,152 @@
+package githttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// packCache stores upload-pack responses on disk, keyed by repository and
+// the hash of the negotiation request. Identical requests, such as the full
+// clones of many CI jobs started at once, run pack-objects only once: the
+// first request fills the cache while the others wait for it.
+type packCache struct {
+	Dir string
+	TTL time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]*packCacheCall
+}
+
+type packCacheCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newPackCache(dir string, ttl time.Duration) *packCache {
+	c := &packCache{
+		Dir:      dir,
+		TTL:      ttl,
+		inflight: make(map[string]*packCacheCall),
+	}
+	if ttl > 0 {
+		go c.pruneLoop()
+	}
+	return c
+}
+
+// Serve writes the response for the request body into w, either from the
+// cache or by calling run and storing what it writes. variant tells apart
+// responses that differ for the same request body.
+func (c *packCache) Serve(w io.Writer, repoPath, variant string, reqBody []byte, run func(io.Writer) error) error {
+	key := packCacheKey(repoPath, variant, reqBody)
+
+	if c.serveCached(w, key) {
+		return nil
+	}
+
+	c.mu.Lock()
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		if call.err == nil && c.serveCached(w, key) {
+			return nil
+		}
+		return run(w)
+	}
+
+	call := &packCacheCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.err = c.fill(w, key, run)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.err
+}
+
+func (c *packCache) serveCached(w io.Writer, key string) bool {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil || time.Since(fi.ModTime()) > c.TTL {
+		return false
+	}
+
+	// A cache hit is a plain file, which copyBuffer hands to the
+	// connection without a userspace copy.
+	copyBuffer(w, f)
+	return true
+}
+
+func (c *packCache) fill(w io.Writer, key string, run func(io.Writer) error) error {
+	fullPath := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		log.Printf("Cannot create pack cache directory: %s", err)
+		return run(w)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fullPath), "tmp-")
+	if err != nil {
+		log.Printf("Cannot create pack cache file: %s", err)
+		return run(w)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = run(io.MultiWriter(tmp, w))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fullPath)
+}
+
+func (c *packCache) path(key string) string {
+	return filepath.Join(c.Dir, key[:2], key)
+}
+
+// pruneLoop removes expired responses from the cache directory.
+func (c *packCache) pruneLoop() {
+	for range time.Tick(c.TTL) {
+		pruneCacheDir(c.Dir, c.TTL)
+	}
+}
+
+// pruneCacheDir removes every file below dir older than ttl
+func pruneCacheDir(dir string, ttl time.Duration) {
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return nil
+		}
+		if time.Since(fi.ModTime()) > ttl {
+			os.Remove(p)
+		}
+		return nil
+	})
+}
+
+func packCacheKey(repoPath, variant string, reqBody []byte) string {
+	h := sha256.New()
+	io.WriteString(h, repoPath)
+	h.Write([]byte{0})
+	io.WriteString(h, variant)
+	h.Write([]byte{0})
+	h.Write(reqBody)
+	return hex.EncodeToString(h.Sum(nil))
+}
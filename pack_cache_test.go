@@ -0,0 +1,95 @@
+package githttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+// truncatedFetch posts a fetch of want whose gzip body ends before its
+// trailer, so that the whole request is read but fails to decompress
+func truncatedFetch(t *testing.T, url, want string, header http.Header) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	fmt.Fprintf(zw, "%04xwant %s\n0000", len("want \n")+len(want)+4, want)
+	fmt.Fprintf(zw, "0009done\n")
+	zw.Close()
+
+	req, err := http.NewRequest("POST", url+"/git-upload-pack", bytes.NewReader(buf.Bytes()[:buf.Len()-4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestPackCacheTruncatedRequest(t *testing.T) {
+	dir := t.TempDir()
+	srv := newTestServer(t, GitSmartHTTPConfig{PackCacheDir: dir, PackCacheTTL: time.Hour, NegotiationCacheTTL: time.Hour})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	head := srv.Ref("test.git", "refs/heads/master")
+
+	if resp := truncatedFetch(t, srv.RepoURL("test.git"), head, http.Header{}); resp.StatusCode == http.StatusOK {
+		t.Error("truncated request served")
+	}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("truncated request cached as %s", path)
+		}
+		return nil
+	})
+
+	session := http.Header{NegotiationSessionHeader: {"session"}}
+	if resp := truncatedFetch(t, srv.RepoURL("test.git"), head, session); resp.StatusCode == http.StatusOK {
+		t.Error("truncated request served in a negotiation session")
+	}
+}
+
+func TestCachedClone(t *testing.T) {
+	var gsh GitSmartHTTP
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh = NewGitSmartHTTP(&GitSmartHTTPConfig{
+			ReposRootPath: root,
+			ExportAll:     true,
+			UploadPack:    true,
+			ReceivePack:   true,
+			RefsCache:     true,
+			PackCacheDir:  t.TempDir(),
+			PackCacheTTL:  time.Hour,
+		})
+		return gsh.Handler()
+	})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	work := srv.Clone("test.git")
+	spawned := gsh.Processes().Spawned
+	again := srv.Clone("test.git")
+	if n := gsh.Processes().Spawned - spawned; n != 0 {
+		t.Errorf("identical clone ran %d git processes, want none", n)
+	}
+	if got, want := githttptest.Git(t, again, "rev-parse", "HEAD"), githttptest.Git(t, work, "rev-parse", "HEAD"); got != want {
+		t.Errorf("cached clone at %s, want %s", got, want)
+	}
+
+	// A push changes both the advertisement and what clones ask for
+	head := githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+	srv.Push(work, "HEAD:master")
+	if got := githttptest.Git(t, srv.Clone("test.git"), "rev-parse", "HEAD"); got != head {
+		t.Errorf("clone after push at %s, want %s", got, head)
+	}
+}
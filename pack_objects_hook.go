@@ -0,0 +1,151 @@
+package githttp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PackObjectsHookCmd is the name of the command running RunPackObjectsHook,
+// which the binary serving the repositories must dispatch to
+const PackObjectsHookCmd = "pack-objects-hook"
+
+// packObjectsHookConfig returns the uploadpack.packObjectsHook setting that
+// makes upload-pack run pack-objects through this binary, caching its output
+// in cacheDir.
+func packObjectsHookConfig(cacheDir string, ttl time.Duration) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	hook := strings.Join([]string{
+		shellQuote(self),
+		PackObjectsHookCmd,
+		shellQuote(cacheDir),
+		shellQuote(ttl.String()),
+	}, " ")
+	return "uploadpack.packObjectsHook=" + hook, nil
+}
+
+// RunPackObjectsHook is the entry point of the pack-objects-hook command.
+// Git invokes it as `<hook> git pack-objects <args>` from within the
+// repository; identical invocations, meaning the same repository, arguments
+// and stdin, are answered from the cache while it is fresh. While one
+// invocation fills the cache, identical ones wait for it instead of running
+// pack-objects themselves.
+func RunPackObjectsHook(args []string) int {
+	if len(args) < 3 {
+		fmt.Fprintf(os.Stderr, "usage: %s <cache-dir> <ttl> git pack-objects [args...]\n", PackObjectsHookCmd)
+		return 1
+	}
+
+	cacheDir := args[0]
+	ttl, err := time.ParseDuration(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid ttl: %s\n", PackObjectsHookCmd, err)
+		return 1
+	}
+	command := args[2:]
+
+	stdin, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: cannot read stdin: %s\n", PackObjectsHookCmd, err)
+		return 1
+	}
+
+	pwd, _ := os.Getwd()
+	h := sha256.New()
+	io.WriteString(h, pwd)
+	for _, arg := range command {
+		h.Write([]byte{0})
+		io.WriteString(h, arg)
+	}
+	h.Write([]byte{0})
+	h.Write(stdin)
+	key := hex.EncodeToString(h.Sum(nil))
+
+	cachePath := filepath.Join(cacheDir, key[:2], key)
+	lockPath := cachePath + ".lock"
+
+	if servePackObjects(cachePath, ttl) {
+		return 0
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return runPackObjects(command, stdin, os.Stdout)
+	}
+
+	lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		// Somebody else is packing the same objects, wait for them.
+		for deadline := time.Now().Add(ttl); time.Now().Before(deadline); {
+			if _, err := os.Stat(lockPath); os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if servePackObjects(cachePath, ttl) {
+			return 0
+		}
+		return runPackObjects(command, stdin, os.Stdout)
+	}
+	lock.Close()
+	defer os.Remove(lockPath)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(cachePath), "tmp-")
+	if err != nil {
+		return runPackObjects(command, stdin, os.Stdout)
+	}
+	defer os.Remove(tmp.Name())
+
+	code := runPackObjects(command, stdin, io.MultiWriter(tmp, os.Stdout))
+	if err := tmp.Close(); err == nil && code == 0 {
+		os.Rename(tmp.Name(), cachePath)
+	}
+	return code
+}
+
+func servePackObjects(cachePath string, ttl time.Duration) bool {
+	f, err := os.Open(cachePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err != nil || time.Since(fi.ModTime()) > ttl {
+		return false
+	}
+
+	_, err = io.Copy(os.Stdout, f)
+	return err == nil
+}
+
+func runPackObjects(command []string, stdin []byte, stdout io.Writer) int {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintf(os.Stderr, "%s: %s\n", PackObjectsHookCmd, err)
+		return 1
+	}
+	return 0
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,143 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// pktMaxLen is the largest pkt-line git sends, length header included
+const pktMaxLen = 65520
+
+func isPktFlush(raw []byte) bool {
+	return string(raw) == pktFlush()
+}
+
+// peekCapabilities returns the capabilities sent with the first pkt-line of
+// an upload-pack or receive-pack request without consuming anything.
+func peekCapabilities(br *bufio.Reader) []string {
+	header, err := br.Peek(4)
+	if err != nil {
+		return nil
+	}
+
+	size, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil || size <= 4 {
+		return nil
+	}
+
+	line, err := br.Peek(int(size))
+	if err != nil {
+		return nil
+	}
+	line = bytes.TrimSuffix(line[4:], []byte("\n"))
+
+	// receive-pack sends them after a NUL, upload-pack after the first want
+	if i := bytes.IndexByte(line, 0); i >= 0 {
+		return strings.Fields(string(line[i+1:]))
+	}
+	if fields := strings.Fields(string(line)); len(fields) > 2 && fields[0] == "want" {
+		return fields[2:]
+	}
+	return nil
+}
+
+func hasCapability(caps []string, name string) bool {
+	for _, c := range caps {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// capabilityValue returns the value of a capability given as name=value,
+// such as session-id, empty when it is missing
+func capabilityValue(caps []string, name string) string {
+	for _, c := range caps {
+		if v, ok := strings.CutPrefix(c, name+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// sidebandMessages returns msg as pkt-lines of the given sideband channel,
+// split into lines that each fit into a packet of at most maxLen bytes.
+func sidebandMessages(band byte, msg string, maxLen int) string {
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(msg, "\n") {
+		for len(line) > 0 {
+			n := len(line)
+			if n > maxLen-5 {
+				n = maxLen - 5
+			}
+			out.WriteString(pktWrite(string(band) + line[:n]))
+			line = line[n:]
+		}
+	}
+	return out.String()
+}
+
+// sidebandMaxLen returns the largest packet the client accepts on a sideband
+// channel, or zero when it did not ask for one.
+func sidebandMaxLen(caps []string) int {
+	if hasCapability(caps, "side-band-64k") {
+		return pktMaxLen
+	}
+	if hasCapability(caps, "side-band") {
+		return 1000
+	}
+	return 0
+}
+
+// copyHoldingFlush copies the pkt-lines of src to dst, except for a final
+// flush-pkt, which is reported instead so that the caller can write more
+// packets before it. Output that turns out not to be pkt-lines is copied
+// as is.
+func copyHoldingFlush(dst io.Writer, src io.Reader) (written int64, held bool, err error) {
+	br := bufio.NewReaderSize(src, pktMaxLen)
+
+	for {
+		header, err := br.Peek(4)
+		if err == io.EOF && len(header) == 0 {
+			return written, held, nil
+		}
+		if err != nil {
+			n, err := copyBuffer(dst, br)
+			return written + n, false, err
+		}
+
+		size, perr := strconv.ParseUint(string(header), 16, 16)
+		if perr != nil {
+			n, err := copyBuffer(dst, br)
+			return written + n, false, err
+		}
+
+		if held {
+			n, err := io.WriteString(dst, pktFlush())
+			written += int64(n)
+			if err != nil {
+				return written, false, err
+			}
+			held = false
+		}
+
+		if isPktFlush(header) {
+			br.Discard(4)
+			held = true
+			continue
+		}
+
+		if size < 4 {
+			size = 4
+		}
+		n, err := io.CopyN(dst, br, int64(size))
+		written += n
+		if err != nil {
+			return written, false, err
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProcessManager owns the git processes spawned on behalf of requests. It
+// limits how many of them run at once, keeps track of the running ones and
+// makes sure every started process is reaped.
+//
+// Processes over the limit wait for a slot in a queue. MaxQueued bounds how
+// many may wait and QueueTimeout how long, those beyond either failing with
+// ErrTooManyRequests. Zero leaves them unbounded, waiting until the request
+// is done.
+//
+// Every process runs GitPath, the git binary found in PATH when empty, with
+// the variables of the server matching GitEnvPassthrough, or
+// DefaultGitEnvPassthrough when nil, and the "KEY=value" pairs of GitEnv
+// as environment.
+type ProcessManager struct {
+	MaxProcesses int
+	MaxQueued    int
+	QueueTimeout time.Duration
+
+	GitPath           string
+	GitEnv            []string
+	GitEnvPassthrough []string
+
+	slots    chan struct{}
+	queued   int64
+	spawned  int64
+	rejected int64
+
+	mu     sync.Mutex
+	active map[*GitRPCClient]struct{}
+}
+
+// ProcessStats is a snapshot of the processes managed by a ProcessManager
+type ProcessStats struct {
+	Active  int   `json:"active"`
+	Queued  int64 `json:"queued"`
+	Spawned int64 `json:"spawned"`
+	// Rejected counts the processes that found the queue full or
+	// waited in it for longer than the QueueTimeout
+	Rejected int64 `json:"rejected"`
+}
+
+// NewProcessManager returns a ProcessManager that runs at most max git
+// processes at once. A max of zero means no limit.
+func NewProcessManager(max int) *ProcessManager {
+	pm := &ProcessManager{
+		MaxProcesses: max,
+		active:       make(map[*GitRPCClient]struct{}),
+	}
+	if max > 0 {
+		pm.slots = make(chan struct{}, max)
+	}
+	return pm
+}
+
+// NewGitRPCClient returns a GitRPCClient whose process is run by the manager
+func (pm *ProcessManager) NewGitRPCClient(config *GitRPCClientConfig) *GitRPCClient {
+	c := *config
+	if c.GitPath == "" {
+		c.GitPath = pm.GitPath
+	}
+	gs := NewGitRPCClient(&c)
+	gs.manager = pm
+	return gs
+}
+
+// Command returns a GitRPCClient run by the manager, with the git command
+// given by args set up. A nil config runs it with the defaults.
+func (pm *ProcessManager) Command(config *GitRPCClientConfig, args ...string) *GitRPCClient {
+	if config == nil {
+		config = &GitRPCClientConfig{}
+	}
+	gs := pm.NewGitRPCClient(config)
+	gs.Git(args...)
+	return gs
+}
+
+// git runs git in the git directory dir and returns its output, failing
+// with what git printed on stderr
+func (pm *ProcessManager) git(ctx context.Context, dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := pm.Command(nil, append([]string{"--git-dir", dir}, args...)...).Run(ctx, nil, &stdout, &stderr)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// environ returns the environment of the processes, extra overriding the
+// configured variables
+func (pm *ProcessManager) environ(extra ...string) []string {
+	passthrough := pm.GitEnvPassthrough
+	if passthrough == nil {
+		passthrough = DefaultGitEnvPassthrough
+	}
+	return gitEnviron(passthrough, pm.GitEnv, extra...)
+}
+
+// Stats returns the current process statistics
+func (pm *ProcessManager) Stats() ProcessStats {
+	pm.mu.Lock()
+	active := len(pm.active)
+	pm.mu.Unlock()
+
+	return ProcessStats{
+		Active:  active,
+		Queued:  atomic.LoadInt64(&pm.queued),
+		Spawned: atomic.LoadInt64(&pm.spawned),
+
+		Rejected: atomic.LoadInt64(&pm.rejected),
+	}
+}
+
+// acquire blocks until a process slot is available or ctx is done, or
+// the queue gives up
+func (pm *ProcessManager) acquire(ctx context.Context, gs *GitRPCClient) error {
+	if pm.slots != nil {
+		select {
+		case pm.slots <- struct{}{}:
+		default:
+			if err := pm.wait(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	pm.mu.Lock()
+	pm.active[gs] = struct{}{}
+	pm.mu.Unlock()
+	atomic.AddInt64(&pm.spawned, 1)
+	return nil
+}
+
+// wait queues for a process slot
+func (pm *ProcessManager) wait(ctx context.Context) error {
+	if queued := atomic.AddInt64(&pm.queued, 1); pm.MaxQueued > 0 && queued > int64(pm.MaxQueued) {
+		atomic.AddInt64(&pm.queued, -1)
+		atomic.AddInt64(&pm.rejected, 1)
+		return fmt.Errorf("%w: %d git processes already waiting", ErrTooManyRequests, pm.MaxQueued)
+	}
+	defer atomic.AddInt64(&pm.queued, -1)
+
+	var timeout <-chan time.Time
+	if pm.QueueTimeout > 0 {
+		t := time.NewTimer(pm.QueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case pm.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		atomic.AddInt64(&pm.rejected, 1)
+		return fmt.Errorf("%w: no git process free within %s", ErrTooManyRequests, pm.QueueTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release gives the process slot of the client back
+func (pm *ProcessManager) release(gs *GitRPCClient) {
+	pm.mu.Lock()
+	delete(pm.active, gs)
+	pm.mu.Unlock()
+
+	if pm.slots != nil {
+		<-pm.slots
+	}
+}
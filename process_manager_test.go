@@ -0,0 +1,32 @@
+package githttp
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestProcessManagerGitSettings(t *testing.T) {
+	managers := make(map[string]*ProcessManager)
+	for _, name := range []string{"a", "b"} {
+		pm := NewProcessManager(0)
+		pm.GitEnv = []string{"GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=test.name", "GIT_CONFIG_VALUE_0=" + name}
+		managers[name] = pm
+	}
+	broken := NewProcessManager(0)
+	broken.GitPath = "/nonexistent/git"
+
+	// Each manager runs git its own way, whichever was created last
+	for name, pm := range managers {
+		out, err := pm.Command(nil, "config", "--get", "test.name").Output(context.Background())
+		if err != nil || strings.TrimSpace(string(out)) != name {
+			t.Errorf("manager %s: git config printed %q, %v", name, out, err)
+		}
+	}
+	if _, err := broken.Command(nil, "version").Output(context.Background()); err == nil {
+		t.Error("manager with a missing git binary ran git")
+	}
+	if gs := broken.NewGitRPCClient(&GitRPCClientConfig{}); gs.CommandLine()[0] != broken.GitPath {
+		t.Errorf("command line %q, want %s", gs.CommandLine(), broken.GitPath)
+	}
+}
@@ -0,0 +1,183 @@
+package githttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+)
+
+// ProtectionRule protects the refs matching Ref in the repositories
+// matching Repo. Both are path.Match patterns, the repository without
+// leading slash, and an empty Repo matches every repository. Immutable refs
+// cannot be moved or deleted once created, as is common for release tags.
+// RequireSignedCommits only accepts new commits signed by one of the
+// commit signing keys of the server.
+type ProtectionRule struct {
+	Repo                 string `json:"repo,omitempty"`
+	Ref                  string `json:"ref"`
+	DenyForcePush        bool   `json:"deny_force_push,omitempty"`
+	DenyDelete           bool   `json:"deny_delete,omitempty"`
+	Immutable            bool   `json:"immutable,omitempty"`
+	RequireSignedCommits bool   `json:"require_signed_commits,omitempty"`
+}
+
+func (rule ProtectionRule) matches(repo, ref string) bool {
+	if rule.Repo != "" {
+		if ok, _ := path.Match(rule.Repo, repo); !ok {
+			return false
+		}
+	}
+	ok, _ := path.Match(rule.Ref, ref)
+	return ok
+}
+
+// BranchProtection holds the protection rules, which are kept in a JSON file
+// and can be changed at runtime through its admin API. Static rules, such
+// as those given on the command line, always apply on top of them.
+type BranchProtection struct {
+	Path   string
+	Static []ProtectionRule
+
+	mu    sync.RWMutex
+	rules []ProtectionRule
+}
+
+// LoadBranchProtection reads the rules stored at path. A missing file
+// means no rules yet.
+func LoadBranchProtection(path string) (*BranchProtection, error) {
+	bp := &BranchProtection{Path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &bp.rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return bp, nil
+}
+
+// Rules returns the current rules
+func (bp *BranchProtection) Rules() []ProtectionRule {
+	bp.mu.RLock()
+	defer bp.mu.RUnlock()
+	return append([]ProtectionRule(nil), bp.rules...)
+}
+
+// effectiveRules returns the static rules followed by the stored ones
+func (bp *BranchProtection) effectiveRules() []ProtectionRule {
+	return append(append([]ProtectionRule(nil), bp.Static...), bp.Rules()...)
+}
+
+// SetRules replaces the rules and stores them
+func (bp *BranchProtection) SetRules(rules []ProtectionRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Repo, ""); err != nil {
+			return fmt.Errorf("repo pattern %q: %w", rule.Repo, err)
+		}
+		if _, err := path.Match(rule.Ref, ""); err != nil {
+			return fmt.Errorf("ref pattern %q: %w", rule.Ref, err)
+		}
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if bp.Path != "" {
+		data, err := json.MarshalIndent(rules, "", "  ")
+		if err != nil {
+			return err
+		}
+		tmp := bp.Path + ".tmp"
+		if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, bp.Path); err != nil {
+			return err
+		}
+	}
+	bp.rules = rules
+	return nil
+}
+
+// ServeHTTP is the admin API of the rules: GET returns them and PUT
+// replaces them with the JSON array in the request body.
+func (bp *BranchProtection) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		var rules []ProtectionRule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			writeErrorMessage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := bp.SetRules(rules); err != nil {
+			writeErrorMessage(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		methodNotAllowed(w, r, []string{"GET", "HEAD", "PUT"})
+		return
+	}
+
+	rules := bp.Rules()
+	if rules == nil {
+		rules = []ProtectionRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// CheckPush implements PushPolicy, rejecting updates that move or delete
+// immutable refs, delete protected refs or force-push to them.
+func (bp *BranchProtection) CheckPush(ctx context.Context, push *Push) (map[string]string, error) {
+	rules := bp.effectiveRules()
+	rejected := make(map[string]string)
+
+	for _, u := range push.Updates {
+		var denyForce, denyDelete, immutable bool
+		for _, rule := range rules {
+			if rule.matches(push.Repo, u.Ref) {
+				denyForce = denyForce || rule.DenyForcePush
+				denyDelete = denyDelete || rule.DenyDelete
+				immutable = immutable || rule.Immutable
+			}
+		}
+
+		switch {
+		case immutable && u.IsDelete():
+			rejected[u.Ref] = "immutable ref cannot be deleted"
+		case immutable && !u.IsCreate():
+			rejected[u.Ref] = "immutable ref cannot be moved"
+		case u.IsDelete() && denyDelete:
+			rejected[u.Ref] = "protected ref cannot be deleted"
+		case denyForce && !u.IsCreate() && !u.IsDelete():
+			ok, err := push.Objects.IsAncestor(ctx, u.Old, u.New)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				rejected[u.Ref] = "protected ref cannot be force-pushed"
+			}
+		}
+	}
+	return rejected, nil
+}
+
+// requiresSignedCommits reports whether commits pushed to the ref need to be
+// signed.
+func (bp *BranchProtection) requiresSignedCommits(repo, ref string) bool {
+	for _, rule := range bp.effectiveRules() {
+		if rule.RequireSignedCommits && rule.matches(repo, ref) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package githttp
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestBranchProtectionPush(t *testing.T) {
+	protection, err := LoadBranchProtection(filepath.Join(t.TempDir(), "rules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	protection.Static = []ProtectionRule{
+		{Ref: "refs/heads/master", DenyForcePush: true, DenyDelete: true},
+		{Ref: "refs/tags/*", Immutable: true},
+	}
+	srv := newTestServer(t, GitSmartHTTPConfig{Protection: protection})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	work := srv.Clone("test.git")
+	first := githttptest.Git(t, work, "rev-parse", "HEAD")
+	second := githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+	githttptest.Git(t, work, "tag", "v1", first)
+	srv.Push(work, "HEAD:master", "v1")
+
+	for _, c := range []struct {
+		name     string
+		refspecs []string
+	}{
+		{"force push", []string{"+" + first + ":refs/heads/master"}},
+		{"delete", []string{":master"}},
+		{"tag move", []string{"+" + second + ":refs/tags/v1"}},
+		{"tag delete", []string{":refs/tags/v1"}},
+	} {
+		if out := srv.PushRejected(work, c.refspecs...); !strings.Contains(out, "remote rejected") {
+			t.Errorf("%s not rejected by the server:\n%s", c.name, out)
+		}
+	}
+	if got := srv.Ref("test.git", "refs/heads/master"); got != second {
+		t.Errorf("master at %s, want %s", got, second)
+	}
+	if got := srv.Ref("test.git", "refs/tags/v1"); got != first {
+		t.Errorf("v1 at %s, want %s", got, first)
+	}
+
+	// Unprotected branches may be rewritten and deleted
+	srv.Push(work, "HEAD:topic")
+	srv.Push(work, "+"+first+":refs/heads/topic")
+	srv.Push(work, ":topic")
+	if got := srv.Ref("test.git", "refs/heads/topic"); got != "" {
+		t.Errorf("topic at %s after its deletion", got)
+	}
+}
@@ -0,0 +1,153 @@
+package githttp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Wire types of protobuf fields
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoMessage is a message the gRPC services answer with
+type protoMessage interface {
+	marshalProto(e *protoEncoder)
+}
+
+// protoEncoder appends the fields of a protobuf message. Fields holding
+// the zero value of their type are left out, as proto3 does.
+type protoEncoder struct {
+	b []byte
+}
+
+func (e *protoEncoder) tag(field, wireType int) {
+	e.b = binary.AppendUvarint(e.b, uint64(field)<<3|uint64(wireType))
+}
+
+func (e *protoEncoder) uint(field int, v uint64) {
+	if v != 0 {
+		e.tag(field, protoVarint)
+		e.b = binary.AppendUvarint(e.b, v)
+	}
+}
+
+func (e *protoEncoder) int(field int, v int64) {
+	e.uint(field, uint64(v))
+}
+
+func (e *protoEncoder) bool(field int, v bool) {
+	if v {
+		e.uint(field, 1)
+	}
+}
+
+func (e *protoEncoder) string(field int, s string) {
+	if s != "" {
+		e.tag(field, protoBytes)
+		e.b = binary.AppendUvarint(e.b, uint64(len(s)))
+		e.b = append(e.b, s...)
+	}
+}
+
+// message appends m as an embedded message, even when empty, since it may
+// be an element of a repeated field
+func (e *protoEncoder) message(field int, m protoMessage) {
+	var sub protoEncoder
+	m.marshalProto(&sub)
+	e.tag(field, protoBytes)
+	e.b = binary.AppendUvarint(e.b, uint64(len(sub.b)))
+	e.b = append(e.b, sub.b...)
+}
+
+// time appends t as a google.protobuf.Timestamp, left out when nil
+func (e *protoEncoder) time(field int, t *time.Time) {
+	if t != nil {
+		e.message(field, protoTimestamp(*t))
+	}
+}
+
+type protoTimestamp time.Time
+
+func (t protoTimestamp) marshalProto(e *protoEncoder) {
+	e.int(1, time.Time(t).Unix())
+	e.int(2, int64(time.Time(t).Nanosecond()))
+}
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// protoDecoder reads the fields of a protobuf message one after the other
+//
+//	d := protoDecoder{b: data}
+//	for d.next() {
+//		switch d.field {
+//		case 1:
+//			name = string(d.bytes)
+//		}
+//	}
+//	if d.err != nil {
+//		...
+//	}
+type protoDecoder struct {
+	b   []byte
+	err error
+
+	// field and wireType are those of the current field, whose value is in
+	// varint for varints and in bytes for length delimited fields
+	field    int
+	wireType int
+	varint   uint64
+	bytes    []byte
+}
+
+// next moves to the next field, returning false at the end of the message
+// or when it is malformed, setting err
+func (d *protoDecoder) next() bool {
+	if d.err != nil || len(d.b) == 0 {
+		return false
+	}
+	key, n := binary.Uvarint(d.b)
+	if n <= 0 || key>>3 == 0 {
+		d.err = errProtoTruncated
+		return false
+	}
+	d.b = d.b[n:]
+	d.field, d.wireType = int(key>>3), int(key&7)
+	d.varint, d.bytes = 0, nil
+
+	switch d.wireType {
+	case protoVarint:
+		d.varint, n = binary.Uvarint(d.b)
+		if n <= 0 {
+			d.err = errProtoTruncated
+			return false
+		}
+		d.b = d.b[n:]
+	case protoBytes:
+		size, n := binary.Uvarint(d.b)
+		if n <= 0 || uint64(len(d.b)-n) < size {
+			d.err = errProtoTruncated
+			return false
+		}
+		d.bytes = d.b[n : n+int(size)]
+		d.b = d.b[n+int(size):]
+	case protoFixed64, protoFixed32:
+		size := 8
+		if d.wireType == protoFixed32 {
+			size = 4
+		}
+		if len(d.b) < size {
+			d.err = errProtoTruncated
+			return false
+		}
+		d.b = d.b[size:]
+	default:
+		d.err = errors.New("unsupported protobuf wire type")
+		return false
+	}
+	return true
+}
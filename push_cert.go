@@ -0,0 +1,194 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pushCert is the push certificate git push --signed sends instead of a
+// plain command list.
+type pushCert struct {
+	// Text is the certificate as sent, signature included
+	Text string
+	// Payload is the signed part of Text
+	Payload   string
+	Signature string
+	Pusher    string
+	Nonce     string
+	Updates   []RefUpdate
+	// Signer is the verified key owner, set once the signature checked out
+	Signer string
+}
+
+// readPushCert reads the lines of a push certificate following its
+// push-cert pkt-line, up to and including push-cert-end.
+func readPushCert(r io.Reader, raw *bytes.Buffer) (*pushCert, error) {
+	var text strings.Builder
+	for {
+		line, end, err := readPkt(r, raw)
+		if err != nil {
+			return nil, err
+		}
+		if end {
+			return nil, errors.New("push certificate without end")
+		}
+		if string(line) == "push-cert-end" {
+			break
+		}
+		text.Write(line)
+		text.WriteByte('\n')
+	}
+
+	cert := &pushCert{Text: text.String()}
+	cert.Payload = cert.Text
+	if i := strings.Index(cert.Text, "-----BEGIN "); i >= 0 {
+		cert.Payload, cert.Signature = cert.Text[:i], cert.Text[i:]
+	}
+
+	header, commands, _ := strings.Cut(cert.Payload, "\n\n")
+	for _, line := range strings.Split(header, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "pusher":
+			cert.Pusher = value
+		case "nonce":
+			cert.Nonce = value
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(commands, "\n"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errors.New("malformed push certificate command")
+		}
+		cert.Updates = append(cert.Updates, RefUpdate{Old: fields[0], New: fields[1], Ref: fields[2]})
+	}
+	return cert, nil
+}
+
+// pushCertNonce computes the nonce receive-pack hands out for the
+// repository at the given time, the way git does: an HMAC-SHA1 keyed with
+// "<path>:<stamp>" over the nonce seed.
+func pushCertNonce(seed, repoPath string, stamp int64) string {
+	mac := hmac.New(sha1.New, []byte(repoPath+":"+strconv.FormatInt(stamp, 10)))
+	mac.Write([]byte(seed))
+	return strconv.FormatInt(stamp, 10) + "-" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkNonce reports whether the certificate carries a nonce issued for the
+// repository no longer than slop ago.
+func (c *pushCert) checkNonce(seed, repoPath string, slop time.Duration) bool {
+	stampStr, _, ok := strings.Cut(c.Nonce, "-")
+	if !ok {
+		return false
+	}
+	stamp, err := strconv.ParseInt(stampStr, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(stamp, 0))
+	if age < -slop || age > slop {
+		return false
+	}
+	return hmac.Equal([]byte(c.Nonce), []byte(pushCertNonce(seed, repoPath, stamp)))
+}
+
+// verify checks the signature of the certificate against the keys of the
+// GPG keyring and returns who signed it.
+func (c *pushCert) verify(ctx context.Context, keyring string) (string, error) {
+	if !strings.HasPrefix(c.Signature, "-----BEGIN PGP SIGNATURE-----") {
+		return "", errors.New("push certificate is not signed with GPG")
+	}
+
+	home, err := os.MkdirTemp("", "git-http-backend-gpg-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(home)
+
+	sigPath := filepath.Join(home, "cert.sig")
+	if err := os.WriteFile(sigPath, []byte(c.Signature), 0600); err != nil {
+		return "", err
+	}
+	keyring, err = filepath.Abs(keyring)
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, "gpg", "--homedir", home, "--no-default-keyring", "--keyring", keyring,
+		"--trust-model", "always", "--status-fd", "1", "--verify", sigPath, "-")
+	cmd.Stdin = strings.NewReader(c.Payload)
+	out, _ := cmd.Output()
+
+	var signer, fingerprint string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		switch fields[1] {
+		case "GOODSIG":
+			signer = strings.Join(fields[3:], " ")
+		case "VALIDSIG":
+			fingerprint = fields[2]
+		}
+	}
+	if signer == "" || fingerprint == "" {
+		return "", errors.New("push certificate signature is not valid")
+	}
+	return signer + " (" + fingerprint + ")", nil
+}
+
+// pushCertPolicy rejects pushes whose push certificate does not verify, and
+// unsigned pushes to repositories requiring signed pushes.
+type pushCertPolicy struct {
+	cfg *GitSmartHTTPConfig
+}
+
+func (p pushCertPolicy) CheckPush(ctx context.Context, push *Push) (map[string]string, error) {
+	reason := p.check(ctx, push)
+	if reason == "" {
+		return nil, nil
+	}
+
+	rejected := make(map[string]string)
+	for _, u := range push.Updates {
+		rejected[u.Ref] = reason
+	}
+	return rejected, nil
+}
+
+// check verifies the push certificate of a push, if any, and returns why
+// the push is rejected, or an empty string.
+func (p pushCertPolicy) check(ctx context.Context, push *Push) string {
+	cert := push.cert
+	if cert == nil {
+		if matchesAny(p.cfg.RequireSignedPush, push.Repo) {
+			return "signed push required, push with --signed"
+		}
+		return ""
+	}
+	if p.cfg.PushCertKeyring == "" {
+		return ""
+	}
+
+	if !cert.checkNonce(p.cfg.PushCertNonceSeed, push.repoPath, p.cfg.PushCertSlop) {
+		return "push certificate nonce is invalid or stale"
+	}
+	signer, err := cert.verify(ctx, p.cfg.PushCertKeyring)
+	if err != nil {
+		return err.Error()
+	}
+	cert.Signer = signer
+	return ""
+}
@@ -0,0 +1,302 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// PushPolicy decides on the ref updates of a push before receive-pack gets
+// to apply them. Embedders add their own rules, such as naming conventions
+// or ticket references in commit messages, through
+// GitSmartHTTPConfig.PushPolicies.
+type PushPolicy interface {
+	// CheckPush returns the reasons for rejecting updates, by ref. A push
+	// is rejected as a whole when any of its updates is.
+	CheckPush(ctx context.Context, push *Push) (map[string]string, error)
+}
+
+// Push is a push being checked by the push policies
+type Push struct {
+	// Repo is the repository path of the URL, without leading slash
+	Repo   string
+	Pusher *Identity
+	// Updates are the ref commands of the push, in the order sent
+	Updates []RefUpdate
+	// Options are the values given with git push -o
+	Options []string
+	// Objects gives access to the objects of the push
+	Objects *PushObjects
+
+	repoPath string
+	cert     *pushCert
+}
+
+// PushObjects gives access to the objects of a push along with those of the
+// repository. The first use spools the request and indexes its pack into a
+// quarantine object directory, which is thrown away once the policies ran,
+// so pushes no policy looks into are not slowed down.
+type PushObjects struct {
+	ctx       context.Context
+	processes *ProcessManager
+	repoPath  string
+	body      io.Reader
+
+	q   *objectQuarantine
+	err error
+}
+
+// Git runs a git command, such as rev-list or cat-file, seeing the objects
+// of the push, and returns its output.
+func (o *PushObjects) Git(ctx context.Context, args ...string) ([]byte, error) {
+	q, err := o.quarantine()
+	if err != nil {
+		return nil, err
+	}
+	return q.git(ctx, nil, args...)
+}
+
+// IsAncestor reports whether old is an ancestor of new, that is whether
+// updating a ref from old to new is a fast-forward.
+func (o *PushObjects) IsAncestor(ctx context.Context, old, new string) (bool, error) {
+	q, err := o.quarantine()
+	if err != nil {
+		return false, err
+	}
+	return q.IsAncestor(ctx, old, new)
+}
+
+// NewCommits returns the commits reachable from id but not from any ref of
+// the repository, newest first.
+func (o *PushObjects) NewCommits(ctx context.Context, id string) ([]string, error) {
+	out, err := o.Git(ctx, "rev-list", id, "--not", "--all")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (o *PushObjects) quarantine() (*objectQuarantine, error) {
+	if o.q == nil && o.err == nil {
+		o.q, o.err = o.load()
+	}
+	return o.q, o.err
+}
+
+func (o *PushObjects) load() (*objectQuarantine, error) {
+	spool, err := os.CreateTemp("", "git-http-backend-push-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(spool.Name())
+	// git reads the spooled request after the policies ran, close it once
+	// the request is done
+	context.AfterFunc(o.ctx, func() { spool.Close() })
+
+	_, err = copyBuffer(spool, o.body)
+	o.body = spool
+	if err != nil {
+		return nil, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Skip the commands and options, leaving the pack to index
+	readPushRequest(spool)
+	q, err := newObjectQuarantine(o.ctx, o.processes, o.repoPath, spool)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		q.Remove()
+		return nil, err
+	}
+	return q, nil
+}
+
+// request returns the request to hand to git
+func (o *PushObjects) request() io.Reader {
+	return o.body
+}
+
+func (o *PushObjects) remove() {
+	if o.q != nil {
+		o.q.Remove()
+	}
+}
+
+// pushPolicies returns the built-in policies enabled by cfg, followed by
+// the ones of the embedding application.
+func pushPolicies(cfg *GitSmartHTTPConfig, keys *commitKeys) []PushPolicy {
+	var policies []PushPolicy
+	if cfg.PushCertKeyring != "" || len(cfg.RequireSignedPush) > 0 {
+		policies = append(policies, pushCertPolicy{cfg})
+	}
+	if cfg.Protection != nil {
+		policies = append(policies, cfg.Protection, signedCommitsPolicy{cfg.Protection, keys})
+	}
+	if len(cfg.RequireDCO) > 0 {
+		policies = append(policies, dcoPolicy{cfg.RequireDCO, cfg.DCOExemptMerges})
+	}
+	if cfg.MaxBlobSize > 0 {
+		policies = append(policies, blobSizePolicy{cfg.MaxBlobSize})
+	}
+	return append(policies, cfg.PushPolicies...)
+}
+
+// checkPush runs the push policies on a receive-pack request before git
+// gets to see it. id is the pusher. It returns the request to hand to git,
+// and whether the push was rejected, in which case the rejection has been
+// reported to the client already.
+func (gsh GitSmartHTTP) checkPush(ctx context.Context, w io.Writer, policies []PushPolicy, id *Identity, repo, repoPath string, push *pushRequest, body io.Reader) (io.Reader, bool, error) {
+	objects := &PushObjects{ctx: ctx, processes: gsh.processes, repoPath: repoPath, body: body}
+	defer objects.remove()
+
+	p := &Push{
+		Repo:     repo,
+		Pusher:   id,
+		Updates:  push.Updates,
+		Options:  push.Options,
+		Objects:  objects,
+		repoPath: repoPath,
+		cert:     push.Cert,
+	}
+
+	rejected := make(map[string]string)
+	for _, policy := range policies {
+		reasons, err := policy.CheckPush(ctx, p)
+		if err != nil {
+			return nil, false, err
+		}
+		// The first reason given for a ref is reported
+		for ref, reason := range reasons {
+			if _, ok := rejected[ref]; !ok {
+				rejected[ref] = reason
+			}
+		}
+	}
+
+	body = objects.request()
+	if len(rejected) == 0 {
+		return body, false, nil
+	}
+
+	// Consume the request, clients only read the result once it is sent
+	copyBuffer(io.Discard, body)
+	writeRefRejections(w, push.Capabilities, push.Updates, rejected)
+	return nil, true, nil
+}
+
+// writeRefRejections reports a push rejected as a whole, giving the reason
+// for each rejected ref.
+func writeRefRejections(w io.Writer, caps []string, updates []RefUpdate, rejected map[string]string) {
+	var report, msg strings.Builder
+	report.WriteString(pktWrite("unpack ok\n"))
+	for _, u := range updates {
+		reason, ok := rejected[u.Ref]
+		if ok {
+			fmt.Fprintf(&msg, "%s: %s\n", u.Ref, reason)
+		} else {
+			reason = "push rejected because of other refs"
+		}
+		report.WriteString(pktWrite("ng " + u.Ref + " " + reason + "\n"))
+	}
+	report.WriteString(pktFlush())
+
+	if !hasCapability(caps, "report-status") && !hasCapability(caps, "report-status-v2") {
+		report.Reset()
+	}
+
+	if maxLen := sidebandMaxLen(caps); maxLen > 0 {
+		io.WriteString(w, sidebandMessages(2, msg.String(), maxLen))
+		if report.Len() > 0 {
+			io.WriteString(w, sidebandMessages(1, report.String(), maxLen))
+		}
+		io.WriteString(w, pktFlush())
+		return
+	}
+	io.WriteString(w, report.String())
+}
+
+// objectQuarantine is a temporary object directory holding the objects of
+// a pushed pack, with the repository's objects as alternate.
+type objectQuarantine struct {
+	processes *ProcessManager
+	gitDir    string
+	dir       string
+}
+
+func newObjectQuarantine(ctx context.Context, processes *ProcessManager, repoPath string, pack io.Reader) (*objectQuarantine, error) {
+	dir, ok := gitDir(repoPath)
+	if !ok {
+		return nil, ErrRepoNotFound
+	}
+	tmp, err := os.MkdirTemp("", "git-http-backend-quarantine-")
+	if err != nil {
+		return nil, err
+	}
+	q := &objectQuarantine{processes: processes, gitDir: dir, dir: tmp}
+
+	br := bufio.NewReader(pack)
+	if _, err := br.Peek(1); err == io.EOF {
+		// Nothing but deletions were pushed
+		return q, nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(tmp, "pack"), 0755); err != nil {
+		q.Remove()
+		return nil, err
+	}
+	if _, err := q.git(ctx, br, "index-pack", "--stdin", "--fix-thin"); err != nil {
+		q.Remove()
+		return nil, err
+	}
+	return q, nil
+}
+
+// IsAncestor reports whether old is an ancestor of new
+func (q *objectQuarantine) IsAncestor(ctx context.Context, old, new string) (bool, error) {
+	_, err := q.git(ctx, nil, "merge-base", "--is-ancestor", old, new)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (q *objectQuarantine) git(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	return q.gitEnv(ctx, nil, stdin, args...)
+}
+
+// gitEnv runs git in the quarantine with additional environment variables
+func (q *objectQuarantine) gitEnv(ctx context.Context, env []string, stdin io.Reader, args ...string) ([]byte, error) {
+	config := &GitRPCClientConfig{Env: append([]string{
+		"GIT_OBJECT_DIRECTORY=" + q.dir,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES=" + filepath.Join(q.gitDir, "objects"),
+	}, env...)}
+	var stdout, stderr bytes.Buffer
+	err := q.processes.Command(config, append([]string{"--git-dir", q.gitDir}, args...)...).Run(ctx, stdin, &stdout, &stderr)
+	out := stdout.Bytes()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return out, err
+		}
+		log.Printf("git %s in quarantine failed: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return out, err
+}
+
+// Remove deletes the quarantined objects
+func (q *objectQuarantine) Remove() {
+	os.RemoveAll(q.dir)
+}
@@ -0,0 +1,59 @@
+package githttp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type sidebandTrailerKey struct{}
+
+// withSidebandTrailer has the git backend call trailer once git succeeded
+// and show what it returns on the progress sideband of the response.
+func withSidebandTrailer(ctx context.Context, trailer func() string) context.Context {
+	return context.WithValue(ctx, sidebandTrailerKey{}, trailer)
+}
+
+func sidebandTrailer(ctx context.Context) func() string {
+	trailer, _ := ctx.Value(sidebandTrailerKey{}).(func() string)
+	return trailer
+}
+
+// pushSummary tells the pusher which refs the push updated and what was
+// set off by it.
+func (gsh GitSmartHTTP) pushSummary(ctx context.Context, repo, repoPath string, updates []RefUpdate) string {
+	applied := appliedRefUpdates(gsh.storage(), repoPath, namespacedRefUpdates(ctx, updates))
+	if len(applied) == 0 {
+		return ""
+	}
+
+	var msg strings.Builder
+	for _, u := range applied {
+		ref := u.Ref
+		if ns := namespace(ctx); ns != "" {
+			ref = strings.TrimPrefix(ref, "refs/namespaces/"+ns+"/")
+		}
+		switch {
+		case u.IsCreate():
+			fmt.Fprintf(&msg, "Created %s at %s\n", ref, shortID(u.New))
+		case u.IsDelete():
+			fmt.Fprintf(&msg, "Deleted %s\n", ref)
+		default:
+			fmt.Fprintf(&msg, "Updated %s %s..%s\n", ref, shortID(u.Old), shortID(u.New))
+		}
+		if gsh.PushSummaryURL != "" && !u.IsDelete() {
+			fmt.Fprintf(&msg, "  %s\n", strings.NewReplacer("{repo}", repo, "{ref}", ref, "{new}", u.New).Replace(gsh.PushSummaryURL))
+		}
+	}
+	if gsh.events != nil {
+		msg.WriteString("Push event queued for subscribers\n")
+	}
+	return msg.String()
+}
+
+func shortID(id string) string {
+	if len(id) > 7 {
+		return id[:7]
+	}
+	return id
+}
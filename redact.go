@@ -0,0 +1,45 @@
+package githttp
+
+import (
+	"io"
+	"regexp"
+)
+
+const redacted = "REDACTED"
+
+// Credentials that may end up in log lines: passwords in URLs, such as
+// the remotes in git's own messages, Authorization header values and
+// secrets passed in query strings.
+var (
+	urlCredentials    = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/\s@]+@`)
+	authorization     = regexp.MustCompile(`(?i)((?:proxy-)?authorization:\s*(?:[a-z]+\s+)?)[^\s"]+`)
+	queryCredentials  = regexp.MustCompile(`(?i)([?&](?:password|passwd|pass|token|access_token|private_token|api_key|apikey|key|secret|signature|sig)=)[^&\s"]+`)
+	bearerCredentials = regexp.MustCompile(`(?i)(\b(?:basic|bearer|token)\s+)[a-z0-9._~+/=-]{16,}`)
+)
+
+// redact replaces the credentials found in s
+func redact(s string) string {
+	s = urlCredentials.ReplaceAllString(s, "${1}"+redacted+"@")
+	s = authorization.ReplaceAllString(s, "${1}"+redacted)
+	s = queryCredentials.ReplaceAllString(s, "${1}"+redacted)
+	return bearerCredentials.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// redactingWriter redacts credentials from everything logged through it.
+// The log package writes every entry with a single Write.
+type redactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter returns a writer redacting credentials from what is
+// written to w, for the output of the log package
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return redactingWriter{w}
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
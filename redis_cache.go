@@ -0,0 +1,197 @@
+package githttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// RedisCache is a Cache stored in Redis. It speaks just enough of the RESP
+// protocol for GET, SET and DEL. Redis being unavailable turns lookups into
+// misses rather than failing requests.
+type RedisCache struct {
+	Addr     string
+	Password string
+	// Prefix is prepended to every key, so several deployments can share
+	// one Redis database
+	Prefix  string
+	Timeout time.Duration
+
+	conns chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// NewRedisCache returns a RedisCache for the server at addr, keeping up to
+// maxIdle connections open.
+func NewRedisCache(addr, password string, maxIdle int) *RedisCache {
+	return &RedisCache{
+		Addr:     addr,
+		Password: password,
+		Prefix:   "git-http-backend:",
+		Timeout:  time.Second,
+		conns:    make(chan *redisConn, maxIdle),
+	}
+}
+
+func (c *RedisCache) Get(key string) ([]byte, bool) {
+	reply, err := c.do("GET", c.Prefix+key)
+	if err != nil {
+		log.Printf("Redis GET failed: %s", err)
+		return nil, false
+	}
+	value, ok := reply.([]byte)
+	return value, ok
+}
+
+func (c *RedisCache) Set(key string, value []byte, ttl time.Duration) {
+	args := []string{"SET", c.Prefix + key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	if _, err := c.do(args...); err != nil {
+		log.Printf("Redis SET failed: %s", err)
+	}
+}
+
+func (c *RedisCache) Delete(keys ...string) {
+	if len(keys) == 0 {
+		return
+	}
+	args := []string{"DEL"}
+	for _, key := range keys {
+		args = append(args, c.Prefix+key)
+	}
+	if _, err := c.do(args...); err != nil {
+		log.Printf("Redis DEL failed: %s", err)
+	}
+}
+
+// do sends a command and reads its reply. Connections are only reused after
+// a complete exchange, so a failed one is never left half read.
+func (c *RedisCache) do(args ...string) (interface{}, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	reply, err := conn.do(args...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close()
+	}
+
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func (c *RedisCache) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	if c.Password != "" {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+		reply, err := conn.do("AUTH", c.Password)
+		if err == nil {
+			if e, ok := reply.(redisError); ok {
+				err = e
+			}
+		}
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func (conn *redisConn) do(args ...string) (interface{}, error) {
+	fmt.Fprintf(conn.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(conn.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := conn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return conn.readReply()
+}
+
+// readReply reads a RESP reply: simple strings and integers become strings,
+// bulk strings []byte, nil bulk strings nil and errors a redisError.
+func (conn *redisConn) readReply() (interface{}, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed redis reply")
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+', ':':
+		return payload, nil
+	case '-':
+		return redisError(payload), nil
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := conn.readReply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
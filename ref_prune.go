@@ -0,0 +1,156 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RefPruneResult lists the refs a prune removed, or would remove on a dry
+// run
+type RefPruneResult struct {
+	DryRun bool `json:"dry_run"`
+	// Remote are the remote-tracking refs whose branch is gone upstream
+	Remote []string `json:"remote"`
+	// Matched are the refs matching the prune patterns
+	Matched []string `json:"matched"`
+}
+
+// refPruner removes stale refs from repositories, mirrors in particular:
+// the remote-tracking refs of origin whose branch is gone upstream, and the
+// refs matching patterns, given as git for-each-ref takes them, whose
+// commit is older than age.
+type refPruner struct {
+	gsh      GitSmartHTTP
+	patterns []string
+	age      time.Duration
+}
+
+func newRefPruner(gsh GitSmartHTTP, patterns []string, age time.Duration) *refPruner {
+	return &refPruner{gsh: gsh, patterns: patterns, age: age}
+}
+
+// run prunes every repository every interval, only logging what it would
+// remove on a dry run
+func (p *refPruner) run(interval time.Duration, dryRun bool) {
+	for {
+		err := p.gsh.walkRepos(func(repo, repoPath string) {
+			res, err := p.prune(context.Background(), repo, repoPath, p.patterns, dryRun)
+			switch {
+			case err != nil:
+				log.Printf("Cannot prune the refs of %s: %s", repo, err)
+			case dryRun && len(res.Remote)+len(res.Matched) > 0:
+				log.Printf("Would prune %d refs of %s: %s", len(res.Remote)+len(res.Matched), repo, strings.Join(append(res.Remote, res.Matched...), " "))
+			case len(res.Remote)+len(res.Matched) > 0:
+				log.Printf("Pruned %d refs of %s", len(res.Remote)+len(res.Matched), repo)
+			}
+		})
+		if err != nil {
+			log.Printf("Cannot list repositories to prune refs of: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// prune removes the stale refs of the repository under its lock
+func (p *refPruner) prune(ctx context.Context, repo, repoPath string, patterns []string, dryRun bool) (RefPruneResult, error) {
+	res := RefPruneResult{DryRun: dryRun, Remote: []string{}, Matched: []string{}}
+
+	unlock, err := p.gsh.repoLocks.Lock(ctx, repoPath)
+	if err != nil {
+		return res, err
+	}
+	defer unlock()
+
+	dir, _ := gitDir(repoPath)
+	defer func() {
+		if !dryRun && len(res.Remote)+len(res.Matched) > 0 {
+			p.gsh.refreshServerInfo(ctx, repoPath)
+			p.gsh.details.Invalidate(repoPath)
+			if p.gsh.refsCache != nil {
+				p.gsh.refsCache.Invalidate(repoPath)
+			}
+		}
+	}()
+
+	if url, _ := p.gsh.processes.git(ctx, dir, "config", "--get", "remote.origin.url"); strings.TrimSpace(url) != "" {
+		args := []string{"remote", "prune", "origin"}
+		if dryRun {
+			args = append(args, "--dry-run")
+		}
+		out, err := p.gsh.processes.git(ctx, dir, args...)
+		if err != nil {
+			return res, err
+		}
+		// Lines read " * [pruned] origin/topic", or [would prune]
+		for _, line := range strings.Split(out, "\n") {
+			if _, ref, ok := strings.Cut(line, "prune] "); ok {
+				res.Remote = append(res.Remote, strings.TrimSpace(ref))
+			} else if _, ref, ok := strings.Cut(line, "pruned] "); ok {
+				res.Remote = append(res.Remote, strings.TrimSpace(ref))
+			}
+		}
+	}
+
+	if len(patterns) == 0 {
+		return res, nil
+	}
+	out, err := p.gsh.processes.git(ctx, dir, append([]string{"for-each-ref", "--format=%(objectname) %(committerdate:unix) %(refname)"}, patterns...)...)
+	if err != nil {
+		return res, err
+	}
+	var deletes bytes.Buffer
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		// Refs to tags and trees have no committer date
+		if date, err := strconv.ParseInt(fields[1], 10, 64); p.age > 0 && (err != nil || time.Since(time.Unix(date, 0)) < p.age) {
+			continue
+		}
+		res.Matched = append(res.Matched, fields[2])
+		fmt.Fprintf(&deletes, "delete %s %s\n", fields[2], fields[0])
+	}
+	if dryRun || deletes.Len() == 0 {
+		return res, nil
+	}
+
+	var output bytes.Buffer
+	if err := p.gsh.processes.Command(nil, "--git-dir", dir, "update-ref", "--stdin").Run(ctx, &deletes, &output, &output); err != nil {
+		return res, fmt.Errorf("%s: %s", err, bytes.TrimSpace(output.Bytes()))
+	}
+	return res, nil
+}
+
+// servePruneRefs prunes the stale refs of the repository on POST, only
+// reporting them when the dry_run parameter is set. Patterns given as
+// pattern parameters replace the configured ones.
+func (gsh GitSmartHTTP) servePruneRefs(w http.ResponseWriter, r *http.Request, repo string) {
+	repoPath := gsh.localPath(repo)
+	if err := gsh.validateRepo(repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	patterns := gsh.PruneRefs
+	if given := r.URL.Query()["pattern"]; len(given) > 0 {
+		patterns = given
+	}
+	res, err := gsh.prunes.prune(r.Context(), repo, repoPath, patterns, dryRun)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	json.NewEncoder(w).Encode(res)
+}
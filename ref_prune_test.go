@@ -0,0 +1,89 @@
+package githttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestPruneRefs(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{
+		AdminToken:   testAdminToken,
+		PruneRefs:    []string{"refs/heads/tmp/"},
+		PruneRefsAge: 24 * time.Hour,
+	})
+	repoPath := srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	work := srv.Clone("test.git")
+	githttptest.Commit(t, work, map[string]string{"README": "recent\n"}, "recent")
+	srv.Push(work, "HEAD:refs/heads/tmp/recent", "HEAD:refs/heads/keep")
+	os.Setenv("GIT_COMMITTER_DATE", "2000-01-01T00:00:00Z")
+	githttptest.Commit(t, work, map[string]string{"README": "old\n"}, "old")
+	os.Unsetenv("GIT_COMMITTER_DATE")
+	srv.Push(work, "HEAD:refs/heads/tmp/old", "HEAD:refs/heads/old")
+
+	prune := func(repo, query string) RefPruneResult {
+		t.Helper()
+		resp, body := adminRequest(t, "POST", srv.URL+"/api/repos/"+repo+"/prune-refs"+query, "")
+		var res RefPruneResult
+		if resp.StatusCode != http.StatusOK || json.Unmarshal([]byte(body), &res) != nil {
+			t.Fatalf("prune of %s%s: %d %s", repo, query, resp.StatusCode, body)
+		}
+		return res
+	}
+	refs := func(repoPath string) string {
+		t.Helper()
+		return githttptest.Git(t, repoPath, "for-each-ref", "--format=%(refname)")
+	}
+
+	if resp, _ := request(t, "POST", srv.URL+"/api/repos/test.git/prune-refs", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("prune without the admin token: %d, want 401", resp.StatusCode)
+	}
+
+	// Only the old refs matching the configured patterns go, and only
+	// when not on a dry run
+	want := RefPruneResult{DryRun: true, Remote: []string{}, Matched: []string{"refs/heads/tmp/old"}}
+	if res := prune("test.git", "?dry_run=1"); !reflect.DeepEqual(res, want) {
+		t.Errorf("dry run %+v, want %+v", res, want)
+	}
+	if !strings.Contains(refs(repoPath), "refs/heads/tmp/old") {
+		t.Error("dry run deleted refs/heads/tmp/old")
+	}
+	want.DryRun = false
+	if res := prune("test.git", ""); !reflect.DeepEqual(res, want) {
+		t.Errorf("prune %+v, want %+v", res, want)
+	}
+	if got, want := refs(repoPath), "refs/heads/keep\nrefs/heads/master\nrefs/heads/old\nrefs/heads/tmp/recent"; got != want {
+		t.Errorf("refs after the prune:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Given patterns replace the configured ones
+	want.Matched = []string{"refs/heads/old"}
+	if res := prune("test.git", "?pattern=refs/heads/old&pattern=refs/heads/keep"); !reflect.DeepEqual(res, want) {
+		t.Errorf("prune of given patterns %+v, want %+v", res, want)
+	}
+
+	// Mirrors lose the branches gone upstream
+	upstream := srv.CreateRepo("upstream.git", map[string]string{"README": "hello\n"})
+	githttptest.Git(t, upstream, "branch", "gone", "master")
+	mirror := filepath.Join(srv.Root, "mirror.git")
+	githttptest.Git(t, "", "clone", "--quiet", "--mirror", upstream, mirror)
+	githttptest.Git(t, upstream, "branch", "-D", "gone")
+	want = RefPruneResult{DryRun: true, Remote: []string{"refs/heads/gone"}, Matched: []string{}}
+	if res := prune("mirror.git", "?dry_run=1&pattern=refs/tags/"); !reflect.DeepEqual(res, want) {
+		t.Errorf("dry run on the mirror %+v, want %+v", res, want)
+	}
+	want.DryRun = false
+	if res := prune("mirror.git", "?pattern=refs/tags/"); !reflect.DeepEqual(res, want) {
+		t.Errorf("prune of the mirror %+v, want %+v", res, want)
+	}
+	if got := refs(mirror); got != "refs/heads/master" {
+		t.Errorf("mirror refs after the prune: %q, want master only", got)
+	}
+}
@@ -0,0 +1,171 @@
+package githttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RefUpdate is a command of a push, setting Ref from Old to New. An all
+// zero object name stands for a ref that does not exist, so Old is zero
+// when the ref is created and New when it is deleted.
+type RefUpdate struct {
+	Ref string `json:"ref"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// IsCreate reports whether the update creates the ref
+func (u RefUpdate) IsCreate() bool { return isZeroID(u.Old) }
+
+// IsDelete reports whether the update deletes the ref
+func (u RefUpdate) IsDelete() bool { return isZeroID(u.New) }
+
+func isZeroID(id string) bool {
+	return id != "" && strings.Trim(id, "0") == ""
+}
+
+// pushRequest is what a receive-pack request says before its pack
+type pushRequest struct {
+	Updates      []RefUpdate
+	Capabilities []string
+	// Options are the values given with git push -o
+	Options []string
+	// Cert is the push certificate of a signed push
+	Cert *pushCert
+}
+
+// SessionID returns the session-id capability the client sent
+func (push pushRequest) SessionID() string {
+	return capabilityValue(push.Capabilities, "session-id")
+}
+
+// readPushRequest reads the command list or push certificate and the push
+// options at the start of a receive-pack request. It returns them along
+// with a reader yielding the whole request again, so git still sees the
+// stream unchanged. Like git, it takes a flush, delim or response-end
+// packet as the end of a list. A request it cannot parse yields no
+// commands and an error; git may still apply part of it.
+func readPushRequest(body io.Reader) (pushRequest, io.Reader, error) {
+	var raw bytes.Buffer
+	var push pushRequest
+	rest := func() io.Reader { return io.MultiReader(bytes.NewReader(raw.Bytes()), body) }
+
+	for {
+		line, end, err := readPkt(body, &raw)
+		if err != nil {
+			return pushRequest{}, rest(), err
+		}
+		if end {
+			break
+		}
+
+		if i := bytes.IndexByte(line, 0); i >= 0 {
+			if push.Capabilities == nil {
+				push.Capabilities = strings.Fields(string(line[i+1:]))
+			}
+			line = line[:i]
+		}
+		if string(line) == "push-cert" {
+			cert, err := readPushCert(body, &raw)
+			if err != nil {
+				return pushRequest{}, rest(), err
+			}
+			push.Cert = cert
+			push.Updates = cert.Updates
+			continue
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) == 2 && fields[0] == "shallow" {
+			continue
+		}
+		if len(fields) != 3 {
+			return pushRequest{}, rest(), fmt.Errorf("malformed command %q", line)
+		}
+		push.Updates = append(push.Updates, RefUpdate{Old: fields[0], New: fields[1], Ref: fields[2]})
+	}
+
+	if len(push.Updates) > 0 && hasCapability(push.Capabilities, "push-options") {
+		for {
+			line, end, err := readPkt(body, &raw)
+			if err != nil {
+				return pushRequest{}, rest(), err
+			}
+			if end {
+				break
+			}
+			push.Options = append(push.Options, string(line))
+		}
+	}
+	return push, rest(), nil
+}
+
+// readPkt reads a pkt-line, without its trailing newline, copying what it
+// read to raw. end is set for the flush, delim and response-end packets.
+func readPkt(r io.Reader, raw *bytes.Buffer) (line []byte, end bool, err error) {
+	header := make([]byte, 4)
+	n, err := io.ReadFull(r, header)
+	raw.Write(header[:n])
+	if err != nil {
+		return nil, false, err
+	}
+	switch string(header) {
+	case pktFlush(), "0001", "0002":
+		return nil, true, nil
+	}
+
+	size, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil || size <= 4 {
+		return nil, false, errors.New("invalid pkt-line")
+	}
+	line = make([]byte, size-4)
+	n, err = io.ReadFull(r, line)
+	raw.Write(line[:n])
+	if err != nil {
+		return nil, false, err
+	}
+	return bytes.TrimSuffix(line, []byte("\n")), false, nil
+}
+
+// appliedRefUpdates returns the updates the repository reflects after
+// receive-pack ran, that is those git did not reject.
+func appliedRefUpdates(storage Storage, repoPath string, updates []RefUpdate) []RefUpdate {
+	refs, err := storage.ListRefs(repoPath)
+	if err != nil {
+		return nil
+	}
+	current := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		current[ref.Name] = ref.Hash
+	}
+
+	var applied []RefUpdate
+	for _, u := range updates {
+		hash, ok := current[u.Ref]
+		if (u.IsDelete() && !ok) || (!u.IsDelete() && hash == u.New) {
+			applied = append(applied, u)
+		}
+	}
+	return applied
+}
+
+// afterPush hands the updates of a successful receive-pack request that
+// were applied to the journal and the event spool.
+func (gsh GitSmartHTTP) afterPush(r *http.Request, urlRepo, repoPath string, push pushRequest) {
+	applied := appliedRefUpdates(gsh.storage(), repoPath, namespacedRefUpdates(r.Context(), push.Updates))
+	if len(applied) == 0 {
+		return
+	}
+
+	repo := strings.TrimPrefix(urlRepo, "/")
+	if gsh.Journal != nil {
+		gsh.recordJournal(r, repo, applied, push.Cert, push.SessionID())
+	}
+	if gsh.events != nil {
+		gsh.publishPush(r, repo, applied, push.Options, push.SessionID())
+	}
+}
@@ -0,0 +1,89 @@
+package githttp
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestReadPushRequestEndPackets(t *testing.T) {
+	const a, b = "1111111111111111111111111111111111111111", "2222222222222222222222222222222222222222"
+	for _, end := range []string{"0000", "0001", "0002"} {
+		req := pktWrite(a+" "+b+" refs/heads/master\x00report-status push-options\n") +
+			pktWrite(b+" "+a+" refs/heads/next\n") + end +
+			pktWrite("ci.skip\n") + end + "PACK"
+
+		push, rest, err := readPushRequest(strings.NewReader(req))
+		if err != nil {
+			t.Fatalf("%s: %s", end, err)
+		}
+		if len(push.Updates) != 2 || push.Updates[1].Ref != "refs/heads/next" {
+			t.Errorf("%s: updates = %v", end, push.Updates)
+		}
+		if len(push.Options) != 1 || push.Options[0] != "ci.skip" {
+			t.Errorf("%s: options = %v", end, push.Options)
+		}
+		if all, _ := io.ReadAll(rest); string(all) != req {
+			t.Errorf("%s: request not given back unchanged", end)
+		}
+	}
+}
+
+func TestReadPushRequestMalformed(t *testing.T) {
+	for _, req := range []string{
+		"0003",
+		"0004" + pktFlush(),
+		pktWrite("refs/heads/master\n") + pktFlush(),
+		pktWrite("push-cert\x00report-status\n") + pktWrite("certificate version 0.1\n") + "0001",
+	} {
+		if push, _, err := readPushRequest(strings.NewReader(req)); err == nil {
+			t.Errorf("%q: no error, updates = %v", req, push.Updates)
+		}
+	}
+}
+
+// A command list ended by a delim packet, which git takes as the end of
+// the list too, must not get past the push policies, nor a request they
+// cannot read.
+func TestPushPolicyEndPackets(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{
+		Protection: &BranchProtection{Static: []ProtectionRule{
+			{Ref: "refs/tags/v*", Immutable: true},
+		}},
+	})
+	path := srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	githttptest.Git(t, path, "tag", "v1", "master")
+	tag := srv.Ref("test.git", "refs/tags/v1")
+	del := tag + " " + strings.Repeat("0", 40) + " refs/tags/v1"
+
+	for _, c := range []struct {
+		name, body string
+		status     int
+	}{
+		{"delim", pktWrite(del+"\x00report-status delete-refs\n") + "0001", http.StatusOK},
+		{"response-end", pktWrite(del+"\x00report-status delete-refs\n") + "0002", http.StatusOK},
+		{"unterminated push-cert", pktWrite("push-cert\x00report-status delete-refs\n") +
+			pktWrite("certificate version 0.1\n") + pktWrite("pusher x\n") + pktWrite("pushee y\n") +
+			pktWrite("nonce z\n") + pktWrite("\n") + pktWrite(del+"\n") + pktFlush(), http.StatusBadRequest},
+	} {
+		resp, err := http.Post(srv.RepoURL("test.git")+"/git-receive-pack", "application/x-git-receive-pack-request", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if srv.Ref("test.git", "refs/tags/v1") != tag {
+			t.Fatalf("%s: protected tag deleted, response %d %q", c.name, resp.StatusCode, out)
+		}
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, resp.StatusCode, c.status)
+		}
+		if c.status == http.StatusOK && !strings.Contains(string(out), "ng refs/tags/v1") {
+			t.Errorf("%s: response %q, want the deletion rejected", c.name, out)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package githttp
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// refsCache keeps the info/refs advertisement per repository and service,
+// so clients polling info/refs do not fork a git process on every request.
+// An entry is only valid as long as the refs stamp of the repository it was
+// generated from has not changed. Entries live in a Cache, which may be
+// shared by several servers.
+type refsCache struct {
+	store Cache
+}
+
+func newRefsCache(store Cache) *refsCache {
+	return &refsCache{store: store}
+}
+
+// Get returns the cached advertisement when it was generated at the given
+// refs stamp.
+func (c *refsCache) Get(repoPath, service string, stamp time.Time) ([]byte, bool) {
+	entry, ok := c.store.Get(refsCacheKey(repoPath, service))
+	if !ok || len(entry) < 8 || int64(binary.BigEndian.Uint64(entry)) != stamp.UnixNano() {
+		return nil, false
+	}
+	return entry[8:], true
+}
+
+// Set stores the advertisement generated at the given refs stamp.
+func (c *refsCache) Set(repoPath, service string, stamp time.Time, refs []byte) {
+	entry := make([]byte, 8+len(refs))
+	binary.BigEndian.PutUint64(entry, uint64(stamp.UnixNano()))
+	copy(entry[8:], refs)
+	c.store.Set(refsCacheKey(repoPath, service), entry, 0)
+}
+
+// Invalidate drops the advertisements of all services of a repository.
+func (c *refsCache) Invalidate(repoPath string) {
+	c.store.Delete(
+		refsCacheKey(repoPath, uploadPack), refsCacheKey(repoPath, receivePack),
+		refsCacheKey(repoPath, uploadPack+":v2"), refsCacheKey(repoPath, receivePack+":v2"),
+	)
+}
+
+func refsCacheKey(repoPath, service string) string {
+	return "refs:" + service + ":" + repoPath
+}
+
+// refsStamp returns the latest modification time of HEAD, packed-refs and
+// every directory below refs/. Git updates refs by renaming lock files, so
+// any ref change touches at least one of them.
+func refsStamp(s Storage, repoPath string) time.Time {
+	var stamp time.Time
+	latest := func(name string) {
+		if fi, err := s.Stat(repoPath, name); err == nil && fi.ModTime().After(stamp) {
+			stamp = fi.ModTime()
+		}
+	}
+
+	latest("HEAD")
+	latest("packed-refs")
+
+	var walk func(dir string)
+	walk = func(dir string) {
+		latest(dir)
+		entries, err := s.ReadDir(repoPath, dir)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				walk(dir + "/" + e.Name())
+			}
+		}
+	}
+	walk("refs")
+
+	return stamp
+}
+
+// cachesRefs tells whether ref advertisements of the request with ctx go
+// through the refs cache. Those showing hidden refs or a namespace differ
+// from the one cached, as do those asking for other protocol parameters
+// than version 2.
+func (gsh GitSmartHTTP) cachesRefs(ctx context.Context) bool {
+	proto := gitProtocol(ctx)
+	return gsh.refsCache != nil && !hiddenRefsShown(ctx) && namespace(ctx) == "" && (proto == "" || proto == "version=2")
+}
+
+// refsCacheService returns the service the advertisement of the request
+// with ctx is cached under. Protocol version 2 advertises capabilities
+// instead of refs.
+func refsCacheService(ctx context.Context, service string) string {
+	if gitProtocol(ctx) == "version=2" {
+		return service + ":v2"
+	}
+	return service
+}
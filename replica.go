@@ -0,0 +1,37 @@
+package githttp
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// newPrimaryProxy returns the reverse proxy forwarding the pushes a replica
+// receives to the primary at primaryURL. Responses are streamed as they
+// come, so the sideband progress of the primary reaches the client.
+func newPrimaryProxy(primaryURL string) (*httputil.ReverseProxy, error) {
+	primary, err := url.Parse(primaryURL)
+	if err != nil {
+		return nil, err
+	}
+	if primary.Scheme != "http" && primary.Scheme != "https" {
+		return nil, fmt.Errorf("invalid primary URL %q", primaryURL)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(primary)
+	proxy.FlushInterval = -1
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		if ns := namespace(r.Context()); ns != "" {
+			r.Header.Set(namespaceHeader, ns)
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Cannot forward %s %s to the primary: %s", r.Method, r.URL.Path, err)
+		writeError(w, r, ErrPrimaryUnavailable)
+	}
+	return proxy, nil
+}
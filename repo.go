@@ -0,0 +1,157 @@
+package githttp
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Ways of handling the .git suffix of repository URLs
+const (
+	// GitSuffixExact serves repositories at exactly the path requested
+	GitSuffixExact = "exact"
+	// GitSuffixOptional serves foo.git at /foo as well, and foo at /foo.git
+	GitSuffixOptional = "optional"
+	// GitSuffixRequire only serves repositories requested with .git
+	GitSuffixRequire = "require"
+	// GitSuffixRedirect redirects /foo to /foo.git when only the latter exists
+	GitSuffixRedirect = "redirect"
+)
+
+// gitDir returns the git directory of the repository at repoPath, which is
+// either a bare repository or a work tree with a .git directory in it.
+func gitDir(repoPath string) (string, bool) {
+	if isGitDir(repoPath) {
+		return repoPath, true
+	}
+
+	dotGit := filepath.Join(repoPath, ".git")
+	if isGitDir(dotGit) {
+		return dotGit, true
+	}
+	return "", false
+}
+
+// isGitDir reports whether dir looks like a git directory, following the
+// same HEAD, objects and refs check git itself does.
+func isGitDir(dir string) bool {
+	if fi, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || fi.IsDir() {
+		return false
+	}
+
+	for _, name := range []string{"objects", "refs"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// insideRoot tells whether repoPath is below the repositories root
+func (gsh GitSmartHTTP) insideRoot(repoPath string) bool {
+	rel, err := filepath.Rel(gsh.ReposRootPath, repoPath)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// validateRepo makes sure repoPath is a git repository below the
+// repositories root that may be served, so git is never spawned against
+// arbitrary paths. Unless ExportAll is set, a repository is only served when
+// it contains a git-daemon-export-ok file, like git-http-backend does.
+func (gsh GitSmartHTTP) validateRepo(repoPath string) error {
+	if !gsh.insideRoot(repoPath) {
+		return ErrRepoNotFound
+	}
+
+	if !isRepo(gsh.storage(), repoPath) {
+		return ErrRepoNotFound
+	}
+
+	if !gsh.ExportAll {
+		if _, err := gsh.storage().Stat(repoPath, "git-daemon-export-ok"); err != nil {
+			return ErrRepoNotExported
+		}
+	}
+	return nil
+}
+
+// cleanRepo returns the repository part of a request path without dot
+// segments and repeated slashes, so that a repository has a single name for
+// access checks, policies, quotas and statistics. Paths with .. segments
+// are refused rather than resolved.
+func cleanRepo(urlRepo string) (string, error) {
+	for _, elem := range strings.Split(urlRepo, "/") {
+		if elem == ".." {
+			return "", ErrRepoNotFound
+		}
+	}
+	if urlRepo == "" {
+		return "", nil
+	}
+	return path.Clean("/" + urlRepo), nil
+}
+
+// normalizeRepo applies the GitSuffix policy to the repository part of a
+// request path and returns the repository path to serve instead.
+func (gsh GitSmartHTTP) normalizeRepo(urlRepo string) (string, error) {
+	// A backslash is a path separator on Windows but not in URLs
+	if strings.Contains(urlRepo, "\\") {
+		return "", ErrRepoNotFound
+	}
+
+	switch gsh.GitSuffix {
+	case GitSuffixRequire:
+		if !strings.HasSuffix(urlRepo, ".git") {
+			return "", ErrRepoNotFound
+		}
+	case GitSuffixOptional:
+		if !gsh.repoExists(urlRepo) {
+			alt := urlRepo + ".git"
+			if strings.HasSuffix(urlRepo, ".git") {
+				alt = strings.TrimSuffix(urlRepo, ".git")
+			}
+			if gsh.repoExists(alt) {
+				return alt, nil
+			}
+		}
+	case GitSuffixRedirect:
+		if !strings.HasSuffix(urlRepo, ".git") && !gsh.repoExists(urlRepo) && gsh.repoExists(urlRepo+".git") {
+			return urlRepo + ".git", nil
+		}
+	}
+	return urlRepo, nil
+}
+
+func (gsh GitSmartHTTP) repoExists(urlRepo string) bool {
+	_, ok := gitDir(gsh.localPath(urlRepo))
+	return ok
+}
+
+// localPath maps the slash separated path of a request URL to the file
+// system path below the repositories root.
+func (gsh GitSmartHTTP) localPath(urlPath string) string {
+	return filepath.Join(gsh.ReposRootPath, filepath.FromSlash(urlPath))
+}
+
+// walkRepos calls fn with the URL path and file system path of every
+// repository below the repositories root, skipping hidden directories such
+// as those of repositories being mirrored or restored.
+func (gsh GitSmartHTTP) walkRepos(fn func(repo, repoPath string)) error {
+	return filepath.WalkDir(gsh.ReposRootPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || p == gsh.ReposRootPath {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if _, ok := gitDir(p); ok {
+			rel, err := filepath.Rel(gsh.ReposRootPath, p)
+			if err == nil {
+				fn(filepath.ToSlash(rel), p)
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
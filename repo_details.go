@@ -0,0 +1,210 @@
+package githttp
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repoDetailsTTL is how long the details of a repository are served from
+// the cache when nothing invalidates them before
+const repoDetailsTTL = 10 * time.Minute
+
+// RepoDetails describes what a repository holds and when it was last used
+type RepoDetails struct {
+	Name     string       `json:"name"`
+	Objects  ObjectCounts `json:"objects"`
+	DiskSize int64        `json:"disk_size"`
+	Refs     RefCounts    `json:"refs"`
+	// LastPush and LastFetch come from the usage statistics, when kept.
+	// Without them LastPush is when a ref last changed.
+	LastPush  *time.Time `json:"last_push,omitempty"`
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+	// Computed is when the objects, disk size and refs were counted
+	Computed time.Time `json:"computed"`
+}
+
+// ObjectCounts is what git count-objects -v reports, with sizes in bytes
+type ObjectCounts struct {
+	Loose         int64 `json:"loose"`
+	LooseSize     int64 `json:"loose_size"`
+	Packed        int64 `json:"packed"`
+	Packs         int64 `json:"packs"`
+	PackSize      int64 `json:"pack_size"`
+	PrunePackable int64 `json:"prune_packable"`
+	Garbage       int64 `json:"garbage"`
+	GarbageSize   int64 `json:"garbage_size"`
+}
+
+// RefCounts counts the refs of a repository by kind
+type RefCounts struct {
+	Branches int `json:"branches"`
+	Tags     int `json:"tags"`
+	Other    int `json:"other"`
+}
+
+// repoDetailsCache keeps the details of repositories, which take a walk of
+// the repository to compute, until they expire or the repository changes
+type repoDetailsCache struct {
+	mu    sync.Mutex
+	repos map[string]RepoDetails
+}
+
+func newRepoDetailsCache() *repoDetailsCache {
+	return &repoDetailsCache{repos: make(map[string]RepoDetails)}
+}
+
+func (c *repoDetailsCache) Get(repoPath string) (RepoDetails, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.repos[repoPath]
+	if !ok || time.Since(d.Computed) > repoDetailsTTL {
+		return RepoDetails{}, false
+	}
+	return d, true
+}
+
+func (c *repoDetailsCache) Set(repoPath string, d RepoDetails) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.repos[repoPath] = d
+}
+
+// Invalidate drops the details of a repository after pushes and
+// maintenance changed it
+func (c *repoDetailsCache) Invalidate(repoPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.repos, repoPath)
+}
+
+// repoDetails returns the details of the repository, computing them when
+// they are not cached
+func (gsh GitSmartHTTP) repoDetails(ctx context.Context, repo, repoPath string) (RepoDetails, error) {
+	d, ok := gsh.details.Get(repoPath)
+	if !ok {
+		var err error
+		if d, err = computeRepoDetails(ctx, gsh.processes, repoPath); err != nil {
+			return RepoDetails{}, err
+		}
+		gsh.details.Set(repoPath, d)
+	}
+
+	d.Name = repo
+	if gsh.repoStats != nil {
+		if stats, ok := gsh.repoStats.Get(repo); ok {
+			d.LastPush = nonZeroTime(stats.LastPush)
+			d.LastFetch = nonZeroTime(stats.LastFetch)
+		}
+	} else {
+		d.LastPush = nonZeroTime(refsStamp(gsh.storage(), repoPath).UTC())
+	}
+	return d, nil
+}
+
+func computeRepoDetails(ctx context.Context, processes *ProcessManager, repoPath string) (RepoDetails, error) {
+	dir, _ := gitDir(repoPath)
+	d := RepoDetails{Computed: time.Now().UTC()}
+
+	out, err := processes.git(ctx, dir, "count-objects", "-v")
+	if err != nil {
+		return RepoDetails{}, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		switch key {
+		case "count":
+			d.Objects.Loose = n
+		case "size":
+			d.Objects.LooseSize = n << 10
+		case "in-pack":
+			d.Objects.Packed = n
+		case "packs":
+			d.Objects.Packs = n
+		case "size-pack":
+			d.Objects.PackSize = n << 10
+		case "prune-packable":
+			d.Objects.PrunePackable = n
+		case "garbage":
+			d.Objects.Garbage = n
+		case "size-garbage":
+			d.Objects.GarbageSize = n << 10
+		}
+	}
+
+	out, err = processes.git(ctx, dir, "for-each-ref", "--format=%(refname)")
+	if err != nil {
+		return RepoDetails{}, err
+	}
+	for _, ref := range strings.Fields(out) {
+		switch {
+		case strings.HasPrefix(ref, "refs/heads/"):
+			d.Refs.Branches++
+		case strings.HasPrefix(ref, "refs/tags/"):
+			d.Refs.Tags++
+		default:
+			d.Refs.Other++
+		}
+	}
+
+	d.DiskSize = dirSize(dir)
+	return d, nil
+}
+
+// dirSize returns the size of the regular files below dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi, err := e.Info(); err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func nonZeroTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// serveRepoDetails serves the details of a repository as JSON to those who
+// may read the repository
+func (gsh GitSmartHTTP) serveRepoDetails(w http.ResponseWriter, r *http.Request, repo string) {
+	repoPath := gsh.localPath(repo)
+	if err := gsh.validateRepo(repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if gsh.Access != nil {
+		if err := gsh.Access.CheckAccess(r, gsh.identity(r), repo, OpRead); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	d, err := gsh.repoDetails(r.Context(), repo, repoPath)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,67 @@
+package githttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestRepoDetails(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{})
+	repoPath := srv.CreateRepo("test.git", map[string]string{"README": "hello\n"}, map[string]string{"README": "more\n"})
+	githttptest.Git(t, repoPath, "tag", "v1", "master")
+
+	details := func(repo string) RepoDetails {
+		t.Helper()
+		resp, body := request(t, "GET", srv.URL+"/api/repos/"+repo, "", "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("details of %s: %d %s", repo, resp.StatusCode, body)
+		}
+		var d RepoDetails
+		if err := json.Unmarshal([]byte(body), &d); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := details("test.git")
+	if d.Name != "test.git" || d.Refs != (RefCounts{Branches: 1, Tags: 1}) {
+		t.Errorf("details name %q refs %+v, want test.git with a branch and a tag", d.Name, d.Refs)
+	}
+	if d.Objects.Loose != 6 || d.Objects.Packed != 0 || d.DiskSize == 0 {
+		t.Errorf("details objects %+v disk size %d, want 6 loose objects", d.Objects, d.DiskSize)
+	}
+	if d.LastPush == nil || d.LastFetch != nil {
+		t.Errorf("details last push %v fetch %v, want the last ref change only", d.LastPush, d.LastFetch)
+	}
+
+	// Details are cached until a push changes the repository
+	if again := details("test.git"); !again.Computed.Equal(d.Computed) {
+		t.Error("details computed again for an unchanged repository")
+	}
+	work := srv.Clone("test.git")
+	githttptest.Commit(t, work, map[string]string{"README": "again\n"}, "third")
+	srv.Push(work, "HEAD:refs/heads/topic")
+	d = details("test.git")
+	if d.Refs.Branches != 2 || d.Objects.Loose+d.Objects.Packed != 9 {
+		t.Errorf("details after a push: refs %+v objects %+v, want 2 branches and 9 objects", d.Refs, d.Objects)
+	}
+
+	if resp, _ := request(t, "GET", srv.URL+"/api/repos/missing.git", "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("details of a missing repository: %d, want 404", resp.StatusCode)
+	}
+
+	// With usage statistics, last push and fetch come from them
+	srv = newTestServer(t, GitSmartHTTPConfig{RepoStatsPath: filepath.Join(t.TempDir(), "stats.json")})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	if d := details("test.git"); d.LastPush != nil || d.LastFetch != nil {
+		t.Errorf("details of an unused repository: last push %v fetch %v", d.LastPush, d.LastFetch)
+	}
+	srv.Clone("test.git")
+	if d := details("test.git"); d.LastPush != nil || d.LastFetch == nil {
+		t.Errorf("details after a clone: last push %v fetch %v, want a fetch only", d.LastPush, d.LastFetch)
+	}
+}
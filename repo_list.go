@@ -0,0 +1,40 @@
+package githttp
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// RepoInfo describes a repository in the repository listing
+type RepoInfo struct {
+	Name string `json:"name"`
+	// Fsck is the outcome of the last integrity check, without its output
+	Fsck *FsckStatus `json:"fsck,omitempty"`
+}
+
+// serveRepoList lists the repositories the client may read as JSON
+func (gsh GitSmartHTTP) serveRepoList(w http.ResponseWriter, r *http.Request) {
+	repos := []RepoInfo{}
+	err := gsh.walkRepos(func(repo, repoPath string) {
+		if gsh.validateRepo(repoPath) != nil {
+			return
+		}
+		if gsh.Access != nil && gsh.Access.CheckAccess(r, gsh.identity(r), repo, OpRead) != nil {
+			return
+		}
+		info := RepoInfo{Name: repo}
+		if st, ok := gsh.fscks.Get(repo); ok {
+			st.Output = ""
+			info.Fsck = &st
+		}
+		repos = append(repos, info)
+	})
+	if err != nil {
+		log.Printf("Cannot list repositories: %s", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	json.NewEncoder(w).Encode(repos)
+}
@@ -0,0 +1,111 @@
+package githttp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// repoLockFile is the file in a git directory servers sharing the storage
+// hold an advisory lock on while rewriting the repository. It is not
+// named *.lock, which the janitor removes.
+const repoLockFile = "git-http.push-lock"
+
+// repoLockPoll is how often a held advisory lock is tried again
+const repoLockPoll = 50 * time.Millisecond
+
+// repoLocks serializes the work rewriting each repository: within the
+// process with a lock per repository, and across servers sharing the
+// storage with an advisory lock on the repoLockFile of the repository,
+// where the platform supports one. A single repoLocks is shared by pushes,
+// when serialized, garbage collections, ref pruning and pack tiering, so
+// that none of them runs along another. Git updates every ref atomically,
+// but concurrent pushes still race on packed-refs and on what push
+// policies checked.
+type repoLocks struct {
+	mu    sync.Mutex
+	repos map[string]*repoLock
+}
+
+type repoLock struct {
+	held  chan struct{}
+	users int
+}
+
+func newRepoLocks() *repoLocks {
+	return &repoLocks{repos: make(map[string]*repoLock)}
+}
+
+// Lock blocks until the repository is locked or ctx is done, returning the
+// function unlocking it.
+func (l *repoLocks) Lock(ctx context.Context, repoPath string) (func(), error) {
+	l.mu.Lock()
+	lock := l.repos[repoPath]
+	if lock == nil {
+		lock = &repoLock{held: make(chan struct{}, 1)}
+		l.repos[repoPath] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+	case <-ctx.Done():
+		l.done(repoPath, lock)
+		return nil, ctx.Err()
+	}
+
+	f, err := lockFile(ctx, repoPath)
+	if err != nil {
+		<-lock.held
+		l.done(repoPath, lock)
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+		<-lock.held
+		l.done(repoPath, lock)
+	}, nil
+}
+
+// done drops the lock of a repository no one waits for anymore
+func (l *repoLocks) done(repoPath string, lock *repoLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lock.users--; lock.users == 0 {
+		delete(l.repos, repoPath)
+	}
+}
+
+// lockFile takes the advisory lock of the repository, polling while
+// another server holds it
+func lockFile(ctx context.Context, repoPath string) (*os.File, error) {
+	dir, _ := gitDir(repoPath)
+	f, err := os.OpenFile(filepath.Join(dir, repoLockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if locked {
+			return f, nil
+		}
+
+		select {
+		case <-time.After(repoLockPoll):
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package githttp
+
+import "os"
+
+// tryLockFile has no advisory lock to take where flock is not available,
+// leaving pushes serialized within the process only
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
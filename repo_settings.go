@@ -0,0 +1,156 @@
+package githttp
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// repoSettingsFile is the file in a repository overriding server settings
+// for it
+const repoSettingsFile = "git-http.json"
+
+// RepoSettings overrides server settings for a single repository. It is
+// read from the git-http.json file of the repository, which is picked up
+// again whenever it changes, and set through the admin API at
+// /api/repos/<repo>/settings. Unset fields keep the server setting.
+type RepoSettings struct {
+	UploadPack             *bool  `json:"upload_pack,omitempty"`
+	ReceivePack            *bool  `json:"receive_pack,omitempty"`
+	MaxUploadPackBodySize  *int64 `json:"max_upload_pack_body_size,omitempty"`
+	MaxReceivePackBodySize *int64 `json:"max_receive_pack_body_size,omitempty"`
+	MaxBlobSize            *int64 `json:"max_blob_size,omitempty"`
+	RequireSignedPush      *bool  `json:"require_signed_push,omitempty"`
+	RequireDCO             *bool  `json:"require_dco,omitempty"`
+	// SHAInWant is one of SHAInWantOff, SHAInWantTip and
+	// SHAInWantReachable
+	SHAInWant        *string `json:"sha_in_want,omitempty"`
+	UpdateServerInfo *bool   `json:"update_server_info,omitempty"`
+}
+
+// overridesPolicies tells whether the settings change the push policies
+func (st RepoSettings) overridesPolicies() bool {
+	return st.MaxBlobSize != nil || st.RequireSignedPush != nil || st.RequireDCO != nil
+}
+
+// repoSettingsCache keeps the parsed settings of repositories along with
+// the modification time of their file, so that the file is only read
+// again once it changed.
+type repoSettingsCache struct {
+	mu    sync.Mutex
+	repos map[string]cachedRepoSettings
+}
+
+type cachedRepoSettings struct {
+	modTime  time.Time
+	size     int64
+	settings RepoSettings
+}
+
+func newRepoSettingsCache() *repoSettingsCache {
+	return &repoSettingsCache{repos: make(map[string]cachedRepoSettings)}
+}
+
+// repoSettings returns the settings of the repository, which are empty when
+// it has no settings file or the file cannot be parsed.
+func (gsh GitSmartHTTP) repoSettings(repoPath string) RepoSettings {
+	fi, err := gsh.storage().Stat(repoPath, repoSettingsFile)
+	if err != nil {
+		return RepoSettings{}
+	}
+
+	c := gsh.settings
+	c.mu.Lock()
+	cached, ok := c.repos[repoPath]
+	c.mu.Unlock()
+	if ok && cached.modTime.Equal(fi.ModTime()) && cached.size == fi.Size() {
+		return cached.settings
+	}
+
+	var st RepoSettings
+	if f, err := gsh.storage().Open(repoPath, repoSettingsFile); err == nil {
+		err = json.NewDecoder(io.LimitReader(f, 64<<10)).Decode(&st)
+		f.Close()
+		if err != nil {
+			log.Printf("Cannot parse %s of %s: %s", repoSettingsFile, repoPath, err)
+			st = RepoSettings{}
+		}
+	}
+
+	c.mu.Lock()
+	c.repos[repoPath] = cachedRepoSettings{modTime: fi.ModTime(), size: fi.Size(), settings: st}
+	c.mu.Unlock()
+	return st
+}
+
+// pushPoliciesFor returns the push policies of a repository with the
+// settings
+func (gsh GitSmartHTTP) pushPoliciesFor(repo string, st RepoSettings) []PushPolicy {
+	if !st.overridesPolicies() {
+		return gsh.policies
+	}
+
+	cfg := *gsh.GitSmartHTTPConfig
+	if st.MaxBlobSize != nil {
+		cfg.MaxBlobSize = *st.MaxBlobSize
+	}
+	if st.RequireSignedPush != nil {
+		cfg.RequireSignedPush = nil
+		if *st.RequireSignedPush {
+			cfg.RequireSignedPush = []string{repo}
+		}
+	}
+	if st.RequireDCO != nil {
+		cfg.RequireDCO = nil
+		if *st.RequireDCO {
+			cfg.RequireDCO = []string{repo}
+		}
+	}
+	return pushPolicies(&cfg, gsh.commitKeys)
+}
+
+// serveRepoSettings serves the settings of the repository as JSON on GET,
+// and replaces them on PUT.
+func (gsh GitSmartHTTP) serveRepoSettings(w http.ResponseWriter, r *http.Request, repo string) {
+	repoPath := gsh.localPath(repo)
+	if err := gsh.validateRepo(repoPath); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if r.Method == "PUT" {
+		var st RepoSettings
+		dec := json.NewDecoder(io.LimitReader(r.Body, 64<<10))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&st); err != nil {
+			writeErrorMessage(w, r, http.StatusBadRequest, "invalid settings: "+err.Error())
+			return
+		}
+		if st.SHAInWant != nil {
+			if err := CheckSHAInWant(*st.SHAInWant); err != nil {
+				writeErrorMessage(w, r, http.StatusBadRequest, "invalid settings: "+err.Error())
+				return
+			}
+		}
+		dir, _ := gitDir(repoPath)
+		data, _ := json.MarshalIndent(st, "", "  ")
+		tmp := filepath.Join(dir, repoSettingsFile+".tmp")
+		if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, repoSettingsFile)); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	json.NewEncoder(w).Encode(gsh.repoSettings(repoPath))
+}
@@ -0,0 +1,215 @@
+package githttp
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// repoStatsMonths is how many months of traffic are kept per repository
+const repoStatsMonths = 24
+
+// RepoStats counts how a repository is used. BytesServed and BytesReceived
+// count the responses and request bodies of fetches, pushes, ref
+// advertisements and dumb HTTP downloads, in total and by month.
+type RepoStats struct {
+	Clones        int64     `json:"clones"`
+	Fetches       int64     `json:"fetches"`
+	Pushes        int64     `json:"pushes"`
+	UniqueClients int       `json:"unique_clients"`
+	BytesServed   int64     `json:"bytes_served"`
+	BytesReceived int64     `json:"bytes_received"`
+	LastUsed      time.Time `json:"last_used"`
+	LastPush      time.Time `json:"last_push"`
+	LastFetch     time.Time `json:"last_fetch"`
+	// Months holds the traffic of the last months by month in UTC, such as
+	// 2026-01
+	Months map[string]RepoMonth `json:"months,omitempty"`
+}
+
+// RepoMonth is the traffic of a repository in a month
+type RepoMonth struct {
+	BytesServed   int64 `json:"bytes_served"`
+	BytesReceived int64 `json:"bytes_received"`
+}
+
+// repoUsage is what is kept of a repository to derive its RepoStats
+type repoUsage struct {
+	RepoStats
+	Clients map[string]struct{} `json:"clients"`
+}
+
+// addBytes counts traffic of the repository at now
+func (u *repoUsage) addBytes(now time.Time, served, received int64) {
+	u.BytesServed += served
+	u.BytesReceived += received
+
+	if u.Months == nil {
+		u.Months = make(map[string]RepoMonth)
+	}
+	month := now.UTC().Format("2006-01")
+	m := u.Months[month]
+	m.BytesServed += served
+	m.BytesReceived += received
+	u.Months[month] = m
+
+	for len(u.Months) > repoStatsMonths {
+		oldest := month
+		for k := range u.Months {
+			if k < oldest {
+				oldest = k
+			}
+		}
+		delete(u.Months, oldest)
+	}
+}
+
+// repoStats keeps the usage of every repository in memory and saves it to
+// a JSON file every minute, so that it survives restarts.
+type repoStats struct {
+	path  string
+	mu    sync.Mutex
+	repos map[string]*repoUsage
+	dirty bool
+}
+
+func loadRepoStats(path string) (*repoStats, error) {
+	s := &repoStats{path: path, repos: make(map[string]*repoUsage)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.repos); err != nil {
+		return nil, err
+	}
+	for _, u := range s.repos {
+		if u.Clients == nil {
+			u.Clients = make(map[string]struct{})
+		}
+	}
+	return s, nil
+}
+
+// record counts a finished upload-pack or receive-pack request
+func (s *repoStats) record(r *http.Request, tr *transfer, out int64) {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.usage(tr.repo)
+	now := time.Now().UTC()
+	switch {
+	case tr.service == receivePack:
+		u.Pushes++
+		u.LastPush = now
+	// Only the last request of a negotiation, the one sending done, gets
+	// the pack.
+	case tr.scan.done && tr.scan.haves == 0:
+		u.Clones++
+		u.LastFetch = now
+	case tr.scan.done:
+		u.Fetches++
+		u.LastFetch = now
+	}
+	u.addBytes(now, out, tr.in)
+	u.Clients[clientIP] = struct{}{}
+	u.UniqueClients = len(u.Clients)
+	u.LastUsed = now
+	s.dirty = true
+}
+
+// recordBytes counts the traffic of a ref advertisement or dumb HTTP
+// download, which record leaves out
+func (s *repoStats) recordBytes(repo string, served, received int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.usage(repo).addBytes(time.Now(), served, received)
+	s.dirty = true
+}
+
+// usage returns the usage of the repository, adding it when new
+func (s *repoStats) usage(repo string) *repoUsage {
+	u := s.repos[repo]
+	if u == nil {
+		u = &repoUsage{Clients: make(map[string]struct{})}
+		s.repos[repo] = u
+	}
+	return u
+}
+
+// Get returns the statistics of the repository
+func (s *repoStats) Get(repo string) (RepoStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.repos[repo]
+	if !ok {
+		return RepoStats{}, false
+	}
+	stats := u.RepoStats
+	stats.Months = make(map[string]RepoMonth, len(u.Months))
+	for month, m := range u.Months {
+		stats.Months[month] = m
+	}
+	return stats, true
+}
+
+// save writes the statistics to their file if they changed
+func (s *repoStats) save() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.repos)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *repoStats) run() {
+	for range time.Tick(time.Minute) {
+		if err := s.save(); err != nil {
+			log.Printf("Cannot save repository statistics to %s: %s", s.path, err)
+		}
+	}
+}
+
+// serveRepoStats serves the statistics of a repository as JSON to those who
+// may read the repository.
+func (gsh GitSmartHTTP) serveRepoStats(w http.ResponseWriter, r *http.Request, repo string) {
+	if gsh.Access != nil {
+		if err := gsh.Access.CheckAccess(r, gsh.identity(r), repo, OpRead); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	stats, ok := gsh.repoStats.Get(repo)
+	if !ok {
+		writeError(w, r, ErrRepoNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,33 @@
+package githttp
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepoPaths(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{})
+	srv.CreateRepo("sub/test.git", map[string]string{"README": "hello\n"})
+
+	gsh := GitSmartHTTP{GitSmartHTTPConfig: &GitSmartHTTPConfig{ReposRootPath: srv.Root}}
+	if got, want := gsh.localPath("/sub/test.git"), filepath.Join(srv.Root, "sub", "test.git"); got != want {
+		t.Errorf("local path %s, want %s", got, want)
+	}
+
+	// Backslashes separate paths on Windows only, in URLs they are refused
+	for path, status := range map[string]int{
+		"/sub/test.git":   http.StatusOK,
+		"/sub%5Ctest.git": http.StatusNotFound,
+		"/sub\\test.git":  http.StatusNotFound,
+	} {
+		resp, _ := request(t, "GET", srv.URL+path+"/info/refs?service=git-upload-pack", "", "")
+		if resp.StatusCode != status {
+			t.Errorf("%s: %d, want %d", path, resp.StatusCode, status)
+		}
+	}
+
+	if git := gitExecutable(); !filepath.IsAbs(git) {
+		t.Errorf("git found at %q, want an absolute path", git)
+	}
+}
@@ -0,0 +1,125 @@
+package githttp
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Routes the limits of RoutePolicies apply to: the ref advertisements of
+// smart HTTP, fetches, pushes and the files of dumb HTTP
+const (
+	RouteInfoRefs    = "info-refs"
+	RouteUploadPack  = "upload-pack"
+	RouteReceivePack = "receive-pack"
+	RouteObjects     = "objects"
+)
+
+// RoutePolicy holds the limits of a route, whose traffic differs by orders
+// of magnitude from that of the others. Zero fields keep the server-wide
+// settings.
+type RoutePolicy struct {
+	// Timeout is how long git may run for info-refs, upload-pack and
+	// receive-pack, and how long writing the response may take for objects
+	Timeout time.Duration
+	// MaxBodySize is the largest request body accepted by upload-pack and
+	// receive-pack
+	MaxBodySize int64
+	// ConnRate and RepoRate are the bytes per second per connection and per
+	// repository, sent for info-refs, upload-pack and objects and received
+	// for receive-pack
+	ConnRate int64
+	RepoRate int64
+}
+
+// ParseRoutePolicy parses a route policy given as
+// route:timeout=1m,max-body-size=1048576,conn-rate=65536,repo-rate=1048576,
+// any of the limits being optional
+func ParseRoutePolicy(s string) (string, RoutePolicy, error) {
+	var p RoutePolicy
+	route, limits, _ := strings.Cut(s, ":")
+	switch route {
+	case RouteInfoRefs, RouteUploadPack, RouteReceivePack, RouteObjects:
+	default:
+		return "", p, fmt.Errorf("invalid route policy %q: unknown route %q", s, route)
+	}
+
+	for _, kv := range strings.Split(limits, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		var err error
+		switch k {
+		case "timeout":
+			p.Timeout, err = time.ParseDuration(v)
+		case "max-body-size":
+			p.MaxBodySize, err = strconv.ParseInt(v, 10, 64)
+		case "conn-rate":
+			p.ConnRate, err = strconv.ParseInt(v, 10, 64)
+		case "repo-rate":
+			p.RepoRate, err = strconv.ParseInt(v, 10, 64)
+		default:
+			return "", p, fmt.Errorf("invalid route policy %q: unknown limit %q", s, k)
+		}
+		if err != nil {
+			return "", p, fmt.Errorf("invalid route policy %q: invalid %s %q", s, k, v)
+		}
+	}
+	return route, p, nil
+}
+
+// requestRoute returns the route of a request to the service, empty for
+// services added with Register
+func requestRoute(s Service, r *http.Request) string {
+	if s.route == RouteInfoRefs && r.URL.Query().Get("service") == "" {
+		// The info/refs file of dumb HTTP
+		return RouteObjects
+	}
+	return s.route
+}
+
+// serviceRoute returns the route of a stateless RPC service
+func serviceRoute(service string) string {
+	if service == uploadPack {
+		return RouteUploadPack
+	}
+	return RouteReceivePack
+}
+
+// routePolicy returns the limits of the route, those of its RoutePolicy
+// overriding the server-wide settings. The ref advertisement of info-refs
+// runs git with the timeout of the service by default.
+func (gsh GitSmartHTTP) routePolicy(route, service string) RoutePolicy {
+	var p RoutePolicy
+	switch route {
+	case RouteInfoRefs:
+		p.Timeout = gsh.ReceivePackTimeout
+		if service == uploadPack {
+			p.Timeout = gsh.UploadPackTimeout
+		}
+	case RouteUploadPack:
+		p = RoutePolicy{gsh.UploadPackTimeout, gsh.MaxUploadPackBodySize, gsh.ConnRateLimit, gsh.RepoRateLimit}
+	case RouteReceivePack:
+		p = RoutePolicy{Timeout: gsh.ReceivePackTimeout, MaxBodySize: gsh.MaxReceivePackBodySize}
+	case RouteObjects:
+		p = RoutePolicy{ConnRate: gsh.ConnRateLimit, RepoRate: gsh.RepoRateLimit}
+	}
+
+	o := gsh.RoutePolicies[route]
+	if o.Timeout != 0 {
+		p.Timeout = o.Timeout
+	}
+	if o.MaxBodySize != 0 {
+		p.MaxBodySize = o.MaxBodySize
+	}
+	if o.ConnRate != 0 {
+		p.ConnRate = o.ConnRate
+	}
+	if o.RepoRate != 0 {
+		p.RepoRate = o.RepoRate
+	}
+	return p
+}
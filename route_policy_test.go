@@ -0,0 +1,94 @@
+package githttp
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestParseRoutePolicy(t *testing.T) {
+	route, p, err := ParseRoutePolicy("upload-pack:timeout=1m,max-body-size=1048576, conn-rate=65536,repo-rate=1048576")
+	want := RoutePolicy{Timeout: time.Minute, MaxBodySize: 1 << 20, ConnRate: 64 << 10, RepoRate: 1 << 20}
+	if err != nil || route != RouteUploadPack || p != want {
+		t.Errorf("ParseRoutePolicy = %s %+v %v, want upload-pack %+v", route, p, err, want)
+	}
+	if route, p, err := ParseRoutePolicy("objects:"); err != nil || route != RouteObjects || p != (RoutePolicy{}) {
+		t.Errorf("ParseRoutePolicy without limits = %s %+v %v", route, p, err)
+	}
+	for _, s := range []string{"fetch:timeout=1m", "receive-pack:timeout=soon", "info-refs:burst=10", "upload-pack:max-body-size=1MB"} {
+		if _, _, err := ParseRoutePolicy(s); err == nil {
+			t.Errorf("ParseRoutePolicy(%q) succeeded", s)
+		}
+	}
+}
+
+func TestRoutePolicies(t *testing.T) {
+	gsh := NewGitSmartHTTP(&GitSmartHTTPConfig{
+		ReposRootPath:         t.TempDir(),
+		UploadPackTimeout:     time.Minute,
+		ReceivePackTimeout:    time.Hour,
+		MaxUploadPackBodySize: 1 << 20,
+		ConnRateLimit:         100,
+		RepoRateLimit:         1000,
+		RoutePolicies: map[string]RoutePolicy{
+			RouteInfoRefs:   {Timeout: time.Second},
+			RouteUploadPack: {MaxBodySize: 1 << 10, ConnRate: 50},
+			RouteObjects:    {RepoRate: 500},
+		},
+	})
+	for _, tc := range []struct {
+		route, service string
+		want           RoutePolicy
+	}{
+		{RouteInfoRefs, uploadPack, RoutePolicy{Timeout: time.Second}},
+		{RouteInfoRefs, receivePack, RoutePolicy{Timeout: time.Second}},
+		{RouteUploadPack, uploadPack, RoutePolicy{Timeout: time.Minute, MaxBodySize: 1 << 10, ConnRate: 50, RepoRate: 1000}},
+		{RouteReceivePack, receivePack, RoutePolicy{Timeout: time.Hour}},
+		{RouteObjects, "", RoutePolicy{ConnRate: 100, RepoRate: 500}},
+	} {
+		if got := gsh.routePolicy(tc.route, tc.service); got != tc.want {
+			t.Errorf("policy of %s for %s %+v, want %+v", tc.route, tc.service, got, tc.want)
+		}
+	}
+
+	// Without a policy, info-refs runs git with the timeout of the service
+	gsh.RoutePolicies = nil
+	if got := gsh.routePolicy(RouteInfoRefs, receivePack).Timeout; got != time.Hour {
+		t.Errorf("info-refs timeout for receive-pack %s, want that of receive-pack", got)
+	}
+}
+
+func TestRoutePoliciesApplied(t *testing.T) {
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		return NewGitSmartHTTP(&GitSmartHTTPConfig{
+			ReposRootPath:         root,
+			ExportAll:             true,
+			UploadPack:            true,
+			UploadPackTimeout:     time.Minute,
+			MaxUploadPackBodySize: 1 << 20,
+			GitPath:               fakeGit(t, "exec sleep 60"),
+			RoutePolicies: map[string]RoutePolicy{
+				RouteInfoRefs:   {Timeout: 100 * time.Millisecond},
+				RouteUploadPack: {MaxBodySize: 1 << 10},
+			},
+		}).Handler()
+	})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	start := time.Now()
+	resp, body := request(t, "GET", srv.RepoURL("test.git")+"/info/refs?service=git-upload-pack", "", "")
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("ref advertisement outliving its timeout: %d %q, want 504", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("git was killed after %s", elapsed)
+	}
+
+	resp, body = request(t, "POST", srv.RepoURL("test.git")+"/git-upload-pack", "application/x-git-upload-pack-request", strings.Repeat("0", 2<<10))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("fetch over the body size of its route: %d %q, want 413", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,287 @@
+package githttp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Bucket stores objects in an S3 compatible bucket. It speaks just enough
+// of the S3 API, signed with AWS Signature Version 4, to put, get, list and
+// delete objects, and to presign downloads. Requests use path style URLs, which S3 and its clones
+// such as MinIO all support.
+type S3Bucket struct {
+	// Endpoint is the URL of the service, such as https://s3.amazonaws.com
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	Client *http.Client
+}
+
+// S3Object is an object listed in a bucket
+type S3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// NewS3Bucket returns an S3Bucket for the bucket at endpoint
+func NewS3Bucket(endpoint, bucket, region, accessKey, secretKey string) *S3Bucket {
+	return &S3Bucket{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    &http.Client{Timeout: time.Hour},
+	}
+}
+
+// Put stores size bytes of body at key. sum is the hex SHA-256 of the body,
+// which requests are signed with.
+func (b *S3Bucket) Put(ctx context.Context, key string, body io.Reader, size int64, sum string) error {
+	req, err := b.request(ctx, "PUT", key, nil, body, sum)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PutFile stores the file at name at key, returning its size
+func (b *S3Bucket) PutFile(ctx context.Context, key, name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return size, b.Put(ctx, key, f, size, hex.EncodeToString(h.Sum(nil)))
+}
+
+// Get returns the content of the object at key, which the caller closes
+func (b *S3Bucket) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := b.request(ctx, "GET", key, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PresignGet returns a URL anyone can download the object at key from
+// until it expires
+func (b *S3Bucket) PresignGet(key string, expires time.Duration) string {
+	rawPath := s3Escape("/"+b.Bucket+"/"+key, false)
+	host := strings.TrimPrefix(strings.TrimPrefix(b.Endpoint, "https://"), "http://")
+
+	now := time.Now().UTC()
+	scope := now.Format("20060102") + "/" + b.Region + "/s3/aws4_request"
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {b.AccessKey + "/" + scope},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {fmt.Sprint(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	rawQuery := s3Query(query)
+
+	canonical := strings.Join([]string{
+		"GET",
+		rawPath,
+		rawQuery,
+		"host:" + host,
+		"",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	signature := b.sign(now, scope, hex.EncodeToString(sha256Sum([]byte(canonical))))
+	return b.Endpoint + rawPath + "?" + rawQuery + "&X-Amz-Signature=" + signature
+}
+
+// List returns every object whose key starts with prefix
+func (b *S3Bucket) List(ctx context.Context, prefix string) ([]S3Object, error) {
+	var objects []S3Object
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		req, err := b.request(ctx, "GET", "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents              []S3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Delete removes the object at key
+func (b *S3Bucket) Delete(ctx context.Context, key string) error {
+	req, err := b.request(ctx, "DELETE", key, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3Bucket) do(req *http.Request) (*http.Response, error) {
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// request builds a signed request for the object at key, or for the bucket
+// itself when key is empty.
+func (b *S3Bucket) request(ctx context.Context, method, key string, query url.Values, body io.Reader, sum string) (*http.Request, error) {
+	if sum == "" {
+		sum = hex.EncodeToString(sha256Sum(nil))
+	}
+	path := "/" + b.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	rawPath := s3Escape(path, false)
+	rawQuery := s3Query(query)
+
+	u := b.Endpoint + rawPath
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", sum)
+
+	canonical := strings.Join([]string{
+		method,
+		rawPath,
+		rawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + sum,
+		"x-amz-date:" + date,
+		"",
+		"host;x-amz-content-sha256;x-amz-date",
+		sum,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + b.Region + "/s3/aws4_request"
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		b.AccessKey, scope, b.sign(now, scope, hex.EncodeToString(sha256Sum([]byte(canonical))))))
+	return req, nil
+}
+
+// sign returns the signature of a canonical request with the given hash
+func (b *S3Bucket) sign(now time.Time, scope, canonicalSum string) string {
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + canonicalSum
+
+	k := hmacSum([]byte("AWS4"+b.SecretKey), now.Format("20060102"))
+	k = hmacSum(k, b.Region)
+	k = hmacSum(k, "s3")
+	k = hmacSum(k, "aws4_request")
+	return hex.EncodeToString(hmacSum(k, toSign))
+}
+
+// s3Escape percent encodes s the way Signature Version 4 expects, leaving
+// slashes alone unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// s3Query encodes query with its keys sorted, as signatures require
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,133 @@
+package githttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is an in-memory S3 bucket, serving the requests S3Bucket makes
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// newFakeS3 serves a fake bucket until the test ends and returns it along
+// with an S3Bucket for it
+func newFakeS3(t *testing.T) (*fakeS3, *S3Bucket) {
+	s3 := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(s3)
+	t.Cleanup(srv.Close)
+	return s3, NewS3Bucket(srv.URL, "bucket", "us-east-1", "key", "secret")
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	presigned := r.Method == "GET" && strings.HasPrefix(r.URL.Query().Get("X-Amz-Credential"), "key/") && r.URL.Query().Get("X-Amz-Signature") != ""
+	if !presigned && !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == "PUT":
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		if sum := sha256.Sum256(body); r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "content hash mismatch", http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = body
+	case r.Method == "GET" && key == "":
+		var result struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []S3Object
+		}
+		for _, k := range s.keys(r.URL.Query().Get("prefix")) {
+			result.Contents = append(result.Contents, S3Object{Key: k, Size: int64(len(s.objects[k]))})
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "GET":
+		body, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// keys returns the sorted keys starting with prefix, s.mu being held
+func (s *fakeS3) keys(prefix string) []string {
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Keys returns the sorted keys starting with prefix
+func (s *fakeS3) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys(prefix)
+}
+
+// Object returns the content of the object at key
+func (s *fakeS3) Object(key string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[key]
+}
+
+func TestS3Bucket(t *testing.T) {
+	_, bucket := newFakeS3(t)
+	ctx := context.Background()
+
+	if err := bucket.Put(ctx, "a/one", strings.NewReader("one"), 3, hex.EncodeToString(sha256Sum([]byte("one")))); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put(ctx, "b/two", strings.NewReader("two"), 3, hex.EncodeToString(sha256Sum([]byte("two")))); err != nil {
+		t.Fatal(err)
+	}
+	body, err := bucket.Get(ctx, "a/one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(body)
+	body.Close()
+	if string(b) != "one" {
+		t.Errorf("got %q, want one", b)
+	}
+
+	objects, err := bucket.List(ctx, "a/")
+	if err != nil || len(objects) != 1 || objects[0].Key != "a/one" || objects[0].Size != 3 {
+		t.Errorf("listed %+v, %v, want a/one", objects, err)
+	}
+	if err := bucket.Delete(ctx, "a/one"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Get(ctx, "a/one"); err == nil {
+		t.Error("deleted object still there")
+	}
+}
@@ -0,0 +1,110 @@
+package githttp
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+var benchPackSize = flag.Int64("pack-size", 256<<20, "size of the pack BenchmarkSendFile downloads, such as 4294967296 for a multi-GB pack")
+
+// BenchmarkSendFile downloads a pack over dumb HTTP, served either through
+// the ReaderFrom of the connection, which uses sendfile(2) on Linux, or
+// through a response writer hiding it, copying the pack in userspace. The
+// statistics, the slow request log and the request callbacks count what
+// is sent without hiding the ReaderFrom.
+func BenchmarkSendFile(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		cfg  GitSmartHTTPConfig
+		wrap func(http.Handler) http.Handler
+	}{
+		{name: "sendfile"},
+		{name: "userspace", wrap: func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.ServeHTTP(struct{ http.ResponseWriter }{w}, r)
+			})
+		}},
+		{name: "stats", cfg: GitSmartHTTPConfig{RepoStatsPath: "stats.json"}},
+		{name: "slowlog", cfg: GitSmartHTTPConfig{SlowRequestThreshold: time.Hour}},
+		{name: "callbacks", cfg: GitSmartHTTPConfig{OnRequestEnd: func(*http.Request, RequestEvent) {}}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			srv := githttptest.NewServer(b, func(root string) http.Handler {
+				cfg := bench.cfg
+				cfg.ReposRootPath, cfg.ExportAll, cfg.UploadPack = root, true, true
+				if cfg.RepoStatsPath != "" {
+					cfg.RepoStatsPath = filepath.Join(b.TempDir(), cfg.RepoStatsPath)
+				}
+				h := NewGitSmartHTTP(&cfg).Handler()
+				if bench.wrap != nil {
+					h = bench.wrap(h)
+				}
+				return h
+			})
+			repo := srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+			// A sparse file, read from the page cache
+			name := "objects/pack/pack-" + strings.Repeat("0", 40) + ".pack"
+			f, err := os.Create(filepath.Join(repo, name))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := f.Truncate(*benchPackSize); err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+
+			b.SetBytes(*benchPackSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(srv.RepoURL("test.git") + "/" + name)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != *benchPackSize {
+					b.Fatalf("read %d bytes, %v", n, err)
+				}
+			}
+		})
+	}
+}
+
+// readerFromRecorder is a ResponseWriter with a ReaderFrom
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (rec *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	rec.readFrom = true
+	return io.Copy(rec.ResponseRecorder, src)
+}
+
+func TestCountingResponseWriterReadFrom(t *testing.T) {
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	out := &countingResponseWriter{ResponseWriter: rec}
+	// As http.ServeContent copies files
+	if n, err := io.CopyN(out, strings.NewReader("hello"), 5); err != nil || n != 5 {
+		t.Fatalf("copied %d bytes, %v", n, err)
+	}
+	if !rec.readFrom || out.n != 5 || rec.Body.String() != "hello" {
+		t.Errorf("ReadFrom used %v, counted %d bytes, sent %q", rec.readFrom, out.n, rec.Body)
+	}
+
+	// Without a ReaderFrom underneath, the copy is still counted
+	out = &countingResponseWriter{ResponseWriter: httptest.NewRecorder()}
+	if n, err := io.CopyN(out, strings.NewReader("hello"), 5); err != nil || n != 5 || out.n != 5 {
+		t.Errorf("copied %d bytes, counted %d, %v", n, out.n, err)
+	}
+}
@@ -0,0 +1,70 @@
+package githttp
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Handler returns the handler of the whole server: the repositories, the
+// repository API, the token endpoint, the admin endpoints and gRPC
+// management service enabled by AdminToken and the debug endpoints, the
+// journal needing AdminToken too
+func (gsh GitSmartHTTP) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", gsh)
+	mux.Handle("/debug/vars", expvar.Handler())
+	if gsh.Journal != nil {
+		mux.Handle("/debug/journal", adminOnly(gsh.AdminToken, JournalHandler(gsh.Journal)))
+	}
+	mux.Handle("/api/repos/", gsh.RepoAPIHandler())
+	if auth, ok := gsh.Access.(*TokenAuth); ok {
+		mux.Handle("/token", auth)
+	}
+	if gsh.AdminToken != "" && gsh.backups != nil {
+		mux.Handle("/api/backups", adminOnly(gsh.AdminToken, gsh.backups))
+	}
+	if gsh.AdminToken != "" && gsh.quotas != nil {
+		mux.Handle("/api/owners", adminOnly(gsh.AdminToken, gsh.quotas))
+		mux.Handle("/api/owners/", adminOnly(gsh.AdminToken, gsh.quotas))
+	}
+	if gsh.AdminToken != "" && gsh.Protection != nil {
+		mux.Handle("/admin/protection", adminOnly(gsh.AdminToken, gsh.Protection))
+	}
+	if gsh.AdminToken != "" {
+		mux.Handle("/"+ManagementService+"/", gsh.managementServer())
+	}
+	return mux
+}
+
+// Processes returns the statistics of the git processes run so far
+func (gsh GitSmartHTTP) Processes() ProcessStats {
+	return gsh.processes.Stats()
+}
+
+// Transfers returns the statistics of the transfers by service
+func (gsh GitSmartHTTP) Transfers() map[string]TransferStats {
+	return gsh.transfers.Stats()
+}
+
+// ListenAndServe serves the handler of gsh on its listeners, or on Port
+// when it has none, until the process is told to stop or to upgrade, then
+// saves what must outlive the process
+func (gsh GitSmartHTTP) ListenAndServe() {
+	listeners := gsh.Listeners
+	if len(listeners) == 0 {
+		listeners = []Listener{{Network: "tcp", Addr: ":" + strconv.Itoa(gsh.Port)}}
+	}
+	serveListeners(listeners, gsh.Handler(), gsh.DrainTimeout)
+	gsh.Close()
+}
+
+// Close saves the repository statistics
+func (gsh GitSmartHTTP) Close() {
+	if gsh.repoStats != nil {
+		if err := gsh.repoStats.save(); err != nil {
+			log.Printf("Cannot save repository statistics to %s: %s", gsh.RepoStatsPath, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package githttp
+
+import (
+	"context"
+	"log"
+)
+
+// updateServerInfo runs git update-server-info on the repository,
+// regenerating the info/refs and objects/info/packs files dumb HTTP clients
+// read.
+func (gsh GitSmartHTTP) updateServerInfo(ctx context.Context, repoPath string) error {
+	gs := gsh.processes.NewGitRPCClient(&GitRPCClientConfig{
+		Stream: false,
+		Args:   gsh.GitArgs,
+	})
+	defer gs.Close()
+
+	dir, _ := gitDir(repoPath)
+	if err := gs.UpdateServerInfo(dir); err != nil {
+		return err
+	}
+	_, err := gs.Output(ctx)
+	return err
+}
+
+// refreshServerInfo regenerates the dumb HTTP files of the repository after
+// its refs or packs changed, when enabled for it, so that they are never
+// stale for clients or static mirrors reading them off the storage rather
+// than through the server.
+func (gsh GitSmartHTTP) refreshServerInfo(ctx context.Context, repoPath string) {
+	enabled := gsh.UpdateServerInfo
+	if st := gsh.repoSettings(repoPath); st.UpdateServerInfo != nil {
+		enabled = *st.UpdateServerInfo
+	}
+	if !enabled {
+		return
+	}
+	if err := gsh.updateServerInfo(ctx, repoPath); err != nil {
+		log.Printf("Cannot update server info of %s: %s", repoPath, err)
+	}
+}
@@ -0,0 +1,37 @@
+package githttp
+
+import "fmt"
+
+// Which objects upload-pack serves when they are asked for by name rather
+// than through an advertised ref, as CI systems fetching the exact commit
+// of a pipeline do
+const (
+	// SHAInWantOff serves only advertised refs, like git by default
+	SHAInWantOff = "off"
+	// SHAInWantTip also serves the tips of refs that are not advertised,
+	// such as hidden ones
+	SHAInWantTip = "tip"
+	// SHAInWantReachable serves any commit reachable from a ref
+	SHAInWantReachable = "reachable"
+)
+
+// CheckSHAInWant makes sure mode is one of the SHAInWant modes, where empty
+// keeps git's configuration.
+func CheckSHAInWant(mode string) error {
+	switch mode {
+	case "", SHAInWantOff, SHAInWantTip, SHAInWantReachable:
+		return nil
+	}
+	return fmt.Errorf("invalid SHA-in-want mode %q, want %s, %s or %s", mode, SHAInWantOff, SHAInWantTip, SHAInWantReachable)
+}
+
+// shaInWantConfig returns the git config upload-pack runs with for mode
+func shaInWantConfig(mode string) []string {
+	if mode == "" {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("uploadpack.allowTipSHA1InWant=%t", mode == SHAInWantTip),
+		fmt.Sprintf("uploadpack.allowReachableSHA1InWant=%t", mode == SHAInWantReachable),
+	}
+}
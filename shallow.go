@@ -0,0 +1,123 @@
+package githttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// infiniteDepth is the depth git fetch --unshallow asks for
+const infiniteDepth = 0x7fffffff
+
+// fetchRequest is what an upload-pack request asks for about history depth
+type fetchRequest struct {
+	// Depth is the depth of deepen, zero when the fetch is not shallow
+	Depth int
+	// Relative is set when Depth deepens the current shallow boundary
+	// rather than counting from the tips
+	Relative bool
+	// Since and Not are set for deepen-since and deepen-not
+	Since bool
+	Not   bool
+
+	// SessionID is the session-id capability of the client, which it
+	// keeps across the requests and retries of a fetch
+	SessionID string
+}
+
+// shallow tells whether the request asks for a shallow fetch
+func (req fetchRequest) shallow() bool {
+	return (req.Depth > 0 && req.Depth < infiniteDepth) || req.Since || req.Not
+}
+
+// readFetchRequest parses the arguments of an upload-pack request, of both
+// protocol v0 and v2, up to its first flush packet. It returns a reader of
+// the complete body, including what was parsed.
+func readFetchRequest(body io.Reader) (fetchRequest, io.Reader) {
+	var raw bytes.Buffer
+	var req fetchRequest
+	rest := func() io.Reader { return io.MultiReader(bytes.NewReader(raw.Bytes()), body) }
+
+	header := make([]byte, 4)
+	for {
+		n, err := io.ReadFull(body, header)
+		raw.Write(header[:n])
+		if err != nil {
+			return fetchRequest{}, rest()
+		}
+		size, err := strconv.ParseUint(string(header), 16, 16)
+		if err != nil {
+			return fetchRequest{}, rest()
+		}
+		if size == 0 {
+			break
+		}
+		if size <= 4 {
+			// The delimiter of protocol v2 between capabilities and
+			// arguments
+			continue
+		}
+
+		line := make([]byte, size-4)
+		n, err = io.ReadFull(body, line)
+		raw.Write(line[:n])
+		if err != nil {
+			return fetchRequest{}, rest()
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "want":
+			// Protocol v0 sends capabilities with the first want
+			if len(fields) > 2 && hasCapability(fields[2:], "deepen-relative") {
+				req.Relative = true
+			}
+			if len(fields) > 2 && req.SessionID == "" {
+				req.SessionID = capabilityValue(fields[2:], "session-id")
+			}
+		case "deepen":
+			if len(fields) == 2 {
+				req.Depth, _ = strconv.Atoi(fields[1])
+			}
+		case "deepen-relative":
+			req.Relative = true
+		case "deepen-since":
+			req.Since = true
+		case "deepen-not":
+			req.Not = true
+		default:
+			// Protocol v2 sends capabilities as lines of their own
+			if id, ok := strings.CutPrefix(fields[0], "session-id="); ok {
+				req.SessionID = id
+			}
+		}
+	}
+	return req, rest()
+}
+
+// checkDepth makes sure the fetch stays within the depth limits. Fetches
+// by date or excluded ref, whose depth is not known upfront, are not
+// limited.
+func (gsh GitSmartHTTP) checkDepth(req fetchRequest) error {
+	if req.Depth <= 0 || req.Depth >= infiniteDepth {
+		return nil
+	}
+	if req.Relative {
+		if gsh.MaxDeepen > 0 && req.Depth > gsh.MaxDeepen {
+			return fmt.Errorf("cannot deepen by %d commits, at most %d allowed", req.Depth, gsh.MaxDeepen)
+		}
+		return nil
+	}
+	if gsh.MinCloneDepth > 0 && req.Depth < gsh.MinCloneDepth {
+		return fmt.Errorf("depth %d too shallow, at least %d required", req.Depth, gsh.MinCloneDepth)
+	}
+	if gsh.MaxCloneDepth > 0 && req.Depth > gsh.MaxCloneDepth {
+		return fmt.Errorf("depth %d too deep, at most %d allowed", req.Depth, gsh.MaxCloneDepth)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package githttp
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type slowRequestKey struct{}
+
+// slowRequest collects the git commands run for a request, to be logged
+// when it turns out slow
+type slowRequest struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+// noteCommand remembers the command line of git run for the request of ctx
+func noteCommand(ctx context.Context, args []string) {
+	if sr, ok := ctx.Value(slowRequestKey{}).(*slowRequest); ok {
+		sr.mu.Lock()
+		sr.commands = append(sr.commands, strings.Join(args, " "))
+		sr.mu.Unlock()
+	}
+}
+
+// serveTimed serves the request and logs it when it takes longer than the
+// slow request threshold, so that repositories in need of a repack can be
+// found.
+func (gsh GitSmartHTTP) serveTimed(s Service, w http.ResponseWriter, r *http.Request, repo string) {
+	sr := &slowRequest{}
+	in := &countingReader{ReadCloser: r.Body}
+	out := &countingResponseWriter{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(r.Context(), slowRequestKey{}, sr))
+	r.Body = in
+
+	start := time.Now()
+	s.Handler(s, out, r)
+	elapsed := time.Since(start)
+	if elapsed < gsh.SlowRequestThreshold {
+		return
+	}
+
+	op := strings.TrimPrefix(r.URL.Path, repo)
+	if service := r.URL.Query().Get("service"); service != "" {
+		op += "?service=" + service
+	}
+	sr.mu.Lock()
+	commands := strings.Join(sr.commands, "; ")
+	sr.mu.Unlock()
+	log.Printf("Slow request took %s: repo %s, %s %s, client %s, %d bytes in, %d bytes out, git: %s",
+		elapsed.Round(time.Millisecond), strings.TrimPrefix(repo, "/"), r.Method, op, r.RemoteAddr, in.n, out.n, commands)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n      int64
+	status int
+}
+
+func (c *countingResponseWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadFrom hands src to the ReaderFrom of the connection when it has one,
+// which sends files with sendfile(2) on Linux, counting what it copies
+func (c *countingResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := c.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return copyBuffer(struct{ io.Writer }{c}, src)
+	}
+	n, err := rf.ReadFrom(src)
+	c.n += n
+	return n, err
+}
+
+func (c *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// bodyReader remembers why reading a request body failed, telling the
+// client going away apart from git no longer reading
+type bodyReader struct {
+	io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
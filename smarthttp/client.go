@@ -0,0 +1,144 @@
+// Package smarthttp is a client of the git smart HTTP protocol. It
+// discovers refs through info/refs and runs upload-pack and receive-pack
+// requests, in protocol version 0 or 2, so that programs can fetch from and
+// push to git servers without the git binary.
+package smarthttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Services of the smart HTTP protocol
+const (
+	UploadPack  = "git-upload-pack"
+	ReceivePack = "git-receive-pack"
+)
+
+// Client talks to git smart HTTP servers. The zero value is usable.
+type Client struct {
+	// HTTPClient defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Header is added to every request, for example for authentication
+	Header http.Header
+	// Username and Password are sent with basic authentication, when set
+	Username string
+	Password string
+	// ProtocolV2 asks upload-pack servers for protocol version 2
+	ProtocolV2 bool
+	// Gzip compresses request bodies
+	Gzip bool
+	// Agent is sent as user agent, defaulting to "git/smarthttp"
+	Agent string
+	// Progress receives the progress messages of the server, when set
+	Progress io.Writer
+}
+
+// RemoteError is an error reported by the server
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Message
+}
+
+// HTTPError is an unexpected HTTP status of the server
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+func (c *Client) agent() string {
+	if c.Agent == "" {
+		return "git/smarthttp"
+	}
+	return c.Agent
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+// do sends the request and returns the response body, failing unless the
+// server answered with 200 and the content type wanted.
+func (c *Client) do(req *http.Request, contentType string) (io.ReadCloser, error) {
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	req.Header.Set("User-Agent", c.agent())
+	if c.ProtocolV2 && strings.Contains(req.URL.RawQuery+req.URL.Path, UploadPack) {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != contentType {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected content type %q, the server may not speak smart HTTP", ct)
+	}
+	return resp.Body, nil
+}
+
+// postBuffer is the size up to which request bodies are sent with a
+// Content-Length instead of chunked, like git's http.postBuffer, as some
+// servers, git http-backend run as CGI among them, cannot take chunked
+// requests.
+const postBuffer = 1 << 20
+
+// post runs a stateless RPC of the service against the repository
+func (c *Client) post(ctx context.Context, repoURL, service string, body io.Reader) (io.ReadCloser, error) {
+	if c.Gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := io.Copy(zw, body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = &buf
+	} else {
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, body, postBuffer); err == io.EOF {
+			body = bytes.NewReader(buf.Bytes())
+		} else if err != nil {
+			return nil, err
+		} else {
+			body = io.MultiReader(&buf, body)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(repoURL, "/")+"/"+service, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-"+service+"-request")
+	req.Header.Set("Accept", "application/x-"+service+"-result")
+	if c.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	return c.do(req, "application/x-"+service+"-result")
+}
@@ -0,0 +1,298 @@
+package smarthttp_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	githttp "github.com/jaxi/git-http-backend"
+	"github.com/jaxi/git-http-backend/githttptest"
+	"github.com/jaxi/git-http-backend/smarthttp"
+)
+
+func newServer(t *testing.T) *githttptest.Server {
+	return githttptest.NewServer(t, func(root string) http.Handler {
+		return githttp.NewGitSmartHTTP(&githttp.GitSmartHTTPConfig{
+			ReposRootPath: root,
+			ExportAll:     true,
+			UploadPack:    true,
+			ReceivePack:   true,
+		}).Handler()
+	})
+}
+
+// hasObjects indexes the pack into a new repository, which it returns,
+// and fails the test unless it holds the objects
+func hasObjects(t *testing.T, pack []byte, oids ...string) string {
+	t.Helper()
+
+	repo := t.TempDir()
+	githttptest.Git(t, "", "init", "--quiet", "--bare", repo)
+	path := filepath.Join(repo, "objects", "pack", "fetched.pack")
+	if err := os.WriteFile(path, pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+	githttptest.Git(t, repo, "index-pack", path)
+	for _, oid := range oids {
+		githttptest.Git(t, repo, "cat-file", "-e", oid)
+	}
+	return repo
+}
+
+// packObjects returns the pack git pack-objects makes of the revisions
+func packObjects(t *testing.T, work string, revs ...string) []byte {
+	t.Helper()
+
+	cmd := exec.Command("git", "pack-objects", "--revs", "--stdout", "--quiet")
+	cmd.Dir = work
+	cmd.Stdin = strings.NewReader(strings.Join(revs, "\n") + "\n")
+	pack, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git pack-objects: %s", err)
+	}
+	return pack
+}
+
+func TestLsRefs(t *testing.T) {
+	srv := newServer(t)
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	master := srv.Ref("test.git", "refs/heads/master")
+
+	ctx := context.Background()
+	client := &smarthttp.Client{ProtocolV2: true}
+	adv, err := client.Discover(ctx, srv.RepoURL("test.git"), smarthttp.UploadPack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adv.Version != 2 {
+		t.Fatalf("advertised version %d, want 2", adv.Version)
+	}
+	if _, ok := adv.Capability("ls-refs"); !ok {
+		t.Errorf("ls-refs is not advertised in %q", adv.Capabilities)
+	}
+
+	refs, err := client.LsRefs(ctx, srv.RepoURL("test.git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []smarthttp.Ref{
+		{Name: "HEAD", Hash: master, Target: "refs/heads/master"},
+		{Name: "refs/heads/master", Hash: master},
+	}
+	if len(refs) != len(want) || refs[0] != want[0] || refs[1] != want[1] {
+		t.Errorf("ls-refs listed %+v, want %+v", refs, want)
+	}
+
+	refs, err = client.LsRefs(ctx, srv.RepoURL("test.git"), "refs/tags/")
+	if err != nil || len(refs) != 0 {
+		t.Errorf("ls-refs of refs/tags/ listed %+v, %v, want none", refs, err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := newServer(t)
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"}, map[string]string{"README": "world\n"})
+	master := srv.Ref("test.git", "refs/heads/master")
+	first := srv.Ref("test.git", "refs/heads/master~1")
+
+	for _, v2 := range []bool{false, true} {
+		name := "v0"
+		if v2 {
+			name = "v2"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			client := &smarthttp.Client{ProtocolV2: v2}
+			adv, err := client.Discover(ctx, srv.RepoURL("test.git"), smarthttp.UploadPack)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v2 != (adv.Version == 2) {
+				t.Fatalf("advertised version %d", adv.Version)
+			}
+			if !v2 && (len(adv.Refs) == 0 || adv.Refs[0].Name != "HEAD" || adv.Refs[0].Hash != master) {
+				t.Fatalf("advertised refs %+v, want HEAD at %s first", adv.Refs, master)
+			}
+
+			var pack bytes.Buffer
+			if err := client.Fetch(ctx, srv.RepoURL("test.git"), adv, smarthttp.FetchRequest{Wants: []string{master}}, &pack); err != nil {
+				t.Fatal(err)
+			}
+			hasObjects(t, pack.Bytes(), master, first)
+
+			// A shallow fetch leaves the parent out
+			pack.Reset()
+			if err := client.Fetch(ctx, srv.RepoURL("test.git"), adv, smarthttp.FetchRequest{Wants: []string{master}, Depth: 1}, &pack); err != nil {
+				t.Fatal(err)
+			}
+			repo := hasObjects(t, pack.Bytes(), master)
+			githttptest.GitFails(t, repo, "cat-file", "-e", first)
+		})
+	}
+}
+
+func TestPush(t *testing.T) {
+	srv := newServer(t)
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	old := srv.Ref("test.git", "refs/heads/master")
+	work := srv.Clone("test.git")
+	head := githttptest.Commit(t, work, map[string]string{"README": "world\n"}, "second")
+
+	ctx := context.Background()
+	var client smarthttp.Client
+	adv, err := client.Discover(ctx, srv.RepoURL("test.git"), smarthttp.ReceivePack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pack := packObjects(t, work, head, "^"+old)
+	res, err := client.Push(ctx, srv.RepoURL("test.git"), adv, []smarthttp.Command{
+		{Ref: "refs/heads/master", Old: old, New: head},
+		{Ref: "refs/heads/topic", Old: smarthttp.ZeroID, New: head},
+	}, bytes.NewReader(pack), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected := res.Rejected(); len(rejected) != 0 || len(res.Refs) != 2 {
+		t.Fatalf("push reported %+v, want both refs updated", res.Refs)
+	}
+	if got := srv.Ref("test.git", "refs/heads/master"); got != head {
+		t.Errorf("master at %s, want %s", got, head)
+	}
+
+	// Updates from a stale old value are rejected
+	res, err = client.Push(ctx, srv.RepoURL("test.git"), adv, []smarthttp.Command{
+		{Ref: "refs/heads/master", Old: old, New: old},
+	}, bytes.NewReader(packObjects(t, work)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected := res.Rejected(); len(rejected) != 1 || rejected[0] != "refs/heads/master" {
+		t.Errorf("push reported %+v, want master rejected", res.Refs)
+	}
+
+	// Deletions need no pack
+	res, err = client.Push(ctx, srv.RepoURL("test.git"), adv, []smarthttp.Command{
+		{Ref: "refs/heads/topic", Old: head, New: smarthttp.ZeroID},
+	}, nil, nil)
+	if err != nil || len(res.Rejected()) != 0 {
+		t.Fatalf("deleting topic: %+v, %v", res, err)
+	}
+	if got := srv.Ref("test.git", "refs/heads/topic"); got != "" {
+		t.Errorf("topic still at %s", got)
+	}
+}
+
+func TestRemoteErrors(t *testing.T) {
+	srv := newServer(t)
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+
+	// upload-pack answers ERR to wants it did not advertise
+	ctx := context.Background()
+	var client smarthttp.Client
+	adv, err := client.Discover(ctx, srv.RepoURL("test.git"), smarthttp.UploadPack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remote *smarthttp.RemoteError
+	err = client.Fetch(ctx, srv.RepoURL("test.git"), adv, smarthttp.FetchRequest{Wants: []string{strings.Repeat("1", 40)}}, io.Discard)
+	if !errors.As(err, &remote) {
+		t.Errorf("fetching an unknown object: %v, want a remote error", err)
+	}
+
+	_, err = client.Discover(ctx, srv.RepoURL("missing.git"), smarthttp.UploadPack)
+	var status *smarthttp.HTTPError
+	if !errors.As(err, &status) || status.StatusCode != http.StatusNotFound {
+		t.Errorf("discovering a missing repository: %v, want HTTP 404", err)
+	}
+}
+
+// fakeServer answers every request with the content type of the service
+// and body
+func fakeServer(t *testing.T, service, body string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+		} else {
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/x-"+service+"-result")
+		}
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/test.git"
+}
+
+func TestSidebandErrors(t *testing.T) {
+	const oid = "1111111111111111111111111111111111111111"
+	adv := &smarthttp.Advertisement{Capabilities: []string{"side-band-64k", "report-status"}}
+	ctx := context.Background()
+	var progress bytes.Buffer
+	client := &smarthttp.Client{Progress: &progress}
+
+	url := fakeServer(t, smarthttp.UploadPack, "0008NAK\n"+"000c\x02working"+"000f\x03disk full\n"+"0000")
+	err := client.Fetch(ctx, url, adv, smarthttp.FetchRequest{Wants: []string{oid}}, io.Discard)
+	var remote *smarthttp.RemoteError
+	if !errors.As(err, &remote) || remote.Message != "disk full" {
+		t.Errorf("fetch: %v, want remote error disk full", err)
+	}
+	if progress.String() != "working" {
+		t.Errorf("fetch progress %q, want working", progress.String())
+	}
+
+	url = fakeServer(t, smarthttp.ReceivePack, "0013\x03hook declined\n"+"0000")
+	_, err = client.Push(ctx, url, adv, []smarthttp.Command{{Ref: "refs/heads/master", Old: smarthttp.ZeroID, New: oid}}, nil, nil)
+	if !errors.As(err, &remote) || remote.Message != "hook declined" {
+		t.Errorf("push: %v, want remote error hook declined", err)
+	}
+
+	url = fakeServer(t, smarthttp.ReceivePack, "001b\x010012unpack failed\n0000"+"0000")
+	_, err = client.Push(ctx, url, adv, []smarthttp.Command{{Ref: "refs/heads/master", Old: smarthttp.ZeroID, New: oid}}, nil, nil)
+	if !errors.As(err, &remote) || remote.Message != "unpack failed: failed" {
+		t.Errorf("push with a failed unpack: %v, want remote error", err)
+	}
+
+	url = fakeServer(t, smarthttp.UploadPack, "0008NAK\n"+"0006\x09x"+"0000")
+	if err := client.Fetch(ctx, url, adv, smarthttp.FetchRequest{Wants: []string{oid}}, io.Discard); err == nil {
+		t.Error("fetch with an invalid band succeeded")
+	}
+}
+
+func TestMalformedPktLines(t *testing.T) {
+	for _, tc := range []struct {
+		name, body string
+	}{
+		{"invalid header", "zzzz# service=git-upload-pack\n"},
+		{"truncated packet", "001e# service=git-upload-pack\n0000" + "0040" + strings.Repeat("1", 40)},
+		{"missing flush", "001e# service=git-upload-pack\n0000" + "003f" + strings.Repeat("1", 40) + " refs/heads/master\n"},
+		{"line without ref", "001e# service=git-upload-pack\n0000" + "002d" + strings.Repeat("1", 40) + "\n0000"},
+		{"ERR packet", "0011ERR not here\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var client smarthttp.Client
+			url := fakeServer(t, smarthttp.UploadPack, tc.body)
+			if adv, err := client.Discover(context.Background(), url, smarthttp.UploadPack); err == nil {
+				t.Errorf("discovered %+v, want an error", adv)
+			}
+		})
+	}
+
+	var client smarthttp.Client
+	url := fakeServer(t, smarthttp.UploadPack, "0008NAK\n"+"0000")
+	adv := &smarthttp.Advertisement{}
+	if err := client.Fetch(context.Background(), url, adv, smarthttp.FetchRequest{Wants: []string{strings.Repeat("1", 40)}}, io.Discard); err != nil {
+		t.Errorf("fetch without sideband: %v", err)
+	}
+	url = fakeServer(t, smarthttp.UploadPack, "0008ACK\n")
+	if err := client.Fetch(context.Background(), url, adv, smarthttp.FetchRequest{Wants: []string{strings.Repeat("1", 40)}}, io.Discard); err == nil {
+		t.Error("fetch with an invalid acknowledgment succeeded")
+	}
+}
@@ -0,0 +1,163 @@
+package smarthttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Ref is a ref advertised by a server. Peeled is the object an annotated
+// tag points to and Target the ref a symbolic ref points to, when known.
+type Ref struct {
+	Name   string
+	Hash   string
+	Peeled string
+	Target string
+}
+
+// Advertisement is what a server tells about a repository in info/refs.
+// Protocol version 2 servers only advertise capabilities, their refs are
+// listed with LsRefs.
+type Advertisement struct {
+	Version      int
+	Refs         []Ref
+	Capabilities []string
+}
+
+// Capability returns the value of the capability, which is empty for
+// capabilities without value, and whether it was advertised.
+func (a *Advertisement) Capability(name string) (string, bool) {
+	for _, c := range a.Capabilities {
+		if c == name {
+			return "", true
+		}
+		if v := strings.TrimPrefix(c, name+"="); v != c {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Discover fetches the ref advertisement of the service of the repository
+func (c *Client) Discover(ctx context.Context, repoURL, service string) (*Advertisement, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(repoURL, "/")+"/info/refs?service="+service, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.do(req, "application/x-"+service+"-advertisement")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	r := newPktReader(body)
+	line, ok, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	// Version 2 servers leave out the service announcement
+	if ok && line == "# service="+service {
+		if _, ok, err := r.readLine(); err != nil || ok {
+			return nil, fmt.Errorf("invalid ref advertisement: %v", err)
+		}
+		if line, ok, err = r.readLine(); err != nil {
+			return nil, err
+		}
+	}
+
+	adv := &Advertisement{}
+	if ok && line == "version 2" {
+		adv.Version = 2
+		for {
+			line, ok, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return adv, nil
+			}
+			adv.Capabilities = append(adv.Capabilities, line)
+		}
+	}
+
+	for ok {
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			adv.Capabilities = strings.Fields(line[i+1:])
+			line = line[:i]
+		}
+		hash, name, found := strings.Cut(line, " ")
+		if !found {
+			return nil, fmt.Errorf("invalid ref advertisement line %q", line)
+		}
+		switch {
+		case name == "capabilities^{}":
+			// an empty repository
+		case strings.HasSuffix(name, "^{}") && len(adv.Refs) > 0:
+			adv.Refs[len(adv.Refs)-1].Peeled = hash
+		default:
+			adv.Refs = append(adv.Refs, Ref{Name: name, Hash: hash})
+		}
+		if line, ok, err = r.readLine(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range adv.Capabilities {
+		if symref := strings.TrimPrefix(c, "symref="); symref != c {
+			from, to, _ := strings.Cut(symref, ":")
+			for i := range adv.Refs {
+				if adv.Refs[i].Name == from {
+					adv.Refs[i].Target = to
+				}
+			}
+		}
+	}
+	return adv, nil
+}
+
+// LsRefs lists the refs of a protocol version 2 repository starting with
+// one of the prefixes, or all of them without prefixes.
+func (c *Client) LsRefs(ctx context.Context, repoURL string, prefixes ...string) ([]Ref, error) {
+	var w pktWriter
+	w.line("command=ls-refs\n")
+	w.line("agent=%s\n", c.agent())
+	w.delim()
+	w.line("peel\n")
+	w.line("symrefs\n")
+	for _, prefix := range prefixes {
+		w.line("ref-prefix %s\n", prefix)
+	}
+	w.flush()
+
+	body, err := c.post(ctx, repoURL, UploadPack, strings.NewReader(w.String()))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var refs []Ref
+	r := newPktReader(body)
+	for {
+		line, ok, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return refs, nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid ls-refs line %q", line)
+		}
+		ref := Ref{Hash: fields[0], Name: fields[1]}
+		for _, attr := range fields[2:] {
+			if v := strings.TrimPrefix(attr, "symref-target:"); v != attr {
+				ref.Target = v
+			} else if v := strings.TrimPrefix(attr, "peeled:"); v != attr {
+				ref.Peeled = v
+			}
+		}
+		refs = append(refs, ref)
+	}
+}
@@ -0,0 +1,158 @@
+package smarthttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FetchRequest names the objects to fetch and those already there. Depth
+// makes a shallow fetch when positive.
+type FetchRequest struct {
+	Wants []string
+	Haves []string
+	Depth int
+}
+
+// Fetch writes the pack of the requested objects to pack. It sends all haves
+// at once, so the pack may contain objects the client already has. adv is
+// the upload-pack advertisement of the repository.
+func (c *Client) Fetch(ctx context.Context, repoURL string, adv *Advertisement, req FetchRequest, pack io.Writer) error {
+	if len(req.Wants) == 0 {
+		return errors.New("nothing to fetch")
+	}
+	if adv.Version == 2 {
+		return c.fetchV2(ctx, repoURL, req, pack)
+	}
+	return c.fetchV0(ctx, repoURL, adv, req, pack)
+}
+
+func (c *Client) fetchV2(ctx context.Context, repoURL string, req FetchRequest, pack io.Writer) error {
+	var w pktWriter
+	w.line("command=fetch\n")
+	w.line("agent=%s\n", c.agent())
+	w.delim()
+	w.line("ofs-delta\n")
+	if c.Progress == nil {
+		w.line("no-progress\n")
+	}
+	for _, want := range req.Wants {
+		w.line("want %s\n", want)
+	}
+	for _, have := range req.Haves {
+		w.line("have %s\n", have)
+	}
+	if req.Depth > 0 {
+		w.line("deepen %d\n", req.Depth)
+	}
+	w.line("done\n")
+	w.flush()
+
+	body, err := c.post(ctx, repoURL, UploadPack, strings.NewReader(w.String()))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	r := newPktReader(body)
+	for {
+		section, ok, err := r.readLine()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("no packfile in fetch response")
+		}
+		if section == "packfile" {
+			return r.demux(pack, c.Progress)
+		}
+		// Skip the acknowledgments, shallow-info and wanted-refs sections
+		for {
+			p, err := r.readPkt()
+			if err != nil {
+				return err
+			}
+			if len(p) == 0 {
+				break
+			}
+		}
+	}
+}
+
+func (c *Client) fetchV0(ctx context.Context, repoURL string, adv *Advertisement, req FetchRequest, pack io.Writer) error {
+	caps := []string{"ofs-delta", "agent=" + c.agent()}
+	sideband := true
+	if _, ok := adv.Capability("side-band-64k"); ok {
+		caps = append(caps, "side-band-64k")
+	} else if _, ok := adv.Capability("side-band"); ok {
+		caps = append(caps, "side-band")
+	} else {
+		sideband = false
+	}
+	if c.Progress == nil {
+		caps = append(caps, "no-progress")
+	}
+	if req.Depth > 0 {
+		if _, ok := adv.Capability("shallow"); !ok {
+			return errors.New("the server does not support shallow fetches")
+		}
+		caps = append(caps, "shallow")
+	}
+
+	var w pktWriter
+	for i, want := range req.Wants {
+		if i == 0 {
+			w.line("want %s %s\n", want, strings.Join(caps, " "))
+		} else {
+			w.line("want %s\n", want)
+		}
+	}
+	if req.Depth > 0 {
+		w.line("deepen %d\n", req.Depth)
+	}
+	w.flush()
+	for _, have := range req.Haves {
+		w.line("have %s\n", have)
+	}
+	w.line("done\n")
+
+	body, err := c.post(ctx, repoURL, UploadPack, strings.NewReader(w.String()))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	r := newPktReader(body)
+	if req.Depth > 0 {
+		// shallow and unshallow lines up to a flush
+		for {
+			_, ok, err := r.readLine()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+		}
+	}
+	for {
+		line, ok, err := r.readLine()
+		if err != nil {
+			return err
+		}
+		if ok && (line == "NAK" || strings.HasPrefix(line, "ACK ")) {
+			break
+		}
+		if !ok || !strings.HasPrefix(line, "ACK ") {
+			return fmt.Errorf("unexpected fetch response line %q", line)
+		}
+	}
+
+	if sideband {
+		return r.demux(pack, c.Progress)
+	}
+	_, err = io.Copy(pack, r.br)
+	return err
+}
@@ -0,0 +1,102 @@
+package smarthttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const pktMaxLen = 65520
+
+type pktWriter struct {
+	strings.Builder
+}
+
+func (w *pktWriter) line(format string, a ...interface{}) {
+	s := fmt.Sprintf(format, a...)
+	fmt.Fprintf(&w.Builder, "%04x%s", len(s)+4, s)
+}
+
+func (w *pktWriter) flush() { w.WriteString("0000") }
+func (w *pktWriter) delim() { w.WriteString("0001") }
+
+type pktReader struct {
+	br *bufio.Reader
+}
+
+func newPktReader(r io.Reader) *pktReader {
+	return &pktReader{br: bufio.NewReaderSize(r, pktMaxLen)}
+}
+
+// readPkt returns the payload of the next packet, which is empty for flush
+// and delim packets
+func (r *pktReader) readPkt() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r.br, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	size, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line header %q", header)
+	}
+	switch {
+	case size == 0, size == 1:
+		return []byte{}, nil
+	case size < 4:
+		// response-end of protocol v2, which stateless HTTP does not need
+		return r.readPkt()
+	}
+
+	payload := make([]byte, size-4)
+	if _, err := io.ReadFull(r.br, payload); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(string(payload), "ERR ") {
+		return nil, &RemoteError{Message: strings.TrimSpace(string(payload[4:]))}
+	}
+	return payload, nil
+}
+
+// readLine returns the next packet as text without trailing newline. ok is
+// false at a flush or delim packet.
+func (r *pktReader) readLine() (line string, ok bool, err error) {
+	p, err := r.readPkt()
+	if err != nil || len(p) == 0 {
+		return "", false, err
+	}
+	return strings.TrimSuffix(string(p), "\n"), true, nil
+}
+
+// demux copies band 1 of a sideband stream to data and band 2 to progress
+// until the flush packet ending it. Band 3 is returned as a RemoteError.
+func (r *pktReader) demux(data, progress io.Writer) error {
+	for {
+		p, err := r.readPkt()
+		if err != nil {
+			return err
+		}
+		if len(p) == 0 {
+			return nil
+		}
+		switch p[0] {
+		case 1:
+			if _, err := data.Write(p[1:]); err != nil {
+				return err
+			}
+		case 2:
+			if progress != nil {
+				progress.Write(p[1:])
+			}
+		case 3:
+			return &RemoteError{Message: strings.TrimSpace(string(p[1:]))}
+		default:
+			return errors.New("invalid sideband packet")
+		}
+	}
+}
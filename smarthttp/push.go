@@ -0,0 +1,133 @@
+package smarthttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ZeroID is the object name of a ref that does not exist, the Old of a
+// Command creating a ref and the New of one deleting it.
+const ZeroID = "0000000000000000000000000000000000000000"
+
+// Command is a ref update of a push
+type Command struct {
+	Ref string
+	Old string
+	New string
+}
+
+// PushResult is the report of the server on a push. Refs maps every ref
+// pushed to the reason it was rejected, an empty string meaning it was
+// updated.
+type PushResult struct {
+	Refs map[string]string
+}
+
+// Rejected returns the refs the server did not update
+func (r *PushResult) Rejected() []string {
+	var refs []string
+	for ref, reason := range r.Refs {
+		if reason != "" {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// Push sends the ref updates, along with the pack of the objects they
+// need, which may be nil when they only delete refs. options are sent as
+// push options. adv is the receive-pack advertisement of the repository.
+func (c *Client) Push(ctx context.Context, repoURL string, adv *Advertisement, cmds []Command, pack io.Reader, options []string) (*PushResult, error) {
+	if len(cmds) == 0 {
+		return nil, errors.New("nothing to push")
+	}
+
+	caps := []string{"report-status", "agent=" + c.agent()}
+	_, sideband := adv.Capability("side-band-64k")
+	if sideband {
+		caps = append(caps, "side-band-64k")
+	}
+	if c.Progress == nil {
+		caps = append(caps, "quiet")
+	}
+	if len(options) > 0 {
+		if _, ok := adv.Capability("push-options"); !ok {
+			return nil, errors.New("the server does not support push options")
+		}
+		caps = append(caps, "push-options")
+	}
+
+	var w pktWriter
+	for i, cmd := range cmds {
+		if i == 0 {
+			w.line("%s %s %s\x00%s\n", cmd.Old, cmd.New, cmd.Ref, strings.Join(caps, " "))
+		} else {
+			w.line("%s %s %s\n", cmd.Old, cmd.New, cmd.Ref)
+		}
+	}
+	w.flush()
+	if len(options) > 0 {
+		for _, option := range options {
+			w.line("%s\n", option)
+		}
+		w.flush()
+	}
+
+	body := io.Reader(strings.NewReader(w.String()))
+	if pack != nil {
+		body = io.MultiReader(body, pack)
+	}
+	resp, err := c.post(ctx, repoURL, ReceivePack, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+
+	report := io.Reader(resp)
+	if sideband {
+		var buf bytes.Buffer
+		if err := newPktReader(resp).demux(&buf, c.Progress); err != nil {
+			return nil, err
+		}
+		report = &buf
+	}
+	return readReport(newPktReader(report))
+}
+
+// readReport parses a report-status
+func readReport(r *pktReader) (*PushResult, error) {
+	line, ok, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !strings.HasPrefix(line, "unpack ") {
+		return nil, fmt.Errorf("invalid push report line %q", line)
+	}
+	if status := strings.TrimPrefix(line, "unpack "); status != "ok" {
+		return nil, &RemoteError{Message: "unpack failed: " + status}
+	}
+
+	result := &PushResult{Refs: make(map[string]string)}
+	for {
+		line, ok, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return result, nil
+		}
+		switch {
+		case strings.HasPrefix(line, "ok "):
+			result.Refs[strings.TrimPrefix(line, "ok ")] = ""
+		case strings.HasPrefix(line, "ng "):
+			ref, reason, _ := strings.Cut(strings.TrimPrefix(line, "ng "), " ")
+			result.Refs[ref] = reason
+		default:
+			return nil, fmt.Errorf("invalid push report line %q", line)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package githttp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage gives the handlers access to the files of repositories. Names are
+// slash separated and relative to the git directory of the repository, so
+// HEAD names the same file for bare repositories and work trees.
+type Storage interface {
+	// Open opens a file of the repository for reading
+	Open(repoPath, name string) (File, error)
+	// Stat describes a file of the repository
+	Stat(repoPath, name string) (fs.FileInfo, error)
+	// ReadDir lists a directory of the repository
+	ReadDir(repoPath, name string) ([]fs.DirEntry, error)
+	// ListRefs returns the refs of the repository, loose refs taking
+	// precedence over packed ones. Symbolic refs are not included.
+	ListRefs(repoPath string) ([]Ref, error)
+}
+
+// File is a readable file of a repository. Handing out *os.File keeps
+// sendfile(2) available to http.ServeContent.
+type File interface {
+	fs.File
+	io.Seeker
+}
+
+// Ref is a ref and the object it points to
+type Ref struct {
+	Name string
+	Hash string
+}
+
+// localStorage is the Storage keeping repositories on a local disk
+type localStorage struct{}
+
+func (localStorage) path(repoPath, name string) (string, error) {
+	dir, ok := gitDir(repoPath)
+	if !ok {
+		return "", ErrRepoNotFound
+	}
+	if !fs.ValidPath(name) {
+		return "", fs.ErrNotExist
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+func (s localStorage) Open(repoPath, name string) (File, error) {
+	p, err := s.path(repoPath, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s localStorage) Stat(repoPath, name string) (fs.FileInfo, error) {
+	p, err := s.path(repoPath, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (s localStorage) ReadDir(repoPath, name string) ([]fs.DirEntry, error) {
+	p, err := s.path(repoPath, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (s localStorage) ListRefs(repoPath string) ([]Ref, error) {
+	dir, ok := gitDir(repoPath)
+	if !ok {
+		return nil, ErrRepoNotFound
+	}
+
+	refs := make(map[string]string)
+	packed, err := os.Open(filepath.Join(dir, "packed-refs"))
+	if err == nil {
+		sc := bufio.NewScanner(packed)
+		for sc.Scan() {
+			line := sc.Text()
+			if line == "" || line[0] == '#' || line[0] == '^' {
+				continue
+			}
+			if hash, name, ok := strings.Cut(line, " "); ok {
+				refs[name] = hash
+			}
+		}
+		packed.Close()
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	err = filepath.WalkDir(filepath.Join(dir, "refs"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		hash := string(bytes.TrimSpace(content))
+		if strings.HasPrefix(hash, "ref: ") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		refs[filepath.ToSlash(rel)] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Ref, 0, len(refs))
+	for name, hash := range refs {
+		list = append(list, Ref{Name: name, Hash: hash})
+	}
+	return list, nil
+}
+
+// isRepo reports whether the storage holds a git directory for the
+// repository, following the same HEAD, objects and refs check git itself
+// does
+func isRepo(s Storage, repoPath string) bool {
+	if fi, err := s.Stat(repoPath, "HEAD"); err != nil || fi.IsDir() {
+		return false
+	}
+	for _, name := range []string{"objects", "refs"} {
+		if fi, err := s.Stat(repoPath, name); err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// storage returns the configured Storage, defaulting to the local disk
+func (gsh GitSmartHTTP) storage() Storage {
+	if gsh.Storage != nil {
+		return gsh.Storage
+	}
+	return localStorage{}
+}
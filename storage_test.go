@@ -0,0 +1,41 @@
+package githttp
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+// hidingStorage is the local disk without the repositories whose path
+// contains hidden
+type hidingStorage struct {
+	localStorage
+	hidden string
+}
+
+func (s hidingStorage) Stat(repoPath, name string) (fs.FileInfo, error) {
+	if strings.Contains(repoPath, s.hidden) {
+		return nil, fs.ErrNotExist
+	}
+	return s.localStorage.Stat(repoPath, name)
+}
+
+func TestStorageRepoAccess(t *testing.T) {
+	srv := newTestServer(t, GitSmartHTTPConfig{Storage: hidingStorage{hidden: "hidden"}, RefsCache: true})
+	srv.CreateRepo("shown.git", map[string]string{"README": "hello\n"})
+	srv.CreateRepo("hidden.git", map[string]string{"README": "hello\n"})
+
+	work := srv.Clone("shown.git")
+	if out := githttptest.GitFails(t, "", "ls-remote", srv.RepoURL("hidden.git")); !strings.Contains(out, "not found") {
+		t.Errorf("repository missing from the storage served:\n%s", out)
+	}
+
+	// The refs stamp comes from the storage too, so pushes are seen
+	head := githttptest.Commit(t, work, map[string]string{"README": "more\n"}, "second")
+	srv.Push(work, "HEAD:master")
+	if got := githttptest.Git(t, "", "ls-remote", srv.RepoURL("shown.git"), "refs/heads/master"); !strings.HasPrefix(got, head) {
+		t.Errorf("advertised %q after push, want %s", got, head)
+	}
+}
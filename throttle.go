@@ -0,0 +1,183 @@
+package githttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket handing out bytes at a fixed rate per second
+type rateLimiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// burst is the largest amount of bytes a single wait may ask for
+func (l *rateLimiter) burst() int {
+	if l.rate < 1 {
+		return 1
+	}
+	return int(l.rate)
+}
+
+// wait blocks until n bytes may be sent or ctx is done
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttledWriter writes to the response through all of its limiters
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rateLimiter
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := len(p)
+		for _, l := range tw.limiters {
+			if b := l.burst(); chunk > b {
+				chunk = b
+			}
+		}
+		for _, l := range tw.limiters {
+			if err := l.wait(tw.ctx, chunk); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := tw.ResponseWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// throttledReader reads the request body through all of its limiters
+type throttledReader struct {
+	io.Reader
+	ctx      context.Context
+	limiters []*rateLimiter
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	for _, l := range tr.limiters {
+		if b := l.burst(); len(p) > b {
+			p = p[:b]
+		}
+	}
+	n, err := tr.Reader.Read(p)
+	for _, l := range tr.limiters {
+		if werr := l.wait(tr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// bandwidth holds the limiters shared by all connections to a repository,
+// by route
+type bandwidth struct {
+	mu    sync.Mutex
+	repos map[string]*rateLimiter
+}
+
+func newBandwidth() *bandwidth {
+	return &bandwidth{repos: make(map[string]*rateLimiter)}
+}
+
+// limiters returns the limiters of a request following the rates of p
+func (b *bandwidth) limiters(route, repoPath string, p RoutePolicy) []*rateLimiter {
+	var limiters []*rateLimiter
+
+	if p.ConnRate > 0 {
+		limiters = append(limiters, newRateLimiter(p.ConnRate))
+	}
+
+	if p.RepoRate > 0 {
+		key := route + " " + repoPath
+		b.mu.Lock()
+		l, ok := b.repos[key]
+		if !ok {
+			l = newRateLimiter(p.RepoRate)
+			b.repos[key] = l
+		}
+		b.mu.Unlock()
+		limiters = append(limiters, l)
+	}
+	return limiters
+}
+
+// Throttle wraps w so that writes respect the per connection limit and the
+// limit shared by all connections to the repository on the route. Writes
+// waiting for bandwidth give up once the request is cancelled.
+func (b *bandwidth) Throttle(w http.ResponseWriter, r *http.Request, route, repoPath string, p RoutePolicy) http.ResponseWriter {
+	limiters := b.limiters(route, repoPath, p)
+	if len(limiters) == 0 {
+		return w
+	}
+
+	return &throttledWriter{
+		ResponseWriter: w,
+		ctx:            r.Context(),
+		limiters:       limiters,
+	}
+}
+
+// ThrottleBody is Throttle for the request body
+func (b *bandwidth) ThrottleBody(body io.Reader, r *http.Request, route, repoPath string, p RoutePolicy) io.Reader {
+	limiters := b.limiters(route, repoPath, p)
+	if len(limiters) == 0 {
+		return body
+	}
+
+	return &throttledReader{
+		Reader:   body,
+		ctx:      r.Context(),
+		limiters: limiters,
+	}
+}
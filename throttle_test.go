@@ -0,0 +1,29 @@
+package githttp
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrottledWriterRate(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test.git/info/refs", nil)
+	w := newBandwidth().Throttle(rec, r, RouteInfoRefs, "test.git", RoutePolicy{ConnRate: 50000})
+
+	// The bucket starts full, the 75000 bytes beyond it take 1.5s
+	start := time.Now()
+	if n, err := w.Write(bytes.Repeat([]byte("x"), 125000)); err != nil || n != 125000 {
+		t.Fatalf("wrote %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 1400*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("125000 bytes at 50000 bytes/s took %s, want 1.5s", elapsed)
+	}
+
+	// The connection stays reachable, to flush it or set its deadlines
+	if err := http.NewResponseController(w).Flush(); err != nil || !rec.Flushed {
+		t.Errorf("flush through the throttled writer: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package githttp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// tieredPacksFile lists, in a git directory, the packs moved to cold
+	// storage, one file name per line
+	tieredPacksFile = "git-http.tiered"
+	// accessedFile is touched in a git directory whenever the repository
+	// is served, at most every accessedResolution
+	accessedFile       = "git-http.accessed"
+	accessedResolution = time.Hour
+	// tierRedirectExpiry is how long the URLs dumb HTTP clients are
+	// redirected to for cold packs stay valid
+	tierRedirectExpiry = 15 * time.Minute
+)
+
+// packTiering moves the packs of repositories no one used for age to a
+// bucket, under <prefix><repo>/<pack>, keeping their indexes. A cold
+// repository gets its packs back before it is served again, except that
+// dumb HTTP pack downloads may be redirected to the bucket instead.
+//
+// A repository is used when it is served, which is recorded in the
+// accessedFile of its git directory, or pushed to. Packs are moved and
+// fetched back under the lock of the repository, so that servers sharing
+// the storage do not get in each other's way.
+type packTiering struct {
+	gsh      GitSmartHTTP
+	bucket   *S3Bucket
+	prefix   string
+	age      time.Duration
+	redirect bool
+}
+
+func newPackTiering(gsh GitSmartHTTP, bucket *S3Bucket, prefix string, age time.Duration, redirect bool) *packTiering {
+	return &packTiering{
+		gsh:      gsh,
+		bucket:   bucket,
+		prefix:   prefix,
+		age:      age,
+		redirect: redirect,
+	}
+}
+
+func (t *packTiering) run(interval time.Duration) {
+	for {
+		err := t.gsh.walkRepos(func(repo, repoPath string) {
+			if err := t.freeze(context.Background(), repo, repoPath); err != nil {
+				log.Printf("Cannot move the packs of %s to cold storage: %s", repo, err)
+			}
+		})
+		if err != nil {
+			log.Printf("Cannot list repositories to move to cold storage: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// lastUsed returns when the repository was last served or pushed to
+func (t *packTiering) lastUsed(repoPath string) time.Time {
+	used := refsStamp(t.gsh.storage(), repoPath)
+	if fi, err := t.gsh.storage().Stat(repoPath, accessedFile); err == nil && fi.ModTime().After(used) {
+		used = fi.ModTime()
+	}
+	return used
+}
+
+// touch records that the repository is being used
+func (t *packTiering) touch(repoPath string) {
+	dir, _ := gitDir(repoPath)
+	p := filepath.Join(dir, accessedFile)
+	if fi, err := os.Stat(p); err == nil && time.Since(fi.ModTime()) < accessedResolution {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); os.IsNotExist(err) {
+		if f, err := os.Create(p); err == nil {
+			f.Close()
+		}
+	}
+}
+
+// freeze moves the packs of the repository to the bucket when it has not
+// been used for age
+func (t *packTiering) freeze(ctx context.Context, repo, repoPath string) error {
+	dir, _ := gitDir(repoPath)
+	if time.Since(t.lastUsed(repoPath)) < t.age {
+		return nil
+	}
+
+	unlock, err := t.gsh.repoLocks.Lock(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Check again, the repository may just have been served
+	if time.Since(t.lastUsed(repoPath)) < t.age {
+		return nil
+	}
+
+	packs, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "pack-*.pack"))
+	if err != nil || len(packs) == 0 {
+		return err
+	}
+
+	tiered := tieredPacks(dir)
+	for _, p := range packs {
+		name := filepath.Base(p)
+		if _, err := t.bucket.PutFile(ctx, t.key(repo, name), p); err != nil {
+			return err
+		}
+		tiered = append(tiered, name)
+	}
+	// Record the packs as cold before removing them, so that they are
+	// fetched back if anything fails from here on
+	if err := writeTieredPacks(dir, tiered); err != nil {
+		return err
+	}
+	for _, p := range packs {
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	t.gsh.details.Invalidate(repoPath)
+	log.Printf("Moved %d packs of %s to cold storage", len(packs), repo)
+	return nil
+}
+
+// warm fetches the packs of a cold repository back from the bucket
+func (t *packTiering) warm(ctx context.Context, repo, repoPath string) error {
+	repo = strings.TrimPrefix(repo, "/")
+	t.touch(repoPath)
+
+	dir, _ := gitDir(repoPath)
+	if len(tieredPacks(dir)) == 0 {
+		return nil
+	}
+
+	unlock, err := t.gsh.repoLocks.Lock(ctx, repoPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tiered := tieredPacks(dir)
+	for len(tiered) > 0 {
+		if err := t.fetch(ctx, repo, dir, tiered[0]); err != nil {
+			return err
+		}
+		tiered = tiered[1:]
+		if err := writeTieredPacks(dir, tiered); err != nil {
+			return err
+		}
+	}
+	t.gsh.details.Invalidate(repoPath)
+	log.Printf("Fetched the packs of %s back from cold storage", repo)
+	return nil
+}
+
+// fetch downloads a pack of the repository into its pack directory
+func (t *packTiering) fetch(ctx context.Context, repo, dir, name string) error {
+	body, err := t.bucket.Get(ctx, t.key(repo, name))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	packDir := filepath.Join(dir, "objects", "pack")
+	f, err := os.CreateTemp(packDir, "tmp_tier_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = copyBuffer(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0444); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(packDir, name))
+}
+
+// ready gets the repository ready to serve r, fetching its packs back if
+// needed. Dumb HTTP requests do not need them when downloads of cold packs
+// are redirected to the bucket, which ready does, returning false, as it
+// does when the packs cannot be fetched.
+func (t *packTiering) ready(w http.ResponseWriter, r *http.Request, repo, repoPath string) bool {
+	if !t.redirect || isSmartRequest(r) {
+		if err := t.warm(r.Context(), repo, repoPath); err != nil {
+			log.Printf("Cannot fetch the packs of %s back from cold storage: %s", repo, err)
+			writeError(w, r, err)
+			return false
+		}
+		return true
+	}
+
+	t.touch(repoPath)
+	if !strings.HasSuffix(r.URL.Path, ".pack") {
+		return true
+	}
+	dir, _ := gitDir(repoPath)
+	name := path.Base(r.URL.Path)
+	for _, tiered := range tieredPacks(dir) {
+		if tiered == name {
+			http.Redirect(w, r, t.bucket.PresignGet(t.key(repo, name), tierRedirectExpiry), http.StatusFound)
+			return false
+		}
+	}
+	return true
+}
+
+// cold tells whether packs of the repository are in cold storage
+func (t *packTiering) cold(repoPath string) bool {
+	dir, _ := gitDir(repoPath)
+	return len(tieredPacks(dir)) > 0
+}
+
+// warmRepo fetches the packs of the repository back from cold storage,
+// for the git commands run on it outside of serving requests
+func (gsh GitSmartHTTP) warmRepo(ctx context.Context, repo, repoPath string) error {
+	if gsh.tiering == nil {
+		return nil
+	}
+	return gsh.tiering.warm(ctx, repo, repoPath)
+}
+
+func (t *packTiering) key(repo, name string) string {
+	return t.prefix + strings.TrimPrefix(repo, "/") + "/" + name
+}
+
+// tieredPacks returns the packs of the git directory in cold storage
+func tieredPacks(dir string) []string {
+	f, err := os.Open(filepath.Join(dir, tieredPacksFile))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var names []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if name := strings.TrimSpace(sc.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// writeTieredPacks replaces the list of packs in cold storage, removing it
+// once there are none
+func writeTieredPacks(dir string, names []string) error {
+	p := filepath.Join(dir, tieredPacksFile)
+	if len(names) == 0 {
+		err := os.Remove(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "tmp_tiered_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = io.WriteString(tmp, strings.Join(uniqueLines(strings.Join(names, "\n")), "\n")+"\n")
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
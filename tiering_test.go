@@ -0,0 +1,110 @@
+package githttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+func TestPackTiering(t *testing.T) {
+	s3, bucket := newFakeS3(t)
+	var gsh GitSmartHTTP
+	srv := githttptest.NewServer(t, func(root string) http.Handler {
+		gsh = NewGitSmartHTTP(&GitSmartHTTPConfig{
+			ReposRootPath: root, ExportAll: true, UploadPack: true, ReceivePack: true,
+			TierBucket: bucket, TierPrefix: "tier/", TierAge: 24 * time.Hour, TierInterval: time.Hour,
+		})
+		return gsh.Handler()
+	})
+	repoPath := srv.CreateRepo("test.git", map[string]string{"README": "hello\n"})
+	head := srv.Ref("test.git", "refs/heads/master")
+	githttptest.Git(t, repoPath, "repack", "-adq")
+	packs, _ := filepath.Glob(filepath.Join(repoPath, "objects", "pack", "pack-*.pack"))
+	if len(packs) != 1 {
+		t.Fatalf("repack left %q", packs)
+	}
+	pack, err := os.ReadFile(packs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Base(packs[0])
+	ctx := context.Background()
+
+	// Repositories used recently keep their packs
+	if err := gsh.tiering.freeze(ctx, "test.git", repoPath); err != nil {
+		t.Fatal(err)
+	}
+	if gsh.tiering.cold(repoPath) || len(s3.Keys("tier/")) != 0 {
+		t.Fatal("packs of a repository just pushed to moved to cold storage")
+	}
+
+	freeze := func() {
+		t.Helper()
+		if err := newPackTiering(gsh, bucket, "tier/", 0, false).freeze(ctx, "test.git", repoPath); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(packs[0]); !os.IsNotExist(err) {
+			t.Fatal("frozen pack kept locally")
+		}
+		if got := tieredPacks(repoPath); !reflect.DeepEqual(got, []string{name}) {
+			t.Fatalf("tiered packs are %q, want %q", got, name)
+		}
+		if got := s3.Object("tier/test.git/" + name); string(got) != string(pack) {
+			t.Fatalf("bucket has %d bytes for the pack, want %d", len(got), len(pack))
+		}
+	}
+	freeze()
+	if _, err := os.Stat(packs[0][:len(packs[0])-len(".pack")] + ".idx"); err != nil {
+		t.Errorf("pack index not kept: %s", err)
+	}
+
+	// Serving the repository fetches its packs back
+	work := srv.Clone("test.git")
+	if got := githttptest.Git(t, work, "rev-parse", "HEAD"); got != head {
+		t.Errorf("clone of a cold repository at %s, want %s", got, head)
+	}
+	if gsh.tiering.cold(repoPath) {
+		t.Error("repository still cold after a clone")
+	}
+	if got, err := os.ReadFile(packs[0]); err != nil || string(got) != string(pack) {
+		t.Errorf("pack fetched back with %d bytes, want %d: %v", len(got), len(pack), err)
+	}
+
+	// Dumb HTTP downloads of cold packs are redirected to the bucket
+	freeze()
+	gsh.tiering.redirect = true
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(srv.RepoURL("test.git") + "/objects/pack/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("cold pack download answered %d, want 302", resp.StatusCode)
+	}
+	resp, err = http.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != string(pack) {
+		t.Errorf("redirect downloaded %d bytes, want the %d of the pack", len(body), len(pack))
+	}
+	if !gsh.tiering.cold(repoPath) {
+		t.Error("redirected download fetched the packs back")
+	}
+
+	// Smart HTTP still fetches them back
+	srv.Clone("test.git")
+	if gsh.tiering.cold(repoPath) {
+		t.Error("repository still cold after a smart clone")
+	}
+}
@@ -0,0 +1,316 @@
+package githttp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions of repository scopes, as container registries name them
+const (
+	ActionPull = "pull"
+	ActionPush = "push"
+)
+
+// TokenAccess is an entry of the access claim of a token, the actions it
+// grants on a repository
+type TokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+type tokenClaims struct {
+	Issuer    string        `json:"iss"`
+	Subject   string        `json:"sub,omitempty"`
+	Audience  string        `json:"aud"`
+	ExpiresAt int64         `json:"exp"`
+	NotBefore int64         `json:"nbf"`
+	IssuedAt  int64         `json:"iat"`
+	ID        string        `json:"jti"`
+	Access    []TokenAccess `json:"access"`
+}
+
+// TokenAuth is an AccessChecker implementing the token flow of container
+// registries. Requests without a token are answered 401 with a challenge
+//
+//	WWW-Authenticate: Bearer realm="<Realm>",service="<Service>",scope="repository:<repo>:pull"
+//
+// sending clients to the token endpoint, TokenAuth itself, which checks
+// the credentials they present there with Checker and hands out a token,
+// signed with Secret and valid for TTL, granting the actions of the scopes
+// asked for that Checker allows. Requests then carry the token as
+// "Authorization: Bearer <token>", so that automated systems only ever
+// hold short-lived credentials for the repositories they work on.
+//
+// Tokens are JSON web tokens signed with HMAC-SHA256, verifiable by every
+// server sharing the secret.
+type TokenAuth struct {
+	Secret  []byte
+	Realm   string
+	Service string
+	TTL     time.Duration
+	// Checker decides on the actions asked for at the token endpoint,
+	// everything being granted when nil
+	Checker AccessChecker
+	// Direct lets requests without a token through to Checker, for users
+	// authenticating with their own credentials
+	Direct bool
+	// IdentityFunc returns the user authenticated at the token endpoint,
+	// who becomes the subject of the token
+	IdentityFunc func(r *http.Request) *Identity
+}
+
+// NewTokenAuth returns a TokenAuth issuing tokens valid for five minutes
+func NewTokenAuth(secret []byte, realm, service string, checker AccessChecker) *TokenAuth {
+	return &TokenAuth{
+		Secret:  secret,
+		Realm:   realm,
+		Service: service,
+		TTL:     5 * time.Minute,
+		Checker: checker,
+	}
+}
+
+// tokenChallengeError asks for a token, carrying the WWW-Authenticate
+// challenge telling the client where to get one
+type tokenChallengeError struct {
+	challenge string
+	err       error
+}
+
+func (e *tokenChallengeError) Error() string { return e.err.Error() }
+func (e *tokenChallengeError) Unwrap() error { return e.err }
+
+func (a *TokenAuth) challenge(repo string, op Operation, invalid bool) error {
+	action := ActionPull
+	if op == OpWrite {
+		action = ActionPull + "," + ActionPush
+	}
+	c := fmt.Sprintf(`Bearer realm=%q,service=%q,scope="repository:%s:%s"`, a.Realm, a.Service, repo, action)
+	if invalid {
+		c += `,error="invalid_token"`
+	}
+	return &tokenChallengeError{challenge: c, err: ErrAuthRequired}
+}
+
+func (a *TokenAuth) CheckAccess(r *http.Request, id *Identity, repo string, op Operation) error {
+	_, err := a.CheckAccessIdentity(r, id, repo, op)
+	return err
+}
+
+// CheckAccessIdentity makes the subject of the token the identity of the
+// request
+func (a *TokenAuth) CheckAccessIdentity(r *http.Request, id *Identity, repo string, op Operation) (*Identity, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		if !a.Direct || a.Checker == nil {
+			return nil, a.challenge(repo, op, false)
+		}
+		if checker, ok := a.Checker.(IdentityChecker); ok {
+			return checker.CheckAccessIdentity(r, id, repo, op)
+		}
+		return nil, a.Checker.CheckAccess(r, id, repo, op)
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, a.challenge(repo, op, true)
+	}
+	want := ActionPull
+	if op == OpWrite {
+		want = ActionPush
+	}
+	for _, access := range claims.Access {
+		if access.Type != "repository" || access.Name != repo {
+			continue
+		}
+		for _, action := range access.Actions {
+			if action == want || action == "*" {
+				if claims.Subject == "" {
+					return nil, nil
+				}
+				return &Identity{Name: claims.Subject}, nil
+			}
+		}
+	}
+	// The token is valid but does not cover the request, which a token for
+	// a wider scope could
+	return nil, a.challenge(repo, op, false)
+}
+
+// ServeHTTP is the token endpoint, taking the service and scope query
+// parameters of the challenge. Scopes read "repository:<repo>:<actions>",
+// with comma separated actions, and may be repeated.
+func (a *TokenAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, []string{"GET"})
+		return
+	}
+	if service := r.URL.Query().Get("service"); service != "" && service != a.Service {
+		writeErrorMessage(w, r, http.StatusBadRequest, "unknown service "+service)
+		return
+	}
+
+	var id *Identity
+	if a.IdentityFunc != nil {
+		id = a.IdentityFunc(r)
+	} else {
+		id = IdentityFromContext(r.Context())
+	}
+
+	var granted []TokenAccess
+	var authErr error
+	for _, param := range r.URL.Query()["scope"] {
+		for _, scope := range strings.Fields(param) {
+			access, found, err := a.grant(r, id, scope)
+			if found != nil {
+				id = found
+			}
+			if err != nil {
+				if ErrorStatus(err) == http.StatusInternalServerError {
+					writeError(w, r, err)
+					return
+				}
+				authErr = err
+			}
+			if len(access.Actions) > 0 {
+				granted = append(granted, access)
+			}
+		}
+	}
+	// Ask for credentials when they would get more than was granted
+	if errors.Is(authErr, ErrAuthRequired) && len(granted) == 0 {
+		writeError(w, r, authErr)
+		return
+	}
+
+	now := time.Now()
+	jti := make([]byte, 16)
+	rand.Read(jti)
+	claims := tokenClaims{
+		Issuer:    a.Service,
+		Audience:  a.Service,
+		ExpiresAt: now.Add(a.TTL).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        hex.EncodeToString(jti),
+		Access:    granted,
+	}
+	if id != nil {
+		claims.Subject = id.Name
+	}
+	if claims.Access == nil {
+		claims.Access = []TokenAccess{}
+	}
+	token, err := a.sign(claims)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setHeaders(w, hdrNoCache())
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":        token,
+		"access_token": token,
+		"expires_in":   int(a.TTL.Seconds()),
+		"issued_at":    now.UTC().Format(time.RFC3339),
+	})
+}
+
+// grant returns the actions of the scope the request is allowed, along
+// with the identity Checker found and the error of the last action denied
+func (a *TokenAuth) grant(r *http.Request, id *Identity, scope string) (TokenAccess, *Identity, error) {
+	i, j := strings.Index(scope, ":"), strings.LastIndex(scope, ":")
+	if i < 0 || i == j || scope[:i] != "repository" {
+		return TokenAccess{}, nil, nil
+	}
+	access := TokenAccess{Type: "repository", Name: strings.TrimPrefix(scope[i+1:j], "/")}
+
+	var found *Identity
+	var err error
+	for _, action := range strings.Split(scope[j+1:], ",") {
+		op := OpRead
+		switch action {
+		case ActionPull:
+		case ActionPush:
+			op = OpWrite
+		default:
+			continue
+		}
+		if checker, ok := a.Checker.(IdentityChecker); ok {
+			granted, aerr := checker.CheckAccessIdentity(r, id, access.Name, op)
+			if aerr != nil {
+				err = aerr
+				continue
+			}
+			if granted != nil {
+				found = granted
+			}
+		} else if a.Checker != nil {
+			if aerr := a.Checker.CheckAccess(r, id, access.Name, op); aerr != nil {
+				err = aerr
+				continue
+			}
+		}
+		access.Actions = append(access.Actions, action)
+	}
+	return access, found, err
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (a *TokenAuth) sign(claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify checks the signature, validity period and audience of a token
+func (a *TokenAuth) verify(token string) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return claims, errors.New("malformed token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errors.New("malformed token")
+	}
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, errors.New("bad token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errors.New("malformed token")
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, err
+	}
+	now := time.Now().Unix()
+	if now >= claims.ExpiresAt || now < claims.NotBefore {
+		return claims, errors.New("token expired, valid until " + strconv.FormatInt(claims.ExpiresAt, 10))
+	}
+	if claims.Audience != a.Service {
+		return claims, errors.New("token for another service")
+	}
+	return claims, nil
+}
@@ -0,0 +1,241 @@
+package githttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trace2Summary holds the key timings of the git processes of a request,
+// taken from their trace2 events
+type trace2Summary struct {
+	mu sync.Mutex
+	// children are the run times of the child processes git spawned, such
+	// as pack-objects and index-pack, by command
+	children timings
+	// regions are the run times of the top level regions, such as the
+	// enumerate-objects, prepare-pack and write-pack-file phases of
+	// pack-objects
+	regions timings
+	// objects is how many objects pack-objects wrote
+	objects int64
+
+	// spans are the git processes and their regions, kept when keepSpans
+	// is set
+	keepSpans bool
+	spans     []trace2Span
+}
+
+// trace2Span is a git process or a region of one. parent is the index of
+// the enclosing span in trace2Summary.spans, -1 for the processes run by
+// the server.
+type trace2Span struct {
+	name       string
+	parent     int
+	start, end time.Time
+	attrs      map[string]string
+}
+
+// timings are durations by name, in the order the names came up
+type timings struct {
+	names []string
+	d     map[string]time.Duration
+}
+
+func (t *timings) add(name string, d time.Duration) {
+	if t.d == nil {
+		t.d = make(map[string]time.Duration)
+	}
+	if _, ok := t.d[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.d[name] += d
+}
+
+func (t timings) String() string {
+	parts := make([]string, len(t.names))
+	for i, name := range t.names {
+		parts[i] = fmt.Sprintf("%s %s", name, t.d[name].Round(time.Millisecond))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// String formats the summary for the transfer log line
+func (s *trace2Summary) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var parts []string
+	if len(s.children.names) > 0 {
+		parts = append(parts, s.children.String())
+	}
+	if len(s.regions.names) > 0 {
+		parts = append(parts, "("+s.regions.String()+")")
+	}
+	if s.objects > 0 {
+		parts = append(parts, fmt.Sprintf("%d objects", s.objects))
+	}
+	return strings.Join(parts, " ")
+}
+
+type trace2Key struct{}
+
+// withTrace2 returns a copy of ctx having the git processes run for it
+// write trace2 events, summarized into s
+func withTrace2(ctx context.Context, s *trace2Summary) context.Context {
+	return context.WithValue(ctx, trace2Key{}, s)
+}
+
+// trace2Capture collects the trace2 events of a git process, and of the
+// processes it spawns, in a temporary file
+type trace2Capture struct {
+	summary *trace2Summary
+	path    string
+}
+
+// newTrace2Capture sets up the capture for a git process run for ctx,
+// returning nil when ctx does not ask for one
+func newTrace2Capture(ctx context.Context) *trace2Capture {
+	s, ok := ctx.Value(trace2Key{}).(*trace2Summary)
+	if !ok {
+		return nil
+	}
+	f, err := os.CreateTemp("", "git-trace2-*.json")
+	if err != nil {
+		return nil
+	}
+	f.Close()
+	return &trace2Capture{summary: s, path: f.Name()}
+}
+
+// env returns the environment making git write its events
+func (c *trace2Capture) env() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{"GIT_TRACE2_EVENT=" + c.path}
+}
+
+// finish adds the events written to the summary and removes them
+func (c *trace2Capture) finish() {
+	if c == nil {
+		return
+	}
+	defer os.Remove(c.path)
+
+	f, err := os.Open(c.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var ev struct {
+		Event    string          `json:"event"`
+		TRel     float64         `json:"t_rel"`
+		Nesting  int             `json:"nesting"`
+		Category string          `json:"category"`
+		Label    string          `json:"label"`
+		Key      string          `json:"key"`
+		Value    json.RawMessage `json:"value"`
+		ChildID  int             `json:"child_id"`
+		Argv     []string        `json:"argv"`
+		SID      string          `json:"sid"`
+		Time     time.Time       `json:"time"`
+		Code     int             `json:"code"`
+	}
+	children := make(map[string]string)
+	// open holds the spans of each process, the process itself followed by
+	// the regions it is in
+	open := make(map[string][]int)
+	enclosing := func(sid string) int {
+		if stack := open[sid]; len(stack) > 0 {
+			return stack[len(stack)-1]
+		}
+		return -1
+	}
+
+	s := c.summary
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		ev.Argv, ev.Value, ev.Nesting = nil, nil, 0
+		if json.Unmarshal(sc.Bytes(), &ev) != nil {
+			continue
+		}
+		d := time.Duration(ev.TRel * float64(time.Second))
+		if s.keepSpans {
+			switch ev.Event {
+			case "start":
+				parent := -1
+				if i := strings.LastIndex(ev.SID, "/"); i > 0 {
+					parent = enclosing(ev.SID[:i])
+				}
+				s.spans = append(s.spans, trace2Span{name: "git " + gitCommandName(ev.Argv), parent: parent, start: ev.Time, end: ev.Time,
+					attrs: map[string]string{"git.argv": strings.Join(ev.Argv, " ")}})
+				open[ev.SID] = []int{len(s.spans) - 1}
+			case "region_enter":
+				if parent := enclosing(ev.SID); parent >= 0 {
+					s.spans = append(s.spans, trace2Span{name: ev.Label, parent: parent, start: ev.Time, end: ev.Time,
+						attrs: map[string]string{"git.category": ev.Category}})
+					open[ev.SID] = append(open[ev.SID], len(s.spans)-1)
+				}
+			case "region_leave":
+				if stack := open[ev.SID]; len(stack) > 1 {
+					s.spans[stack[len(stack)-1]].end = ev.Time
+					open[ev.SID] = stack[:len(stack)-1]
+				}
+			case "exit":
+				if stack := open[ev.SID]; len(stack) > 0 {
+					s.spans[stack[0]].end = ev.Time
+					s.spans[stack[0]].attrs["git.exit_code"] = strconv.Itoa(ev.Code)
+				}
+			}
+		}
+		switch ev.Event {
+		case "child_start":
+			children[fmt.Sprintf("%s/%d", ev.SID, ev.ChildID)] = gitCommandName(ev.Argv)
+		case "child_exit":
+			if name := children[fmt.Sprintf("%s/%d", ev.SID, ev.ChildID)]; name != "" {
+				s.children.add(name, d)
+			}
+		case "region_leave":
+			if ev.Nesting == 1 {
+				s.regions.add(ev.Label, d)
+			}
+		case "data":
+			if ev.Category == "pack-objects" && ev.Key == "write_pack_file/wrote" {
+				var n int64
+				fmt.Sscan(strings.Trim(string(ev.Value), `"`), &n)
+				s.objects += n
+			}
+		}
+	}
+}
+
+// gitCommandName returns the git command of a command line, such as
+// pack-objects for "git pack-objects --revs", or the program run, such as
+// a hook
+func gitCommandName(argv []string) string {
+	if len(argv) == 0 {
+		return ""
+	}
+	if filepath.Base(argv[0]) != "git" {
+		return filepath.Base(argv[0])
+	}
+	for i, arg := range argv[1:] {
+		if !strings.HasPrefix(arg, "-") && argv[i] != "-c" {
+			return arg
+		}
+	}
+	return "git"
+}
@@ -0,0 +1,94 @@
+package githttp
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jaxi/git-http-backend/githttptest"
+)
+
+// logBuffer collects what is logged while a test runs
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return b
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Line returns the last line logged containing s
+func (b *logBuffer) Line(s string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := strings.Split(b.buf.String(), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.Contains(lines[i], s) {
+			return lines[i]
+		}
+	}
+	return ""
+}
+
+func TestTrace2(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	logs := captureLog(t)
+
+	srv := newTestServer(t, GitSmartHTTPConfig{Trace2: true})
+	srv.CreateRepo("test.git", map[string]string{"README": "hello\n"}, map[string]string{"README": "more\n"})
+	work := srv.Clone("test.git")
+	githttptest.Commit(t, work, map[string]string{"README": "again\n"}, "third")
+	srv.Push(work, "HEAD:master")
+
+	// Fetches log the time pack-objects took, its phases and the objects
+	// it wrote
+	var line string
+	waitFor(t, "the fetch to be logged", func() bool {
+		line = logs.Line("upload-pack test.git: ")
+		return strings.Contains(line, ", git: ")
+	})
+	for _, want := range []string{", git: pack-objects ", "write-pack-file ", " 6 objects"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("fetch logged %q, want %q", line, want)
+		}
+	}
+	waitFor(t, "the push to be logged", func() bool {
+		line = logs.Line("receive-pack test.git: ")
+		return strings.Contains(line, ", git: ")
+	})
+	if !strings.Contains(line, ", git: unpack-objects ") && !strings.Contains(line, ", git: index-pack ") {
+		t.Errorf("push logged %q, want the time unpacking took", line)
+	}
+
+	// The events are gone once summarized
+	if events, _ := filepath.Glob(filepath.Join(tmp, "git-trace2-*")); len(events) > 0 {
+		t.Errorf("trace2 events left behind: %q", events)
+	}
+
+	// Nothing is captured unless asked for
+	srv = newTestServer(t, GitSmartHTTPConfig{})
+	srv.CreateRepo("plain.git", map[string]string{"README": "hello\n"})
+	srv.Clone("plain.git")
+	waitFor(t, "the fetch to be logged", func() bool {
+		line = logs.Line("upload-pack plain.git: ")
+		return strings.Contains(line, "bytes out")
+	})
+	if strings.Contains(line, ", git: ") {
+		t.Errorf("fetch without trace2 logged %q", line)
+	}
+}
@@ -0,0 +1,203 @@
+package githttp
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransferStats aggregates the requests served by one service
+type TransferStats struct {
+	Requests int64   `json:"requests"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+	Rounds   int64   `json:"rounds"`
+	Seconds  float64 `json:"seconds"`
+
+	// Shallow counts the upload-pack requests sending the pack of a
+	// shallow fetch, ShallowRejected those refused for their depth
+	Shallow         int64 `json:"shallow,omitempty"`
+	ShallowRejected int64 `json:"shallow_rejected,omitempty"`
+}
+
+// transferStats collects the TransferStats of upload-pack and receive-pack
+type transferStats struct {
+	mu       sync.Mutex
+	services map[string]*TransferStats
+}
+
+func newTransferStats() *transferStats {
+	return &transferStats{services: make(map[string]*TransferStats)}
+}
+
+// Stats returns a snapshot of the statistics per service
+func (t *transferStats) Stats() map[string]TransferStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := make(map[string]TransferStats, len(t.services))
+	for service, s := range t.services {
+		stats[service] = *s
+	}
+	return stats
+}
+
+// finish logs the transfer once its response is written and adds it to the
+// statistics of its service.
+func (t *transferStats) finish(tr *transfer, out *writeTracker) {
+	elapsed := time.Since(tr.start)
+	extra := ""
+	if tr.session != "" {
+		extra += ", session " + tr.session
+	}
+	if tr.trace2 != nil {
+		if s := tr.trace2.String(); s != "" {
+			extra += ", git: " + s
+		}
+	}
+	log.Printf("%s %s: %d bytes in, %d bytes out, %d rounds in %s%s",
+		tr.service, tr.repo, tr.in, out.n, tr.scan.flushes, elapsed.Round(time.Millisecond), extra)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := t.services[tr.service]
+	if s == nil {
+		s = &TransferStats{}
+		t.services[tr.service] = s
+	}
+	s.Requests++
+	s.BytesIn += tr.in
+	s.BytesOut += out.n
+	s.Rounds += tr.scan.flushes
+	s.Seconds += elapsed.Seconds()
+	if tr.fetch.shallow() && tr.scan.done {
+		s.Shallow++
+	}
+	if tr.depthRejected {
+		s.ShallowRejected++
+	}
+}
+
+// transfer measures the request body of a single upload-pack or
+// receive-pack request as it is read.
+type transfer struct {
+	service string
+	repo    string
+	start   time.Time
+	body    io.Reader
+	in      int64
+	scan    pktCounter
+
+	// fetch is what an upload-pack request asked for, depthRejected set
+	// when it was refused for the depth
+	fetch         fetchRequest
+	depthRejected bool
+
+	// session is the session-id capability of the client
+	session string
+	// trace2 summarizes the trace2 events of git, when captured
+	trace2 *trace2Summary
+	// span is the span of the request, when traced
+	span *Span
+}
+
+func newTransfer(service, repo string, body io.Reader) *transfer {
+	return &transfer{service: service, repo: repo, start: time.Now(), body: body}
+}
+
+func (tr *transfer) Read(p []byte) (int, error) {
+	n, err := tr.body.Read(p)
+	tr.in += int64(n)
+	// Only upload-pack negotiates, a push is mostly pack data.
+	if tr.service == uploadPack {
+		tr.scan.scan(p[:n])
+	}
+	return n, err
+}
+
+// pktCounter follows the pkt-lines of a stream to count its flush packets,
+// each of which ends a negotiation round of the client, and its have lines.
+// done is set once the client asks for the pack.
+type pktCounter struct {
+	hdr     [4]byte
+	hdrN    int
+	skip    int
+	line    []byte
+	flushes int64
+	haves   int64
+	done    bool
+	broken  bool
+}
+
+func (c *pktCounter) scan(p []byte) {
+	for len(p) > 0 && !c.broken {
+		if c.skip > 0 {
+			n := c.skip
+			if n > len(p) {
+				n = len(p)
+			}
+			if keep := 5 - len(c.line); keep > 0 {
+				if keep > n {
+					keep = n
+				}
+				c.line = append(c.line, p[:keep]...)
+			}
+			c.skip -= n
+			p = p[n:]
+			if c.skip == 0 {
+				c.endLine()
+			}
+			continue
+		}
+
+		c.hdr[c.hdrN] = p[0]
+		c.hdrN++
+		p = p[1:]
+		if c.hdrN < len(c.hdr) {
+			continue
+		}
+		c.hdrN = 0
+
+		size, err := strconv.ParseUint(string(c.hdr[:]), 16, 16)
+		switch {
+		case err != nil:
+			c.broken = true
+		case size == 0:
+			c.flushes++
+		case size > 4:
+			c.skip = int(size) - 4
+			c.line = c.line[:0]
+		}
+	}
+}
+
+// endLine looks at the start of the pkt-line just read
+func (c *pktCounter) endLine() {
+	switch line := string(c.line); {
+	case strings.HasPrefix(line, "have "):
+		c.haves++
+	case line == "done" || line == "done\n":
+		c.done = true
+	}
+}
+
+// finishTransfer accounts for a served upload-pack or receive-pack request
+func (gsh GitSmartHTTP) finishTransfer(r *http.Request, tr *transfer, out *writeTracker) {
+	gsh.transfers.finish(tr, out)
+	if tr.span != nil {
+		tr.span.Attrs["http.request.body.size"] = strconv.FormatInt(tr.in, 10)
+		tr.span.Attrs["http.response.body.size"] = strconv.FormatInt(out.n, 10)
+		if tr.session != "" {
+			tr.span.Attrs["git.session_id"] = tr.session
+		}
+		gsh.Tracing.exportRequest(tr.span, tr.trace2)
+	}
+	if gsh.repoStats != nil {
+		gsh.repoStats.record(r, tr, out.n)
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package githttp
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// upgradeSignals is empty where sockets cannot be handed over to another
+// process, upgrades having to restart the server
+var upgradeSignals []os.Signal
+
+func inheritedListeners() map[string]net.Listener {
+	return nil
+}
+
+func notifyReady() {}
+
+func handOver(listeners []Listener, lns []net.Listener) error {
+	return errors.New("upgrades are not supported on this platform")
+}
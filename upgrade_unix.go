@@ -0,0 +1,144 @@
+//go:build unix
+
+package githttp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The environment telling an upgraded binary which of its file descriptors
+// are the sockets of which listeners, from 3 on in order, and which one to
+// write to once it serves them
+const (
+	listenFdsEnv = "GIT_HTTP_BACKEND_LISTEN_FDS"
+	readyFdEnv   = "GIT_HTTP_BACKEND_READY_FD"
+)
+
+// upgradeTimeout is how long an upgraded binary has to start serving
+const upgradeTimeout = time.Minute
+
+// upgradeSignals ask the server to upgrade: to start the binary at its path
+// again, hand it the sockets it listens on and drain its own requests once
+// the new binary serves them, so that upgrades interrupt no clone or push
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// inheritedListeners returns the sockets handed over by the binary this one
+// upgrades, by listener
+func inheritedListeners() map[string]net.Listener {
+	names := os.Getenv(listenFdsEnv)
+	os.Unsetenv(listenFdsEnv)
+	if names == "" {
+		return nil
+	}
+
+	listeners := make(map[string]net.Listener)
+	for i, name := range strings.Split(names, "\n") {
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Cannot take over %s: %s", name, err)
+			continue
+		}
+		listeners[name] = ln
+	}
+	return listeners
+}
+
+// notifyReady tells the binary this one upgrades that it serves its
+// listeners
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyFdEnv))
+	os.Unsetenv(readyFdEnv)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// handOver starts the binary again with the sockets of the listeners,
+// returning once it serves them
+func handOver(listeners []Listener, lns []net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, len(lns))
+	for i, ln := range lns {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("cannot hand over %s", listeners[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names[i] = listeners[i].String()
+	}
+
+	ready, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		listenFdsEnv+"="+strings.Join(names, "\n"),
+		fmt.Sprintf("%s=%d", readyFdEnv, 3+len(files)))
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	// The pipe closes without a byte when the new binary exits first
+	done := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			cmd.Wait()
+			return errors.New("new binary exited before serving")
+		}
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("new binary did not serve in time")
+	}
+
+	// The sockets now belong to the new binary too, closing them must not
+	// remove their files
+	for _, ln := range lns {
+		if u, ok := ln.(*net.UnixListener); ok {
+			u.SetUnlinkOnClose(false)
+		}
+	}
+	log.Printf("Upgraded to %s, pid %d", exe, cmd.Process.Pid)
+	cmd.Process.Release()
+	return nil
+}
@@ -0,0 +1,113 @@
+//go:build unix
+
+package githttp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(listenFdsEnv) != "" {
+		upgradedServer()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// upgradedServer stands for the binary TestUpgrade upgrades to, run as the
+// test binary again: it serves the sockets handed over to it until asked
+// to quit
+func upgradedServer() {
+	quit := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/quit" {
+			close(quit)
+		}
+		io.WriteString(w, "upgraded")
+	})}
+	for _, ln := range inheritedListeners() {
+		go srv.Serve(ln)
+	}
+	notifyReady()
+
+	select {
+	case <-quit:
+	case <-time.After(time.Minute):
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
+
+func TestUpgrade(t *testing.T) {
+	listeners := []Listener{
+		{Network: "unix", Addr: filepath.Join(t.TempDir(), "git.sock")},
+		{Network: "tcp", Addr: "127.0.0.1:0"},
+	}
+	lns := make([]net.Listener, len(listeners))
+	for i, l := range listeners {
+		ln, err := l.listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns[i] = ln
+	}
+	tcpGet := func(path string) string {
+		t.Helper()
+		resp, err := http.Get("http://" + lns[1].Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	old := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(entered)
+			<-release
+		}
+		io.WriteString(w, "old")
+	})}
+	for _, ln := range lns {
+		go old.Serve(ln)
+	}
+	defer old.Close()
+	slow := make(chan string, 1)
+	go func() { slow <- tcpGet("/slow") }()
+	<-entered
+
+	if err := handOver(listeners, lns); err != nil {
+		t.Fatal(err)
+	}
+	defer tcpGet("/quit")
+
+	// The old server drains the request it was serving while the new one
+	// takes the new requests
+	stopped := make(chan struct{})
+	go func() {
+		shutdown([]*http.Server{old}, 0)
+		close(stopped)
+	}()
+	close(release)
+	if got := <-slow; got != "old" {
+		t.Errorf("request served during the upgrade got %q, want old", got)
+	}
+	<-stopped
+
+	if got := unixGet(t, listeners[0].Addr, "/"); got != "upgraded" {
+		t.Errorf("unix socket served %q after the upgrade, want upgraded", got)
+	}
+	if got := tcpGet("/"); got != "upgraded" {
+		t.Errorf("tcp socket served %q after the upgrade, want upgraded", got)
+	}
+}
@@ -0,0 +1,178 @@
+package githttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamFetchedFile is touched in a mirror whenever it is fetched
+const upstreamFetchedFile = "upstream-fetched"
+
+// upstreamMirror turns the server into a caching proxy of an upstream
+// server: repositories missing locally are mirrored from it on first use,
+// and mirrors fetched longer than TTL ago are refreshed in the background
+// while the stale copy is served. Ref advertisements of mirrors fetched
+// longer than SyncAge ago wait up to SyncTimeout for a refresh instead.
+type upstreamMirror struct {
+	processes *ProcessManager
+
+	URL         string
+	TTL         time.Duration
+	SyncAge     time.Duration
+	SyncTimeout time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]*upstreamCall
+}
+
+type upstreamCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newUpstreamMirror(processes *ProcessManager, url string, ttl, syncAge, syncTimeout time.Duration) *upstreamMirror {
+	return &upstreamMirror{
+		processes:   processes,
+		URL:         strings.TrimSuffix(url, "/"),
+		TTL:         ttl,
+		SyncAge:     syncAge,
+		SyncTimeout: syncTimeout,
+		inflight:    make(map[string]*upstreamCall),
+	}
+}
+
+// ensure makes sure the repository is there, cloning it from upstream when
+// it is missing. advertisement tells whether its refs are about to be
+// advertised.
+func (m *upstreamMirror) ensure(ctx context.Context, repo, repoPath string, advertisement bool) error {
+	if _, ok := gitDir(repoPath); ok {
+		age := m.age(repoPath)
+		if advertisement && m.SyncAge > 0 && age > m.SyncAge {
+			call := m.start(repoPath, func() error { return m.fetch(repoPath) })
+			// Serve the stale copy when upstream is slow or failing
+			timer := time.NewTimer(m.SyncTimeout)
+			defer timer.Stop()
+			select {
+			case <-call.done:
+			case <-timer.C:
+			case <-ctx.Done():
+			}
+		} else if m.TTL > 0 && age > m.TTL {
+			m.start(repoPath, func() error { return m.fetch(repoPath) })
+		}
+		return nil
+	}
+
+	call := m.start(repoPath, func() error { return m.clone(repo, repoPath) })
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sync fetches the mirror from upstream now, cloning it when it is missing
+func (m *upstreamMirror) sync(ctx context.Context, repo, repoPath string) error {
+	fn := func() error { return m.fetch(repoPath) }
+	if _, ok := gitDir(repoPath); !ok {
+		fn = func() error { return m.clone(repo, repoPath) }
+	}
+	call := m.start(repoPath, fn)
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start runs fn for the repository unless it is already running, and
+// returns the call to wait for.
+func (m *upstreamMirror) start(repoPath string, fn func() error) *upstreamCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if call, ok := m.inflight[repoPath]; ok {
+		return call
+	}
+	call := &upstreamCall{done: make(chan struct{})}
+	m.inflight[repoPath] = call
+
+	go func() {
+		call.err = fn()
+		m.mu.Lock()
+		delete(m.inflight, repoPath)
+		m.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// age returns how long ago the mirror was last fetched
+func (m *upstreamMirror) age(repoPath string) time.Duration {
+	fi, err := os.Stat(filepath.Join(repoPath, upstreamFetchedFile))
+	if err != nil {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Since(fi.ModTime())
+}
+
+// clone mirrors the repository next to where it goes, moving it in place
+// once complete so that half cloned repositories are never served.
+func (m *upstreamMirror) clone(repo, repoPath string) error {
+	if err := os.MkdirAll(filepath.Dir(repoPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(repoPath), "."+filepath.Base(repoPath)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	url := m.URL + "/" + strings.TrimPrefix(repo, "/")
+	if err := m.git("clone", "--mirror", "--quiet", url, tmp); err != nil {
+		log.Printf("Cannot mirror %s: %s", url, err)
+		return ErrRepoNotFound
+	}
+	if err := touch(filepath.Join(tmp, upstreamFetchedFile)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, repoPath)
+}
+
+// fetch refreshes a mirror from upstream
+func (m *upstreamMirror) fetch(repoPath string) error {
+	if err := m.git("--git-dir", repoPath, "fetch", "--prune", "--quiet", "origin"); err != nil {
+		log.Printf("Cannot refresh mirror %s: %s", repoPath, err)
+		return err
+	}
+	return touch(filepath.Join(repoPath, upstreamFetchedFile))
+}
+
+// git runs git, never prompting for credentials upstream asks for
+func (m *upstreamMirror) git(args ...string) error {
+	var out bytes.Buffer
+	config := &GitRPCClientConfig{Env: []string{"GIT_TERMINAL_PROMPT=0"}}
+	if err := m.processes.Command(config, args...).Run(context.Background(), nil, &out, &out); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+func touch(path string) error {
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		return os.WriteFile(path, nil, 0644)
+	}
+	return err
+}